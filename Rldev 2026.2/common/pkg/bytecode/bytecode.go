@@ -9,6 +9,7 @@ import (
 	"fmt"
 
 	"github.com/yoremi/rldev-go/pkg/binarray"
+	"github.com/yoremi/rldev-go/pkg/metadata"
 )
 
 // HeaderVersion identifies the bytecode format generation.
@@ -44,8 +45,9 @@ type FileHeader struct {
 	Int0x2C          int
 	EntryPoints      [100]int32
 	KidokuLnums      []int32
-	DramatisPersonae []string // Character names
-	Archived         bool     // Whether this was in a SEEN.TXT archive
+	DramatisPersonae []string          // Character names
+	Metadata         metadata.Metadata // RLdev compiler metadata (empty if none)
+	Archived         bool              // Whether this was in a SEEN.TXT archive
 }
 
 // EmptyHeader returns a default empty header.
@@ -179,6 +181,13 @@ func ReadFullHeader(arr *binarray.Buffer, archived bool) (FileHeader, error) {
 			hdr.DramatisPersonae[i] = arr.ReadSz(offset+4, nameLen)
 			offset += 4 + nameLen
 		}
+		// RLdev metadata, between the dramatis personae and the bytecode
+		metaOff := dpOffset + int(arr.GetInt(0x1c))
+		if metaOff+8 <= hdr.DataOffset && hdr.DataOffset <= arr.Len() {
+			if n := int(arr.GetInt(metaOff)); n > 0 && metaOff+n <= hdr.DataOffset {
+				hdr.Metadata = metadata.Read(arr, metaOff)
+			}
+		}
 	}
 
 	return hdr, nil
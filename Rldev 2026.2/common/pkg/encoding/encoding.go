@@ -10,6 +10,7 @@ package encoding
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/text/encoding/japanese"
 	"golang.org/x/text/encoding/korean"
@@ -26,7 +27,7 @@ const (
 	EUCJP                 // Japanese (EUC-JP) - rare
 	UTF8                  // UTF-8 - newer games
 	GBK                   // Simplified Chinese (CP936)
-	EUC_KR                // Korean (CP949)
+	EUC_KR                // Korean (CP949, EUC-KR with the UHC extension)
 	Other                 // Unknown/unsupported
 )
 
@@ -39,9 +40,9 @@ func (t Type) String() string {
 	case UTF8:
 		return "UTF-8"
 	case GBK:
-		return "GBK"
+		return "CP936"
 	case EUC_KR:
-		return "EUC-KR"
+		return "CP949"
 	default:
 		return "Other"
 	}
@@ -59,7 +60,7 @@ func Parse(name string) Type {
 		return UTF8
 	case "GBK", "CP936", "GB2312":
 		return GBK
-	case "EUC-KR", "EUC_KR", "CP949":
+	case "EUC-KR", "EUC_KR", "CP949", "UHC":
 		return EUC_KR
 	default:
 		return Other
@@ -100,7 +101,21 @@ func ToUTF8(data []byte, enc Type) (string, error) {
 	return string(result), nil
 }
 
-// FromUTF8 converts a UTF-8 string to the given encoding.
+// UnrepresentableError reports a character that has no encoding in the
+// target codepage. Offset is the byte offset of the character in the
+// UTF-8 input.
+type UnrepresentableError struct {
+	Rune   rune
+	Offset int
+	Enc    Type
+}
+
+func (e *UnrepresentableError) Error() string {
+	return fmt.Sprintf("cannot represent '%c' (U+%04X) in %s", e.Rune, e.Rune, e.Enc)
+}
+
+// FromUTF8 converts a UTF-8 string to the given encoding. A character the
+// encoding cannot represent yields an *UnrepresentableError.
 func FromUTF8(text string, enc Type) ([]byte, error) {
 	return FromUTF8String(text, enc)
 }
@@ -123,8 +138,12 @@ func FromUTF8String(text string, enc Type) ([]byte, error) {
 		return nil, fmt.Errorf("unsupported encoding: %v", enc)
 	}
 
-	result, _, err := transform.String(encoder, text)
+	result, n, err := transform.String(encoder, text)
 	if err != nil {
+		// n is the length of the input converted before the failure.
+		if r, _ := utf8.DecodeRuneInString(text[n:]); n < len(text) {
+			return nil, &UnrepresentableError{Rune: r, Offset: n, Enc: enc}
+		}
 		return nil, fmt.Errorf("encoding conversion failed: %w", err)
 	}
 	return []byte(result), nil
@@ -141,13 +160,18 @@ func UTF8ToSJS(text string) ([]byte, error) {
 }
 
 // IsLeadByte returns true if the byte is a lead byte in the given encoding.
-// Used for safely iterating through multibyte strings.
+// Used for safely iterating through multibyte strings: a lead byte and the
+// byte after it form one character. GBK and UHC trail bytes may be ASCII
+// letters, so a string cannot be split on bytes below 0x80 alone. UTF-8 has
+// no two-byte lead bytes in this sense and always returns false.
 func IsLeadByte(b byte, enc Type) bool {
 	switch enc {
 	case ShiftJIS:
 		return (b >= 0x81 && b <= 0x9F) || (b >= 0xE0 && b <= 0xFC)
 	case EUCJP:
-		return b >= 0xA1 && b <= 0xFE
+		// 0x8E introduces a half-width katakana, 0x8F a JIS X 0212
+		// character.
+		return b == 0x8E || b == 0x8F || (b >= 0xA1 && b <= 0xFE)
 	case GBK:
 		return b >= 0x81 && b <= 0xFE
 	case EUC_KR:
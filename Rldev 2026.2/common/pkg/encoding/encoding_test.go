@@ -0,0 +1,57 @@
+package encoding
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRoundTripCJK(t *testing.T) {
+	cases := []struct {
+		enc  Type
+		text string
+		want string
+	}{
+		{ShiftJIS, "【理樹】", "\x81\x79\x97\x9d\x8e\xf7\x81\x7a"},
+		{GBK, "中文", "\xd6\xd0\xce\xc4"},
+		{GBK, "丂", "\x81\x40"},
+		{EUC_KR, "한국어", "\xc7\xd1\xb1\xb9\xbe\xee"},
+		{EUC_KR, "똠", "\x8c\x63"},
+	}
+	for _, c := range cases {
+		b, err := FromUTF8(c.text, c.enc)
+		if err != nil || string(b) != c.want { t.Errorf("%s %q: got %q, %v", c.enc, c.text, b, err) }
+		if s, _ := ToUTF8(b, c.enc); s != c.text { t.Errorf("%s %q: decoded %q", c.enc, c.text, s) }
+	}
+}
+
+func TestUnrepresentable(t *testing.T) {
+	_, err := FromUTF8("abc中😀", GBK)
+	var ue *UnrepresentableError
+	if !errors.As(err, &ue) { t.Fatalf("got %v", err) }
+	if ue.Rune != '😀' || ue.Offset != 6 || ue.Enc != GBK { t.Errorf("got %+v", ue) }
+	if err.Error() != "cannot represent '😀' (U+1F600) in CP936" { t.Errorf("message %q", err) }
+	if _, err := FromUTF8("한", ShiftJIS); err == nil { t.Error("hangul accepted in Shift_JIS") }
+}
+
+func TestParse(t *testing.T) {
+	if Parse("cp936") != GBK || Parse("GB2312") != GBK { t.Error("CP936") }
+	if Parse("CP949") != EUC_KR || Parse("uhc") != EUC_KR { t.Error("CP949") }
+	if Parse("latin1") != Other { t.Error("unknown encoding") }
+}
+
+func TestIsLeadByte(t *testing.T) {
+	cases := []struct {
+		enc  Type
+		b    byte
+		want bool
+	}{
+		{ShiftJIS, 0x81, true}, {ShiftJIS, 0xA1, false}, {ShiftJIS, 0xE0, true}, {ShiftJIS, 0xFD, false},
+		{EUCJP, 0x8E, true}, {EUCJP, 0xA1, true}, {EUCJP, 0x80, false},
+		{GBK, 0x81, true}, {GBK, 0xFE, true}, {GBK, 0x80, false}, {GBK, 0xFF, false},
+		{EUC_KR, 0x81, true}, {EUC_KR, 0xC7, true}, {EUC_KR, 0x41, false},
+		{UTF8, 0xE3, false},
+	}
+	for _, c := range cases {
+		if IsLeadByte(c.b, c.enc) != c.want { t.Errorf("%s %#x: want %v", c.enc, c.b, c.want) }
+	}
+}
@@ -65,13 +65,22 @@ var (
 )
 
 // KnownGames maps game identifiers to their predefined keys.
-var KnownGames = map[string][]XORSubkey{
-	"CFV":  KeyCFV,
-	"LB":   KeyLB,
-	"LBEX": KeyLBEX,
-	"LBME": KeyLBEX, // Memorial Edition uses same keys as EX
-	"FIVE": KeyFIVE,
-	"SNOW": KeySNOW,
+//
+// Deprecated: KnownGames is a snapshot of the keys of the built-in game
+// definitions; use Builtin().Lookup, which also sees game.cfg files once
+// merged.
+var KnownGames = builtinKeys()
+
+// builtinKeys returns the keys of every built-in game, by ID.
+func builtinKeys() map[string][]XORSubkey {
+	r := Builtin()
+	keys := make(map[string][]XORSubkey)
+	for _, id := range r.IDs() {
+		if g, err := r.Lookup(id); err == nil {
+			keys[id] = g.Key
+		}
+	}
+	return keys
 }
 
 // SetKeyFromHex parses a 32-character hex string into a 16-byte XOR key.
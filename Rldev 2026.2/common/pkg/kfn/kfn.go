@@ -110,6 +110,43 @@ type Prototype struct {
 	Params  []Parameter
 }
 
+// String renders the parameter in KFN syntax, e.g. "?int" or "intC 'x'".
+func (p Parameter) String() string {
+	var pre, post strings.Builder
+	for _, f := range p.Flags {
+		switch f {
+		case FTextObject:
+			pre.WriteByte('#')
+		case FOptional:
+			pre.WriteByte('?')
+		case FUncount:
+			pre.WriteByte('<')
+		case FReturn:
+			pre.WriteByte('>')
+		case FFake:
+			pre.WriteByte('=')
+		case FArgc:
+			post.WriteByte('+')
+		case FTagged:
+			fmt.Fprintf(&post, " '%s'", p.Tag)
+		}
+	}
+	return pre.String() + p.Type.String() + post.String()
+}
+
+// String renders the prototype's parameter list, or "?" if the overload
+// is undefined.
+func (p Prototype) String() string {
+	if !p.Defined {
+		return "?"
+	}
+	params := make([]string, len(p.Params))
+	for i, q := range p.Params {
+		params[i] = q.String()
+	}
+	return "(" + strings.Join(params, ", ") + ")"
+}
+
 // ============================================================
 // Target/version types (from keTypes.ml)
 // ============================================================
@@ -146,6 +183,17 @@ func ParseTarget(s string) Target {
 // Version is a 4-component version number.
 type Version [4]int
 
+// Compare returns -1, 0 or 1 as v is older than, equal to or newer than w.
+func (v Version) Compare(w Version) int {
+	for i := range v {
+		switch {
+		case v[i] < w[i]: return -1
+		case v[i] > w[i]: return 1
+		}
+	}
+	return 0
+}
+
 // VersionConstraint tests whether a version matches.
 type VersionConstraint func(Version) bool
 
@@ -176,6 +224,18 @@ func IdentOfOpcode(opType, opModule, opCode, overload int) string {
 	return fmt.Sprintf("__op_%d_%d_%d_%d", opType, opModule, opCode, overload)
 }
 
+// Signatures returns one line per defined overload, in the form
+// "ident <type:module:code, overload> (params)".
+func (f *FuncDef) Signatures() []string {
+	var sigs []string
+	for i, p := range f.Prototypes {
+		if p.Defined {
+			sigs = append(sigs, fmt.Sprintf("%s <%d:%d:%05d, %d> %s", f.Ident, f.OpType, f.OpModule, f.OpCode, i, p))
+		}
+	}
+	return sigs
+}
+
 // HasFlag checks if the function has a given flag.
 func (f *FuncDef) HasFlag(flag FuncFlag) bool {
 	for _, fl := range f.Flags {
@@ -214,6 +274,8 @@ type Registry struct {
 	GotoFuncs []string              // identifiers with IsGoto flag
 	Target    Target
 	Version   Version
+
+	byOpcode map[[3]int][]*FuncDef // (type, module, code) → defs, for disassembly
 }
 
 // NewRegistry creates an empty registry.
@@ -223,9 +285,18 @@ func NewRegistry() *Registry {
 		CtrlCodes: make(map[string][]*FuncDef),
 		Modules:   make(map[string]int),
 		Target:    TargetDefault,
+		byOpcode:  make(map[[3]int][]*FuncDef),
 	}
 }
 
+// Clone returns a registry sharing the function tables of r, whose target
+// and version can be set independently. The tables must not be modified
+// while clones are in use.
+func (r *Registry) Clone() *Registry {
+	c := *r
+	return &c
+}
+
 // Register adds a function definition to the registry.
 func (r *Registry) Register(fd *FuncDef) {
 	r.Functions[fd.Ident] = append(r.Functions[fd.Ident], fd)
@@ -235,6 +306,8 @@ func (r *Registry) Register(fd *FuncDef) {
 	if fd.HasFlag(FlagIsGoto) {
 		r.GotoFuncs = append(r.GotoFuncs, fd.Ident)
 	}
+	key := [3]int{fd.OpType, fd.OpModule, fd.OpCode}
+	r.byOpcode[key] = append(r.byOpcode[key], fd)
 }
 
 // Lookup finds a function by identifier, filtering by current target/version.
@@ -247,6 +320,27 @@ func (r *Registry) Lookup(ident string) (*FuncDef, bool) {
 	return fns[0], true // fallback to first
 }
 
+// LookupOpcode finds the function with the given opcode, filtering by
+// current target/version like Lookup. It is the reverse of Lookup, used
+// by the disassembler.
+func (r *Registry) LookupOpcode(opType, opModule, opCode int) (*FuncDef, bool) {
+	fns := r.byOpcode[[3]int{opType, opModule, opCode}]
+	if len(fns) == 0 { return nil, false }
+	for _, fn := range fns {
+		if r.validForTarget(fn) { return fn, true }
+	}
+	return fns[0], true
+}
+
+// ModuleName returns the name the KFN gives module num, or "" if none.
+func (r *Registry) ModuleName(num int) string {
+	name := ""
+	for n, m := range r.Modules {
+		if m == num && (name == "" || n < name) { name = n }
+	}
+	return name
+}
+
 // LookupCtrlCode finds a control code function.
 func (r *Registry) LookupCtrlCode(name string) (*FuncDef, bool) {
 	fns, ok := r.CtrlCodes[name]
@@ -257,6 +351,17 @@ func (r *Registry) LookupCtrlCode(name string) (*FuncDef, bool) {
 	return fns[0], true
 }
 
+// ForTarget returns the definitions in fns that are valid for the current
+// target and version. It returns nil if the function is not available
+// there.
+func (r *Registry) ForTarget(fns []*FuncDef) []*FuncDef {
+	var valid []*FuncDef
+	for _, fn := range fns {
+		if r.validForTarget(fn) { valid = append(valid, fn) }
+	}
+	return valid
+}
+
 func (r *Registry) validForTarget(fd *FuncDef) bool {
 	if len(fd.Targets) == 0 { return true }
 	target := r.Target
@@ -712,10 +817,11 @@ func (p *kfnParser) parseVersionConstraint() TargetConstraint {
 		hasEq := p.match(kEq)
 		v := p.parseVStamp()
 		return TargetConstraint{Compare: func(cur Version) bool {
-			if isLt && hasEq { return cur[0] <= v[0] || (cur[0] == v[0] && cur[1] <= v[1]) }
-			if isLt { return cur[0] < v[0] || (cur[0] == v[0] && cur[1] < v[1]) }
-			if hasEq { return cur[0] >= v[0] || (cur[0] == v[0] && cur[1] >= v[1]) }
-			return cur[0] > v[0] || (cur[0] == v[0] && cur[1] > v[1])
+			c := cur.Compare(v)
+			if isLt && hasEq { return c <= 0 }
+			if isLt { return c < 0 }
+			if hasEq { return c >= 0 }
+			return c > 0
 		}}
 	}
 	return TargetConstraint{}
@@ -121,6 +121,15 @@ func TestParseParameterFlags(t *testing.T) {
 	if param.Tag != "condition" { t.Errorf("tag: got %q, want 'condition'", param.Tag) }
 }
 
+func TestSignatures(t *testing.T) {
+	reg := parseTestKFN(t)
+	fn, _ := reg.Lookup("jump")
+	sigs := fn.Signatures()
+	if len(sigs) != 2 || sigs[1] != "jump <0:1:00011, 1> (intC 'scenario', intC 'entrypoint')" { t.Errorf("jump: %q", sigs) }
+	fn, _ = reg.Lookup("goto_if")
+	if got := fn.Prototypes[0].String(); got != "(<intC 'condition')" { t.Errorf("goto_if: %q", got) }
+}
+
 func TestParseStoreFlag(t *testing.T) {
 	reg := parseTestKFN(t)
 	fn, _ := reg.Lookup("intout")
@@ -245,3 +254,54 @@ func TestParseRealFile(t *testing.T) {
 	t.Logf("Parsed %d functions, %d modules, %d goto funcs",
 		count, len(reg.Modules), len(reg.GotoFuncs))
 }
+
+func TestForTarget(t *testing.T) {
+	reg, err := Parse(strings.NewReader(`
+module 001 = Jmp
+ver < 1.3
+  fun f <0:Jmp:00100, 0> ()
+end
+ver >= 1.3
+  fun f <0:Jmp:00101, 0> ()
+end
+ver Kinetic
+  fun f <0:Jmp:00102, 0> ()
+end
+`))
+	if err != nil { t.Fatal(err) }
+	pick := func(target Target, v Version) int {
+		reg.Target, reg.Version = target, v
+		fns := reg.ForTarget(reg.Functions["f"])
+		if len(fns) != 1 { t.Fatalf("%v %v: %d candidates", target, v, len(fns)) }
+		return fns[0].OpCode
+	}
+	if op := pick(TargetRealLive, Version{1, 2, 7, 0}); op != 100 { t.Errorf("1.2.7: %d", op) }
+	if op := pick(TargetRealLive, Version{1, 3, 0, 0}); op != 101 { t.Errorf("1.3: %d", op) }
+	if op := pick(TargetRealLive, Version{1, 6, 5, 0}); op != 101 { t.Errorf("1.6.5: %d", op) }
+	var kinetic []*FuncDef
+	for _, fn := range reg.Functions["f"] {
+		if fn.OpCode == 102 { kinetic = append(kinetic, fn) }
+	}
+	reg.Target = TargetRealLive
+	if fns := reg.ForTarget(kinetic); len(fns) != 0 { t.Errorf("Kinetic only: %d candidates in RealLive, want none", len(fns)) }
+	if (Version{1, 2, 7, 1}).Compare(Version{1, 2, 7, 0}) != 1 || (Version{1, 2, 0, 0}).Compare(Version{1, 3, 0, 0}) != -1 { t.Error("Compare") }
+}
+
+func TestLookupOpcode(t *testing.T) {
+	reg, err := Parse(strings.NewReader(`
+module 033 = Grp
+ver < 1.3
+  fun old <1:Grp:00070, 0> ()
+end
+ver >= 1.3
+  fun new <1:Grp:00070, 0> ()
+end
+`))
+	if err != nil { t.Fatal(err) }
+	reg.Target, reg.Version = TargetRealLive, Version{1, 6, 5, 0}
+	if fn, ok := reg.LookupOpcode(1, 33, 70); !ok || fn.Ident != "new" { t.Errorf("got %v", fn) }
+	reg.Version = Version{1, 2, 7, 0}
+	if fn, ok := reg.LookupOpcode(1, 33, 70); !ok || fn.Ident != "old" { t.Errorf("got %v", fn) }
+	if _, ok := reg.LookupOpcode(0, 33, 70); ok { t.Error("wrong op type matched") }
+	if reg.ModuleName(33) != "Grp" || reg.ModuleName(34) != "" { t.Error("ModuleName") }
+}
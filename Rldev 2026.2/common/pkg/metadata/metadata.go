@@ -2,7 +2,7 @@
 // Transposed from OCaml's metadata.ml.
 //
 // Metadata format:
-//   int  metadata_len
+//   int  metadata_len (of the whole block, this field included)
 //   int  id_len
 //   char[id_len+1] compiler_identifier (null-terminated)
 //   int  compiler_version * 100
@@ -11,6 +11,9 @@
 package metadata
 
 import (
+	"fmt"
+	"math"
+
 	"github.com/yoremi/rldev-go/pkg/binarray"
 )
 
@@ -45,6 +48,28 @@ type Metadata struct {
 	TextTransform   TextTransform
 }
 
+// IsEmpty reports whether m holds no metadata, as for files not built by
+// RLdev.
+func (m Metadata) IsEmpty() bool {
+	return m.CompilerName == ""
+}
+
+// TargetVersionString returns the target version as "a.b.c.d".
+func (m Metadata) TargetVersionString() string {
+	v := m.TargetVersion
+	return fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
+}
+
+// String returns a one-line summary such as
+// "rldev-go 2.0.26 (2.00), target 1.2.7.0, text Western".
+func (m Metadata) String() string {
+	if m.IsEmpty() {
+		return ""
+	}
+	return fmt.Sprintf("%s (%d.%02d), target %s, text %s", m.CompilerName,
+		m.CompilerVersion/100, m.CompilerVersion%100, m.TargetVersionString(), m.TextTransform)
+}
+
 // Empty returns a zero-value metadata.
 func Empty() Metadata {
 	return Metadata{}
@@ -60,7 +85,8 @@ func Read(arr *binarray.Buffer, idx int) Metadata {
 	metaLen := int(arr.GetInt(idx))
 	idLen := int(arr.GetInt(idx+4)) + 1
 
-	if metaLen < idLen+17 {
+	// Files not built by RLdev may hold anything here.
+	if idLen <= 0 || metaLen < idLen+17 || idx+metaLen > arr.Len() {
 		return Empty()
 	}
 
@@ -96,15 +122,15 @@ func (m *Metadata) ToBytes(ident string, version float64, targetVersion [4]byte,
 	identLen := len(identBytes)
 
 	// Calculate total size
-	totalLen := 4 + identLen + 1 + 4 + 4 + 1
-	buf := binarray.New(totalLen + 4)
+	totalLen := 4 + 4 + identLen + 1 + 4 + 4 + 1
+	buf := binarray.New(totalLen)
 
 	buf.PutInt(0, int32(totalLen))
 	buf.PutInt(4, int32(identLen))
 	buf.Write(8, ident)
 	buf.PutU8(8+identLen, 0) // null terminator
 
-	verInt := int32(version * 100)
+	verInt := int32(math.Round(version * 100))
 	buf.PutInt(8+identLen+1, verInt)
 
 	off := 8 + identLen + 1 + 4
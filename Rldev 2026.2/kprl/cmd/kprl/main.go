@@ -27,6 +27,7 @@ import (
 	"github.com/yoremi/rldev-go/pkg/bytecode"
 	"github.com/yoremi/rldev-go/pkg/disasm"
 	"github.com/yoremi/rldev-go/pkg/gamedef"
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/pkg/kprl"
 	"github.com/yoremi/rldev-go/pkg/rlcmp"
 )
@@ -67,6 +68,8 @@ var (
 	showOpcodes    = flag.Bool("opcodes", false, "show opcode annotations")
 	hexDump        = flag.Bool("hexdump", false, "generate hex dump")
 	rawStrings     = flag.Bool("raw-strings", false, "no special markup in strings")
+	kfnFile        = flag.String("K", "reallive.kfn", "reallive.kfn path (function names and prototypes)")
+	makeMap        = flag.Bool("map", false, "write a map of the jumps between scenes (seenmap.txt, .dot, .json)")
 )
 
 func main() {
@@ -77,7 +80,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  -a    add files to archive\n")
 		fmt.Fprintf(os.Stderr, "  -k    remove files from archive\n")
 		fmt.Fprintf(os.Stderr, "  -l    list archive contents\n")
-		fmt.Fprintf(os.Stderr, "  -i    display file info\n")
+		fmt.Fprintf(os.Stderr, "  -i    display archive or file info (with rlc build metadata)\n")
 		fmt.Fprintf(os.Stderr, "  -b    extract files (still compressed)\n")
 		fmt.Fprintf(os.Stderr, "  -x    extract and decompress files\n")
 		fmt.Fprintf(os.Stderr, "  -d    disassemble bytecode (default)\n")
@@ -102,8 +105,8 @@ func main() {
 	}
 
 	if *gameID != "" {
-		if keys, ok := gamedef.KnownGames[strings.ToUpper(*gameID)]; ok {
-			opts.Keys = keys
+		if g, err := gamedef.Builtin().Lookup(*gameID); err == nil {
+			opts.Keys = g.Key
 		}
 	}
 
@@ -181,6 +184,9 @@ func doList(args []string, opts kprl.Options) error {
 
 func doInfo(args []string, opts kprl.Options) error {
 	fname := args[0]
+	if !kprl.IsArchive(fname) {
+		return doFileInfo(fname)
+	}
 	// For info, show archive structure details
 	arc, err := kprl.LoadArchive(fname)
 	if err != nil {
@@ -188,8 +194,8 @@ func doInfo(args []string, opts kprl.Options) error {
 	}
 
 	fmt.Printf("Archive: %s (%d entries)\n\n", filepath.Base(fname), arc.Count)
-	fmt.Printf("%-16s %8s %10s %10s %7s\n", "File", "Index", "Offset", "Length", "Ratio")
-	fmt.Println(strings.Repeat("-", 55))
+	fmt.Printf("%-16s %8s %10s %10s %7s  %s\n", "File", "Index", "Offset", "Length", "Ratio", "Compiled by")
+	fmt.Println(strings.Repeat("-", 70))
 
 	for i := 0; i < kprl.MaxSeens; i++ {
 		entry := arc.Entries[i]
@@ -210,18 +216,54 @@ func doInfo(args []string, opts kprl.Options) error {
 		}
 
 		unc := hdr.UncompressedSize + hdr.DataOffset
+		ratio := ""
 		if hdr.IsCompressed {
 			cmp := hdr.CompressedSize + hdr.DataOffset
-			ratio := float64(cmp) / float64(unc) * 100.0
-			fmt.Printf("%-16s %8d %10d %10d %6.1f%%\n", name, i, entry.Offset, entry.Length, ratio)
-		} else {
-			fmt.Printf("%-16s %8d %10d %10d\n", name, i, entry.Offset, entry.Length)
+			ratio = fmt.Sprintf("%.1f%%", float64(cmp)/float64(unc)*100.0)
 		}
+		line := fmt.Sprintf("%-16s %8d %10d %10d %7s  %s", name, i, entry.Offset, entry.Length, ratio, hdr.Metadata)
+		fmt.Println(strings.TrimRight(line, " "))
 	}
 
 	return nil
 }
 
+// doFileInfo shows the header of a single bytecode file, including the
+// metadata rlc embeds to identify the build that produced it.
+func doFileInfo(fname string) error {
+	arr, err := binarray.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	hdr, err := bytecode.ReadFullHeader(arr, false)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(fname), err)
+	}
+	entrypoints := 0
+	for _, ep := range hdr.EntryPoints {
+		if ep > 0 {
+			entrypoints++
+		}
+	}
+	fmt.Printf("File: %s\n", filepath.Base(fname))
+	fmt.Printf("  Compiler version: %d\n", hdr.CompilerVersion)
+	fmt.Printf("  Bytecode: %d bytes", hdr.UncompressedSize)
+	if hdr.IsCompressed {
+		fmt.Printf(" (%d compressed)", hdr.CompressedSize)
+	}
+	fmt.Println()
+	fmt.Printf("  Entrypoints: %d, kidoku markers: %d\n", entrypoints, len(hdr.KidokuLnums))
+	if len(hdr.DramatisPersonae) > 0 {
+		fmt.Printf("  Characters: %s\n", strings.Join(hdr.DramatisPersonae, ", "))
+	}
+	if m := hdr.Metadata; !m.IsEmpty() {
+		fmt.Printf("  Compiled by: %s (%d.%02d)\n", m.CompilerName, m.CompilerVersion/100, m.CompilerVersion%100)
+		fmt.Printf("  Target version: %s\n", m.TargetVersionString())
+		fmt.Printf("  Text transform: %s\n", m.TextTransform)
+	}
+	return nil
+}
+
 func doBreak(args []string, opts kprl.Options) error {
 	fname := args[0]
 	var ranges []int
@@ -259,12 +301,19 @@ func doDisassemble(args []string, opts kprl.Options) error {
 		ShowOpcodes:      *showOpcodes,
 		HexDump:          *hexDump,
 		RawStrings:       *rawStrings,
+		MakeMap:          *makeMap,
 		SrcExt:           *srcExt,
 		Encoding:         *encoding,
 		BOM:              *bom,
 		Verbose:          *verbose,
 	}
 
+	reg, err := loadKfn(*kfnFile)
+	if err != nil {
+		return err
+	}
+	disOpts.KFN = reg
+
 	if *target != "" {
 		switch strings.ToLower(*target) {
 		case "reallive", "2":
@@ -279,23 +328,36 @@ func doDisassemble(args []string, opts kprl.Options) error {
 	}
 
 	writer := disasm.NewWriter(opts.OutDir, disOpts)
+	var maps map[int]*disasm.SeenMap
+	if disOpts.MakeMap {
+		maps = make(map[int]*disasm.SeenMap)
+	}
 
 	// Check if first file is an archive
 	firstFile := args[0]
 	if kprl.IsArchive(firstFile) {
-		return disassembleArchive(firstFile, args[1:], opts, disOpts, writer)
+		if err := disassembleArchive(firstFile, args[1:], opts, disOpts, writer, maps); err != nil {
+			return err
+		}
+	} else {
+		// Process individual files
+		for _, fname := range args {
+			if err := disassembleFile(fname, opts, disOpts, writer, maps); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
 	}
 
-	// Process individual files
-	for _, fname := range args {
-		if err := disassembleFile(fname, opts, disOpts, writer); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
-		}
+	if maps != nil {
+		disasm.BuildMap(maps)
+		return writer.WriteMap(maps)
 	}
 	return nil
 }
 
-func disassembleArchive(arcName string, rangeArgs []string, opts kprl.Options, disOpts disasm.Options, writer *disasm.Writer) error {
+// disassembleArchive disassembles the SEENs of an archive in ranges, or
+// all of them. If maps is not nil, their seen maps are added to it.
+func disassembleArchive(arcName string, rangeArgs []string, opts kprl.Options, disOpts disasm.Options, writer *disasm.Writer, maps map[int]*disasm.SeenMap) error {
 	arc, err := kprl.LoadArchive(arcName)
 	if err != nil {
 		return err
@@ -340,11 +402,15 @@ func disassembleArchive(arcName string, rangeArgs []string, opts kprl.Options, d
 			data = decompressed
 		}
 
+		disOpts.Seen = i
 		result, err := disasm.Disassemble(data, disOpts)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: failed to disassemble %s: %v\n", seenName, err)
 			continue
 		}
+		if maps != nil {
+			maps[i] = result.SeenMap
+		}
 
 		if result.Error != "" && *verbose > 0 {
 			fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", seenName, result.Error)
@@ -358,7 +424,9 @@ func disassembleArchive(arcName string, rangeArgs []string, opts kprl.Options, d
 	return nil
 }
 
-func disassembleFile(fname string, opts kprl.Options, disOpts disasm.Options, writer *disasm.Writer) error {
+// disassembleFile disassembles a standalone SEEN. If maps is not nil,
+// its seen map is added to it under the index in its name.
+func disassembleFile(fname string, opts kprl.Options, disOpts disasm.Options, writer *disasm.Writer, maps map[int]*disasm.SeenMap) error {
 	arr, err := binarray.ReadFile(fname)
 	if err != nil {
 		return fmt.Errorf("cannot read '%s': %w", fname, err)
@@ -373,15 +441,59 @@ func disassembleFile(fname string, opts kprl.Options, disOpts disasm.Options, wr
 		arr = decompressed
 	}
 
+	baseName := filepath.Base(fname)
+	seen, numbered := seenIndex(baseName)
+	if maps != nil && !numbered {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not named SEENnnnn, left out of the map\n", fname)
+	}
+	disOpts.Seen = seen
+
 	result, err := disasm.Disassemble(arr, disOpts)
 	if err != nil {
 		return fmt.Errorf("failed to disassemble '%s': %w", fname, err)
 	}
+	if maps != nil && numbered {
+		maps[seen] = result.SeenMap
+	}
 
-	baseName := filepath.Base(fname)
 	return writer.WriteSource(baseName, result)
 }
 
+// seenIndex returns the index of a SEEN from its file name, as in
+// SEEN0123.TXT.
+func seenIndex(name string) (int, bool) {
+	var n int
+	if len(name) < 8 || !strings.EqualFold(name[:4], "SEEN") {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(name[4:8], "%04d", &n); err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// loadKfn loads the function definitions used to name opcodes. Without
+// the file, calls are disassembled as op<...>.
+func loadKfn(path string) (*kfn.Registry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		if *verbose > 0 {
+			fmt.Fprintf(os.Stderr, "warning: %s not found, opcodes will not be named\n", path)
+		}
+		return nil, nil
+	}
+	if *verbose > 0 {
+		fmt.Fprintf(os.Stderr, "Reading KFN: %s\n", path)
+	}
+	reg, err := kfn.ParseFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reg, nil
+}
+
 func fatal(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "Error: "+format+"\n", args...)
 	os.Exit(1)
@@ -2,7 +2,15 @@ package disasm
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/yoremi/rldev-go/pkg/bytecode"
+	"github.com/yoremi/rldev-go/pkg/kfn"
 )
 
 func TestReaderBasics(t *testing.T) {
@@ -51,10 +59,10 @@ func TestReaderInt(t *testing.T) {
 }
 
 func TestReaderExpression(t *testing.T) {
-	// Test immediate integer: 0xff followed by LE int32
-	data := make([]byte, 5)
-	data[0] = 0xff
-	binary.LittleEndian.PutUint32(data[1:], 42)
+	// Test immediate integer: "$\xff" followed by LE int32
+	data := make([]byte, 6)
+	data[0], data[1] = '$', 0xff
+	binary.LittleEndian.PutUint32(data[2:], 42)
 
 	r := NewReader(data, 0, len(data), ModeRealLive)
 	expr, err := r.GetExpression()
@@ -157,25 +165,221 @@ func TestCommandText(t *testing.T) {
 	}
 }
 
-func TestFuncRegistryLookup(t *testing.T) {
-	reg := NewFuncRegistry()
-	reg.Register("0:001:00003,0", FuncDef{
-		Name:  "gosub",
-		Flags: []FuncFlag{FlagIsJump, FlagIsCall},
-	})
+const testKFN = `
+module 001 = Jmp
+module 003 = Msg
+module 004 = Sys
+module 010 = Str
+module 033 = Grp
+fun goto (skip goto) <0:Jmp:00000, 0> ()
+fun goto_if (if goto) <0:Jmp:00001, 0> (<'condition')
+fun goto_on (skip gotos) <0:Jmp:00003, 0> (int)
+fun goto_case (skip cases) <0:Jmp:00004, 0> (int)
+fun ret (skip ret) <0:Jmp:00010, 0> ()
+fun gosub_with (goto) <0:Jmp:00016, 0> (any+)
+fun farcall_with <0:Jmp:00018, 0> (int, int, any+)
+fun intout <0:Msg:00001, 0> (int)
+fun rnd (store) <1:Sys:00001, 0> (int, int)
+fun getName <1:Sys:00002, 0> (>strV)
+fun grpOpenBg <1:Grp:00070, 0> (str, intC)
+fun itoa <1:Str:00012, 0> (int, >strV)
+fun __vwf_TextoutStart <1:Msg:00100, 0> (str)
+fun __vwf_TextoutAppend <1:Msg:00101, 0> (str)
+fun __vwf_TextoutDisplay <1:Msg:00102, 0> ()
+fun __vwf_GlossTextStart <1:Msg:00103, 0> (str)
+fun __vwf_GlossTextSet <1:Msg:00105, 0> ()
+`
+
+func i32(v int32) string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(v))
+	return string(b)
+}
+
+func opcode(typ, module, fn, argc, overload int) string {
+	return string([]byte{'#', byte(typ), byte(module), byte(fn), byte(fn >> 8), byte(argc), byte(argc >> 8), byte(overload)})
+}
+
+func intLit(v int32) string { return "$\xff" + i32(v) }
+
+// disasmCode disassembles raw code with the test KFN and returns the
+// visible commands.
+func disasmCode(t *testing.T, code string) ([]string, *DisassemblyResult) {
+	t.Helper()
+	reg, err := kfn.Parse(strings.NewReader(testKFN))
+	if err != nil { t.Fatal(err) }
+	opts := DefaultOptions()
+	opts.KFN = reg
+	result := &DisassemblyResult{Pointers: make(map[int]bool), SeenMap: NewSeenMap()}
+	r := NewReader([]byte(code), 0, len(code), ModeRealLive)
+	for !r.AtEnd() {
+		if err := readCommand(r, &bytecode.FileHeader{}, result, opts); err != nil { t.Fatalf("at 0x%x: %v", r.Pos(), err) }
+	}
+	rebuildVWFText(result, opts)
+	labels := buildLabelMap(result.Pointers)
+	var lines []string
+	for _, cmd := range result.Commands {
+		lines = append(lines, formatCommand(cmd, labels, opts))
+	}
+	return lines, result
+}
+
+func TestDisassembleKFNCalls(t *testing.T) {
+	code := opcode(0, 3, 1, 1, 0) + "(\\\x01" + intLit(5) + "\\\x00$\x00[" + intLit(2) + "])" +
+		opcode(1, 33, 70, 2, 0) + "(BG01" + intLit(0) + ")" +
+		opcode(1, 4, 1, 2, 0) + "(" + intLit(1) + intLit(10) + ")" +
+		opcode(1, 4, 2, 1, 0) + "($\x12[" + intLit(3) + "])" +
+		opcode(1, 33, 99, 1, 0) + "(\"a \\\"b\\\"\")" +
+		"$\x0b[" + intLit(0) + "]\\\x14" + intLit(3) +
+		"$\x12[" + intLit(1) + "]\\\x1ex"
+	goto_ := opcode(0, 1, 1, 0, 0) + "($\x00[" + intLit(0) + "]\\\x28" + intLit(1) + ")"
+	code += goto_ + i32(int32(len(code)+len(goto_)+4)) + opcode(0, 1, 10, 0, 0)
+	got, result := disasmCode(t, code)
+	want := []string{
+		"intout(-5 + intA[2])",
+		"grpOpenBg('BG01', 0)",
+		"rnd(1, 10) -> store",
+		"getName() -> strS[3]",
+		`op<1:Grp:00099, 0>('a "b"')`,
+		"intL[0] += 3",
+		"strS[1] = 'x'",
+		"goto_if(intA[0] == 1) @1",
+		"ret()",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") { t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n")) }
+	if !result.Pointers[len(code)-8] { t.Errorf("pointers: %v", result.Pointers) }
+	if !result.Commands[len(result.Commands)-1].IsJmp { t.Error("ret should end the block") }
+}
+
+// jumpTables returns goto_on, goto_case, gosub_with and farcall_with
+// calls, the first three jumping to the last two.
+func jumpTables() string {
+	intA0 := "$\x00[" + intLit(0) + "]"
+	tables := func(a, b int32) string {
+		return opcode(0, 1, 3, 2, 0) + "(" + intA0 + "){" + i32(a) + i32(b) + "}" +
+			opcode(0, 1, 4, 2, 0) + "(" + intA0 + "){(" + intLit(1) + ")" + i32(a) + "()" + i32(b) + "}"
+	}
+	a := int32(len(tables(0, 0)))
+	with := opcode(0, 1, 16, 2, 0) + "(" + intLit(1) + "\"x y\")"
+	b := a + int32(len(with)) + 4
+	return tables(a, b) + with + i32(b) + opcode(0, 1, 18, 3, 0) + "(" + intLit(5) + intLit(0) + intLit(1) + ")"
+}
+
+func TestDisassembleJumpTables(t *testing.T) {
+	code := jumpTables()
+	got, result := disasmCode(t, code)
+	want := []string{
+		"goto_on intA[0] { @1, @2 }",
+		"goto_case intA[0] { 1: @1; _: @2 }",
+		"gosub_with(1, 'x y') @2",
+		"farcall_with(5, 0, 1)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") { t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n")) }
+	if len(result.Pointers) != 2 { t.Errorf("pointers: %v", result.Pointers) }
+
+	// The jumps stay in sync without a KFN registry.
+	r := NewReader([]byte(code), 0, len(code), ModeRealLive)
+	result = &DisassemblyResult{Pointers: make(map[int]bool), SeenMap: NewSeenMap()}
+	for !r.AtEnd() {
+		if err := readCommand(r, &bytecode.FileHeader{}, result, DefaultOptions()); err != nil { t.Fatalf("at 0x%x: %v", r.Pos(), err) }
+	}
+	if got := result.Commands[3].Text(); got != "farcall_with(5, 0, 1)" { t.Errorf("without KFN: got %q", got) }
+	if c := result.SeenMap.Calls; len(c) != 1 || c[0].Target != (Address{Scene: 5, Entry: 0}) || c[0].Kind != "farcall_with" { t.Errorf("calls: %v", c) }
+}
+
+func TestSeenMap(t *testing.T) {
+	maps := map[int]*SeenMap{1: NewSeenMap(), 2: NewSeenMap()}
+	maps[1].Calls = []Jump{{Origin: Location{Seen: 1, Line: 12}, Target: Address{Scene: 2, Entry: 1}, Kind: "farcall"}}
+	maps[1].Gotos = []Jump{{Origin: Location{Seen: 1, Line: 30}, Target: Address{Scene: 9}, Kind: "jump"}}
+	maps[2].EntryPoints = []int{0, 1}
+	BuildMap(maps)
+	if e := maps[2].Entries[1]; len(e) != 1 || e[0].Origin.Seen != 1 { t.Errorf("entries: %v", maps[2].Entries) }
 
-	def, ok := reg.Lookup("0:001:00003,0")
-	if !ok {
-		t.Fatal("expected to find gosub")
+	dir := t.TempDir()
+	if err := NewWriter(dir, DefaultOptions()).WriteMap(maps); err != nil { t.Fatal(err) }
+	read := func(name string) string { b, _ := os.ReadFile(filepath.Join(dir, name)); return string(b) }
+	for _, want := range []string{"  farcall -> SEEN0002 #001 (line 12)\n", "  jump -> SEEN0009 #000 (line 30) (not in archive)\n", "  #entrypoint 001\n    <- SEEN0001 farcall (line 12)\n"} {
+		if !strings.Contains(read("seenmap.txt"), want) { t.Errorf("seenmap.txt lacks %q:\n%s", want, read("seenmap.txt")) }
 	}
-	if def.Name != "gosub" {
-		t.Errorf("got name %q", def.Name)
+	if !strings.Contains(read("seenmap.dot"), "SEEN0001 -> SEEN0002 [label=\"farcall #001\", style=dashed];") { t.Errorf("seenmap.dot:\n%s", read("seenmap.dot")) }
+	var back map[int]*SeenMap
+	if err := json.Unmarshal([]byte(read("seenmap.json")), &back); err != nil || len(back[2].Entries[1]) != 1 { t.Errorf("seenmap.json: %v %v", err, back) }
+}
+
+func TestDisassembleSelect(t *testing.T) {
+	code := opcode(0, 2, 3, 3, 0) + "(" + intLit(1) + "){" +
+		"\n\x01\x00\"Option A\"" +
+		"\n\x02\x00(($\x00[" + intLit(0) + "]\\\x28" + intLit(1) + ")2)B" +
+		"\n\x03\x00(0" + intLit(2) + "($\x00[" + intLit(1) + "])4)$\x12[" + intLit(0) + "]}" +
+		opcode(0, 2, 1, 1, 0) + "{\x83\x5c}"
+	got, result := disasmCode(t, code)
+	want := []string{
+		"select_s[1](<res_0000>, hide if intA[0] == 1: <res_0001>, colour(2) cursor if intA[1]: strS[0])",
+		"select(<res_0002>)",
 	}
-	if !def.HasFlag(FlagIsJump) {
-		t.Error("expected FlagIsJump")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") { t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n")) }
+	if strings.Join(result.ResStrs, "|") != "Option A|B|\x83\x5c" { t.Errorf("resources: %q", result.ResStrs) }
+}
+
+// rlcSelect is what rlc compiles rlcSelectSource to; rlc's
+// TestSelectConditions checks the other way.
+const (
+	rlcSelect       = "#\x00\x02\x03\x00\x03\x00\x00($\xff\x01\x00\x00\x00){\"Option A\"(($\x00[$\xff\x00\x00\x00\x00]\\($\xff\x01\x00\x00\x00)2)B(0$\xff\x02\x00\x00\x00($\x00[$\xff\x01\x00\x00\x00])4)$\x12[$\xff\x00\x00\x00\x00]}"
+	rlcSelectSource = "select_s[1]('Option A', hide if intA[0] == 1: 'B', colour(2) cursor if intA[1]: strS[0])"
+)
+
+func TestDisassembleRlcSelect(t *testing.T) {
+	got, result := disasmCode(t, rlcSelect)
+	if len(got) != 1 { t.Fatalf("got %q", got) }
+	for i, s := range result.ResStrs {
+		got[0] = strings.Replace(got[0], fmt.Sprintf("<res_%04d>", i), "'"+s+"'", 1)
 	}
-	if def.HasFlag(FlagIsGoto) {
-		t.Error("did not expect FlagIsGoto")
+	if got[0] != rlcSelectSource { t.Errorf("got  %s\nwant %s", got[0], rlcSelectSource) }
+}
+
+// vwfCall calls an rlBabel function of testKFN with a quoted argument.
+func vwfCall(fn int, arg string) string {
+	return opcode(1, 3, fn, 1, 0) + "(\"" + arg + "\")"
+}
+
+func TestDisassembleVWFText(t *testing.T) {
+	code := vwfCall(100, "\x01A\x02Hi ") + vwfCall(103, "a note") + opcode(1, 3, 105, 0, 0) +
+		vwfCall(101, "\x1fword\x1f, \x08it's\x08\x05\x03\x09\x06\x30\x35\x0a\x03So") +
+		opcode(1, 10, 12, 2, 0) + "($\x00[" + intLit(0) + "]$\x12[" + intLit(9) + "])" +
+		opcode(1, 3, 101, 1, 0) + "($\x12[" + intLit(9) + "])" + opcode(1, 3, 101, 1, 0) + "($\x12[" + intLit(1) + "])" +
+		"@\x01\x00" + opcode(1, 3, 102, 0, 0)
+	got, result := disasmCode(t, code)
+	if len(got) != 1 || got[0] != "<res_0000>" { t.Errorf("got %q", got) }
+	want := `\{A}Hi \g{word}={a note}, "it's"\r\b\e{5}\u\n{}So\i{intA[0]}\s{strS[1]}`
+	if len(result.ResStrs) != 1 || result.ResStrs[0] != want { t.Errorf("text:\n%q\nwant:\n%q", result.ResStrs, want) }
+
+	// Anything but text between the calls leaves them alone.
+	code = vwfCall(100, "Hi") + opcode(0, 3, 1, 1, 0) + "(" + intLit(7) + ")" + opcode(1, 3, 102, 0, 0)
+	if got, _ := disasmCode(t, code); len(got) != 3 || got[0] != "__vwf_TextoutStart('Hi')" { t.Errorf("got %q", got) }
+}
+
+func TestDisassembleQuotedText(t *testing.T) {
+	code := "\x82\xa0\"Hello, \\\"you\\\"\"\x82\xa0"
+	got, result := disasmCode(t, code)
+	if len(got) != 1 || result.ResStrs[0] != "\x82\xa0Hello, \"you\"\x82\xa0" { t.Errorf("got %q %q", got, result.ResStrs) }
+}
+
+func TestDisassembleWithoutKFN(t *testing.T) {
+	code := opcode(0, 3, 1, 1, 0) + "(" + intLit(7) + ")"
+	r := NewReader([]byte(code), 0, len(code), ModeRealLive)
+	result := &DisassemblyResult{Pointers: make(map[int]bool), SeenMap: NewSeenMap()}
+	if err := readCommand(r, &bytecode.FileHeader{}, result, DefaultOptions()); err != nil { t.Fatal(err) }
+	if got := result.Commands[0].Text(); got != "op<0:003:00001, 0>(7)" { t.Errorf("got %q", got) }
+}
+
+func TestStrLiteral(t *testing.T) {
+	// The trail byte of ソ (0x83 0x5c) is not an escape.
+	if got := strLiteral([]byte("it's \x83\x5c")); got != "'it\\'s \x83\x5c'" { t.Errorf("got %q", got) }
+}
+
+func TestVarName(t *testing.T) {
+	for bank, want := range map[byte]string{0x00: "intA", 0x06: "intG", 0x19: "intZ", 0x0b: "intL", 0x12: "strS", 0x1a: "intAb", 0x4d: "intZ2b", 0x81: "intZ8b"} {
+		if got := varName(bank); got != want { t.Errorf("%#x: got %q, want %q", bank, got, want) }
 	}
 }
 
@@ -3,10 +3,12 @@ package disasm
 import (
 	"encoding/binary"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/yoremi/rldev-go/pkg/binarray"
 	"github.com/yoremi/rldev-go/pkg/bytecode"
+	"github.com/yoremi/rldev-go/pkg/kfn"
 )
 
 // Reader reads bytecodes sequentially from a buffer.
@@ -156,12 +158,24 @@ func (r *Reader) ReadBytes(n int) ([]byte, error) {
 
 // --- Expression parser ---
 // Translates the OCaml get_expression/get_expr_term/get_expr_arith/etc.
+// Operators are encoded as '\\' followed by an operator byte, integer
+// constants as "$\xff" + int32, the store register as "$\xc8", and
+// variables as '$' + bank + '[' index ']'.
 
 // GetExpression reads an expression from the bytecode, returning its string representation.
 func (r *Reader) GetExpression() (string, error) {
 	return r.getExprBool()
 }
 
+// peekOp returns the operator byte following a '\\', if the next bytes
+// are an operator.
+func (r *Reader) peekOp() (byte, bool) {
+	if r.pos+1 >= r.limit || r.data[r.pos] != '\\' {
+		return 0, false
+	}
+	return r.data[r.pos+1], true
+}
+
 func (r *Reader) getExprBool() (string, error) {
 	left, err := r.getExprCond()
 	if err != nil {
@@ -169,68 +183,47 @@ func (r *Reader) getExprBool() (string, error) {
 	}
 
 	for {
-		b, err := r.Peek()
-		if err != nil {
+		b, ok := r.peekOp()
+		if !ok || (b != 0x3c && b != 0x3d) {
 			return left, nil
 		}
-		switch b {
-		case 0x3c: // &&
-			r.Next()
-			right, err := r.getExprCond()
-			if err != nil {
-				return "", err
-			}
+		r.Skip(2)
+		right, err := r.getExprCond()
+		if err != nil {
+			return "", err
+		}
+		if b == 0x3c {
 			left = left + " && " + right
-		case 0x3d: // ||
-			r.Next()
-			right, err := r.getExprCond()
-			if err != nil {
-				return "", err
-			}
+		} else {
 			left = left + " || " + right
-		default:
-			return left, nil
 		}
 	}
 }
 
+// cmpOps are the comparison operators, indexed from 0x28.
+var cmpOps = [...]string{"==", "!=", "<=", "<", ">=", ">"}
+
 func (r *Reader) getExprCond() (string, error) {
 	left, err := r.getExprArith()
 	if err != nil {
 		return "", err
 	}
 
-	b, err := r.Peek()
-	if err != nil {
-		return left, nil
-	}
-
-	var op string
-	switch b {
-	case 0x28:
-		op = "=="
-	case 0x29:
-		op = "!="
-	case 0x2a:
-		op = "<="
-	case 0x2b:
-		op = "<"
-	case 0x2c:
-		op = ">="
-	case 0x2d:
-		op = ">"
-	default:
+	b, ok := r.peekOp()
+	if !ok || b < 0x28 || b > 0x2d {
 		return left, nil
 	}
-
-	r.Next()
+	r.Skip(2)
 	right, err := r.getExprArith()
 	if err != nil {
 		return "", err
 	}
-	return left + " " + op + " " + right, nil
+	return left + " " + cmpOps[b-0x28] + " " + right, nil
 }
 
+// arithOps are the arithmetic operators, indexed from 0x00.
+var arithOps = [...]string{"+", "-", "*", "/", "%", "&", "|", "^", "<<", ">>"}
+
 func (r *Reader) getExprArith() (string, error) {
 	left, err := r.getExprTerm()
 	if err != nil {
@@ -238,43 +231,16 @@ func (r *Reader) getExprArith() (string, error) {
 	}
 
 	for {
-		b, err := r.Peek()
-		if err != nil {
-			return left, nil
-		}
-
-		var op string
-		switch b {
-		case 0x00:
-			op = "+"
-		case 0x01:
-			op = "-"
-		case 0x02:
-			op = "*"
-		case 0x03:
-			op = "/"
-		case 0x04:
-			op = "%"
-		case 0x05:
-			op = "&"
-		case 0x06:
-			op = "|"
-		case 0x07:
-			op = "^"
-		case 0x08:
-			op = "<<"
-		case 0x09:
-			op = ">>"
-		default:
+		b, ok := r.peekOp()
+		if !ok || b > 0x09 {
 			return left, nil
 		}
-
-		r.Next()
+		r.Skip(2)
 		right, err := r.getExprTerm()
 		if err != nil {
 			return "", err
 		}
-		left = left + " " + op + " " + right
+		left = left + " " + arithOps[b] + " " + right
 	}
 }
 
@@ -284,184 +250,247 @@ func (r *Reader) getExprTerm() (string, error) {
 		return "", err
 	}
 
-	switch {
-	case b == 0xff: // Immediate integer constant
-		v, err := r.ReadInt32()
+	switch b {
+	case '$':
+		return r.readVar()
+
+	case '\\': // Unary operator
+		op, err := r.Next()
 		if err != nil {
 			return "", err
 		}
-		return fmt.Sprintf("%d", v), nil
-
-	case b == 0xc8: // Store register
-		return "store", nil
-
-	case b == 0x0a: // Unary minus
 		term, err := r.getExprTerm()
 		if err != nil {
 			return "", err
 		}
-		return "-" + term, nil
+		switch op {
+		case 0x00:
+			return term, nil
+		case 0x01:
+			return "-" + term, nil
+		}
+		return "", fmt.Errorf("unexpected unary operator 0x%02x at offset 0x%x", op, r.pos)
 
-	case b == 0x0b: // Parenthesized expression
+	case '(': // Parenthesized expression
 		expr, err := r.GetExpression()
 		if err != nil {
 			return "", err
 		}
-		if err := r.Expect(0x29, "getExprTerm/paren"); err != nil {
-			// Try to continue
+		if err := r.Expect(')', "getExprTerm/paren"); err != nil {
+			return "", err
 		}
 		return "(" + expr + ")", nil
 
-	case b >= 0x14 && b <= 0x1e: // Unary operators
-		switch b {
-		case 0x14:
-			term, err := r.getExprTerm()
-			if err != nil {
-				return "", err
-			}
-			return "~" + term, nil
-		default:
-			// Other unary ops - read term
-			term, err := r.getExprTerm()
-			if err != nil {
-				return "", err
-			}
-			return fmt.Sprintf("op_%02x(%s)", b, term), nil
-		}
-
-	case b == '$': // Integer variable
-		return r.readIntVar()
-
 	default:
 		r.Rollback(1)
 		return "", fmt.Errorf("unexpected byte 0x%02x in expression at offset 0x%x", b, r.pos)
 	}
 }
 
-// readIntVar reads an integer variable reference (intA[idx], intB[idx], etc.)
-func (r *Reader) readIntVar() (string, error) {
-	// Variable type byte
-	varType, err := r.Next()
+// readVar reads what follows a '$': an integer constant, the store
+// register, or a variable reference (intA[idx], strS[idx], etc.)
+func (r *Reader) readVar() (string, error) {
+	bank, err := r.Next()
 	if err != nil {
 		return "", err
 	}
-
-	// Read array index expression enclosed in [ ]
-	if err := r.Expect('[', "readIntVar"); err != nil {
-		r.Rollback(1)
-		// Some formats use different bracketing
+	switch bank {
+	case 0xff:
+		v, err := r.ReadInt32()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d", v), nil
+	case 0xc8:
+		return "store", nil
 	}
 
+	if err := r.Expect('[', "readVar"); err != nil {
+		return "", err
+	}
 	idx, err := r.GetExpression()
 	if err != nil {
 		return "", err
 	}
-
-	if err := r.Expect(']', "readIntVar"); err != nil {
-		// Try to continue
+	if err := r.Expect(']', "readVar"); err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%s[%s]", varName(bank), idx), nil
+}
 
-	prefix := "int"
+// varName returns the name of a variable bank.
+func varName(bank byte) string {
 	switch {
-	case varType < 6:
-		letters := []string{"A", "B", "C", "D", "E", "F"}
-		prefix = "int" + letters[varType]
-	case varType == 6:
-		prefix = "intG"
-	case varType == 7:
-		prefix = "intZ"
-	case varType == 0x0a:
-		prefix = "intL"
-	default:
-		prefix = fmt.Sprintf("int_%02x", varType)
+	case bank <= 0x06:
+		return "int" + string(rune('A'+bank))
+	case bank == 0x19:
+		return "intZ"
+	case bank == 0x0b:
+		return "intL"
+	case bank == 0x0a:
+		return "strK"
+	case bank == 0x0c:
+		return "strM"
+	case bank == 0x12:
+		return "strS"
 	}
+	// Bit-width variants: 0x1a intAb ... 0x81 intZ8b
+	widths := []struct {
+		base  byte
+		width string
+	}{{0x1a, "b"}, {0x34, "2b"}, {0x4e, "4b"}, {0x68, "8b"}}
+	for _, w := range widths {
+		switch {
+		case bank >= w.base && bank <= w.base+6:
+			return "int" + string(rune('A'+bank-w.base)) + w.width
+		case bank == w.base+0x19:
+			return "intZ" + w.width
+		}
+	}
+	return fmt.Sprintf("var_%02x", bank)
+}
 
-	return fmt.Sprintf("%s[%s]", prefix, idx), nil
+// isStrBank reports whether bank is a string variable bank.
+func isStrBank(bank byte) bool {
+	return bank == 0x0a || bank == 0x0c || bank == 0x12
 }
 
-// GetData reads a "data" element - either a string or expression.
-// This is the main data reader used for function arguments.
+// GetData reads a "data" element of unknown type - a string or an
+// expression, told apart by their first bytes.
 func (r *Reader) GetData() (string, error) {
 	b, err := r.Peek()
 	if err != nil {
 		return "", err
 	}
 
-	if b == '"' || b == 0x0a {
-		// String data
-		return r.readStringData()
+	switch {
+	case b == '"':
+		return r.readQuoted()
+	case b == '$' || b == '\\' || b == '(':
+		return r.GetExpression()
 	}
-
-	// Expression data
-	return r.GetExpression()
+	return r.readBare()
 }
 
-// readStringData reads a string argument (quoted string or string variable).
-func (r *Reader) readStringData() (string, error) {
-	b, err := r.Next()
+// readString reads a string parameter: a quoted or bare literal, or a
+// string variable.
+func (r *Reader) readString() (string, error) {
+	b, err := r.Peek()
 	if err != nil {
 		return "", err
 	}
-
 	switch b {
 	case '"':
-		// Literal string
-		var sb strings.Builder
-		sb.WriteByte('"')
-		for {
-			c, err := r.Next()
-			if err != nil {
-				break
-			}
-			if c == '"' {
-				sb.WriteByte('"')
-				break
-			}
-			sb.WriteByte(c)
-		}
-		return sb.String(), nil
-
-	case 0x0a:
-		// String variable reference
-		return r.readStrVar()
-
-	default:
-		r.Rollback(1)
-		return "", fmt.Errorf("unexpected byte 0x%02x in string data", b)
+		return r.readQuoted()
+	case '$':
+		return r.GetExpression()
 	}
+	return r.readBare()
 }
 
-// readStrVar reads a string variable reference (strS[idx], etc.)
-func (r *Reader) readStrVar() (string, error) {
-	varType, err := r.Next()
+// readQuoted reads a double-quoted string literal, in which '"' is
+// escaped as \", and returns it as a Kepago literal.
+func (r *Reader) readQuoted() (string, error) {
+	text, err := r.readQuotedText()
 	if err != nil {
 		return "", err
 	}
+	return strLiteral(text), nil
+}
 
-	if err := r.Expect('[', "readStrVar"); err != nil {
-		r.Rollback(1)
+// readQuotedText reads a double-quoted string literal and returns its
+// unescaped text.
+func (r *Reader) readQuotedText() ([]byte, error) {
+	if err := r.Expect('"', "readQuoted"); err != nil {
+		return nil, err
+	}
+	var text []byte
+	for {
+		c, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		if c == '"' {
+			break
+		}
+		if c == '\\' && r.pos < r.limit && r.data[r.pos] == '"' {
+			c, _ = r.Next()
+		} else if isShiftJISLead(c) && r.pos < r.limit {
+			text = append(text, c)
+			c, _ = r.Next()
+		}
+		text = append(text, c)
 	}
+	return text, nil
+}
 
-	idx, err := r.GetExpression()
+// readBare reads an unquoted string literal: identifier characters and
+// double-byte characters.
+func (r *Reader) readBare() (string, error) {
+	text, err := r.readBareText()
 	if err != nil {
 		return "", err
 	}
+	return strLiteral(text), nil
+}
 
-	if err := r.Expect(']', "readStrVar"); err != nil {
-		// Continue
+// readBareText reads an unquoted string literal and returns its text.
+func (r *Reader) readBareText() ([]byte, error) {
+	start := r.pos
+	for r.pos < r.limit {
+		c := r.data[r.pos]
+		switch {
+		case c == '_' || (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'):
+			r.pos++
+		case isShiftJISLead(c) && r.pos+1 < r.limit:
+			r.pos += 2
+		default:
+			if r.pos == start {
+				return nil, fmt.Errorf("unexpected byte 0x%02x in data at offset 0x%x", c, r.pos)
+			}
+			return r.data[start:r.pos], nil
+		}
 	}
+	return r.data[start:r.pos], nil
+}
 
-	prefix := "str"
-	switch varType {
-	case 0x0c:
-		prefix = "strS"
-	case 0x12:
-		prefix = "strM"
-	default:
-		prefix = fmt.Sprintf("str_%02x", varType)
+// strLiteral quotes text as a Kepago string literal. Trail bytes of
+// double-byte characters may be '\\' and are not escaped.
+func strLiteral(text []byte) string {
+	b := []byte{'\''}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case isShiftJISLead(c) && i+1 < len(text):
+			b = append(b, c, text[i+1])
+			i++
+			continue
+		case c == '\'' || c == '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, c)
 	}
+	return string(append(b, '\''))
+}
 
-	return fmt.Sprintf("%s[%s]", prefix, idx), nil
+// kepagoText escapes the backslashes of text, so that it reads as the
+// same text in Kepago. Trail bytes of double-byte characters are left
+// alone.
+func kepagoText(text []byte) string {
+	var b []byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case isShiftJISLead(c) && i+1 < len(text):
+			b = append(b, c, text[i+1])
+			i++
+			continue
+		case c == '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return string(b)
 }
 
 // --- Main disassembly loop ---
@@ -476,6 +505,8 @@ type DisassemblyResult struct {
 	Header    bytecode.FileHeader
 	Error     string
 	SeenMap   *SeenMap
+
+	line int // last debug line read, the origin of jumps in the seen map
 }
 
 // Disassemble performs bytecode disassembly on the given data.
@@ -498,14 +529,26 @@ func Disassemble(arr *binarray.Buffer, opts Options) (*DisassemblyResult, error)
 
 	// Determine version
 	var version Version
-	// TODO: read from metadata or command line
+	// TODO: read from command line
 
-	if mode == ModeAvg2000 {
+	switch {
+	case !hdr.Metadata.IsEmpty():
+		for i, n := range hdr.Metadata.TargetVersion {
+			version[i] = int(n)
+		}
+	case mode == ModeAvg2000:
 		version = Version{1, 0, 0, 0}
-	} else {
+	default:
 		version = Version{1, 2, 7, 0}
 	}
 
+	// Function names and prototypes depend on the target
+	if opts.KFN != nil {
+		reg := opts.KFN.Clone()
+		reg.Target, reg.Version = kfnTarget(mode), kfn.Version(version)
+		opts.KFN = reg
+	}
+
 	// Calculate bounds
 	startAddr := hdr.DataOffset
 	if opts.StartAddress > hdr.DataOffset && opts.StartAddress < arr.Len() {
@@ -542,10 +585,22 @@ func Disassemble(arr *binarray.Buffer, opts Options) (*DisassemblyResult, error)
 			break
 		}
 	}
+	rebuildVWFText(result, opts)
 
 	return result, nil
 }
 
+// kfnTarget returns the KFN target of an engine mode.
+func kfnTarget(mode EngineMode) kfn.Target {
+	switch mode {
+	case ModeAvg2000:
+		return kfn.TargetAVG2000
+	case ModeKinetic:
+		return kfn.TargetKinetic
+	}
+	return kfn.TargetRealLive
+}
+
 // readCommand reads one command from the bytecode stream.
 func readCommand(r *Reader, hdr *bytecode.FileHeader, result *DisassemblyResult, opts Options) error {
 	offset := r.RelPos()
@@ -592,6 +647,9 @@ func readCommand(r *Reader, hdr *bytecode.FileHeader, result *DisassemblyResult,
 			Overload: int(overload),
 		}
 
+		if name, ok := selectNames[op.Function]; ok && op.Type == 0 && op.Module == selectModule {
+			return readSelect(r, result, offset, op, name, opts)
+		}
 		return readFunction(r, result, offset, op, argc, opts)
 
 	case b == '$':
@@ -612,6 +670,7 @@ func readCommand(r *Reader, hdr *bytecode.FileHeader, result *DisassemblyResult,
 		}
 		cmd.Kepago = []CommandElem{ElemString{Value: fmt.Sprintf("#line %d", lineNum)}}
 		result.Commands = append(result.Commands, cmd)
+		result.line = lineNum
 
 	case b == ',':
 		// Debug separator
@@ -648,7 +707,7 @@ func readCommand(r *Reader, hdr *bytecode.FileHeader, result *DisassemblyResult,
 			cmd.Kepago = []CommandElem{ElemString{
 				Value: fmt.Sprintf("#entrypoint %03d // Z%02d", entryIdx, entryIdx),
 			}}
-			result.SeenMap.EntryPoints = append(result.SeenMap.EntryPoints, offset)
+			result.SeenMap.EntryPoints = append(result.SeenMap.EntryPoints, int(entryIdx))
 		} else {
 			cmd.Hidden = !opts.ReadDebugSymbols
 			cmd.CType = "kidoku"
@@ -667,186 +726,566 @@ func readCommand(r *Reader, hdr *bytecode.FileHeader, result *DisassemblyResult,
 	return nil
 }
 
-// readFunction handles a function call opcode.
+// readFunction handles a function call opcode. Functions defined in the
+// KFN registry are printed under their name, with their parameters read
+// according to the prototype of the overload called; the others are
+// printed as op<type:module:function, overload>(...). The jumps of
+// module 001 are known without the registry, since their targets must be
+// read to stay in sync.
 func readFunction(r *Reader, result *DisassemblyResult, offset int, op Opcode, argc int, opts Options) error {
-	cmd := Command{Offset: offset}
-	opStr := op.String()
+	cmd := Command{Offset: offset, Opcode: op.String()}
 
-	// Read function arguments
-	args, err := readFuncArgs(r, argc)
-	if err != nil {
-		// If we fail to parse args, emit what we can
-		cmd.Kepago = []CommandElem{ElemString{Value: fmt.Sprintf("op<%s>(?)", opStr)}}
-		cmd.Opcode = opStr
+	var def *kfn.FuncDef
+	if opts.KFN != nil {
+		if fd, ok := opts.KFN.LookupOpcode(op.Type, op.Module, op.Function); ok && !strings.HasPrefix(fd.Ident, "__op_") {
+			def = fd
+		}
+	}
+	name, jump := jumpOf(op, def)
+
+	// Parameters are enclosed in parentheses when there are any; uncounted
+	// parameters (the condition of goto_if) are not included in argc. The
+	// argc of a jump table is the length of the table, which follows.
+	var params []kfn.Parameter
+	parens := argc > 0 || jump == jumpOn || jump == jumpCase
+	if def != nil && op.Overload < len(def.Prototypes) && def.Prototypes[op.Overload].Defined {
+		params = def.Prototypes[op.Overload].Params
+		for _, p := range params {
+			parens = parens || hasParamFlag(p, kfn.FUncount)
+		}
+	} else if b, err := r.Peek(); err == nil && b == '(' {
+		parens = true
+	}
+	var args []string
+	if parens {
+		var err error
+		if args, err = readFuncArgs(r, params); err != nil {
+			return fmt.Errorf("parameters of %s: %w", unknownOp(op, opts.KFN), err)
+		}
+	}
+
+	if name == "" {
+		text := unknownOp(op, opts.KFN)
+		if len(args) > 0 {
+			text += "(" + strings.Join(args, ", ") + ")"
+		}
+		cmd.Kepago = []CommandElem{ElemString{Value: text}}
 		result.Commands = append(result.Commands, cmd)
-		return nil // Don't propagate - try to continue
+		return nil
 	}
 
-	// Special handling for known opcodes
-	switch {
-	case op.Module == 1 && (op.Function == 1 || op.Function == 3):
-		// goto / gosub - has pointer target
-		handleGoto(r, result, &cmd, op, args, offset)
-	case op.Module == 1 && (op.Function == 5 || op.Function == 8 ||
-		op.Function == 9 || op.Function == 16):
-		// Conditional goto/gosub
-		handleCondGoto(r, result, &cmd, op, args, offset)
-	case op.Module == 5 && op.Function == 1:
-		// ret
-		cmd.Kepago = []CommandElem{ElemString{Value: "ret"}}
-		cmd.IsJmp = true
-	default:
-		// Generic function
-		var sb strings.Builder
-		sb.WriteString(fmt.Sprintf("op<%s>", opStr))
+	// The return value goes to the store register, or to the variable
+	// passed as the return parameter.
+	dest := ""
+	if def != nil && def.HasFlag(kfn.FlagPushStore) {
+		dest = "store"
+	}
+	for i, p := range params {
+		if hasParamFlag(p, kfn.FReturn) && i < len(args) {
+			dest = args[i]
+			args = append(args[:i:i], args[i+1:]...)
+			break
+		}
+	}
+
+	switch jump {
+	case jumpOn, jumpCase:
+		if len(args) != 1 {
+			return fmt.Errorf("%s takes one value, got %d", name, len(args))
+		}
+		elems, err := readJumpTable(r, result, jump, argc)
+		if err != nil {
+			return fmt.Errorf("targets of %s: %w", name, err)
+		}
+		cmd.Kepago = append([]CommandElem{ElemString{Value: name + " " + args[0] + " { "}}, elems...)
+		cmd.Kepago = append(cmd.Kepago, ElemString{Value: " }"})
+	case jumpLabel:
+		text := name
 		if len(args) > 0 {
-			sb.WriteByte('(')
-			for i, arg := range args {
-				if i > 0 {
-					sb.WriteString(", ")
-				}
-				sb.WriteString(arg)
-			}
-			sb.WriteByte(')')
+			text += "(" + strings.Join(args, ", ") + ")"
 		}
-		cmd.Kepago = []CommandElem{ElemString{Value: sb.String()}}
-		cmd.Opcode = opStr
+		target, err := r.GetInt()
+		if err != nil {
+			return err
+		}
+		result.Pointers[target] = true
+		cmd.Kepago = []CommandElem{ElemString{Value: text + " "}, ElemPointer{Offset: target}}
+	case jumpScene, callScene:
+		cmd.Kepago = []CommandElem{ElemString{Value: name + "(" + strings.Join(args, ", ") + ")"}}
+		recordSceneJump(result, opts, name, jump, args)
+	default:
+		cmd.Kepago = []CommandElem{ElemString{Value: name + "(" + strings.Join(args, ", ") + ")"}}
+	}
+	if dest != "" {
+		cmd.Kepago = append(cmd.Kepago, ElemString{Value: " -> " + dest})
+	}
+	cmd.call = &funcCall{name: name, args: args, dest: dest}
+	if def != nil {
+		cmd.IsJmp = def.HasFlag(kfn.FlagIsSkip)
+	} else {
+		cmd.IsJmp = name == "goto"
 	}
 
 	result.Commands = append(result.Commands, cmd)
 	return nil
 }
 
-// readFuncArgs reads argc function arguments.
-func readFuncArgs(r *Reader, argc int) ([]string, error) {
-	var args []string
+// jumpKind tells how the targets of a jump follow its parameters.
+type jumpKind int
 
-	// Check for opening paren
-	b, err := r.Peek()
+const (
+	jumpNone  jumpKind = iota
+	jumpLabel          // one label
+	jumpOn             // a list of labels, indexed by the value
+	jumpCase           // a list of (value) label cases
+	jumpScene          // a scene and entrypoint, as parameters
+	callScene          // the same, returning with rtl
+)
+
+// jmpModule is the module of the jumps (001 = Jmp).
+const jmpModule = 1
+
+// jmpFuncs are the jumps of module 001 by opcode, used when the KFN
+// registry does not define them or their flags.
+var jmpFuncs = map[int]struct {
+	name string
+	kind jumpKind
+}{
+	0:  {"goto", jumpLabel},
+	1:  {"goto_if", jumpLabel},
+	2:  {"goto_unless", jumpLabel},
+	3:  {"goto_on", jumpOn},
+	4:  {"goto_case", jumpCase},
+	5:  {"gosub", jumpLabel},
+	6:  {"gosub_if", jumpLabel},
+	7:  {"gosub_unless", jumpLabel},
+	8:  {"gosub_on", jumpOn},
+	9:  {"gosub_case", jumpCase},
+	11: {"jump", jumpScene},
+	12: {"farcall", callScene},
+	16: {"gosub_with", jumpLabel},
+	18: {"farcall_with", callScene},
+}
+
+// jumpOf returns the name a function is printed under, or "" if it is
+// unknown, and how its targets are encoded. The flags of def take
+// precedence over the opcode; goto_on and goto_case are keywords of
+// Kepago, so their tables are read whatever def says.
+func jumpOf(op Opcode, def *kfn.FuncDef) (string, jumpKind) {
+	f, builtin := jmpFuncs[op.Function]
+	builtin = builtin && op.Type == 0 && op.Module == jmpModule
+	if def == nil {
+		if builtin {
+			return f.name, f.kind
+		}
+		return "", jumpNone
+	}
+	switch {
+	case def.HasFlag(kfn.FlagHasGotos):
+		return def.Ident, jumpOn
+	case def.HasFlag(kfn.FlagHasCases):
+		return def.Ident, jumpCase
+	case builtin:
+		return def.Ident, f.kind
+	case def.HasFlag(kfn.FlagIsGoto):
+		return def.Ident, jumpLabel
+	case def.HasFlag(kfn.FlagIsJump) && def.HasFlag(kfn.FlagIsCall):
+		return def.Ident, callScene
+	case def.HasFlag(kfn.FlagIsJump):
+		return def.Ident, jumpScene
+	}
+	return def.Ident, jumpNone
+}
+
+// recordSceneJump adds a jump to another scene to the seen map. Its
+// parameters are the scene and the entrypoint, 0 if omitted; targets
+// computed at run time cannot be mapped.
+func recordSceneJump(result *DisassemblyResult, opts Options, name string, kind jumpKind, args []string) {
+	if len(args) == 0 {
+		return
+	}
+	scene, err := strconv.Atoi(args[0])
 	if err != nil {
+		return
+	}
+	entry := 0
+	if len(args) > 1 {
+		if entry, err = strconv.Atoi(args[1]); err != nil {
+			return
+		}
+	}
+	j := Jump{
+		Origin: Location{Seen: opts.Seen, Line: result.line},
+		Target: Address{Scene: scene, Entry: entry},
+		Kind:   name,
+	}
+	if kind == callScene {
+		result.SeenMap.Calls = append(result.SeenMap.Calls, j)
+	} else {
+		result.SeenMap.Gotos = append(result.SeenMap.Gotos, j)
+	}
+}
+
+// readJumpTable reads the n targets of a goto_on or goto_case:
+//
+//	'{' { label } '}'
+//	'{' { '(' [ value ] ')' label } '}'
+//
+// registers them as pointers and returns them as @label, ... or
+// value: @label; ...; _: @label.
+func readJumpTable(r *Reader, result *DisassemblyResult, kind jumpKind, n int) ([]CommandElem, error) {
+	if err := r.Expect('{', "readJumpTable"); err != nil {
 		return nil, err
 	}
-	if b == '(' {
-		r.Next()
+	sep := ", "
+	if kind == jumpCase {
+		sep = "; "
+	}
+	var elems []CommandElem
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			elems = append(elems, ElemString{Value: sep})
+		}
+		if kind == jumpCase {
+			if err := r.Expect('(', "readJumpTable"); err != nil {
+				return nil, err
+			}
+			value := "_"
+			if b, err := r.Peek(); err == nil && b != ')' {
+				if value, err = r.GetExpression(); err != nil {
+					return nil, err
+				}
+			}
+			if err := r.Expect(')', "readJumpTable"); err != nil {
+				return nil, err
+			}
+			elems = append(elems, ElemString{Value: value + ": "})
+		}
+		target, err := r.GetInt()
+		if err != nil {
+			return nil, err
+		}
+		result.Pointers[target] = true
+		elems = append(elems, ElemPointer{Offset: target})
+	}
+	if err := r.Expect('}', "readJumpTable"); err != nil {
+		return nil, err
+	}
+	return elems, nil
+}
+
+// unknownOp renders an opcode in rlc's op<...> syntax, naming the module
+// if the KFN does.
+func unknownOp(op Opcode, reg *kfn.Registry) string {
+	module := fmt.Sprintf("%03d", op.Module)
+	if reg != nil {
+		if name := reg.ModuleName(op.Module); name != "" {
+			module = name
+		}
 	}
+	return fmt.Sprintf("op<%d:%s:%05d, %d>", op.Type, module, op.Function, op.Overload)
+}
+
+func hasParamFlag(p kfn.Parameter, flag kfn.ParamFlag) bool {
+	for _, f := range p.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
 
-	for i := 0; i < argc; i++ {
-		arg, err := r.GetData()
+// readFuncArgs reads a parenthesized parameter list. Each parameter is
+// read according to its type in params; past the end of params, the last
+// parameter repeats if it is variadic, and untyped data is read otherwise.
+func readFuncArgs(r *Reader, params []kfn.Parameter) ([]string, error) {
+	if err := r.Expect('(', "readFuncArgs"); err != nil {
+		return nil, err
+	}
+	var args []string
+	for {
+		b, err := r.Peek()
+		if err != nil {
+			return args, err
+		}
+		switch b {
+		case ')':
+			r.Next()
+			return args, nil
+		case ',':
+			r.Next()
+			continue
+		}
+		var param *kfn.Parameter
+		switch i := len(args); {
+		case i < len(params):
+			param = &params[i]
+		case len(params) > 0 && hasParamFlag(params[len(params)-1], kfn.FArgc):
+			param = &params[len(params)-1]
+		}
+		arg, err := r.readParam(param)
 		if err != nil {
 			return args, err
 		}
 		args = append(args, arg)
 	}
+}
 
-	// Check for closing paren
-	b, err = r.Peek()
-	if err == nil && b == ')' {
-		r.Next()
+// readParam reads one parameter of the given type (nil if unknown).
+func (r *Reader) readParam(p *kfn.Parameter) (string, error) {
+	if p == nil {
+		return r.GetData()
 	}
+	switch p.Type {
+	case kfn.PStr, kfn.PStrC, kfn.PStrV, kfn.PResStr:
+		return r.readString()
+	case kfn.PInt, kfn.PIntC, kfn.PIntV:
+		return r.GetExpression()
+	case kfn.PComplex:
+		if b, err := r.Peek(); err == nil && b == '(' {
+			items, err := readFuncArgs(r, nil)
+			return "{" + strings.Join(items, ", ") + "}", err
+		}
+	case kfn.PSpecial:
+		// a<tag>, then a parenthesized list or a single datum
+		if b, err := r.Peek(); err == nil && b == 'a' {
+			r.Next()
+			tag, err := r.Next()
+			if err != nil {
+				return "", err
+			}
+			var items []string
+			if b, err := r.Peek(); err == nil && b == '(' {
+				items, err = readFuncArgs(r, nil)
+				if err != nil {
+					return "", err
+				}
+			} else {
+				item, err := r.GetData()
+				if err != nil {
+					return "", err
+				}
+				items = []string{item}
+			}
+			return fmt.Sprintf("%d:{%s}", tag, strings.Join(items, ", ")), nil
+		}
+	}
+	return r.GetData()
+}
+
+// assignOps are the assignment operators, indexed from 0x14.
+var assignOps = [...]string{"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "<<=", ">>=", "="}
+
+// ============================================================
+// Select
+// ============================================================
+
+// selectModule is the module of the select functions (002 = Sel).
+const selectModule = 2
+
+// selectNames are the select functions whose options are given as a
+// braced list, by opcode. They are keywords of Kepago rather than KFN
+// functions.
+var selectNames = map[int]string{
+	0:  "select_w",
+	1:  "select",
+	2:  "select_s2",
+	3:  "select_s",
+	10: "select_w2",
+	11: "select_msgcancel",
+	12: "select_btncancel",
+	13: "select_btnwkcancel",
+}
 
-	return args, nil
+// selectEffects are the effects of select conditions, by bytecode.
+var selectEffects = map[byte]string{
+	'0': "colour",
+	'1': "title",
+	'2': "hide",
+	'3': "blank",
+	'4': "cursor",
 }
 
-// handleGoto processes goto/gosub instructions.
-func handleGoto(r *Reader, result *DisassemblyResult, cmd *Command, op Opcode, args []string, offset int) {
-	name := "goto"
-	if op.Function == 3 {
-		name = "gosub"
+// readSelect reads a select command:
+//
+//	[ '(' window ')' ] '{' { [ '(' conditions ')' ] option } '}'
+//
+// and prints it as name[window](option, conditions: option, ...). The
+// choice goes to the store register. Literal options are resource
+// strings, so they end up in the resource file with the text.
+func readSelect(r *Reader, result *DisassemblyResult, offset int, op Opcode, name string, opts Options) error {
+	cmd := Command{Offset: offset, Opcode: op.String()}
+
+	text := name
+	if b, err := r.Peek(); err == nil && b == '(' {
+		r.Next()
+		window, err := r.GetExpression()
+		if err != nil {
+			return fmt.Errorf("window of %s: %w", name, err)
+		}
+		if err := r.Expect(')', "readSelect"); err != nil {
+			return err
+		}
+		text += "[" + window + "]"
+	}
+	if err := r.Expect('{', "readSelect"); err != nil {
+		return err
 	}
 
-	cmd.IsJmp = (op.Function == 1) // goto is unconditional jump
-	cmd.Kepago = []CommandElem{ElemString{Value: name}}
+	var options []string
+	for {
+		b, err := r.Peek()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case '}':
+			r.Next()
+			cmd.Kepago = []CommandElem{ElemString{Value: text + "(" + strings.Join(options, ", ") + ")"}}
+			result.Commands = append(result.Commands, cmd)
+			return nil
+		case '\n':
+			// Line markers separate the options of multi-line selects
+			r.Next()
+			if _, err := r.GetIntForMode(); err != nil {
+				return err
+			}
+			continue
+		case ',':
+			r.Next()
+			continue
+		}
 
-	// The argument is a pointer offset
-	if len(args) > 0 {
-		cmd.Kepago = append(cmd.Kepago, ElemString{Value: "(" + args[0] + ")"})
+		opt := ""
+		if b == '(' {
+			r.Next()
+			conds, err := r.readSelectConds()
+			if err != nil {
+				return fmt.Errorf("option %d of %s: %w", len(options)+1, name, err)
+			}
+			opt = conds + ": "
+		}
+		val, err := r.readSelectOption(result, opts)
+		if err != nil {
+			return fmt.Errorf("option %d of %s: %w", len(options)+1, name, err)
+		}
+		options = append(options, opt+val)
 	}
 }
 
-// handleCondGoto processes conditional goto/gosub.
-func handleCondGoto(r *Reader, result *DisassemblyResult, cmd *Command, op Opcode, args []string, offset int) {
-	name := "goto_if"
-	switch op.Function {
-	case 5:
-		name = "goto_if"
-	case 8:
-		name = "goto_unless"
-	case 9:
-		name = "gosub_if"
-	case 16:
-		name = "gosub_unless"
+// readSelectConds reads the conditions of a select option, up to the
+// closing ')'. Each is an effect, optionally with an argument, which
+// applies if its condition holds:
+//
+//	[ '(' condition ')' ] effect [ argument ]
+//
+// They are printed as effect(argument) if condition.
+func (r *Reader) readSelectConds() (string, error) {
+	var conds []string
+	for {
+		b, err := r.Next()
+		if err != nil {
+			return "", err
+		}
+		if b == ')' {
+			if len(conds) == 0 {
+				return "", fmt.Errorf("empty condition list")
+			}
+			return strings.Join(conds, " "), nil
+		}
+		cond := ""
+		if b == '(' {
+			if cond, err = r.GetExpression(); err != nil {
+				return "", err
+			}
+			if err := r.Expect(')', "readSelectConds"); err != nil {
+				return "", err
+			}
+			if b, err = r.Next(); err != nil {
+				return "", err
+			}
+		}
+		effect, ok := selectEffects[b]
+		if !ok {
+			return "", fmt.Errorf("unknown select effect 0x%02x at offset 0x%x", b, r.pos-1)
+		}
+		if b, err := r.Peek(); err == nil && (b == '$' || b == '\\') {
+			arg, err := r.GetExpression()
+			if err != nil {
+				return "", err
+			}
+			effect += "(" + arg + ")"
+		}
+		if cond != "" {
+			effect += " if " + cond
+		}
+		conds = append(conds, effect)
 	}
+}
 
-	var sb strings.Builder
-	sb.WriteString(name)
-	if len(args) > 0 {
-		sb.WriteByte('(')
-		sb.WriteString(strings.Join(args, ", "))
-		sb.WriteByte(')')
+// readSelectOption reads the text of a select option. Literal text is
+// added to the resource strings; string variables are printed as they
+// are.
+func (r *Reader) readSelectOption(result *DisassemblyResult, opts Options) (string, error) {
+	b, err := r.Peek()
+	if err != nil {
+		return "", err
 	}
-
-	cmd.Kepago = []CommandElem{ElemString{Value: sb.String()}}
+	var text []byte
+	switch b {
+	case '$':
+		return r.GetExpression()
+	case '"':
+		text, err = r.readQuotedText()
+	default:
+		text, err = r.readBareText()
+	}
+	if err != nil {
+		return "", err
+	}
+	_, res := addResource(result, kepagoText(text), opts)
+	return res, nil
 }
 
-// readAssignment reads a variable assignment ('$' prefix).
+// readAssignment reads a variable assignment: dest '\\' op expr.
 func readAssignment(r *Reader, result *DisassemblyResult, offset int) error {
 	cmd := Command{Offset: offset}
 
-	// Read destination variable
-	dest, err := r.readIntVar()
+	// Read destination variable; the '$' was consumed by readCommand
+	bank, err := r.Peek()
+	if err != nil {
+		return err
+	}
+	dest, err := r.readVar()
 	if err != nil {
 		return err
 	}
 
 	// Read operator
+	if err := r.Expect('\\', "readAssignment"); err != nil {
+		return err
+	}
 	opByte, err := r.Next()
 	if err != nil {
 		return err
 	}
-
-	var op string
-	switch opByte {
-	case 0x14:
-		op = "="
-	case 0x15:
-		op = "+="
-	case 0x16:
-		op = "-="
-	case 0x17:
-		op = "*="
-	case 0x18:
-		op = "/="
-	case 0x19:
-		op = "%="
-	case 0x1a:
-		op = "&="
-	case 0x1b:
-		op = "|="
-	case 0x1c:
-		op = "^="
-	case 0x1d:
-		op = "<<="
-	case 0x1e:
-		op = ">>="
-	default:
-		op = fmt.Sprintf("?=%02x=", opByte)
+	if opByte < 0x14 || opByte > 0x1e {
+		return fmt.Errorf("unknown assignment operator 0x%02x", opByte)
 	}
 
-	// Read source expression
-	if err := r.Expect(0x5c, "readAssignment"); err != nil {
-		// backslash separator - may be missing in some versions
+	// Read source expression; string variables are assigned strings
+	var src string
+	if isStrBank(bank) {
+		src, err = r.readString()
+	} else {
+		src, err = r.GetExpression()
 	}
-
-	src, err := r.GetExpression()
 	if err != nil {
-		src = "???"
+		return err
 	}
 
-	// Expect terminator
-	r.Expect(0x5c, "readAssignment/end")
-
 	cmd.Kepago = []CommandElem{ElemString{
-		Value: fmt.Sprintf("%s %s %s", dest, op, src),
+		Value: fmt.Sprintf("%s %s %s", dest, assignOps[opByte-0x14], src),
 	}}
 	result.Commands = append(result.Commands, cmd)
 	return nil
@@ -924,6 +1363,18 @@ func readTextout(r *Reader, result *DisassemblyResult, offset int, opts Options)
 			text.WriteByte(b)
 			text.WriteByte(b2)
 
+		case b == '"':
+			// Quoted run of ASCII, which may contain any character
+			r.Rollback(1)
+			run, err := r.readQuotedText()
+			if err != nil {
+				return err
+			}
+			text.WriteString(kepagoText(run))
+
+		case b == '\\':
+			text.WriteString("\\\\")
+
 		case b >= 0x20 && b < 0x80:
 			// ASCII
 			text.WriteByte(b)
@@ -940,23 +1391,24 @@ func readTextout(r *Reader, result *DisassemblyResult, offset int, opts Options)
 		return nil // Don't emit empty text commands
 	}
 
-	textStr := text.String()
+	var res string
+	cmd.ResIdx, res = addResource(result, text.String(), opts)
+	cmd.Kepago = []CommandElem{ElemString{Value: res}}
 
-	// Add as resource string
-	resIdx := len(result.ResStrs)
-	result.ResStrs = append(result.ResStrs, textStr)
-	cmd.ResIdx = resIdx
+	result.Commands = append(result.Commands, cmd)
+	return nil
+}
 
+// addResource adds text to the resource strings and returns its index
+// and how the source refers to it: by reference when strings are
+// separated, inline otherwise.
+func addResource(result *DisassemblyResult, text string, opts Options) (int, string) {
+	idx := len(result.ResStrs)
+	result.ResStrs = append(result.ResStrs, text)
 	if opts.SeparateStrings {
-		cmd.Kepago = []CommandElem{ElemString{
-			Value: fmt.Sprintf("<res_%04d>", resIdx),
-		}}
-	} else {
-		cmd.Kepago = []CommandElem{ElemString{Value: "'" + textStr + "'"}}
+		return idx, fmt.Sprintf("<res_%04d>", idx)
 	}
-
-	result.Commands = append(result.Commands, cmd)
-	return nil
+	return idx, "'" + strings.ReplaceAll(text, "'", "\\'") + "'"
 }
 
 // isShiftJISLead returns true if the byte is a ShiftJIS lead byte.
@@ -0,0 +1,138 @@
+package disasm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ============================================================
+// Seen map
+// ============================================================
+
+// BuildMap links the seen maps of the scenes of an archive, keyed by
+// SEEN index: the outgoing calls and gotos of each scene become the
+// incoming entries of their target, by entrypoint. Jumps to scenes not
+// in maps are left out of the entries.
+func BuildMap(maps map[int]*SeenMap) {
+	for _, m := range maps {
+		m.Entries = make(map[int][]Jump)
+	}
+	for _, seen := range seenIndices(maps) {
+		m := maps[seen]
+		for _, jumps := range [][]Jump{m.Calls, m.Gotos} {
+			for _, j := range jumps {
+				if t, ok := maps[j.Target.Scene]; ok {
+					t.Entries[j.Target.Entry] = append(t.Entries[j.Target.Entry], j)
+				}
+			}
+		}
+	}
+}
+
+// seenIndices returns the keys of maps in order.
+func seenIndices(maps map[int]*SeenMap) []int {
+	seens := make([]int, 0, len(maps))
+	for seen := range maps {
+		seens = append(seens, seen)
+	}
+	sort.Ints(seens)
+	return seens
+}
+
+// WriteMap writes the seen map of an archive, linked by BuildMap, in
+// three forms:
+//   - seenmap.txt  (readable, scene by scene)
+//   - seenmap.dot  (Graphviz call graph)
+//   - seenmap.json
+func (w *Writer) WriteMap(maps map[int]*SeenMap) error {
+	if err := os.MkdirAll(w.outDir, 0755); err != nil {
+		return fmt.Errorf("cannot create output directory: %w", err)
+	}
+	for _, out := range []struct {
+		name  string
+		write func(io.Writer, map[int]*SeenMap) error
+	}{
+		{"seenmap.txt", writeMapText},
+		{"seenmap.dot", writeMapDot},
+		{"seenmap.json", writeMapJSON},
+	} {
+		f, err := os.Create(filepath.Join(w.outDir, out.name))
+		if err != nil {
+			return fmt.Errorf("cannot create seen map: %w", err)
+		}
+		err = out.write(f, maps)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", out.name, err)
+		}
+	}
+	return nil
+}
+
+// writeMapText writes, for each scene, its entrypoints with where they
+// are entered from, then its calls and gotos to other scenes.
+func writeMapText(w io.Writer, maps map[int]*SeenMap) error {
+	for _, seen := range seenIndices(maps) {
+		m := maps[seen]
+		fmt.Fprintf(w, "SEEN%04d\n", seen)
+		for _, ep := range m.EntryPoints {
+			fmt.Fprintf(w, "  #entrypoint %03d\n", ep)
+			for _, j := range m.Entries[ep] {
+				fmt.Fprintf(w, "    <- SEEN%04d %s%s\n", j.Origin.Seen, j.Kind, atLine(j.Origin))
+			}
+		}
+		for _, jumps := range [][]Jump{m.Calls, m.Gotos} {
+			for _, j := range jumps {
+				fmt.Fprintf(w, "  %s -> SEEN%04d #%03d%s", j.Kind, j.Target.Scene, j.Target.Entry, atLine(j.Origin))
+				if _, ok := maps[j.Target.Scene]; !ok {
+					fmt.Fprint(w, " (not in archive)")
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+	return nil
+}
+
+// atLine returns where a jump is, if the scene has debug line numbers.
+func atLine(l Location) string {
+	if l.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (line %d)", l.Line)
+}
+
+// writeMapDot writes the scenes as nodes and the jumps as edges, calls
+// dashed, labelled with the jump and target entrypoint.
+func writeMapDot(w io.Writer, maps map[int]*SeenMap) error {
+	fmt.Fprintln(w, "digraph seenmap {")
+	fmt.Fprintln(w, "\tnode [shape=box];")
+	for _, seen := range seenIndices(maps) {
+		fmt.Fprintf(w, "\tSEEN%04d;\n", seen)
+	}
+	for _, seen := range seenIndices(maps) {
+		m := maps[seen]
+		for _, j := range m.Calls {
+			fmt.Fprintf(w, "\tSEEN%04d -> SEEN%04d [label=\"%s #%03d\", style=dashed];\n", seen, j.Target.Scene, j.Kind, j.Target.Entry)
+		}
+		for _, j := range m.Gotos {
+			fmt.Fprintf(w, "\tSEEN%04d -> SEEN%04d [label=\"%s #%03d\"];\n", seen, j.Target.Scene, j.Kind, j.Target.Entry)
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// writeMapJSON writes the seen maps as a JSON object keyed by SEEN
+// index.
+func writeMapJSON(w io.Writer, maps map[int]*SeenMap) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(maps)
+}
@@ -9,6 +9,8 @@ package disasm
 import (
 	"fmt"
 	"strings"
+
+	"github.com/yoremi/rldev-go/pkg/kfn"
 )
 
 // --- Target engine modes ---
@@ -123,6 +125,15 @@ type Command struct {
 	Opcode  string        // Opcode string for annotation
 	LineNo  int           // Debug line number
 	ResIdx  int           // Resource string index (-1 if none)
+
+	call *funcCall // Named function call, for rebuilding rlBabel text
+}
+
+// funcCall is a function call as read, before it is printed.
+type funcCall struct {
+	name string
+	args []string // Kepago parameters
+	dest string   // variable receiving the result, or ""
 }
 
 // Text returns the text representation of the command's kepago elements.
@@ -160,10 +171,15 @@ type Options struct {
 	HexDump          bool   // Generate hex dump
 	RawStrings       bool   // Don't process text encoding
 	MakeMap          bool   // Generate seen map
+	Seen             int    // SEEN file index, for the seen map
 	SrcExt           string // Source file extension (default "org")
 	Encoding         string // Output encoding (default "CP932")
 	BOM              bool   // Write UTF-8 BOM
 	Verbose          int
+
+	// KFN holds the function definitions of reallive.kfn. Without it,
+	// every call is printed as op<...>.
+	KFN *kfn.Registry
 }
 
 // DefaultOptions returns the default disassembler options.
@@ -182,124 +198,34 @@ func DefaultOptions() Options {
 
 // Location represents a source location.
 type Location struct {
-	Seen int // SEEN file index
-	Line int // Line number within the file
+	Seen int `json:"seen"` // SEEN file index
+	Line int `json:"line"` // Line number within the file
 }
 
 // Address represents a target address (for jumps/calls).
 type Address struct {
-	Scene int // Target SEEN index
-	Entry int // Entry point index (-1 = none)
+	Scene int `json:"scene"` // Target SEEN index
+	Entry int `json:"entry"` // Entry point index
 }
 
 // Jump represents a cross-scene jump or call.
 type Jump struct {
-	Origin Location
-	Target Address
-	Kind   string // "goto", "gosub", "call", etc.
+	Origin Location `json:"origin"`
+	Target Address  `json:"target"`
+	Kind   string   `json:"kind"` // "jump", "farcall", etc.
 }
 
 // SeenMap holds navigation information for one SEEN file.
 type SeenMap struct {
-	EntryPoints []int              // Entry point line numbers
-	Calls       []Jump             // Outgoing calls
-	Gotos       []Jump             // Outgoing gotos
-	Entries     map[int]Jump       // Incoming calls/gotos (keyed by entry index)
+	EntryPoints []int          `json:"entrypoints"` // Entry point indices
+	Calls       []Jump         `json:"calls"`       // Outgoing calls
+	Gotos       []Jump         `json:"gotos"`       // Outgoing gotos
+	Entries     map[int][]Jump `json:"entries"`     // Incoming calls/gotos (keyed by entry index)
 }
 
 // NewSeenMap creates an empty SeenMap.
 func NewSeenMap() *SeenMap {
 	return &SeenMap{
-		Entries: make(map[int]Jump),
-	}
-}
-
-// --- KFN function definition types ---
-
-// ParamType describes a function parameter type.
-type ParamType int
-
-const (
-	ParamAny    ParamType = iota
-	ParamInt              // Integer expression
-	ParamIntC             // Integer constant
-	ParamIntV             // Integer variable
-	ParamStr              // String expression
-	ParamStrC             // String constant
-	ParamStrV             // String variable
-	ParamResStr           // Resource string
-)
-
-// FuncFlag describes properties of a function.
-type FuncFlag int
-
-const (
-	FlagPushStore FuncFlag = iota
-	FlagIsJump
-	FlagIsGoto
-	FlagIsCond
-	FlagIsNeg
-	FlagIsTextout
-	FlagNoBraces
-	FlagIsLbr
-	FlagHasGotos
-	FlagHasCases
-	FlagIsCall
-	FlagIsSkip
-	FlagIsRet
-)
-
-// FuncDef describes a known RealLive function.
-type FuncDef struct {
-	Name       string
-	Flags      []FuncFlag
-	Prototypes [][]ParamType // One or more parameter lists
-}
-
-// FuncRegistry holds known function definitions, loaded from KFN files.
-type FuncRegistry struct {
-	funcs   map[string]FuncDef
-	modules map[int]string
-}
-
-// NewFuncRegistry creates an empty function registry.
-func NewFuncRegistry() *FuncRegistry {
-	return &FuncRegistry{
-		funcs:   make(map[string]FuncDef),
-		modules: make(map[int]string),
-	}
-}
-
-// Register adds a function definition.
-func (r *FuncRegistry) Register(opStr string, def FuncDef) {
-	r.funcs[opStr] = def
-}
-
-// Lookup finds a function definition by opcode string.
-func (r *FuncRegistry) Lookup(opStr string) (FuncDef, bool) {
-	d, ok := r.funcs[opStr]
-	return d, ok
-}
-
-// RegisterModule sets the name for a module number.
-func (r *FuncRegistry) RegisterModule(num int, name string) {
-	r.modules[num] = name
-}
-
-// ModuleName returns the name for a module, or its number as string.
-func (r *FuncRegistry) ModuleName(num int) string {
-	if name, ok := r.modules[num]; ok {
-		return name
-	}
-	return fmt.Sprintf("%03d", num)
-}
-
-// HasFlag checks if a function definition has a specific flag.
-func (d FuncDef) HasFlag(f FuncFlag) bool {
-	for _, flag := range d.Flags {
-		if flag == f {
-			return true
-		}
+		Entries: make(map[int][]Jump),
 	}
-	return false
 }
@@ -0,0 +1,195 @@
+package disasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================
+// rlBabel text
+// ============================================================
+
+// The rlBabel runtime functions, as named by rlc's rlBabel package. A
+// line of text is compiled to a start call, append calls and a display
+// call, with the glosses set just before the chunk they annotate.
+const (
+	vwfTextStart   = "__vwf_TextoutStart"
+	vwfTextAppend  = "__vwf_TextoutAppend"
+	vwfTextDisplay = "__vwf_TextoutDisplay"
+	vwfGlossStart  = "__vwf_GlossTextStart"
+	vwfGlossAppend = "__vwf_GlossTextAppend"
+	vwfGlossSet    = "__vwf_GlossTextSet"
+)
+
+// rebuildVWFText replaces the rlBabel call sequences of result with the
+// text lines they were compiled from, so that compiling the disassembly
+// with rlBabel gives the same bytecode. A sequence that does not come
+// from a text line, such as one with a label inside, is left as calls.
+func rebuildVWFText(result *DisassemblyResult, opts Options) {
+	var cmds []Command
+	for i := 0; i < len(result.Commands); i++ {
+		c := result.Commands[i]
+		if c.call == nil || c.call.name != vwfTextStart {
+			cmds = append(cmds, c)
+			continue
+		}
+		text, end, ok := readVWFText(result, i)
+		if !ok {
+			cmds = append(cmds, c)
+			continue
+		}
+		cmd := Command{Offset: c.Offset, CType: "textout"}
+		var res string
+		cmd.ResIdx, res = addResource(result, text, opts)
+		cmd.Kepago = []CommandElem{ElemString{Value: res}}
+		cmds = append(cmds, cmd)
+		i = end
+	}
+	result.Commands = cmds
+}
+
+// readVWFText reads the call sequence starting at result.Commands[start]
+// and returns its text and the index of its display call.
+func readVWFText(result *DisassemblyResult, start int) (string, int, bool) {
+	t := vwfText{itoa: make(map[string]string)}
+	var gloss *vwfText
+	for i := start; i < len(result.Commands); i++ {
+		c := result.Commands[i]
+		if i > start && result.Pointers[c.Offset] {
+			return "", 0, false
+		}
+		if c.CType == "kidoku" || c.CType == "dbline" {
+			continue
+		}
+		if c.call == nil {
+			return "", 0, false
+		}
+		ok := true
+		switch name, args := c.call.name, c.call.args; {
+		case name == vwfTextDisplay:
+			return t.String(), i, len(args) == 0 && gloss == nil && !t.inGloss
+		case name == vwfTextStart && i == start, name == vwfTextAppend && i > start:
+			ok = len(args) == 1 && t.add(args[0])
+		case name == vwfGlossStart && gloss == nil:
+			gloss = &vwfText{itoa: t.itoa}
+			ok = len(args) == 1 && gloss.add(args[0])
+		case name == vwfGlossAppend && gloss != nil:
+			ok = len(args) == 1 && gloss.add(args[0])
+		case name == vwfGlossSet && gloss != nil:
+			t.glosses = append(t.glosses, gloss.String())
+			ok, gloss = len(args) == 0 && !gloss.inGloss, nil
+		case name == "itoa" && c.call.dest != "" && len(args) == 1:
+			t.itoa[c.call.dest] = args[0]
+		default:
+			ok = false
+		}
+		if !ok {
+			return "", 0, false
+		}
+	}
+	return "", 0, false
+}
+
+// vwfText accumulates the text of an rlBabel call sequence.
+type vwfText struct {
+	strings.Builder
+	glosses []string          // glosses set and not yet placed
+	inGloss bool              // inside the text of a gloss
+	code    bool              // a code without parameters was just written
+	itoa    map[string]string // expressions formatted into variables
+}
+
+// add adds a chunk of text, given as a Kepago string literal, or a
+// string variable, printed as \s{} or as the \i{} it was formatted from.
+func (t *vwfText) add(arg string) bool {
+	if !strings.HasPrefix(arg, "'") {
+		t.code = false
+		if expr, ok := t.itoa[arg]; ok {
+			fmt.Fprintf(t, "\\i{%s}", expr)
+		} else {
+			fmt.Fprintf(t, "\\s{%s}", arg)
+		}
+		return true
+	}
+	chunk := unquote(arg)
+	for i := 0; i < len(chunk); i++ {
+		b := chunk[i]
+		if t.code {
+			// rlc reads letters after a code as part of its name, and
+			// skips the spaces after it
+			if b == ' ' || b == '_' || b == ':' || b == '{' || (b|0x20 >= 'a' && b|0x20 <= 'z') {
+				t.WriteString("{}")
+			}
+			t.code = false
+		}
+		switch {
+		case isShiftJISLead(b) && i+1 < len(chunk):
+			t.Write(chunk[i : i+2])
+			i++
+		case b == 0x01:
+			t.WriteString("\\{")
+		case b == 0x02:
+			t.WriteByte('}')
+		case b == 0x03:
+			t.WriteString("\\n")
+			t.code = true
+		case b == 0x05 && i+1 < len(chunk) && chunk[i+1] == 0x03:
+			t.WriteString("\\r")
+			t.code = true
+			i++
+		case b == 0x08:
+			t.WriteByte('"')
+		case b == 0x09:
+			t.WriteString("\\b")
+			t.code = true
+		case b == 0x0a:
+			t.WriteString("\\u")
+			t.code = true
+		case (b == 0x06 || b == 0x07) && i+2 < len(chunk):
+			var n int
+			if _, err := fmt.Sscanf(string(chunk[i+1:i+3]), "%02d", &n); err != nil {
+				return false
+			}
+			code := "e"
+			if b == 0x07 {
+				code = "em"
+			}
+			fmt.Fprintf(t, "\\%s{%d}", code, n)
+			i += 2
+		case b == 0x1f && !t.inGloss:
+			t.WriteString("\\g{")
+			t.inGloss = true
+		case b == 0x1f:
+			if len(t.glosses) == 0 {
+				return false
+			}
+			fmt.Fprintf(t, "}={%s}", t.glosses[0])
+			t.glosses, t.inGloss = t.glosses[1:], false
+		case b == '\\':
+			t.WriteString("\\\\")
+		case b < 0x20:
+			return false
+		default:
+			t.WriteByte(b)
+		}
+	}
+	return true
+}
+
+// unquote returns the text of a string literal made by strLiteral.
+func unquote(lit string) []byte {
+	var text []byte
+	for i := 1; i < len(lit)-1; i++ {
+		c := lit[i]
+		switch {
+		case isShiftJISLead(c) && i+2 < len(lit):
+			text = append(text, c, lit[i+1])
+			i++
+			continue
+		case c == '\\':
+			i++
+		}
+		text = append(text, lit[i])
+	}
+	return text
+}
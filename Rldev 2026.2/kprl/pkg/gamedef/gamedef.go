@@ -70,6 +70,8 @@ type GameDef struct {
 	Inherits []string    // Parent game IDs
 	Target   *Target     // Engine target (nil = default)
 	Key      []XORSubkey // XOR encryption keys (nil = none)
+	Encoding string      // Default source encoding ("" = default)
+	Gameexe  string      // GAMEEXE.INI path, relative to Dir
 	Dir      string      // Game directory
 }
 
@@ -0,0 +1,322 @@
+package gamedef
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Game definition files (game.cfg) describe one game per section:
+//
+//	# Little Busters! Memorial Edition uses the EX keys
+//	[LBME]
+//	title    = "Little Busters! Memorial Edition"
+//	by       = Key
+//	inherits = LBEX
+//	target   = RealLive 1.6.5.0
+//	encoding = CP932
+//	seens    = 150
+//	gameexe  = GAMEEXE.INI
+//	key      = 256 128 a828fd71b423641596488a43620eadf0
+//
+// key may be repeated, one line per subkey (offset, length, 32 hex
+// digits). inherits takes a comma-separated list of parent IDs: a field
+// left unset is taken from the first parent that sets it. A section for a
+// game that is already defined, such as a built-in one, only overrides the
+// fields it sets. gameexe is relative to the file defining it. IDs are
+// case-insensitive.
+
+// Registry holds game definitions by ID.
+type Registry struct {
+	games map[string]*GameDef
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{games: make(map[string]*GameDef)}
+}
+
+// builtinGames are the games whose keys ship with RLdev; game.cfg files
+// may override or extend them.
+var builtinGames = []GameDef{
+	{ID: "CFV", Title: "Clannad Full Voice", By: "Key", Seens: -1, Key: KeyCFV},
+	{ID: "LB", Title: "Little Busters!", By: "Key", Seens: -1, Key: KeyLB},
+	{ID: "LBEX", Title: "Little Busters! EX", By: "Key", Seens: -1, Key: KeyLBEX},
+	{ID: "LBME", Title: "Little Busters! Memorial Edition", Seens: -1, Inherits: []string{"LBEX"}},
+	{ID: "FIVE", Title: "5 -Faibu-", By: "RAM", Seens: -1, Key: KeyFIVE},
+	{ID: "SNOW", Title: "Snow Standard Edition", By: "Studio Mebius", Seens: -1, Key: KeySNOW},
+}
+
+// Builtin returns a registry holding the built-in game definitions.
+func Builtin() *Registry {
+	r := NewRegistry()
+	for _, g := range builtinGames {
+		r.Add(g)
+	}
+	return r
+}
+
+// Add defines (or redefines) a game.
+func (r *Registry) Add(g GameDef) {
+	g.ID = strings.ToUpper(g.ID)
+	r.games[g.ID] = &g
+}
+
+// Merge adds every game of other to r. A game r already defines is
+// redefined: the fields other leaves unset keep their value in r.
+func (r *Registry) Merge(other *Registry) {
+	for id, g := range other.games {
+		def := *g
+		if old, ok := r.games[id]; ok {
+			if def.Inherits == nil {
+				def.Inherits = old.Inherits
+			}
+			inherit(&def, *old)
+		}
+		r.Add(def)
+	}
+}
+
+// IDs returns the defined game IDs in sorted order.
+func (r *Registry) IDs() []string {
+	ids := make([]string, 0, len(r.games))
+	for id := range r.games {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Lookup returns the game with the given ID, with inherited fields filled
+// in from its parents.
+func (r *Registry) Lookup(id string) (GameDef, error) {
+	return r.resolve(strings.ToUpper(id), nil)
+}
+
+func (r *Registry) resolve(id string, stack []string) (GameDef, error) {
+	for _, s := range stack {
+		if s == id {
+			return GameDef{}, fmt.Errorf("game %s inherits from itself (%s)", id, strings.Join(append(stack, id), " -> "))
+		}
+	}
+	def, ok := r.games[id]
+	if !ok {
+		if len(stack) > 0 {
+			return GameDef{}, fmt.Errorf("game %s inherits from unknown game %s", stack[len(stack)-1], id)
+		}
+		return GameDef{}, fmt.Errorf("unknown game %s", id)
+	}
+	g := *def
+	for _, pid := range g.Inherits {
+		p, err := r.resolve(strings.ToUpper(pid), append(stack, id))
+		if err != nil {
+			return GameDef{}, err
+		}
+		inherit(&g, p)
+	}
+	return g, nil
+}
+
+// inherit sets the fields g leaves unset to those of p.
+func inherit(g *GameDef, p GameDef) {
+	if g.Title == "" {
+		g.Title = p.Title
+	}
+	if g.By == "" {
+		g.By = p.By
+	}
+	if g.Seens < 0 {
+		g.Seens = p.Seens
+	}
+	if g.Target == nil {
+		g.Target = p.Target
+	}
+	if g.Key == nil {
+		g.Key = p.Key
+	}
+	if g.Encoding == "" {
+		g.Encoding = p.Encoding
+	}
+	if g.Gameexe == "" {
+		g.Gameexe, g.Dir = p.Gameexe, p.Dir
+	}
+}
+
+// GameexePath returns the GAMEEXE.INI path of the game, resolved against
+// the directory of the file that defined it ("" if none is set).
+func (g *GameDef) GameexePath() string {
+	if g.Gameexe == "" || filepath.IsAbs(g.Gameexe) {
+		return g.Gameexe
+	}
+	return filepath.Join(g.Dir, g.Gameexe)
+}
+
+// ============================================================
+// Parsing
+// ============================================================
+
+// ParseFile reads a game definition file.
+func ParseFile(path string) (*Registry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := Parse(f, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range r.games {
+		g.Dir = filepath.Dir(path)
+	}
+	return r, nil
+}
+
+// Parse reads game definitions from rd; name is used in error messages.
+func Parse(rd io.Reader, name string) (*Registry, error) {
+	r := NewRegistry()
+	var cur *GameDef
+	sc := bufio.NewScanner(rd)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return nil, fmt.Errorf("%s:%d: malformed section header %q", name, n, line)
+			}
+			g := EmptyGame()
+			g.ID = strings.ToUpper(strings.TrimSpace(line[1 : len(line)-1]))
+			if _, dup := r.games[g.ID]; dup {
+				return nil, fmt.Errorf("%s:%d: game %s defined twice", name, n, g.ID)
+			}
+			r.games[g.ID] = &g
+			cur = &g
+			continue
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("%s:%d: definition outside a [GAME] section", name, n)
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", name, n)
+		}
+		if err := cur.set(strings.ToLower(strings.TrimSpace(key)), unquote(strings.TrimSpace(val))); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// set assigns one key = value line of a section.
+func (g *GameDef) set(key, val string) error {
+	switch key {
+	case "title":
+		g.Title = val
+	case "by":
+		g.By = val
+	case "seens":
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid SEEN count %q", val)
+		}
+		g.Seens = n
+	case "inherits":
+		for _, id := range strings.Split(val, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				g.Inherits = append(g.Inherits, id)
+			}
+		}
+	case "target":
+		t, err := ParseTarget(val)
+		if err != nil {
+			return err
+		}
+		g.Target = t
+	case "encoding":
+		g.Encoding = val
+	case "gameexe":
+		g.Gameexe = val
+	case "key":
+		sk, err := parseSubkey(val)
+		if err != nil {
+			return err
+		}
+		g.Key = append(g.Key, sk)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+// ParseTarget parses "Engine [major.minor[.patch[.build]]]".
+func ParseTarget(s string) (*Target, error) {
+	f := strings.Fields(s)
+	if len(f) == 0 || len(f) > 2 {
+		return nil, fmt.Errorf("invalid target %q", s)
+	}
+	t := &Target{Compat: -1}
+	switch strings.ToLower(f[0]) {
+	case "reallive":
+		t.Engine = EngineRealLive
+	case "kinetic":
+		t.Engine = EngineKinetic
+	case "avg2000":
+		t.Engine = EngineAvg2000
+	case "siglus":
+		t.Engine = EngineSiglus
+	default:
+		return nil, fmt.Errorf("unknown engine %q", f[0])
+	}
+	if len(f) == 2 {
+		parts := strings.Split(f[1], ".")
+		if len(parts) > 4 {
+			return nil, fmt.Errorf("invalid version %q", f[1])
+		}
+		var v [4]int
+		for i, p := range parts {
+			n, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version %q", f[1])
+			}
+			v[i] = n
+		}
+		t.Version = &Version{v[0], v[1], v[2], v[3]}
+	}
+	return t, nil
+}
+
+// parseSubkey parses "offset length hex".
+func parseSubkey(s string) (XORSubkey, error) {
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return XORSubkey{}, fmt.Errorf("key must be: offset length hex")
+	}
+	off, err1 := strconv.Atoi(f[0])
+	n, err2 := strconv.Atoi(f[1])
+	if err1 != nil || err2 != nil || off < 0 || n <= 0 {
+		return XORSubkey{}, fmt.Errorf("invalid key range %s %s", f[0], f[1])
+	}
+	sk, err := SetKeyFromHex(f[2])
+	if err != nil {
+		return XORSubkey{}, err
+	}
+	sk.Offset, sk.Length = off, n
+	return sk, nil
+}
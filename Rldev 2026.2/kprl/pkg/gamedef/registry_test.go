@@ -0,0 +1,136 @@
+package gamedef
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCfg = `# test games
+[base]
+title = "Base Game"
+by = Key
+target = RealLive 1.2.7
+encoding = CP932
+gameexe = ini/GAMEEXE.INI
+key = 256 257 000102030405060708090a0b0c0d0e0f
+
+[CHILD]
+inherits = base
+title = Child
+seens = 42
+key = 256 128 ffffffffffffffffffffffffffffffff
+key = 384 16 eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee
+`
+
+func TestParseAndInherit(t *testing.T) {
+	r, err := Parse(strings.NewReader(testCfg), "test.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := r.Lookup("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ID != "CHILD" || g.Title != "Child" || g.By != "Key" || g.Seens != 42 || g.Encoding != "CP932" {
+		t.Errorf("fields: %+v", g)
+	}
+	if g.Target == nil || g.Target.Engine != EngineRealLive || g.Target.Version.String() != "1.2.7" {
+		t.Errorf("target: %+v", g.Target)
+	}
+	if len(g.Key) != 2 || g.Key[1].Offset != 384 || g.Key[1].Length != 16 || g.Key[1].Data[0] != 0xee {
+		t.Errorf("keys: %+v", g.Key)
+	}
+	b, _ := r.Lookup("BASE")
+	if b.Seens != -1 || len(b.Key) != 1 || b.Key[0].Data[15] != 0x0f {
+		t.Errorf("base: %+v", b)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"title = x\n",
+		"[A]\ncolour = red\n",
+		"[A]\nkey = 256 257 abc\n",
+		"[A]\ntarget = Nope\n",
+		"[A]\n[a]\n",
+		"[A\n",
+	} {
+		if _, err := Parse(strings.NewReader(src), "bad.cfg"); err == nil || !strings.HasPrefix(err.Error(), "bad.cfg:") {
+			t.Errorf("%q: got %v", src, err)
+		}
+	}
+}
+
+func TestInheritanceErrors(t *testing.T) {
+	r, _ := Parse(strings.NewReader("[A]\ninherits = B\n[B]\ninherits = A\n[C]\ninherits = D\n"), "x")
+	if _, err := r.Lookup("A"); err == nil {
+		t.Error("cycle not detected")
+	}
+	if _, err := r.Lookup("C"); err == nil {
+		t.Error("unknown parent not reported")
+	}
+	if _, err := r.Lookup("Z"); err == nil {
+		t.Error("unknown game not reported")
+	}
+}
+
+func TestBuiltin(t *testing.T) {
+	g, err := Builtin().Lookup("lbme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Key) != len(KeyLBEX) || g.By != "Key" {
+		t.Errorf("LBME should inherit LBEX: %+v", g)
+	}
+}
+
+func TestParseFileGameexe(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "game.cfg")
+	if err := os.WriteFile(path, []byte(testCfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Builtin()
+	r.Merge(file)
+	g, err := r.Lookup("CHILD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "ini", "GAMEEXE.INI"); g.GameexePath() != want {
+		t.Errorf("gameexe: %q, want %q", g.GameexePath(), want)
+	}
+	if _, err := r.Lookup("CFV"); err != nil {
+		t.Error("merge lost the built-in games")
+	}
+}
+
+func TestMergeRedefinition(t *testing.T) {
+	file, err := Parse(strings.NewReader("[lb]\ntitle = \"Little Busters! (fan patch)\"\n"), "game.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Builtin()
+	r.Merge(file)
+	g, err := r.Lookup("LB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Title != "Little Busters! (fan patch)" || g.By != "Key" {
+		t.Errorf("redefinition: %+v", g)
+	}
+	if len(g.Key) != len(KeyLB) || g.Key[0] != KeyLB[0] {
+		t.Errorf("redefinition dropped the keys: %v", g.Key)
+	}
+}
+
+func TestKnownGames(t *testing.T) {
+	if len(KnownGames["LBME"]) != len(KeyLBEX) || len(KnownGames["SNOW"]) != len(KeySNOW) {
+		t.Errorf("KnownGames: %v", KnownGames)
+	}
+}
@@ -322,6 +322,50 @@ func Pack(files []string, opts Options) error {
 	return nil
 }
 
+// seenRe matches the SEEN number in the name of a bytecode file.
+var seenRe = regexp.MustCompile(`(?i)seen(\d{4})`)
+
+// SeenIndex returns the SEEN number in the name of a bytecode file, which
+// must contain SEENxxxx.
+func SeenIndex(fname string) (int, bool) {
+	match := seenRe.FindStringSubmatch(filepath.Base(fname))
+	if match == nil {
+		return 0, false
+	}
+	idx, _ := strconv.Atoi(match[1])
+	return idx, true
+}
+
+// Create writes a new archive holding exactly files, replacing arcName if
+// it exists. Unlike Add, every file must be a bytecode file named
+// SEENxxxx, no two may hold the same SEEN, and on error nothing is
+// written.
+func Create(arcName string, files []string, opts Options) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no files to process")
+	}
+	names := make(map[int]string)
+	for _, fname := range files {
+		idx, ok := SeenIndex(fname)
+		if !ok {
+			return fmt.Errorf("unable to add '%s': name must contain SEENxxxx (0000-9999)", fname)
+		}
+		if prev, dup := names[idx]; dup {
+			return fmt.Errorf("'%s' and '%s' are both SEEN%04d", prev, fname, idx)
+		}
+		names[idx] = fname
+	}
+	sources := make(map[int]interface{})
+	for idx, fname := range names {
+		data, err := readAndCompress(fname, opts)
+		if err != nil {
+			return err
+		}
+		sources[idx] = data
+	}
+	return rebuildArc(nil, arcName, sources, opts)
+}
+
 // Add adds bytecode files to an archive, creating it if needed.
 // Files must be named SEENxxxx.TXT where xxxx is 0000-9999.
 // Equivalent to OCaml's Archiver.add.
@@ -364,7 +408,6 @@ func Add(arcName string, files []string, opts Options) error {
 	}
 
 	// Parse SEEN indices from filenames and prepare sources
-	seenRe := regexp.MustCompile(`(?i)seen(\d{4})`)
 	sources := make(map[int]interface{}) // int -> SeenEntry (keep) or string (file)
 
 	// Start with existing entries
@@ -379,12 +422,11 @@ func Add(arcName string, files []string, opts Options) error {
 			fmt.Printf("Warning: file not found: %s\n", fname)
 			continue
 		}
-		match := seenRe.FindStringSubmatch(filepath.Base(fname))
-		if match == nil {
+		idx, ok := SeenIndex(fname)
+		if !ok {
 			fmt.Printf("Warning: unable to add '%s': name must contain SEENxxxx (0000-9999)\n", fname)
 			continue
 		}
-		idx, _ := strconv.Atoi(match[1])
 		sources[idx] = fname
 		anyAdded = true
 	}
@@ -443,7 +485,8 @@ func Remove(arcName string, ranges []int, opts Options) error {
 // --- Internal helpers ---
 
 // rebuildArc reconstructs the archive file from sources.
-// sources maps SEEN index -> SeenEntry (keep from existing) or string (read from file).
+// sources maps SEEN index -> SeenEntry (keep from existing), string (read
+// from file) or []byte (compressed data).
 func rebuildArc(arc *binarray.Buffer, arcName string, sources map[int]interface{}, opts Options) error {
 	// Create temp file
 	tmpName := arcName + ".tmp"
@@ -492,6 +535,8 @@ func rebuildArc(arc *binarray.Buffer, arcName string, sources map[int]interface{
 				continue
 			}
 			data = fileData
+		case []byte:
+			data = s
 		}
 
 		if len(data) == 0 {
@@ -1,6 +1,7 @@
 package kprl
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/yoremi/rldev-go/pkg/bytecode"
@@ -149,3 +150,32 @@ func TestGetUncompressedMagic(t *testing.T) {
 func fakeHeader(headerVer, compilerVer int) bytecode.FileHeader {
 	return bytecode.FileHeader{HeaderVersion: headerVer, CompilerVersion: compilerVer}
 }
+
+func TestSeenIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		want int
+		ok   bool
+	}{
+		{"SEEN0042.TXT", 42, true},
+		{"out/seen9999.txt", 9999, true},
+		{"INTRO.TXT", 0, false},
+		{"SEEN1.TXT", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := SeenIndex(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("SeenIndex(%q) = %d, %v, want %d, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCreateRejectsNames(t *testing.T) {
+	if err := Create("SEEN.TXT", []string{"INTRO.TXT"}, Options{}); err == nil {
+		t.Error("expected error for a name without SEENxxxx")
+	}
+	err := Create("SEEN.TXT", []string{"a/SEEN0001.TXT", "b/seen0001.txt"}, Options{})
+	if err == nil || !strings.Contains(err.Error(), "both SEEN0001") {
+		t.Errorf("got %v, want duplicate SEEN error", err)
+	}
+}
@@ -0,0 +1,45 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/yoremi/rldev-go/pkg/binarray"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var m Metadata
+	data := m.ToBytes("rldev-go 2.0.26", 2.0, [4]byte{1, 2, 7, 0}, TransformWestern)
+	buf := binarray.FromBytes(append([]byte{0xaa, 0xbb}, data...))
+	got := Read(buf, 2)
+	want := Metadata{CompilerName: "rldev-go 2.0.26", CompilerVersion: 200, TargetVersion: [4]byte{1, 2, 7, 0}, TextTransform: TransformWestern}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if s := got.String(); s != "rldev-go 2.0.26 (2.00), target 1.2.7.0, text Western" {
+		t.Errorf("String: %q", s)
+	}
+	if !Read(binarray.FromBytes(make([]byte, 32)), 0).IsEmpty() {
+		t.Error("zeroes should read as empty metadata")
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	var m Metadata
+	data := m.ToBytes("rldev-go", 2.0, [4]byte{1, 2, 7, 0}, TransformNone)
+	tests := []struct {
+		name           string
+		metaLen, idLen int32
+	}{
+		{"negative id length", 40, -5},
+		{"id past the block", int32(len(data)), 100},
+		{"block past the buffer", int32(len(data)) + 40, 8},
+	}
+	for _, tt := range tests {
+		buf := binarray.FromBytes(append(append([]byte(nil), data...), make([]byte, 32)...))
+		buf.PutInt(0, tt.metaLen)
+		buf.PutInt(4, tt.idLen)
+		if got := Read(buf, 0); !got.IsEmpty() {
+			t.Errorf("%s: got %+v", tt.name, got)
+		}
+	}
+}
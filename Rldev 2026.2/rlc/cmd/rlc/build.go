@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yoremi/rldev-go/pkg/kprl"
+)
+
+// ============================================================
+// Project builds (--build)
+// ============================================================
+
+// buildResult is the outcome of compiling one source of a project.
+type buildResult struct {
+	src string
+	out string
+	err error
+}
+
+// projectSources lists the .org and .utf files of dir in name order.
+func projectSources(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var srcs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".org", ".utf":
+			srcs = append(srcs, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(srcs)
+	return srcs, nil
+}
+
+// buildProject compiles every source of dir with opts.Jobs workers, then
+// packs the bytecode files into a new archive named by -o (SEEN.TXT by
+// default) in the output directory, replacing any archive already there.
+// GAMEEXE.INI, the KFN registry and the cast are loaded once for the whole
+// project. Every bytecode file must be named SEENxxxx, and no two sources
+// may give the same SEEN. If any source fails, the failures are
+// summarised and the archive is left untouched. A game
+// definition that gives its number of SEENs (seens = n in game.cfg)
+// requires the project to have exactly that many sources.
+func buildProject(opts *Options, dir string, rep *reporter) error {
+	srcs, err := projectSources(dir)
+	if err != nil {
+		return err
+	}
+	if len(srcs) == 0 {
+		return fmt.Errorf("no .org or .utf sources in %s", dir)
+	}
+	if n := opts.Game.Seens; n >= 0 && len(srcs) != n {
+		return fmt.Errorf("game %s has %d SEEN(s), but the project has %d source(s)", opts.Game.ID, n, len(srcs))
+	}
+	// -o names the archive, not each SEEN.
+	fileOpts := *opts
+	fileOpts.OutFile = ""
+	in, err := loadInputs(&fileOpts, srcs[0])
+	if err != nil {
+		return err
+	}
+
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > len(srcs) {
+		jobs = len(srcs)
+	}
+	results := make([]buildResult, len(srcs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				out, err := compileWith(&fileOpts, in, srcs[i], rep)
+				results[i] = buildResult{src: srcs[i], out: out, err: err}
+			}
+		}()
+	}
+	for i := range srcs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var outs []string
+	var failed []buildResult
+	seens := make(map[int]string)
+	for _, r := range results {
+		if r.err == nil {
+			idx, ok := kprl.SeenIndex(r.out)
+			if !ok {
+				r.err = fmt.Errorf("output %s is not named SEENxxxx (0000-9999)", filepath.Base(r.out))
+			} else if prev, dup := seens[idx]; dup {
+				r.err = fmt.Errorf("output %s is SEEN%04d, as is the output of %s", filepath.Base(r.out), idx, prev)
+			} else {
+				seens[idx] = r.src
+			}
+		}
+		if r.err != nil {
+			failed = append(failed, r)
+		} else {
+			outs = append(outs, r.out)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d file(s) failed to compile:\n", len(failed), len(srcs))
+		for _, r := range failed {
+			fmt.Fprintf(os.Stderr, "  %s: %v\n", r.src, r.err)
+		}
+		return fmt.Errorf("build failed, archive not written")
+	}
+
+	name := opts.OutFile
+	if name == "" {
+		name = "SEEN.TXT"
+	}
+	arcName := filepath.Join(opts.OutDir, name)
+	if err := kprl.Create(arcName, outs, kprl.Options{Verbose: opts.Verbose, OutDir: opts.OutDir, Keys: opts.Game.Key}); err != nil {
+		return fmt.Errorf("packing %s: %w", arcName, err)
+	}
+	if !opts.Quiet {
+		fmt.Fprintf(os.Stderr, "Packed %d file(s) into %s\n", len(outs), arcName)
+	}
+	return nil
+}
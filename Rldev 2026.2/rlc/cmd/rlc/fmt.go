@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/yoremi/rldev-go/pkg/encoding"
+	"github.com/yoremi/rldev-go/rlc/pkg/format"
+)
+
+// runFmt reformats Kepago sources into canonical form: `rlc fmt [-w]
+// files...`. The result goes to stdout, or back into each file with -w.
+// .utf sources are read as UTF-8 and the others in the -e encoding, as
+// when compiling. A file that does not parse is reported and left as it
+// is; the others are still formatted.
+func runFmt(args []string) error {
+	opts := DefaultOptions()
+	fs := flag.NewFlagSet("rlc fmt", flag.ContinueOnError)
+	write := fs.Bool("w", false, "write the result back to the source files instead of stdout")
+	fs.StringVar(&opts.Encoding, "e", opts.Encoding, "encoding (CP932|CP936|CP949|UTF-8)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fmt [-w] [-e encoding] <file.org>...\n\nOptions:\n", appName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no input files")
+	}
+	failed := 0
+	for _, path := range fs.Args() {
+		if err := fmtFile(opts, path, *write); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) not formatted", failed)
+	}
+	return nil
+}
+
+// fmtFile formats one source file. With write, the file is only rewritten
+// if its formatting changed.
+func fmtFile(opts *Options, path string, write bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	enc := sourceEncoding(opts, path)
+	src, err := encoding.ToUTF8(data, enc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	out, err := format.Source([]byte(src), path)
+	if err != nil {
+		return err
+	}
+	res, err := encoding.FromUTF8(string(out), enc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if !write {
+		_, err := os.Stdout.Write(res)
+		return err
+	}
+	if bytes.Equal(res, data) {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, res, info.Mode().Perm())
+}
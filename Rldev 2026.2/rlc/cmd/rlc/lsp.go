@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"github.com/yoremi/rldev-go/rlc/pkg/compilerframe"
+	"github.com/yoremi/rldev-go/rlc/pkg/lsp"
+)
+
+// runLSP serves the language server on stdin and stdout. `rlc lsp` takes
+// the usual options (-K, -g, -I, -e, --id, --target...), and checks
+// documents as they would be compiled with them. As when compiling, an
+// unknown target or target version is an error, reported before serving.
+// GAMEEXE.INI is looked for from the working directory.
+func runLSP(args []string) error {
+	opts, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+	in, err := loadInputs(opts, "")
+	if err != nil {
+		return err
+	}
+	srv := &lsp.Server{
+		KFN: in.kfn,
+		NewCompiler: func(path string) *compilerframe.Compiler {
+			return newCompiler(opts, in, path)
+		},
+	}
+	return srv.Serve(os.Stdin, os.Stdout)
+}
@@ -8,29 +8,44 @@
 //
 //	rlc [options] <file.org>
 //
-// Reads a .org (Kepago source) file and produces a .seen (RealLive bytecode)
-// output file. The compiler pipeline:
+// Reads a .org (Kepago source) file and produces a SEENxxxx.TXT (RealLive
+// bytecode) output file. The compiler pipeline:
 //
 //  1. Parse the GAMEEXE.INI config (via the ini package)
 //  2. Parse the KFN function definitions (via the kfn package)
 //  3. Lex and parse the .org source file (via the lexer+parser packages)
-//  4. Normalize expressions (via the expr package)
-//  5. Compile statements (via compilerFrame when available)
-//  6. Emit bytecode (via the codegen package)
+//  4. Compile statements (via the compilerframe package)
+//  5. Optimise the IR at -O1 and above (via the optimize package)
+//  6. Emit bytecode and build the header (via the codegen package)
+//  7. Compress and apply the per-game XOR keys (via the rlcmp package)
 package main
 
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
-
+	"sync"
+
+	"github.com/yoremi/rldev-go/pkg/binarray"
+	"github.com/yoremi/rldev-go/pkg/config"
+	"github.com/yoremi/rldev-go/pkg/encoding"
+	"github.com/yoremi/rldev-go/pkg/gamedef"
+	"github.com/yoremi/rldev-go/pkg/kfn"
+	"github.com/yoremi/rldev-go/pkg/metadata"
+	"github.com/yoremi/rldev-go/pkg/rlcmp"
+	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/buildcache"
+	"github.com/yoremi/rldev-go/rlc/pkg/cast"
+	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
+	"github.com/yoremi/rldev-go/rlc/pkg/compilerframe"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
 	"github.com/yoremi/rldev-go/rlc/pkg/ini"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
-	"github.com/yoremi/rldev-go/rlc/pkg/lexer"
-	"github.com/yoremi/rldev-go/rlc/pkg/parser"
+	"github.com/yoremi/rldev-go/rlc/pkg/optimize"
 )
 
 // ============================================================
@@ -48,8 +63,15 @@ type Options struct {
 	GameFile string // --game game.cfg
 	GameID   string // --id game identifier
 	ResDir   string // --resdir resource directory
+	BuildDir string // --build scenario directory
+	CacheDir string // --cache build cache directory
 	SrcExt   string // --src-ext source extension (default "org")
 
+	IncludeDirs []string // -I directories searched by #load
+
+	// Game definition selected by --id (see applyGame)
+	Game gamedef.GameDef
+
 	// Encoding
 	Encoding string // -e encoding (default "CP932")
 
@@ -74,9 +96,13 @@ type Options struct {
 	// Runtime
 	RuntimeTrace int // --runtime-trace
 
+	// Build
+	Jobs int // -j parallel compilations for --build
+
 	// Verbosity
-	Verbose int  // -v (can be repeated)
-	Quiet   bool // -q
+	Verbose     int    // -v (can be repeated)
+	Quiet       bool   // -q
+	Diagnostics string // --diagnostics text|json
 
 	// Remaining args
 	InputFiles []string
@@ -84,7 +110,7 @@ type Options struct {
 
 // DefaultOptions returns the default options matching app.ml defaults.
 func DefaultOptions() *Options {
-	return &Options{
+	opts := &Options{
 		Gameexe:      "",
 		KfnFile:      "reallive.kfn",
 		GameFile:     "game.cfg",
@@ -102,7 +128,12 @@ func DefaultOptions() *Options {
 		ArrayBounds:  false,
 		FlagLabels:   false,
 		RuntimeTrace: 0,
+		Diagnostics:  "text",
+		Jobs:         runtime.NumCPU(),
 	}
+	// The built-in definition of GameID, until applyGame reads game.cfg
+	opts.Game, _ = gamedef.Builtin().Lookup(opts.GameID)
+	return opts
 }
 
 // ============================================================
@@ -122,6 +153,12 @@ func (v *verboseCounter) String() string     { return strconv.Itoa(int(*v)) }
 func (v *verboseCounter) Set(string) error   { *v++; return nil }
 func (v *verboseCounter) IsBoolFlag() bool   { return true }
 
+// stringList is a flag.Value collecting every occurrence of a flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
 func parseFlags(args []string) (*Options, error) {
 	opts := DefaultOptions()
 	fs := flag.NewFlagSet("rlc", flag.ContinueOnError)
@@ -131,42 +168,47 @@ func parseFlags(args []string) (*Options, error) {
 	fs.StringVar(&opts.OutFile, "o", opts.OutFile, "output filename")
 	fs.StringVar(&opts.Gameexe, "g", opts.Gameexe, "GAMEEXE.INI path")
 	fs.StringVar(&opts.KfnFile, "K", opts.KfnFile, "reallive.kfn path")
-	fs.StringVar(&opts.CastFile, "cast", opts.CastFile, "cast file")
-	fs.StringVar(&opts.GameFile, "game", opts.GameFile, "game.cfg path")
-	fs.StringVar(&opts.GameID, "id", opts.GameID, "game identifier")
+	fs.StringVar(&opts.CastFile, "cast", opts.CastFile, "cast file translating speaker names")
+	fs.StringVar(&opts.GameFile, "game", opts.GameFile, "game definition file (game.cfg)")
+	fs.StringVar(&opts.GameID, "id", opts.GameID, "game identifier: selects keys, target, encoding and GAMEEXE.INI")
 	fs.StringVar(&opts.ResDir, "resdir", opts.ResDir, "resource directory")
 	fs.StringVar(&opts.SrcExt, "src-ext", opts.SrcExt, "source extension")
+	fs.StringVar(&opts.BuildDir, "build", opts.BuildDir, "compile every source in a directory and pack them into SEEN.TXT (-o)")
+	fs.StringVar(&opts.CacheDir, "cache", opts.CacheDir, "reuse the bytecode of unchanged scenes from this directory")
+	fs.IntVar(&opts.Jobs, "j", opts.Jobs, "parallel compilations for --build")
+	fs.Var((*stringList)(&opts.IncludeDirs), "I", "add a directory to the #load search path (repeatable)")
 
 	// Encoding
-	fs.StringVar(&opts.Encoding, "e", opts.Encoding, "encoding (CP932|UTF-8|...)")
+	fs.StringVar(&opts.Encoding, "e", opts.Encoding, "encoding (CP932|CP936|CP949|UTF-8)")
 
 	// Target
 	fs.StringVar(&opts.Target, "target", "", "target engine: RealLive|AVG2000|Kinetic")
 	fs.StringVar(&opts.TargetVersion, "target-version", "", "target version (e.g. 1.2.7.0)")
 
 	// Compilation
-	fs.IntVar(&opts.StartLine, "start-line", opts.StartLine, "start line for partial compilation")
-	fs.IntVar(&opts.EndLine, "end-line", opts.EndLine, "end line for partial compilation")
+	fs.IntVar(&opts.StartLine, "start-line", opts.StartLine, "compile only from this line (rest is stubbed with halt)")
+	fs.IntVar(&opts.EndLine, "end-line", opts.EndLine, "compile only up to this line (rest is stubbed with halt)")
 	fs.IntVar(&opts.OptLevel, "O", opts.OptLevel, "optimization level (0|1|2)")
 	fs.BoolVar(&opts.Compress, "compress", opts.Compress, "compress output")
 	fs.BoolVar(&opts.OldVars, "old-vars", opts.OldVars, "use old variable layout")
 	fs.BoolVar(&opts.WithRtl, "with-rtl", opts.WithRtl, "include runtime library")
 	fs.BoolVar(&opts.Assertions, "assertions", opts.Assertions, "enable runtime assertions")
 	fs.BoolVar(&opts.DebugInfo, "debug-info", opts.DebugInfo, "include debug info")
-	fs.BoolVar(&opts.Metadata, "metadata", opts.Metadata, "include metadata")
-	fs.BoolVar(&opts.ArrayBounds, "array-bounds", opts.ArrayBounds, "runtime array bounds checking")
-	fs.BoolVar(&opts.FlagLabels, "flag-labels", opts.FlagLabels, "flag labels in output")
-	fs.IntVar(&opts.RuntimeTrace, "runtime-trace", opts.RuntimeTrace, "runtime trace level")
+	fs.BoolVar(&opts.Metadata, "metadata", opts.Metadata, "record compiler, target version and text transform in the header")
+	fs.BoolVar(&opts.ArrayBounds, "array-bounds", opts.ArrayBounds, "check variable indices at runtime")
+	fs.BoolVar(&opts.FlagLabels, "flag-labels", opts.FlagLabels, "emit a kidoku marker at every label")
+	fs.IntVar(&opts.RuntimeTrace, "runtime-trace", opts.RuntimeTrace, "log each line (1) and assigned values (2) at runtime")
 
 	// Verbosity
 	vc := (*verboseCounter)(&opts.Verbose)
 	fs.Var(vc, "v", "verbose (repeat for more)")
 	fs.BoolVar(&opts.Quiet, "q", opts.Quiet, "quiet mode")
+	fs.StringVar(&opts.Diagnostics, "diagnostics", opts.Diagnostics, "diagnostics format: text|json")
 
 	// Usage
 	fs.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s - %s (%s)\n", appName, appDescription, appVersion)
-		fmt.Fprintf(os.Stderr, "\nUsage: %s [options] <file.org>\n\nOptions:\n", appName)
+		fmt.Fprintf(os.Stderr, "\nUsage: %s [options] <file.org>\n       %s [options] --build <dir>\n       %s lsp [options]\n       %s fmt [-w] <file.org>...\n\nOptions:\n", appName, appName, appName, appName)
 		fs.PrintDefaults()
 	}
 
@@ -174,72 +216,386 @@ func parseFlags(args []string) (*Options, error) {
 		return nil, err
 	}
 
+	if opts.Diagnostics != "text" && opts.Diagnostics != "json" {
+		return nil, fmt.Errorf("unknown diagnostics format: %s (expected text|json)", opts.Diagnostics)
+	}
 	opts.InputFiles = fs.Args()
-	if opts.Target != "" {
-		opts.TargetForced = true
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	opts.TargetForced = set["target"]
+	if err := applyGame(opts, set); err != nil {
+		return nil, err
+	}
+	if encoding.Parse(opts.Encoding) == encoding.Other {
+		return nil, fmt.Errorf("unknown encoding: %s (expected CP932|CP936|CP949|UTF-8)", opts.Encoding)
 	}
 	return opts, nil
 }
 
+// applyGame looks up --id among the built-in game definitions and those
+// of the --game file, then fills in the keys, target, encoding and
+// GAMEEXE.INI it defines, unless they were given on the command line. A
+// missing game.cfg is only an error if --game was given explicitly.
+func applyGame(opts *Options, set map[string]bool) error {
+	reg := gamedef.Builtin()
+	if opts.GameFile != "" {
+		file, err := gamedef.ParseFile(opts.GameFile)
+		switch {
+		case err == nil:
+			reg.Merge(file)
+		case set["game"] || !os.IsNotExist(err):
+			return fmt.Errorf("reading game definitions: %w", err)
+		}
+	}
+	g, err := reg.Lookup(opts.GameID)
+	if err != nil {
+		return err
+	}
+	opts.Game = g
+	if g.Target != nil {
+		if !set["target"] {
+			opts.Target = g.Target.Engine.String()
+		}
+		if !set["target-version"] && g.Target.Version != nil {
+			opts.TargetVersion = g.Target.Version.String()
+		}
+	}
+	if !set["e"] && g.Encoding != "" {
+		opts.Encoding = g.Encoding
+	}
+	if !set["g"] && g.Gameexe != "" {
+		opts.Gameexe = g.GameexePath()
+	}
+	return nil
+}
+
 // ============================================================
 // Compilation pipeline (from main.ml)
 // ============================================================
 
 // compileFile runs the full compilation pipeline on one source file.
-func compileFile(opts *Options, srcPath string) error {
-	if opts.Verbose > 0 {
-		fmt.Fprintf(os.Stderr, "Compiling: %s\n", srcPath)
+// Source diagnostics go to rep; other failures are returned.
+func compileFile(opts *Options, srcPath string, rep *reporter) error {
+	in, err := loadInputs(opts, srcPath)
+	if err != nil {
+		return err
+	}
+	_, err = compileWith(opts, in, srcPath, rep)
+	return err
+}
+
+// inputs are the files read by every compilation besides the source:
+// GAMEEXE.INI, the KFN registry and the cast. --build loads them once and
+// shares them between workers; each compilation works on its own copy of
+// anything it may modify. With --cache, key is the cache key of
+// everything but the sources (see cacheKey). target and version are
+// the parsed --target and --target-version, if given.
+type inputs struct {
+	ini     *ini.Table
+	kfn     *kfn.Registry
+	cast    cast.Table
+	cache   *buildcache.Cache
+	key     string
+	target  kfn.Target
+	version kfn.Version
+}
+
+// loadInputs loads the inputs for sources next to srcPath.
+func loadInputs(opts *Options, srcPath string) (inputs, error) {
+	var in inputs
+	var err error
+	if opts.Verbose > 1 {
+		fmt.Fprintf(os.Stderr, "Game: %s (%s), %d key(s), %d SEEN(s)\n", opts.Game.ID, opts.Game.Title, len(opts.Game.Key), opts.Game.Seens)
+	}
+	if opts.Target != "" {
+		if in.target, err = parseTarget(opts.Target); err != nil {
+			return in, err
+		}
+	}
+	if opts.TargetVersion != "" {
+		if in.version, err = parseVersion(opts.TargetVersion); err != nil {
+			return in, fmt.Errorf("target version: %w", err)
+		}
 	}
 
 	// 1. Load GAMEEXE.INI if available
-	iniTable, err := loadGameexe(opts, srcPath)
+	iniPath, err := gameexePath(opts, srcPath)
 	if err != nil {
-		return fmt.Errorf("loading GAMEEXE: %w", err)
+		return in, fmt.Errorf("loading GAMEEXE: %w", err)
+	}
+	if in.ini, err = loadGameexe(opts, iniPath); err != nil {
+		return in, fmt.Errorf("loading GAMEEXE: %w", err)
 	}
 	if opts.Verbose > 1 {
-		fmt.Fprintf(os.Stderr, "  GAMEEXE entries: %d\n", iniTable.Count())
+		fmt.Fprintf(os.Stderr, "  GAMEEXE entries: %d\n", in.ini.Count())
 	}
 
 	// 2. Load KFN file if available
-	kfnReg, err := loadKfn(opts)
-	if err != nil {
-		return fmt.Errorf("loading KFN: %w", err)
+	if in.kfn, err = loadKfn(opts); err != nil {
+		return in, fmt.Errorf("loading KFN: %w", err)
 	}
-	if opts.Verbose > 1 && kfnReg != nil {
-		fmt.Fprintf(os.Stderr, "  KFN functions: %d\n", len(kfnReg.Functions))
+	if opts.Verbose > 1 {
+		fmt.Fprintf(os.Stderr, "  KFN functions: %d\n", len(in.kfn.Functions))
 	}
 
-	// 3. Read source file
-	srcBytes, err := os.ReadFile(srcPath)
-	if err != nil {
-		return fmt.Errorf("reading source: %w", err)
+	if opts.CastFile != "" {
+		if in.cast, err = cast.ParseFile(opts.CastFile, encoding.Parse(opts.Encoding)); err != nil {
+			return in, fmt.Errorf("loading cast: %w", err)
+		}
 	}
 
-	// 4. Lex + parse
-	lx := lexer.New(string(srcBytes), srcPath)
-	if opts.Verbose > 1 {
-		fmt.Fprintf(os.Stderr, "  Lexer created for %s\n", srcPath)
+	if opts.CacheDir != "" {
+		if in.cache, err = buildcache.Open(opts.CacheDir); err != nil {
+			return in, err
+		}
+		in.key = cacheKey(opts, iniPath)
 	}
+	return in, nil
+}
 
-	p := parser.New(lx)
-	program := p.ParseProgram()
-	if opts.Verbose > 1 {
-		fmt.Fprintf(os.Stderr, "  Statements: %d\n", len(program.Stmts))
+// cacheKey digests what the output of a compilation depends on besides
+// its source files: the compiler, the options that affect the bytecode,
+// and the KFN, GAMEEXE.INI and cast files.
+func cacheKey(opts *Options, iniPath string) string {
+	parts := []string{
+		compilerIdent,
+		fmt.Sprintf("target=%s/%s encoding=%s -o=%s -O%d", opts.Target, opts.TargetVersion, opts.Encoding, opts.OutFile, opts.OptLevel),
+		fmt.Sprintf("compress=%t debug-info=%t metadata=%t old-vars=%t rtl=%t assertions=%t",
+			opts.Compress, opts.DebugInfo, opts.Metadata, opts.OldVars, opts.WithRtl, opts.Assertions),
+		fmt.Sprintf("lines=%d-%d flag-labels=%t array-bounds=%t runtime-trace=%d",
+			opts.StartLine, opts.EndLine, opts.FlagLabels, opts.ArrayBounds, opts.RuntimeTrace),
+		fmt.Sprintf("include=%q key=%v", opts.IncludeDirs, opts.Game.Key),
+	}
+	for _, f := range []string{opts.KfnFile, iniPath, opts.CastFile} {
+		d, _ := buildcache.FileDigest(f) // missing files digest as ""
+		parts = append(parts, d)
+	}
+	return buildcache.Key(parts...)
+}
+
+// sourceEncoding returns the encoding of a source file: .utf sources are
+// always UTF-8, others are in the -e encoding.
+func sourceEncoding(opts *Options, path string) encoding.Type {
+	if strings.EqualFold(filepath.Ext(path), ".utf") {
+		return encoding.UTF8
 	}
+	return encoding.Parse(opts.Encoding)
+}
 
-	// 5. Compile (TODO: once compilerFrame is ready)
-	// For now, just report success at the parse stage.
+// compileWith compiles one source file and returns the path of the
+// bytecode file it wrote. With --cache, the bytecode of a source whose
+// inputs are unchanged is copied from the cache instead; warnings are
+// only reported when a source is actually compiled.
+func compileWith(opts *Options, in inputs, srcPath string, rep *reporter) (string, error) {
+	if in.cache != nil {
+		if name, data, ok := in.cache.Lookup(srcPath, in.key); ok {
+			outPath := filepath.Join(opts.OutDir, name)
+			if err := binarray.FromBytes(data).WriteFile(outPath); err != nil {
+				return "", fmt.Errorf("writing output: %w", err)
+			}
+			if opts.Verbose > 0 {
+				fmt.Fprintf(os.Stderr, "Up to date: %s\n", srcPath)
+			}
+			return outPath, nil
+		}
+	}
 	if opts.Verbose > 0 {
-		fmt.Fprintf(os.Stderr, "  Parsed %d statements successfully.\n", len(program.Stmts))
-		fmt.Fprintf(os.Stderr, "  (compilerFrame not yet implemented — full bytecode emission pending)\n")
+		fmt.Fprintf(os.Stderr, "Compiling: %s\n", srcPath)
 	}
 
-	_ = iniTable
-	_ = kfnReg
-	return nil
+	// 3. Lex, parse and compile the source and any #load'ed headers
+	comp := newCompiler(opts, in, srcPath)
+	if err := comp.CompileFile(srcPath); err != nil {
+		comp.Errors = append(comp.Errors, diag.Wrap(ast.Nowhere, diag.Load, err))
+	}
+	rep.report(comp.Diagnostics()...)
+	if comp.HasErrors() {
+		return "", fmt.Errorf("%d error(s), no output written", len(comp.Errors))
+	}
+
+	// 4. Optimise the IR, then generate the bytecode file
+	optimize.Optimize(comp.Out, opts.OptLevel)
+	genOpts := codegen.DefaultOptions()
+	genOpts.Target = comp.Target
+	genOpts.Version = comp.Version
+	genOpts.Compress = opts.Compress && comp.Target != kfn.TargetAVG2000
+	genOpts.DebugInfo = opts.DebugInfo
+	if opts.Metadata && comp.Target != kfn.TargetAVG2000 {
+		genOpts.Metadata = buildMetadata(comp)
+	}
+	for _, name := range comp.State.DramatisPersonae {
+		b, err := encoding.FromUTF8(name, comp.Encoding)
+		if err != nil {
+			return "", fmt.Errorf("#character '%s': %w", name, err)
+		}
+		genOpts.Dramatis = append(genOpts.Dramatis, b)
+	}
+	data, err := comp.Out.Generate(genOpts)
+	if err != nil {
+		return "", err
+	}
+
+	// 5. Compress with the per-game keys
+	buf := binarray.FromBytes(data)
+	if genOpts.Compress {
+		buf, err = rlcmp.Compress(buf, opts.Game.Key)
+		if err != nil {
+			return "", fmt.Errorf("compressing: %w", err)
+		}
+	}
+
+	outName := outputName(opts, srcPath, comp.Directive.OutFile)
+	outPath := filepath.Join(opts.OutDir, outName)
+	if err := buf.WriteFile(outPath); err != nil {
+		return "", fmt.Errorf("writing output: %w", err)
+	}
+	if opts.Verbose > 0 {
+		fmt.Fprintf(os.Stderr, "  Wrote %s (%d bytes)\n", outPath, buf.Len())
+	}
+	if in.cache != nil {
+		if err := in.cache.Store(srcPath, in.key, outName, comp.Files(), comp.Missed(), buf.Data); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s not cached: %v\n", srcPath, err)
+		}
+	}
+	return outPath, nil
+}
+
+// newCompiler returns a compiler for srcPath set up from the options and
+// the shared inputs.
+func newCompiler(opts *Options, in inputs, srcPath string) *compilerframe.Compiler {
+	comp := compilerframe.New(in.kfn.Clone(), in.ini.Clone())
+	comp.Verbose = opts.Verbose
+	comp.OptLevel = opts.OptLevel
+	comp.RuntimeTrace = opts.RuntimeTrace
+	comp.ArrayBounds = opts.ArrayBounds
+	comp.StartLine = opts.StartLine
+	comp.EndLine = opts.EndLine
+	comp.FlagLabels = opts.FlagLabels
+	comp.Encoding = encoding.Parse(opts.Encoding)
+	comp.SourceEncoding = sourceEncoding(opts, srcPath)
+	comp.IncludeDirs = opts.IncludeDirs
+	comp.State.Cast = in.cast
+	if opts.Target != "" {
+		comp.Target = in.target
+		comp.Directive.TargetForced = opts.TargetForced
+	}
+	if opts.TargetVersion != "" {
+		comp.Version = in.version
+	}
+	return comp
+}
+
+// compilerIdent names this compiler in the output metadata. The numeric
+// version field only holds major.minor (x100), so the full version is
+// part of the identifier.
+var compilerIdent = "rldev-go " + config.Version
+
+// buildMetadata returns the metadata block identifying the compiler, the
+// target version and the text transformation a SEEN was built with.
+func buildMetadata(comp *compilerframe.Compiler) []byte {
+	var major, minor int
+	fmt.Sscanf(config.Version, "%d.%d", &major, &minor)
+	var target [4]byte
+	for i, n := range comp.Version {
+		target[i] = byte(n)
+	}
+	var m metadata.Metadata
+	return m.ToBytes(compilerIdent, float64(major*100+minor)/100, target, comp.TextTransform())
+}
+
+// ============================================================
+// Diagnostics
+// ============================================================
+
+// reporter renders diagnostics to w as they are produced
+// (--diagnostics=text), or collects them and writes a single JSON array
+// at exit (--diagnostics=json). It is safe for concurrent use; the
+// diagnostics of one report call are never interleaved with others.
+type reporter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	json  bool
+	quiet bool
+	opts  *Options
+	all   []*diag.Diagnostic
+	files map[string][]string
+}
+
+func newReporter(opts *Options, w io.Writer) *reporter {
+	return &reporter{
+		w:     w,
+		json:  opts.Diagnostics == "json",
+		quiet: opts.Quiet,
+		opts:  opts,
+		files: make(map[string][]string),
+	}
+}
+
+func (r *reporter) report(ds ...*diag.Diagnostic) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.json {
+		r.all = append(r.all, ds...)
+		return
+	}
+	for _, d := range ds {
+		if r.quiet && d.Severity != diag.SevError {
+			continue
+		}
+		diag.Render(r.w, d, r.line)
+	}
 }
 
-// loadGameexe attempts to locate and load GAMEEXE.INI.
+// flush writes the collected JSON array; it does nothing in text mode.
+func (r *reporter) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.json {
+		return nil
+	}
+	return diag.WriteJSON(r.w, r.all)
+}
+
+// line returns a source line for excerpts, reading each file once.
+func (r *reporter) line(file string, n int) (string, bool) {
+	lines, ok := r.files[file]
+	if !ok {
+		if data, err := os.ReadFile(file); err == nil {
+			if src, err := encoding.ToUTF8(data, sourceEncoding(r.opts, file)); err == nil {
+				lines = strings.Split(src, "\n")
+			}
+		}
+		r.files[file] = lines
+	}
+	if n < 1 || n > len(lines) {
+		return "", false
+	}
+	return lines[n-1], true
+}
+
+// outputName picks the bytecode filename: -o, then #file, then the source
+// name. Sources named seenNNNN become SEENNNNN.TXT as the engine expects.
+func outputName(opts *Options, srcPath, dirFile string) string {
+	name := opts.OutFile
+	if name == "" {
+		name = dirFile
+	}
+	if name != "" {
+		if filepath.Ext(name) == "" {
+			name += ".TXT"
+		}
+		return name
+	}
+	base := strings.TrimSuffix(filepath.Base(srcPath), filepath.Ext(srcPath))
+	if len(base) > 4 && strings.EqualFold(base[:4], "seen") {
+		if n, err := strconv.Atoi(base[4:]); err == nil {
+			return fmt.Sprintf("SEEN%04d.TXT", n)
+		}
+	}
+	return base + ".TXT"
+}
+
+// gameexePath locates GAMEEXE.INI ("" if there is none).
 // Search order:
 //  1. --gameexe flag
 //  2. $GAMEEXE env var
@@ -247,11 +603,11 @@ func compileFile(opts *Options, srcPath string) error {
 //  4. gameexe.ini in source directory
 //  5. ../GAMEEXE.INI
 //  6. ../gameexe.ini
-func loadGameexe(opts *Options, srcPath string) (*ini.Table, error) {
+func gameexePath(opts *Options, srcPath string) (string, error) {
 	var path string
 	if opts.Gameexe != "" {
 		if _, err := os.Stat(opts.Gameexe); err != nil {
-			return nil, fmt.Errorf("'%s' is not a valid INI file", opts.Gameexe)
+			return "", fmt.Errorf("'%s' is not a valid INI file", opts.Gameexe)
 		}
 		path = opts.Gameexe
 	} else if env := os.Getenv("GAMEEXE"); env != "" {
@@ -271,7 +627,12 @@ func loadGameexe(opts *Options, srcPath string) (*ini.Table, error) {
 			}
 		}
 	}
+	return path, nil
+}
 
+// loadGameexe loads the GAMEEXE.INI at path, or returns an empty table if
+// path is "".
+func loadGameexe(opts *Options, path string) (*ini.Table, error) {
 	if path == "" {
 		if opts.Verbose > 0 {
 			fmt.Fprintln(os.Stderr, "warning: unable to locate gameexe.ini, using defaults")
@@ -353,6 +714,27 @@ func parseVersion(s string) (kfn.Version, error) {
 // ============================================================
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		if err := runLSP(os.Args[2:]); err != nil {
+			if err == flag.ErrHelp {
+				os.Exit(0)
+			}
+			fmt.Fprintf(os.Stderr, "%s lsp: %v\n", appName, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		if err := runFmt(os.Args[2:]); err != nil {
+			if err == flag.ErrHelp {
+				os.Exit(0)
+			}
+			fmt.Fprintf(os.Stderr, "%s fmt: %v\n", appName, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	opts, err := parseFlags(os.Args[1:])
 	if err != nil {
 		if err == flag.ErrHelp {
@@ -362,7 +744,7 @@ func main() {
 		os.Exit(2)
 	}
 
-	if len(opts.InputFiles) == 0 {
+	if len(opts.InputFiles) == 0 && opts.BuildDir == "" {
 		fmt.Fprintf(os.Stderr, "%s: no input files\n", appName)
 		fmt.Fprintf(os.Stderr, "Run '%s -h' for usage.\n", appName)
 		os.Exit(1)
@@ -384,15 +766,31 @@ func main() {
 		}
 	}
 
-	// Compile each input file
+	// Compile each input file. JSON diagnostics go to stdout, so that
+	// progress and summary messages on stderr do not corrupt them.
+	out := io.Writer(os.Stderr)
+	if opts.Diagnostics == "json" {
+		out = os.Stdout
+	}
+	rep := newReporter(opts, out)
 	errors := 0
+	if opts.BuildDir != "" {
+		if err := buildProject(opts, opts.BuildDir, rep); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", opts.BuildDir, err)
+			errors++
+		}
+	}
 	for _, f := range opts.InputFiles {
 		srcPath := resolveSourcePath(opts, f)
-		if err := compileFile(opts, srcPath); err != nil {
+		if err := compileFile(opts, srcPath, rep); err != nil {
 			fmt.Fprintf(os.Stderr, "%s: %v\n", srcPath, err)
 			errors++
 		}
 	}
+	if err := rep.flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		errors++
+	}
 
 	if errors > 0 {
 		os.Exit(1)
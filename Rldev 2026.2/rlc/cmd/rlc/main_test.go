@@ -1,9 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
+	"github.com/yoremi/rldev-go/pkg/binarray"
+	"github.com/yoremi/rldev-go/pkg/bytecode"
+	"github.com/yoremi/rldev-go/pkg/gamedef"
+	"github.com/yoremi/rldev-go/pkg/kfn"
+	"github.com/yoremi/rldev-go/pkg/kprl"
+	"github.com/yoremi/rldev-go/pkg/metadata"
+	"github.com/yoremi/rldev-go/pkg/rlcmp"
 )
 
 func TestDefaultOptions(t *testing.T) {
@@ -47,6 +59,14 @@ func TestParseFlagsOutput(t *testing.T) {
 	if opts.OutDir != "/tmp" { t.Errorf("OutDir: %q", opts.OutDir) }
 }
 
+func TestParseFlagsIncludeDirs(t *testing.T) {
+	opts, err := parseFlags([]string{"-I", "inc", "-I", "lib", "test.org"})
+	if err != nil { t.Fatal(err) }
+	if len(opts.IncludeDirs) != 2 || opts.IncludeDirs[0] != "inc" || opts.IncludeDirs[1] != "lib" {
+		t.Errorf("IncludeDirs: %q", opts.IncludeDirs)
+	}
+}
+
 func TestParseTarget(t *testing.T) {
 	tests := []struct{ in string; want kfn.Target; err bool }{
 		{"RealLive", kfn.TargetRealLive, false},
@@ -106,3 +126,446 @@ func TestVerboseCounter(t *testing.T) {
 	if int(v) != 3 { t.Errorf("got %d", v) }
 	if !v.IsBoolFlag() { t.Error("should be bool flag") }
 }
+
+func TestOutputName(t *testing.T) {
+	opts := DefaultOptions()
+	if got := outputName(opts, "src/seen0042.org", ""); got != "SEEN0042.TXT" { t.Errorf("seen: %q", got) }
+	if got := outputName(opts, "src/intro.org", ""); got != "intro.TXT" { t.Errorf("other: %q", got) }
+	if got := outputName(opts, "seen0042.org", "SEEN0100"); got != "SEEN0100.TXT" { t.Errorf("#file: %q", got) }
+	opts.OutFile = "out.seen"
+	if got := outputName(opts, "seen0042.org", "SEEN0100"); got != "out.seen" { t.Errorf("-o: %q", got) }
+}
+
+const testKFN = `
+module 001 = Jmp
+module 003 = Msg
+fun goto (skip goto) <0:Jmp:00000, 0> ()
+fun goto_unless (if neg goto) <0:Jmp:00002, 0> (<'condition')
+fun intout <0:Msg:00001, 0> (int)
+`
+
+const testSource = `#entrypoint 0
+intA[0] = 3
+@top
+intA[0] -= 1
+if intA[0] > 0 goto @top
+intout(intA[0])
+halt
+`
+
+func TestCompileFileEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	srcPath := filepath.Join(dir, "seen0001.org")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	os.WriteFile(srcPath, []byte(testSource), 0644)
+
+	opts := DefaultOptions()
+	opts.KfnFile = kfnPath
+	opts.OutDir = dir
+	if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+
+	arr, err := binarray.ReadFile(filepath.Join(dir, "SEEN0001.TXT"))
+	if err != nil { t.Fatal(err) }
+	if !bytecode.IsBytecode(arr, 0) { t.Fatal("output is not a bytecode file") }
+	dec, err := rlcmp.Decompress(arr, gamedef.KnownGames["LB"], true)
+	if err != nil { t.Fatal(err) }
+	hdr, err := bytecode.ReadFullHeader(dec, false)
+	if err != nil { t.Fatal(err) }
+	code := dec.Data[hdr.DataOffset:]
+	if code[0] != '!' { t.Errorf("expected entrypoint marker, got %q", code[0]) }
+	if hdr.EntryPoints[0] != 0 { t.Errorf("entrypoint 0 at %d", hdr.EntryPoints[0]) }
+	if code[len(code)-1] != 0x00 { t.Errorf("expected trailing halt, got %#x", code[len(code)-1]) }
+}
+
+func TestCompileFileErrorsWriteNothing(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "seen0002.org")
+	os.WriteFile(srcPath, []byte("undefined_function\n"), 0644)
+
+	opts := DefaultOptions()
+	opts.KfnFile = ""
+	opts.OutDir = dir
+	opts.Quiet = true
+	var out bytes.Buffer
+	if err := compileFile(opts, srcPath, newReporter(opts, &out)); err == nil { t.Fatal("expected compile error") }
+	if _, err := os.Stat(filepath.Join(dir, "SEEN0002.TXT")); err == nil { t.Error("output written despite errors") }
+	want := "seen0002.org:1: error[E0100]: "
+	if !strings.Contains(out.String(), want) { t.Errorf("missing %q in:\n%s", want, out.String()) }
+	if !strings.Contains(out.String(), "    1 | undefined_function\n      | ^\n") { t.Errorf("no excerpt:\n%s", out.String()) }
+}
+
+func TestCompileFileBadTarget(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "seen0003.org")
+	os.WriteFile(srcPath, []byte("halt\n"), 0644)
+
+	for _, o := range []struct{ target, version string }{{"Nope", ""}, {"", "1.x"}} {
+		opts := DefaultOptions()
+		opts.KfnFile = ""
+		opts.OutDir = dir
+		opts.Target, opts.TargetVersion = o.target, o.version
+		if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err == nil { t.Errorf("%+v: expected an error", o) }
+		if _, err := os.Stat(filepath.Join(dir, "SEEN0003.TXT")); err == nil { t.Errorf("%+v: output written", o) }
+	}
+}
+
+func TestRunLSPBadTarget(t *testing.T) {
+	for _, args := range [][]string{{"--target", "Nope"}, {"--target-version", "1.x"}} {
+		err := runLSP(append([]string{"-K", ""}, args...))
+		if err == nil || !strings.Contains(err.Error(), "target") { t.Errorf("%v: got %v", args, err) }
+	}
+}
+
+func TestParseFlagsDiagnostics(t *testing.T) {
+	opts, err := parseFlags([]string{"--diagnostics=json", "a.org"})
+	if err != nil { t.Fatal(err) }
+	if opts.Diagnostics != "json" { t.Errorf("diagnostics: %s", opts.Diagnostics) }
+	if _, err := parseFlags([]string{"--diagnostics=xml", "a.org"}); err == nil { t.Error("expected error for unknown format") }
+}
+
+func TestCompileFileJSONDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "seen0003.org")
+	os.WriteFile(srcPath, []byte("#warn 'careful'\nintout(x)\n"), 0644)
+
+	opts := DefaultOptions()
+	opts.KfnFile = ""
+	opts.OutDir = dir
+	opts.Diagnostics = "json"
+	var out bytes.Buffer
+	rep := newReporter(opts, &out)
+	if err := compileFile(opts, srcPath, rep); err == nil { t.Fatal("expected compile error") }
+	if err := rep.flush(); err != nil { t.Fatal(err) }
+	var ds []struct{ File, Severity, Code, Message string; Line int }
+	if err := json.Unmarshal(out.Bytes(), &ds); err != nil { t.Fatalf("%v in %s", err, out.String()) }
+	if len(ds) != 2 { t.Fatalf("diagnostics: %+v", ds) }
+	if ds[0].Severity != "warning" || ds[0].Code != "W0002" || ds[0].Message != "careful" { t.Errorf("warning: %+v", ds[0]) }
+	if ds[1].Severity != "error" || ds[1].Line != 2 || ds[1].File != srcPath { t.Errorf("error: %+v", ds[1]) }
+}
+
+func TestCompileFileOptLevels(t *testing.T) {
+	dir := t.TempDir()
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	srcPath := filepath.Join(dir, "seen0004.org")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	os.WriteFile(srcPath, []byte("#entrypoint 0\nif 1 intout(1) else intout(2)\nhalt\nintout(3)\n"), 0644)
+
+	compile := func(level int) []byte {
+		opts := DefaultOptions()
+		opts.KfnFile = kfnPath
+		opts.OutDir = dir
+		opts.OptLevel = level
+		if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+		arr, err := binarray.ReadFile(filepath.Join(dir, "SEEN0004.TXT"))
+		if err != nil { t.Fatal(err) }
+		dec, err := rlcmp.Decompress(arr, gamedef.KnownGames["LB"], true)
+		if err != nil { t.Fatal(err) }
+		hdr, err := bytecode.ReadFullHeader(dec, false)
+		if err != nil { t.Fatal(err) }
+		return dec.Data[hdr.DataOffset:]
+	}
+	o0, o2 := compile(0), compile(2)
+	for _, n := range []byte{1, 2, 3} {
+		if !bytes.Contains(o0, []byte{'$', 0xff, n, 0, 0, 0}) { t.Errorf("-O0 lost intout(%d)", n) }
+	}
+	if len(o2) >= len(o0) { t.Errorf("-O2 (%d bytes) not smaller than -O0 (%d bytes)", len(o2), len(o0)) }
+	if bytes.Contains(o2, []byte("$\xff\x02\x00\x00\x00")) || bytes.Contains(o2, []byte("$\xff\x03\x00\x00\x00")) { t.Errorf("-O2 kept dead code: %q", o2) }
+}
+
+func TestParseFlagsGame(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "game.cfg")
+	os.WriteFile(cfg, []byte("[MINE]\ninherits = LBEX\ntarget = Kinetic 1.1\nencoding = UTF-8\ngameexe = GAMEEXE.INI\nseens = 3\n"), 0644)
+
+	opts, err := parseFlags([]string{"--game", cfg, "--id", "mine", "a.org"})
+	if err != nil { t.Fatal(err) }
+	if len(opts.Game.Key) != len(gamedef.KeyLBEX) { t.Errorf("keys: %v", opts.Game.Key) }
+	if opts.Target != "Kinetic" || opts.TargetForced { t.Errorf("target: %q forced=%v", opts.Target, opts.TargetForced) }
+	if opts.TargetVersion != "1.1" { t.Errorf("version: %q", opts.TargetVersion) }
+	if opts.Encoding != "UTF-8" { t.Errorf("encoding: %q", opts.Encoding) }
+	if opts.Gameexe != filepath.Join(dir, "GAMEEXE.INI") { t.Errorf("gameexe: %q", opts.Gameexe) }
+	if opts.Game.Seens != 3 { t.Errorf("seens: %d", opts.Game.Seens) }
+
+	// The command line wins over the game definition
+	opts, err = parseFlags([]string{"--game", cfg, "--id", "MINE", "-e", "CP932", "--target", "RealLive", "a.org"})
+	if err != nil { t.Fatal(err) }
+	if opts.Encoding != "CP932" || opts.Target != "RealLive" || !opts.TargetForced { t.Errorf("overrides: %+v", opts) }
+
+	if _, err := parseFlags([]string{"--game", cfg, "--id", "NOPE", "a.org"}); err == nil { t.Error("unknown id accepted") }
+	if _, err := parseFlags([]string{"--game", filepath.Join(dir, "missing.cfg"), "a.org"}); err == nil { t.Error("missing --game file accepted") }
+	if _, err := parseFlags([]string{"--id", "snow", "a.org"}); err != nil { t.Errorf("built-in game: %v", err) }
+}
+
+func TestCompileFileCast(t *testing.T) {
+	dir := t.TempDir()
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	srcPath := filepath.Join(dir, "seen0005.org")
+	castPath := filepath.Join(dir, "cast.txt")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	os.WriteFile(srcPath, []byte("#character 'Kotomi'\nintout(1)\n"), 0644)
+	os.WriteFile(castPath, []byte("Kotomi = Kotomi Ichinose\n"), 0644)
+
+	opts := DefaultOptions()
+	opts.KfnFile = kfnPath
+	opts.OutDir = dir
+	opts.CastFile = castPath
+	opts.Compress = false
+	if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+	arr, err := binarray.ReadFile(filepath.Join(dir, "SEEN0005.TXT"))
+	if err != nil { t.Fatal(err) }
+	hdr, err := bytecode.ReadFullHeader(arr, false)
+	if err != nil { t.Fatal(err) }
+	if len(hdr.DramatisPersonae) != 1 || hdr.DramatisPersonae[0] != "Kotomi Ichinose" { t.Errorf("dramatis: %q", hdr.DramatisPersonae) }
+
+	opts.CastFile = filepath.Join(dir, "missing.txt")
+	if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err == nil { t.Error("missing cast file accepted") }
+}
+
+func TestCompileFileMetadata(t *testing.T) {
+	dir := t.TempDir()
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	srcPath := filepath.Join(dir, "seen0006.org")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	os.WriteFile(srcPath, []byte("#character 'A'\nintout(1)\n"), 0644)
+
+	opts, err := parseFlags([]string{"--target-version", "1.6.5.2", "--compress=false", "-K", kfnPath, "-d", dir, srcPath})
+	if err != nil { t.Fatal(err) }
+	if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+	arr, err := binarray.ReadFile(filepath.Join(dir, "SEEN0006.TXT"))
+	if err != nil { t.Fatal(err) }
+	hdr, err := bytecode.ReadFullHeader(arr, false)
+	if err != nil { t.Fatal(err) }
+	m := hdr.Metadata
+	if m.CompilerName != compilerIdent || m.TargetVersionString() != "1.6.5.2" || m.TextTransform != metadata.TransformNone { t.Errorf("metadata: %+v", m) }
+	if len(hdr.DramatisPersonae) != 1 { t.Errorf("dramatis: %q", hdr.DramatisPersonae) }
+
+	opts.Metadata = false
+	if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+	arr, _ = binarray.ReadFile(filepath.Join(dir, "SEEN0006.TXT"))
+	if hdr, _ := bytecode.ReadFullHeader(arr, false); !hdr.Metadata.IsEmpty() { t.Error("--metadata=false still wrote metadata") }
+}
+
+func TestCompileFileEncodings(t *testing.T) {
+	dir := t.TempDir()
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	cases := []struct{ enc, text, want string; tt metadata.TextTransform }{
+		{"CP936", "中文", "\xd6\xd0\xce\xc4", metadata.TransformChinese},
+		{"CP949", "한국어 똠", "\xc7\xd1\xb1\xb9\xbe\xee\" \"\x8c\x63", metadata.TransformKorean},
+	}
+	for _, c := range cases {
+		srcPath := filepath.Join(dir, "seen0007.utf")
+		os.WriteFile(srcPath, []byte("'"+c.text+"'\n"), 0644)
+		opts, err := parseFlags([]string{"-e", c.enc, "--compress=false", "-K", kfnPath, "-d", dir, srcPath})
+		if err != nil { t.Fatal(err) }
+		if err := compileFile(opts, srcPath, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+		arr, _ := binarray.ReadFile(filepath.Join(dir, "SEEN0007.TXT"))
+		hdr, err := bytecode.ReadFullHeader(arr, false)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Contains(arr.Data[hdr.DataOffset:], []byte(c.want)) { t.Errorf("%s: %q", c.enc, arr.Data[hdr.DataOffset:]) }
+		if hdr.Metadata.TextTransform != c.tt { t.Errorf("%s: transform %v", c.enc, hdr.Metadata.TextTransform) }
+	}
+
+	srcPath := filepath.Join(dir, "seen0008.utf")
+	os.WriteFile(srcPath, []byte("intout(1)\n'中文😀'\n"), 0644)
+	opts, _ := parseFlags([]string{"-e", "CP936", "-q", "-K", kfnPath, "-d", dir, srcPath})
+	var out bytes.Buffer
+	if err := compileFile(opts, srcPath, newReporter(opts, &out)); err == nil { t.Fatal("unrepresentable character accepted") }
+	want := "seen0008.utf:2: error[E0500]: cannot represent '😀' (U+1F600) in CP936"
+	if !strings.Contains(out.String(), want) { t.Errorf("missing %q in:\n%s", want, out.String()) }
+	if _, err := parseFlags([]string{"-e", "latin1", "a.org"}); err == nil { t.Error("unknown encoding accepted") }
+}
+
+func TestParseFlagsBuild(t *testing.T) {
+	opts, err := parseFlags([]string{"--build", "src", "-j", "3"})
+	if err != nil { t.Fatal(err) }
+	if opts.BuildDir != "src" || opts.Jobs != 3 || len(opts.InputFiles) != 0 { t.Errorf("got %+v", opts) }
+}
+
+func TestBuildProject(t *testing.T) {
+	dir := t.TempDir()
+	srcDir, outDir := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+	os.Mkdir(srcDir, 0755)
+	os.Mkdir(outDir, 0755)
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	for _, name := range []string{"seen0001.org", "SEEN0002.ORG", "seen0003.utf"} {
+		os.WriteFile(filepath.Join(srcDir, name), []byte(testSource), 0644)
+	}
+	os.WriteFile(filepath.Join(srcDir, "notes.txt"), []byte("not a source"), 0644)
+
+	opts := DefaultOptions()
+	opts.KfnFile = kfnPath
+	opts.OutDir = outDir
+	opts.Quiet = true
+	opts.Jobs = 2
+	if err := applyGame(opts, nil); err != nil { t.Fatal(err) }
+	if err := buildProject(opts, srcDir, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+	arc, err := binarray.ReadFile(filepath.Join(outDir, "SEEN.TXT"))
+	if err != nil { t.Fatal(err) }
+	if n := kprl.SeenCount(arc); n != 3 { t.Errorf("archive holds %d SEENs, want 3", n) }
+
+	// A failing source leaves the archive as it was.
+	os.WriteFile(filepath.Join(srcDir, "seen0004.org"), []byte("undefined_function\n"), 0644)
+	opts.OutFile = "OTHER.TXT"
+	var out bytes.Buffer
+	if err := buildProject(opts, srcDir, newReporter(opts, &out)); err == nil { t.Fatal("expected build error") }
+	if _, err := os.Stat(filepath.Join(outDir, "OTHER.TXT")); err == nil { t.Error("archive written despite errors") }
+	if !strings.Contains(out.String(), "seen0004.org:1: error") { t.Errorf("missing diagnostic:\n%s", out.String()) }
+}
+
+func TestBuildProjectArchive(t *testing.T) {
+	dir := t.TempDir()
+	srcDir, outDir := filepath.Join(dir, "src"), filepath.Join(dir, "out")
+	os.Mkdir(srcDir, 0755)
+	os.Mkdir(outDir, 0755)
+	os.WriteFile(filepath.Join(dir, "reallive.kfn"), []byte(testKFN), 0644)
+	for _, name := range []string{"seen0001.org", "seen0002.org", "seen0003.org"} {
+		os.WriteFile(filepath.Join(srcDir, name), []byte(testSource), 0644)
+	}
+
+	opts := DefaultOptions()
+	opts.KfnFile = filepath.Join(dir, "reallive.kfn")
+	opts.OutDir = outDir
+	opts.Quiet = true
+	if err := applyGame(opts, nil); err != nil { t.Fatal(err) }
+	arcPath := filepath.Join(outDir, "SEEN.TXT")
+	seens := func() int {
+		t.Helper()
+		arc, err := binarray.ReadFile(arcPath)
+		if err != nil { t.Fatal(err) }
+		return kprl.SeenCount(arc)
+	}
+	if err := buildProject(opts, srcDir, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+	if n := seens(); n != 3 { t.Fatalf("archive holds %d SEENs, want 3", n) }
+
+	// The archive is rebuilt, so a removed source leaves no stale SEEN.
+	os.Remove(filepath.Join(srcDir, "seen0003.org"))
+	if err := buildProject(opts, srcDir, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+	if n := seens(); n != 2 { t.Errorf("archive holds %d SEENs, want 2", n) }
+
+	// Outputs not named SEENxxxx, and two outputs for one SEEN, fail the build.
+	for _, name := range []string{"intro.org", "seen1.org"} {
+		path := filepath.Join(srcDir, name)
+		os.WriteFile(path, []byte(testSource), 0644)
+		if err := buildProject(opts, srcDir, newReporter(opts, io.Discard)); err == nil { t.Errorf("%s: expected build error", name) }
+		if n := seens(); n != 2 { t.Errorf("%s: archive holds %d SEENs, want 2", name, n) }
+		os.Remove(path)
+	}
+}
+
+func TestBuildProjectSeenCount(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "game.cfg")
+	os.WriteFile(cfg, []byte("[MINE]\ninherits = LB\nseens = 2\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "reallive.kfn"), []byte(testKFN), 0644)
+	for _, name := range []string{"seen0001.org", "seen0002.org", "seen0003.org"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(testSource), 0644)
+	}
+
+	opts := DefaultOptions()
+	opts.KfnFile = filepath.Join(dir, "reallive.kfn")
+	opts.OutDir = dir
+	opts.Quiet = true
+	opts.GameFile, opts.GameID = cfg, "MINE"
+	if err := applyGame(opts, map[string]bool{"game": true}); err != nil { t.Fatal(err) }
+	err := buildProject(opts, dir, newReporter(opts, io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "2 SEEN(s)") { t.Errorf("got %v", err) }
+
+	os.Remove(filepath.Join(dir, "seen0003.org"))
+	if err := buildProject(opts, dir, newReporter(opts, io.Discard)); err != nil { t.Error(err) }
+}
+
+func TestCompileFileCache(t *testing.T) {
+	dir := t.TempDir()
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	os.WriteFile(filepath.Join(dir, "count.kh"), []byte("#define COUNT = 3\n"), 0644)
+	src1, src2 := filepath.Join(dir, "seen0001.org"), filepath.Join(dir, "seen0002.org")
+	os.WriteFile(src1, []byte(testSource), 0644)
+	os.WriteFile(src2, []byte("#load 'count'\nintout(COUNT)\n"), 0644)
+
+	opts := DefaultOptions()
+	opts.KfnFile = kfnPath
+	opts.OutDir = dir
+	opts.CacheDir = filepath.Join(dir, "cache")
+	if err := applyGame(opts, nil); err != nil { t.Fatal(err) }
+	compile := func() {
+		t.Helper()
+		for _, src := range []string{src1, src2} {
+			if err := compileFile(opts, src, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+		}
+	}
+	compile()
+
+	// Mark the cached bytecode, so that reuse shows in the output.
+	bins, _ := filepath.Glob(filepath.Join(opts.CacheDir, "*.bin"))
+	if len(bins) != 2 { t.Fatalf("%d cache entries, want 2", len(bins)) }
+	for _, b := range bins { os.WriteFile(b, []byte("cached"), 0644) }
+	output := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+
+	compile()
+	if output("SEEN0001.TXT") != "cached" || output("SEEN0002.TXT") != "cached" { t.Error("unchanged scenes were recompiled") }
+
+	os.WriteFile(filepath.Join(dir, "count.kh"), []byte("#define COUNT = 4\n"), 0644)
+	compile()
+	if output("SEEN0001.TXT") != "cached" { t.Error("scene 1 recompiled") }
+	if output("SEEN0002.TXT") == "cached" { t.Error("scene 2 not recompiled after its header changed") }
+
+	opts.OptLevel = 0
+	compile()
+	if output("SEEN0001.TXT") == "cached" { t.Error("cache reused with different options") }
+}
+
+func TestCompileFileCacheShadowedHeader(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	os.Mkdir(lib, 0755)
+	kfnPath := filepath.Join(dir, "reallive.kfn")
+	os.WriteFile(kfnPath, []byte(testKFN), 0644)
+	os.WriteFile(filepath.Join(lib, "util.kh"), []byte("#define COUNT = 3\n"), 0644)
+	src := filepath.Join(dir, "seen0001.org")
+	os.WriteFile(src, []byte("#load 'util'\nintout(COUNT)\n"), 0644)
+
+	opts := DefaultOptions()
+	opts.KfnFile = kfnPath
+	opts.OutDir = dir
+	opts.IncludeDirs = []string{lib}
+	opts.CacheDir = filepath.Join(dir, "cache")
+	if err := applyGame(opts, nil); err != nil { t.Fatal(err) }
+	compile := func() string {
+		t.Helper()
+		if err := compileFile(opts, src, newReporter(opts, io.Discard)); err != nil { t.Fatal(err) }
+		data, _ := os.ReadFile(filepath.Join(dir, "SEEN0001.TXT"))
+		return string(data)
+	}
+	compile()
+	bins, _ := filepath.Glob(filepath.Join(opts.CacheDir, "*.bin"))
+	if len(bins) != 1 { t.Fatalf("%d cache entries, want 1", len(bins)) }
+	os.WriteFile(bins[0], []byte("cached"), 0644)
+	if compile() != "cached" { t.Fatal("unchanged scene was recompiled") }
+
+	// A header next to the scene is found before the -I one.
+	os.WriteFile(filepath.Join(dir, "util.kh"), []byte("#define COUNT = 4\n"), 0644)
+	if compile() == "cached" { t.Error("scene not recompiled after a header shadowed the one it loaded") }
+}
+
+func TestFmtFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "seen0001.org")
+	sjis := []byte{0x27, 0x82, 0xa0, 0x27, 0x0a} // 'あ'
+	os.WriteFile(src, append([]byte("intA[0]=1\n"), sjis...), 0644)
+	opts := DefaultOptions()
+	if err := fmtFile(opts, src, true); err != nil { t.Fatal(err) }
+	got, _ := os.ReadFile(src)
+	if want := append([]byte("intA[0] = 1\n"), sjis...); !bytes.Equal(got, want) { t.Errorf("got %q", got) }
+
+	bad := filepath.Join(dir, "bad.org")
+	os.WriteFile(bad, []byte("intA[0 = 1\n"), 0644)
+	if err := fmtFile(opts, bad, true); err == nil { t.Error("syntax error accepted") }
+	if got, _ := os.ReadFile(bad); string(got) != "intA[0 = 1\n" { t.Error("file with a syntax error rewritten") }
+}
@@ -1,3 +1,9 @@
 module github.com/yoremi/rldev-go/rlc
 
 go 1.21
+
+require github.com/yoremi/rldev-go v0.0.0
+
+require golang.org/x/text v0.14.0 // indirect
+
+replace github.com/yoremi/rldev-go => ../common
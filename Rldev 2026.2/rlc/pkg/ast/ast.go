@@ -138,12 +138,14 @@ type Expr interface {
 type IntLit struct {
 	Loc Loc
 	Val int32
+	Raw string // source spelling ("$FF", "1_000"), empty if synthesised
 }
 
 // StrLit is a string literal with rich tokens.
 type StrLit struct {
 	Loc    Loc
 	Tokens []StrToken // rich string tokens
+	Raw    string     // source text with quotes, empty if synthesised
 }
 
 // ResRef is a resource string reference: #res<key>.
@@ -528,12 +530,13 @@ type GotoCaseArm struct {
 
 type UnknownOpStmt struct {
 	Loc       Loc
-	OpIdent   string
+	OpIdent   string // module name, if given by name rather than number
 	OpType    int
 	OpModule  int
 	OpCode    int
 	Overload  int
 	Params    []Param
+	Dest      Expr   // optional -> store target (nil = ignored)
 }
 
 type VarOrFuncStmt struct {
@@ -675,6 +678,7 @@ type DSetStmt struct {
 	Loc      Loc
 	Ident    string
 	ReadOnly bool // false for #set (mutable), true for #redef
+	Op       AssignOp // as written; the compiler treats every op as =
 	Value    Expr
 }
 
@@ -711,7 +715,7 @@ type LoadFileStmt struct {
 type DInlineStmt struct {
 	Loc    Loc
 	Ident  string
-	Scoped bool
+	Scoped bool // #sinline: the body is expanded in a scope of its own
 	Params []InlineParam
 	Body   Stmt
 }
@@ -732,10 +736,11 @@ type DForStmt struct {
 }
 
 type DIfStmt struct {
-	Loc  Loc
-	Cond Expr
-	Body []Stmt
-	Cont DIfCont // DElseStmt, DEndifStmt, or nested DIfStmt
+	Loc   Loc
+	Cond  Expr
+	Ifdef bool // #ifdef/#ifndef: Cond is the defined?() test they stand for
+	Body  []Stmt
+	Cont  DIfCont // DElseStmt, DEndifStmt, or nested DIfStmt
 }
 
 type DIfCont interface {
@@ -831,8 +836,17 @@ func (s DIfStmt) StmtLoc() Loc       { return s.Loc }
 
 // SourceFile is a parsed .org source file.
 type SourceFile struct {
-	Name  string
-	Stmts []Stmt
+	Name     string
+	Stmts    []Stmt
+	Comments []Comment // in source order; the compiler ignores them
+}
+
+// Comment is a comment of the source, kept for tools that print the AST
+// back out. #line directives are kept as comments too.
+type Comment struct {
+	Loc      Loc
+	Text     string // as written, delimiters included
+	Trailing bool   // follows code on the same line
 }
 
 // ============================================================
@@ -0,0 +1,147 @@
+// Package buildcache keeps the bytecode of compiled scenes between runs
+// (--cache), so that a rebuild only recompiles the scenes whose inputs
+// changed.
+//
+// Each source file has one entry, named after the digest of its absolute
+// path:
+//
+//	<id>.dep  the key, the output name, then one "digest path" line for
+//	          every file the compilation read, and one "- path" line for
+//	          every path #load looked for and did not find
+//	<id>.bin  the bytecode written for it
+//
+// The key is the digest of everything besides source files that the
+// output depends on (KFN, GAMEEXE.INI, options; see Key). The files are
+// the source itself and its transitive #load headers, which are only known
+// once the scene has been compiled. An entry is reused while its key is
+// the same, every file it lists still has the recorded digest, and none of
+// the missing paths has been created, as a header there would be loaded
+// instead.
+//
+// Digests are those of binarray.Buffer.Digest.
+package buildcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yoremi/rldev-go/pkg/binarray"
+)
+
+// Cache is a build cache directory.
+type Cache struct {
+	Dir string
+}
+
+// Open returns the cache in dir, creating the directory if needed.
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cache directory: %w", err)
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// Digest returns the hex digest of data.
+func Digest(data []byte) string {
+	d := binarray.FromBytes(data).Digest()
+	return hex.EncodeToString(d[:])
+}
+
+// FileDigest returns the hex digest of the contents of a file.
+func FileDigest(path string) (string, error) {
+	buf, err := binarray.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	d := buf.Digest()
+	return hex.EncodeToString(d[:]), nil
+}
+
+// Key combines the parts of a cache key into one digest. Parts that are
+// file paths should be given as their FileDigest.
+func Key(parts ...string) string {
+	return Digest([]byte(strings.Join(parts, "\n")))
+}
+
+// entry returns the path of the entry for src, without extension.
+func (c *Cache) entry(src string) string {
+	if abs, err := filepath.Abs(src); err == nil {
+		src = abs
+	}
+	return filepath.Join(c.Dir, Digest([]byte(src))[:16])
+}
+
+// Lookup returns the output name and bytecode cached for src, if the
+// entry was stored with key, none of the files it read has changed and
+// none of the files it missed exists.
+func (c *Cache) Lookup(src, key string) (name string, data []byte, ok bool) {
+	base := c.entry(src)
+	dep, err := os.ReadFile(base + ".dep")
+	if err != nil {
+		return "", nil, false
+	}
+	sc := bufio.NewScanner(bytes.NewReader(dep))
+	if !sc.Scan() || sc.Text() != key || !sc.Scan() {
+		return "", nil, false
+	}
+	name = sc.Text()
+	for sc.Scan() {
+		digest, path, found := strings.Cut(sc.Text(), " ")
+		if !found {
+			return "", nil, false
+		}
+		if digest == "-" {
+			if st, err := os.Stat(path); err == nil && !st.IsDir() {
+				return "", nil, false
+			}
+			continue
+		}
+		if d, err := FileDigest(path); err != nil || d != digest {
+			return "", nil, false
+		}
+	}
+	if data, err = os.ReadFile(base + ".bin"); err != nil {
+		return "", nil, false
+	}
+	return name, data, true
+}
+
+// Store records the bytecode compiled from src with key, under its output
+// name, along with the files the compilation read and those it looked for
+// and did not find.
+func (c *Cache) Store(src, key, name string, files, missed []string, data []byte) error {
+	var dep strings.Builder
+	fmt.Fprintf(&dep, "%s\n%s\n", key, name)
+	for _, f := range files {
+		d, err := FileDigest(f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&dep, "%s %s\n", d, f)
+	}
+	for _, f := range missed {
+		fmt.Fprintf(&dep, "- %s\n", f)
+	}
+	base := c.entry(src)
+	// The bytecode is written first: a .dep file is only ever paired with
+	// the bytecode it describes.
+	os.Remove(base + ".dep")
+	if err := writeFile(base+".bin", data); err != nil {
+		return err
+	}
+	return writeFile(base+".dep", []byte(dep.String()))
+}
+
+// writeFile replaces path atomically.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
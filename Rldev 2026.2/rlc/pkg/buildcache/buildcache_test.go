@@ -0,0 +1,51 @@
+package buildcache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyAndDigest(t *testing.T) {
+	if Digest(nil) != "d41d8cd98f00b204e9800998ecf8427e" { t.Errorf("digest of nothing: %s", Digest(nil)) }
+	if Key("a", "b") != Key("a\nb") { t.Error("key should join its parts with newlines") }
+	if Key("a", "b") == Key("b", "a") { t.Error("key ignores the order of its parts") }
+}
+
+func TestLookupStore(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "seen0001.org")
+	hdr := filepath.Join(dir, "common.kh")
+	os.WriteFile(src, []byte("#load 'common'\n"), 0644)
+	os.WriteFile(hdr, []byte("#define X = 1\n"), 0644)
+
+	c, err := Open(filepath.Join(dir, "cache"))
+	if err != nil { t.Fatal(err) }
+	if _, _, ok := c.Lookup(src, "k"); ok { t.Fatal("hit in an empty cache") }
+	if err := c.Store(src, "k", "SEEN0001.TXT", []string{src, hdr}, nil, []byte("code")); err != nil { t.Fatal(err) }
+
+	name, data, ok := c.Lookup(src, "k")
+	if !ok || name != "SEEN0001.TXT" || string(data) != "code" { t.Fatalf("got %q %q %v", name, data, ok) }
+	if _, _, ok := c.Lookup(src, "other"); ok { t.Error("hit with a different key") }
+	if _, _, ok := c.Lookup(hdr, "k"); ok { t.Error("hit for a different source") }
+
+	os.WriteFile(hdr, []byte("#define X = 2\n"), 0644)
+	if _, _, ok := c.Lookup(src, "k"); ok { t.Error("hit after a header changed") }
+	os.WriteFile(hdr, []byte("#define X = 1\n"), 0644)
+	if _, _, ok := c.Lookup(src, "k"); !ok { t.Error("miss after the header was restored") }
+	os.Remove(hdr)
+	if _, _, ok := c.Lookup(src, "k"); ok { t.Error("hit after a header was removed") }
+}
+
+func TestLookupMissed(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "seen0001.org")
+	shadow := filepath.Join(dir, "util.kh")
+	os.WriteFile(src, []byte("#load 'util'\n"), 0644)
+	c, err := Open(filepath.Join(dir, "cache"))
+	if err != nil { t.Fatal(err) }
+	if err := c.Store(src, "k", "SEEN0001.TXT", []string{src}, []string{shadow}, []byte("code")); err != nil { t.Fatal(err) }
+	if _, _, ok := c.Lookup(src, "k"); !ok { t.Fatal("miss with the path still missing") }
+	os.WriteFile(shadow, []byte("#define X = 1\n"), 0644)
+	if _, _, ok := c.Lookup(src, "k"); ok { t.Error("hit after a missed header was created") }
+}
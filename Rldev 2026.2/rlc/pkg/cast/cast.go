@@ -0,0 +1,71 @@
+// Package cast reads cast files: the list of character name translations
+// applied while compiling (--cast).
+//
+// A cast file maps each original speaker name to its translation, one per
+// line, in the source encoding:
+//
+//	# Little Busters! main cast
+//	直枝理樹 = Riki Naoe
+//	棗鈴     = Rin Natsume
+//
+// Blank lines and lines starting with # are ignored. The compiler applies
+// the table to the name blocks of text output (\{...} and 【...】) and to
+// the dramatis personae (#character) written into the SEEN header, so that
+// names are localised in one place rather than in every scene.
+package cast
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yoremi/rldev-go/pkg/encoding"
+)
+
+// Table maps original names to translated names.
+type Table map[string]string
+
+// Name returns the translation of name, or name itself if the table has
+// none. A nil Table translates nothing.
+func (t Table) Name(name string) string {
+	if tr, ok := t[strings.TrimSpace(name)]; ok {
+		return tr
+	}
+	return name
+}
+
+// ParseFile reads a cast file written in the given source encoding.
+func ParseFile(path string, enc encoding.Type) (Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := encoding.ToUTF8(data, enc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return Parse(src, path)
+}
+
+// Parse reads a cast file from UTF-8 text; name is used in error messages.
+func Parse(src, name string) (Table, error) {
+	t := make(Table)
+	sc := bufio.NewScanner(strings.NewReader(src))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(strings.TrimPrefix(sc.Text(), "\ufeff"))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		orig, tr, ok := strings.Cut(line, "=")
+		orig, tr = strings.TrimSpace(orig), strings.TrimSpace(tr)
+		if !ok || orig == "" || tr == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'original = translation'", name, n)
+		}
+		if prev, dup := t[orig]; dup && prev != tr {
+			return nil, fmt.Errorf("%s:%d: '%s' is already cast as '%s'", name, n, orig, prev)
+		}
+		t[orig] = tr
+	}
+	return t, sc.Err()
+}
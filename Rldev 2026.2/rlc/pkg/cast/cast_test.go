@@ -0,0 +1,22 @@
+package cast
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tab, err := Parse("\ufeff# cast\n直枝理樹 = Riki Naoe\n\n  棗鈴=Rin  \n", "c.txt")
+	if err != nil { t.Fatal(err) }
+	if len(tab) != 2 || tab["直枝理樹"] != "Riki Naoe" || tab["棗鈴"] != "Rin" { t.Errorf("got %v", tab) }
+	if tab.Name(" 棗鈴 ") != "Rin" { t.Error("names should be trimmed") }
+	if tab.Name("恭介") != "恭介" { t.Error("unknown names should be unchanged") }
+	if Table(nil).Name("x") != "x" { t.Error("nil table") }
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{"no separator\n", "= Riki\n", "a = b\na = c\n"} {
+		if _, err := Parse(src, "c.txt"); err == nil || !strings.HasPrefix(err.Error(), "c.txt:") { t.Errorf("%q: %v", src, err) }
+	}
+	if _, err := Parse("a = b\na = b\n", "c.txt"); err != nil { t.Errorf("repeated identical entry: %v", err) }
+}
@@ -23,8 +23,9 @@ import (
 	"encoding/binary"
 	"fmt"
 
+	"github.com/yoremi/rldev-go/pkg/encoding"
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 )
 
 // ============================================================
@@ -132,12 +133,24 @@ const (
 	IRLineref                  // line number reference (for debug info)
 )
 
+// Flow describes how control leaves an IRCode element. It is only used by
+// the optimiser and never affects the generated bytes.
+type Flow int
+
+const (
+	FlowNext     Flow = iota // falls through to the next element
+	FlowGoto                 // unconditional goto; the next element is its IRLabelRef
+	FlowCondGoto             // conditional goto; the next element is its IRLabelRef
+	FlowExit                 // never falls through (halt, ret)
+)
+
 // IR is one element of the intermediate representation.
 type IR struct {
 	Type  IRType
 	Bytes []byte // for IRCode
 	Label string // for IRLabel, IRLabelRef
 	Index int    // for IREntrypoint, IRKidoku, IRLineref
+	Flow  Flow   // for IRCode
 	Loc   ast.Loc
 }
 
@@ -166,6 +179,24 @@ func (o *Output) AddCodeStr(loc ast.Loc, s string) {
 	o.AddCode(loc, []byte(s))
 }
 
+// AddJump appends a goto-style instruction: its opcode and parameters,
+// then a reference to label.
+func (o *Output) AddJump(loc ast.Loc, code []byte, label ast.Label, cond bool) {
+	o.maybeLine(loc)
+	flow := FlowGoto
+	if cond {
+		flow = FlowCondGoto
+	}
+	o.IR = append(o.IR, IR{Type: IRCode, Bytes: code, Flow: flow, Loc: loc})
+	o.AddLabelRef(label.Ident, label.Loc)
+}
+
+// AddExit appends an instruction after which control never falls through.
+func (o *Output) AddExit(loc ast.Loc, code []byte) {
+	o.maybeLine(loc)
+	o.IR = append(o.IR, IR{Type: IRCode, Bytes: code, Flow: FlowExit, Loc: loc})
+}
+
 // AddLabel defines a label at the current position.
 func (o *Output) AddLabel(name string, loc ast.Loc) error {
 	if o.labels[name] {
@@ -240,7 +271,85 @@ func (o *Output) EmitExpr(e ast.Expr) {
 		o.AddCode(x.Loc, []byte{'('})
 		o.EmitExpr(x.Expr)
 		o.AddCode(x.Loc, []byte{')'})
+	case ast.StrLit:
+		var text []byte
+		for _, t := range x.Tokens {
+			if tt, ok := t.(ast.TextToken); ok {
+				text = append(text, tt.Text...)
+			}
+		}
+		o.AddCode(x.Loc, EncodeString(text))
+	}
+}
+
+// EncodeExpr returns the bytecode for an expression without appending it
+// to any output buffer. Used when a parameter has to be serialized before
+// it is known where it will be placed (function assembly, return values).
+func EncodeExpr(e ast.Expr) []byte {
+	tmp := NewOutput()
+	tmp.EmitExpr(e)
+	var b []byte
+	for _, ir := range tmp.IR {
+		b = append(b, ir.Bytes...)
+	}
+	return b
+}
+
+// EncodeString encodes a string literal parameter. The text must already
+// be in the target encoding. Plain ASCII identifiers are emitted bare;
+// anything else is wrapped in double quotes with embedded quotes escaped.
+func EncodeString(text []byte) []byte {
+	bare := len(text) > 0 && !(text[0] >= '0' && text[0] <= '9')
+	for _, c := range text {
+		if !(c == '_' || (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')) {
+			bare = false
+			break
+		}
 	}
+	if bare {
+		return append([]byte(nil), text...)
+	}
+	b := make([]byte, 0, len(text)+2)
+	b = append(b, '"')
+	for _, c := range text {
+		if c == '"' {
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return append(b, '"')
+}
+
+// EncodeText encodes message text written directly into the bytecode by
+// static textout. The text must already be in the target encoding enc.
+// Double-byte characters are emitted as is; runs of single-byte characters
+// go through EncodeString so that they cannot be mistaken for commands.
+// The trail byte of a double-byte character may be ASCII (GBK, UHC, and
+// Shift_JIS all allow it), so characters are found with IsLeadByte.
+func EncodeText(text []byte, enc encoding.Type) []byte {
+	var b []byte
+	for i := 0; i < len(text); {
+		j := i
+		if text[i] >= 0x80 {
+			for j < len(text) && text[j] >= 0x80 {
+				if encoding.IsLeadByte(text[j], enc) {
+					j++
+				}
+				j++
+			}
+			if j > len(text) {
+				j = len(text)
+			}
+			b = append(b, text[i:j]...)
+		} else {
+			for j < len(text) && text[j] < 0x80 {
+				j++
+			}
+			b = append(b, EncodeString(text[i:j])...)
+		}
+		i = j
+	}
+	return b
 }
 
 // EmitAssignment encodes an assignment and appends it.
@@ -262,12 +371,13 @@ func (o *Output) EmitOpcode(loc ast.Loc, opType, opModule, opCode, argc, overloa
 // GenerateOptions controls output file generation.
 type GenerateOptions struct {
 	Target          kfn.Target
-	CompilerVersion int    // e.g., 10002
+	CompilerVersion int      // e.g., 10002
 	Compress        bool
 	DebugInfo       bool
-	Metadata        []byte // optional metadata bytes
+	Metadata        []byte   // optional metadata bytes
+	Dramatis        [][]byte // encoded dramatis personae (#character)
 	Version         kfn.Version
-	KidokuType      int    // 0=auto, 1=@, 2=!
+	KidokuType      int      // 0=auto, 1=@, 2=!
 }
 
 // DefaultOptions returns sensible defaults.
@@ -423,12 +533,19 @@ func (o *Output) Generate(opts GenerateOptions) ([]byte, error) {
 }
 
 // buildRealLive creates a RealLive format .TXT (SEEN) file.
-// Header: 0x1d0 bytes, then kidoku table, then optional metadata, then bytecode.
+// Header: 0x1d0 bytes, then kidoku table, then dramatis personae, then
+// optional metadata, then bytecode. Each dramatis entry is its length
+// (including the terminating NUL) followed by the NUL-terminated name.
 func buildRealLive(bytecode []byte, bytecodeLen, compressedLen int, entrypoints []int, kidokuTable []int, opts GenerateOptions) ([]byte, error) {
 	metadataLen := len(opts.Metadata)
 	kidokuBytes := len(kidokuTable) * 4
 	dramOff := 0x1d0 + kidokuBytes
-	bcOff := dramOff + metadataLen
+	dramLen := 0
+	for _, name := range opts.Dramatis {
+		dramLen += 4 + len(name) + 1
+	}
+	metaOff := dramOff + dramLen
+	bcOff := metaOff + metadataLen
 	fileLen := bcOff + compressedLen
 
 	file := make([]byte, fileLen)
@@ -444,8 +561,8 @@ func buildRealLive(bytecode []byte, bytecodeLen, compressedLen int, entrypoints
 	putInt32(file, 0x0c, len(kidokuTable))       // kidoku count
 	putInt32(file, 0x10, kidokuBytes)            // kidoku table size
 	putInt32(file, 0x14, dramOff)                // dramatis offset
-	putInt32(file, 0x18, 0)                      // dramatis count
-	putInt32(file, 0x1c, 0)                      // dramatis size
+	putInt32(file, 0x18, len(opts.Dramatis))     // dramatis count
+	putInt32(file, 0x1c, dramLen)                // dramatis size
 	putInt32(file, 0x20, bcOff)                  // bytecode offset
 	putInt32(file, 0x24, bytecodeLen)            // bytecode length
 	putInt32(file, 0x28, compressedLen)          // compressed length
@@ -460,9 +577,17 @@ func buildRealLive(bytecode []byte, bytecodeLen, compressedLen int, entrypoints
 		putInt32(file, 0x1d0+i*4, v)
 	}
 
+	// Dramatis personae
+	pos := dramOff
+	for _, name := range opts.Dramatis {
+		putInt32(file, pos, len(name)+1)
+		copy(file[pos+4:], name)
+		pos += 4 + len(name) + 1
+	}
+
 	// Metadata
 	if metadataLen > 0 {
-		copy(file[dramOff:], opts.Metadata)
+		copy(file[metaOff:], opts.Metadata)
 	}
 
 	// Bytecode
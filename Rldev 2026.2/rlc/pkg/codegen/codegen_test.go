@@ -4,8 +4,9 @@ import (
 	"encoding/binary"
 	"testing"
 
+	"github.com/yoremi/rldev-go/pkg/encoding"
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 )
 
 func TestOpCodes(t *testing.T) {
@@ -266,3 +267,46 @@ func TestGenerateKidokuTable(t *testing.T) {
 		t.Errorf("kidoku count: got %d, want 3", kidokuCount)
 	}
 }
+
+func TestEncodeExpr(t *testing.T) {
+	b := EncodeExpr(ast.IntVar{Bank: 0x0b, Index: ast.IntLit{Val: 5}})
+	want := "$\x0b[$\xff\x05\x00\x00\x00]"
+	if string(b) != want { t.Errorf("got %q, want %q", b, want) }
+}
+
+func TestEncodeString(t *testing.T) {
+	if got := string(EncodeString([]byte("bgm01"))); got != "bgm01" { t.Errorf("bare: %q", got) }
+	if got := string(EncodeString([]byte("01"))); got != "\"01\"" { t.Errorf("digit: %q", got) }
+	if got := string(EncodeString([]byte("a b"))); got != "\"a b\"" { t.Errorf("space: %q", got) }
+	if got := string(EncodeString([]byte(`say "hi"`))); got != `"say \"hi\""` { t.Errorf("quote: %q", got) }
+	if got := string(EncodeString(nil)); got != "\"\"" { t.Errorf("empty: %q", got) }
+}
+
+func TestEncodeText(t *testing.T) {
+	// 【A】 in Shift_JIS: the trail byte 0x41 of "\x82\x41" must not start an ASCII run.
+	text := []byte("\x81\x79\x82\x41\x81\x7aHi, you")
+	want := "\x81\x79\x82\x41\x81\x7a\"Hi, you\""
+	if got := string(EncodeText(text, encoding.ShiftJIS)); got != want { t.Errorf("got %q, want %q", got, want) }
+	if got := string(EncodeText([]byte("Hello"), encoding.ShiftJIS)); got != "Hello" { t.Errorf("bare: %q", got) }
+	// A half-width katakana is a single byte: "ｱa" keeps the 'a' in an ASCII run.
+	if got := string(EncodeText([]byte("\xb1ab"), encoding.ShiftJIS)); got != "\xb1ab" { t.Errorf("kana: %q", got) }
+	// 丂A in GBK: the trail byte 0x40 belongs to the first character.
+	if got := string(EncodeText([]byte("\x81\x40A"), encoding.GBK)); got != "\x81\x40A" { t.Errorf("GBK: %q", got) }
+	if got := string(EncodeText([]byte("\xd6\xd0x y"), encoding.GBK)); got != "\xd6\xd0\"x y\"" { t.Errorf("GBK run: %q", got) }
+}
+
+func TestGenerateDramatis(t *testing.T) {
+	o := NewOutput()
+	o.AddCode(ast.Nowhere, []byte{0x00})
+	opts := DefaultOptions()
+	opts.Dramatis = [][]byte{[]byte("Riki"), []byte("Rin")}
+	opts.Metadata = []byte("META")
+	data, err := o.Generate(opts)
+	if err != nil { t.Fatal(err) }
+	off := binary.LittleEndian.Uint32(data[0x14:])
+	if n := binary.LittleEndian.Uint32(data[0x18:]); n != 2 { t.Errorf("dramatis count %d", n) }
+	if n := binary.LittleEndian.Uint32(data[0x1c:]); n != 4+5+4+4 { t.Errorf("dramatis size %d", n) }
+	if string(data[off:off+17]) != "\x05\x00\x00\x00Riki\x00\x04\x00\x00\x00Rin\x00" { t.Errorf("dramatis: %q", data[off:off+17]) }
+	if string(data[off+17:off+21]) != "META" { t.Error("metadata should follow the dramatis personae") }
+	if bc := binary.LittleEndian.Uint32(data[0x20:]); bc != off+21 { t.Errorf("bytecode offset %#x", bc) }
+}
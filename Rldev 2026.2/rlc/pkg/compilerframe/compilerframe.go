@@ -7,12 +7,13 @@
 // and wires meta's CompileStatements callback so other packages can recurse
 // into the compiler without creating import cycles.
 //
-// # Status: SKELETON
+// # Status
 //
 // The public API, dependency wiring, and dispatch structure are in place.
-// The dispatch cases for most statement types are TODOs, documented below
-// with the OCaml line numbers to port from. Control-flow structures
-// (if/while/for/do-while) and switch are the main remaining work.
+// Control flow (if/while/for/repeat), assignments, labels, variable
+// declarations, KFN function calls and text output (static, dynamic
+// lineation and rlBabel) compile to bytecode. The remaining TODOs are documented below with
+// the OCaml line numbers to port from.
 //
 // # Architecture
 //
@@ -40,24 +41,35 @@
 //	       +-- LoadFile -> recursive parse (get_ast_of_file)
 //	   |
 //	   v
-//	Output.Build -> .seen bytecode
+//	Output.Generate -> SEEN bytecode
 package compilerframe
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/yoremi/rldev-go/pkg/config"
+	"github.com/yoremi/rldev-go/pkg/encoding"
+	"github.com/yoremi/rldev-go/pkg/kfn"
+	"github.com/yoremi/rldev-go/pkg/metadata"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
 	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
 	"github.com/yoremi/rldev-go/rlc/pkg/directive"
 	"github.com/yoremi/rldev-go/rlc/pkg/expr"
 	fn "github.com/yoremi/rldev-go/rlc/pkg/function"
 	gotojmp "github.com/yoremi/rldev-go/rlc/pkg/goto"
 	"github.com/yoremi/rldev-go/rlc/pkg/ini"
 	"github.com/yoremi/rldev-go/rlc/pkg/intrinsic"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/memory"
 	"github.com/yoremi/rldev-go/rlc/pkg/meta"
+	"github.com/yoremi/rldev-go/rlc/pkg/parser"
+	rlbabel "github.com/yoremi/rldev-go/rlc/pkg/rlBabel"
 	"github.com/yoremi/rldev-go/rlc/pkg/sel"
+	"github.com/yoremi/rldev-go/rlc/pkg/textout"
 )
 
 // Compiler holds all the state needed to compile a Kepago program.
@@ -73,12 +85,60 @@ type Compiler struct {
 	Ini       *ini.Table
 	State     *meta.State
 
+	// Target engine and version; #target and #version write through to
+	// these via the directive compiler.
+	Target  kfn.Target
+	Version kfn.Version
+
+	// Encoding is the output encoding for string literals (CP932 by default).
+	Encoding encoding.Type
+
+	// SourceEncoding is the encoding of .org/.kh sources on disk.
+	SourceEncoding encoding.Type
+
+	// IncludeDirs are searched by #load after the including file's
+	// directory and before the RLdev library directory.
+	IncludeDirs []string
+
+	// Parsed source files by path, and the chain of files being loaded
+	// (used for cycle detection).
+	files     map[string]*ast.SourceFile
+	loadStack []loadFrame
+
+	// Paths #load looked for and did not find, before the file it loaded
+	missed map[string]bool
+
 	// Runtime control flow stacks (populated by while/for/do-while/switch)
 	breakStack    []string
 	continueStack []string
 
+	// OptLevel is the -O level. Above 0, conditional jumps on constant
+	// conditions are folded as they are compiled; the IR passes proper are
+	// run by the optimize package.
+	OptLevel int
+
+	// StartLine and EndLine (--start-line/--end-line), when positive,
+	// restrict the main file to the statements in that window; see window.
+	// FlagLabels (--flag-labels) adds a kidoku marker at every source label.
+	StartLine  int
+	EndLine    int
+	FlagLabels bool
+
+	// RuntimeTrace (--runtime-trace=N) logs the source position of each
+	// line at 1, and also the values assigned at 2, through the engine's
+	// debug output. ArrayBounds (--array-bounds) checks variable indices
+	// at runtime. See trace and checkBounds.
+	RuntimeTrace int
+	ArrayBounds  bool
+	traceLoc     ast.Loc
+	instrumenting bool
+	noDebugFunc  bool
+
+	// Nesting depth of #inline expansions, to catch runaway recursion.
+	inlineDepth int
+
 	Errors   []error
-	Warnings []string
+	Warnings []*diag.Diagnostic
 
 	Verbose int
 }
@@ -93,20 +153,29 @@ func New(reg *kfn.Registry, iniTable *ini.Table) *Compiler {
 	state := meta.NewState()
 
 	c := &Compiler{
-		Mem:    mem,
-		Out:    out,
-		Norm:   norm,
-		Intrin: intrinsic.New(mem),
-		Reg:    reg,
-		Ini:    iniTable,
-		State:  state,
+		Mem:      mem,
+		Out:      out,
+		Norm:     norm,
+		Intrin:   intrinsic.New(mem),
+		Reg:      reg,
+		Ini:      iniTable,
+		State:    state,
+		Target:   kfn.TargetRealLive,
+		Version:  kfn.Version{1, 2, 7, 0},
+		Encoding: encoding.ShiftJIS,
+
+		SourceEncoding: encoding.ShiftJIS,
+		files:          make(map[string]*ast.SourceFile),
+		missed:         make(map[string]bool),
 	}
 	c.Directive = &directive.Compiler{
-		Mem:    mem,
-		Norm:   norm,
-		Output: out,
-		Ini:    iniTable,
-		State:  state,
+		Mem:     mem,
+		Norm:    norm,
+		Output:  out,
+		Ini:     iniTable,
+		State:   state,
+		Target:  &c.Target,
+		Version: &c.Version,
 	}
 
 	// Wire meta's Parse callback back to our Parse method. This corresponds
@@ -121,11 +190,66 @@ func New(reg *kfn.Registry, iniTable *ini.Table) *Compiler {
 // Compile compiles a full program and merges any errors/warnings from
 // sub-compilers. This is the main entry point.
 func (c *Compiler) Compile(stmts []ast.Stmt) {
+	c.syncTarget()
 	c.Parse(stmts)
 	if c.Directive != nil {
 		c.Errors = append(c.Errors, c.Directive.Errors...)
 		c.Warnings = append(c.Warnings, c.Directive.Warnings...)
 	}
+	c.Errors = append(c.Errors, c.Norm.Errors...)
+}
+
+// syncTarget makes function lookups follow the target and version set on
+// the command line or by #target and #version.
+func (c *Compiler) syncTarget() {
+	if c.Reg != nil {
+		c.Reg.Target, c.Reg.Version = c.Target, c.Version
+	}
+}
+
+// TextTransform returns the text transformation recorded in the output
+// metadata: Western when rlBabel handles text output, otherwise the one
+// implied by the output encoding.
+func (c *Compiler) TextTransform() metadata.TextTransform {
+	switch {
+	case c.Mem.Defined("__RLBABEL_KH__"):
+		return metadata.TransformWestern
+	case c.Encoding == encoding.GBK:
+		return metadata.TransformChinese
+	case c.Encoding == encoding.EUC_KR:
+		return metadata.TransformKorean
+	}
+	return metadata.TransformNone
+}
+
+// CompileFile reads, parses and compiles a complete source file. Read and
+// syntax errors are returned; compile errors are collected in c.Errors.
+// Corresponds to compile (line 1107) in compilerFrame.ml.
+func (c *Compiler) CompileFile(path string) error {
+	sf, err := c.readSource(path)
+	if err != nil {
+		return err
+	}
+	stmts := sf.Stmts
+	if c.StartLine > 0 || c.EndLine > 0 {
+		stmts = c.window(stmts)
+	}
+	c.loadStack = append(c.loadStack, loadFrame{path: cleanPath(path), loc: ast.Nowhere})
+	c.Compile(stmts)
+	c.loadStack = c.loadStack[:len(c.loadStack)-1]
+	return nil
+}
+
+// CompileSource compiles src, the UTF-8 text of the file at path, in place
+// of the file on disk. The language server uses it to check the unsaved
+// contents of an editor buffer.
+func (c *Compiler) CompileSource(path string, src []byte) error {
+	sf, err := parser.ParseFile(src, path)
+	if err != nil {
+		return err
+	}
+	c.files[cleanPath(path)] = sf
+	return c.CompileFile(path)
 }
 
 // Parse processes a batch of statements. Called recursively from
@@ -139,17 +263,18 @@ func (c *Compiler) Parse(stmts []ast.Stmt) {
 // ParseElt dispatches a single statement.
 // Corresponds to parse_elt (line 682) in compilerFrame.ml.
 func (c *Compiler) ParseElt(stmt ast.Stmt) {
+	c.trace(stmt)
 	// 1. Structures: if/while/for/repeat/case/block/seq/hiding
 	switch stmt.(type) {
 	case ast.IfStmt, ast.WhileStmt, ast.ForStmt, ast.RepeatStmt,
-		ast.CaseStmt, ast.BlockStmt, ast.SeqStmt, ast.HidingStmt:
+		ast.CaseStmt, ast.BlockStmt, ast.SeqStmt, ast.HidingStmt,
+		ast.DIfStmt, ast.DForStmt:
 		c.parseStruct(stmt)
 		return
 	}
-	// 2. Implicit return = textout (TODO: full textout dispatch)
+	// 2. Implicit return = textout
 	if ret, ok := stmt.(ast.ReturnStmt); ok && !ret.Explicit {
-		// TODO: handleTextout — dispatch to textout/rlbabel based on __DynamicLineation__
-		_ = ret
+		c.handleTextout(ret)
 		return
 	}
 	// 3. Everything else: normalize then dispatch via ParseNormElt
@@ -166,20 +291,20 @@ func (c *Compiler) ParseNormElt(stmt ast.Stmt) {
 		// return _ == nop at the normalized level
 
 	case ast.DeclStmt:
-		// Variable allocation — TODO: Variables.allocate(s)
-		_ = s
+		c.declare(s)
 
 	// --- Directives ---
 	case ast.DirectiveStmt, ast.DTargetStmt, ast.DefineStmt, ast.DConstStmt,
 		ast.DInlineStmt, ast.DUndefStmt, ast.DSetStmt, ast.DVersionStmt:
 		c.Directive.Compile(s)
+		c.syncTarget()
 
 	case ast.HaltStmt:
-		c.Out.AddCode(s.Loc, []byte{0x00})
+		c.Out.AddExit(s.Loc, []byte{0x00})
 
 	case ast.BreakStmt:
 		if len(c.breakStack) == 0 {
-			c.error(s.Loc, "break outside breakable structure")
+			c.error(s.Loc, diag.ControlFlow, "break outside breakable structure")
 			return
 		}
 		lbl := ast.Label{Ident: c.breakStack[len(c.breakStack)-1]}
@@ -187,14 +312,20 @@ func (c *Compiler) ParseNormElt(stmt ast.Stmt) {
 
 	case ast.ContinueStmt:
 		if len(c.continueStack) == 0 {
-			c.error(s.Loc, "continue outside loop")
+			c.error(s.Loc, diag.ControlFlow, "continue outside loop")
 			return
 		}
 		lbl := ast.Label{Ident: c.continueStack[len(c.continueStack)-1]}
 		c.ParseElt(meta.MakeGoto(lbl))
 
 	case ast.LabelStmt:
-		c.Out.AddLabel(s.Label.Ident, s.Loc)
+		c.traceLoc = ast.Nowhere
+		if err := c.Out.AddLabel(s.Label.Ident, s.Loc); err != nil {
+			c.fail(s.Loc, diag.DuplicateLabel, err)
+		}
+		if c.FlagLabels && !meta.IsUniqueLabel(s.Label.Ident) {
+			c.Out.AddKidoku(s.Loc, s.Loc.Line)
+		}
 
 	case ast.GotoOnStmt:
 		gotojmp.EmitGotoOn(c.Out, s.Loc, c.Reg, s.Ident, s.Expr, s.Labels)
@@ -209,68 +340,58 @@ func (c *Compiler) ParseNormElt(stmt ast.Stmt) {
 		gotojmp.EmitGotoCase(c.Out, s.Loc, c.Reg, s.Ident, s.Expr, arms)
 
 	case ast.AssignStmt:
-		c.Out.EmitAssignment(s.Loc, s.Dest, s.Op, s.Expr)
+		dest := c.normExpr(s.Dest)
+		if fc, ok := s.Expr.(ast.FuncCall); ok && s.Op == ast.AssignSet && !c.Intrin.IsBuiltin(fc.Ident) {
+			c.compileFuncCall(ast.FuncCallStmt{
+				Loc: s.Loc, Dest: dest, Ident: fc.Ident, Params: fc.Params, Label: fc.Label,
+			})
+			return
+		}
+		rhs := c.normExpr(c.Norm.NormalizeAssignment(dest, s.Op, s.Expr))
+		if !c.checkEncodable(s.Loc, dest) || !c.checkEncodable(s.Loc, rhs) {
+			return
+		}
+		c.checkBounds(s.Loc, dest, rhs)
+		c.Out.EmitAssignment(s.Loc, dest, s.Op, rhs)
+		c.traceValue(s.Loc, dest)
+
+	case ast.VarOrFuncStmt:
+		// A bare identifier is a parameterless function call.
+		c.compileFuncCall(ast.FuncCallStmt{Loc: s.Loc, Ident: s.Ident})
 
 	case ast.FuncCallStmt:
 		if c.Intrin.IsBuiltin(s.Ident) {
 			// Intrinsic: evaluate as code and recurse
 			result, err := c.Intrin.EvalAsExpr(s.Ident, s.Loc, s.Params)
 			if err != nil {
-				c.error(s.Loc, err.Error())
+				c.fail(s.Loc, diag.Expr, err)
 			}
 			_ = result
 			// TODO: wrap result as a statement and recurse via ParseElt
 		} else {
-			// Regular function call via Function.compile
-			fd, err := fn.LookupFuncDef(c.Reg, s.Ident, s.Params, false)
-			if err != nil {
-				c.error(s.Loc, err.Error())
-				return
-			}
-			overload, _ := fn.ChooseOverloadByParams(fd.Prototypes, s.Params)
-			// Build assembled params (simplified)
-			asmParams := make([]fn.AsmParam, 0, len(s.Params))
-			for _, p := range s.Params {
-				if _, ok := p.(ast.SimpleParam); ok {
-					asmParams = append(asmParams, fn.AsmParam{
-						Kind: fn.AsmUnknown,
-						Code: "", // TODO: c.Out.EncodeExpr(sp.Expr)
-					})
-				}
-			}
-			result, err := fn.Assemble(fd, asmParams, overload, "")
-			if err != nil {
-				c.error(s.Loc, err.Error())
-				return
-			}
-			c.Out.AddCode(s.Loc, result.Code)
-			if result.Append != nil {
-				c.Out.AddCode(s.Loc, result.Append)
-			}
-			if s.Label != nil {
-				c.Out.AddLabelRef(s.Label.Ident, s.Label.Loc)
-			}
+			c.compileFuncCall(s)
 		}
 
 	case ast.SelectStmt:
 		// TODO: VWF dispatch based on __DynamicLineation__ / __RLBABEL_KH__
 		params := make([]sel.SelParam, len(s.Params))
 		for i, p := range s.Params {
-			if ap, ok := p.(ast.AlwaysSelParam); ok {
-				params[i] = sel.SelParam{Kind: sel.SelAlways, Loc: ap.Loc, Expr: ap.Expr}
+			switch sp := p.(type) {
+			case ast.AlwaysSelParam:
+				params[i] = sel.SelParam{Kind: sel.SelAlways, Loc: sp.Loc, Expr: c.normExpr(sp.Expr)}
+			case ast.CondSelParam:
+				params[i] = sel.SelParam{Kind: sel.SelSpecial, Loc: sp.Loc, Expr: c.normExpr(sp.Expr), Conds: c.selConds(sp.Conds)}
 			}
 		}
 		if err := sel.EmitSelect(c.Out, s.Loc, s.Opcode, s.Window, s.Dest, params); err != nil {
-			c.error(s.Loc, err.Error())
+			c.fail(s.Loc, diag.Expr, err)
 		}
 
 	case ast.UnknownOpStmt:
-		// TODO: Function.compile_unknown
-		c.warning(s.Loc, "unknown opcode: TODO")
+		c.compileUnknownOp(s)
 
 	case ast.LoadFileStmt:
-		// TODO: recursive file loading
-		c.warning(s.Loc, "#load: TODO — recursive file loading")
+		c.loadFile(s)
 
 	case ast.RawCodeStmt:
 		for _, elt := range s.Elts {
@@ -293,13 +414,1263 @@ func (c *Compiler) ParseNormElt(stmt ast.Stmt) {
 					}
 					c.Out.AddCode(s.Loc, out)
 				} else {
-					c.error(s.Loc, "unsupported raw ident")
+					c.error(s.Loc, diag.Internal, "unsupported raw ident")
+				}
+			}
+		}
+
+	default:
+		c.warning(ast.Nowhere, diag.Unhandled, fmt.Sprintf("unhandled normalized stmt: %T", stmt))
+	}
+}
+
+// ============================================================
+// Function calls (Function.compile, function.ml)
+// ============================================================
+
+// compileFuncCall normalizes the parameters of a KFN function call,
+// selects an overload, serializes the parameters and emits the opcode.
+func (c *Compiler) compileFuncCall(s ast.FuncCallStmt) {
+	if sym, ok := c.Mem.Get(s.Ident); ok && sym.Kind == memory.KindInline {
+		if s.Dest != nil {
+			c.error(s.Loc, diag.ReturnValue, fmt.Sprintf("inline '%s' does not return a value", s.Ident))
+			return
+		}
+		c.expandInline(s)
+		return
+	}
+	params := c.Norm.NormalizeParams(s.Params)
+	fd, err := fn.LookupFuncDef(c.Reg, s.Ident, params, false)
+	if err != nil {
+		c.fail(s.Loc, diag.Undefined, err)
+		return
+	}
+	overload, err := fn.ChooseOverloadByParams(fd.Prototypes, params)
+	if err != nil {
+		c.error(s.Loc, diag.ParamCount, fmt.Sprintf("%s: %v", s.Ident, err))
+		return
+	}
+	if err := fn.CheckParams(fd, overload, params); err != nil {
+		c.fail(s.Loc, diag.ParamType, err)
+		return
+	}
+	if c.OptLevel > 0 && c.foldCondJump(s, fd, params) {
+		return
+	}
+	asmParams := make([]fn.AsmParam, 0, len(params))
+	for _, p := range params {
+		ap, ok := c.assembleParam(p)
+		if !ok {
+			return
+		}
+		asmParams = append(asmParams, ap)
+	}
+	returnVal := ""
+	var dest ast.Expr
+	if s.Dest != nil {
+		dest = c.normExpr(s.Dest)
+		if !c.checkEncodable(s.Loc, dest) {
+			return
+		}
+		returnVal = string(codegen.EncodeExpr(dest))
+	}
+	result, err := fn.Assemble(fd, asmParams, overload, returnVal)
+	if err != nil {
+		c.fail(s.Loc, diag.ReturnValue, err)
+		return
+	}
+	if c.ArrayBounds && !c.instrumenting {
+		exprs := []ast.Expr{dest}
+		for _, p := range params {
+			if sp, ok := p.(ast.SimpleParam); ok {
+				exprs = append(exprs, c.normExpr(sp.Expr))
+			}
+		}
+		c.checkBounds(s.Loc, exprs...)
+	}
+	switch {
+	case s.Label != nil && fd.HasFlag(kfn.FlagIsGoto) && !fd.HasFlag(kfn.FlagIsCall):
+		c.Out.AddJump(s.Loc, result.Code, *s.Label, fd.HasFlag(kfn.FlagIsCond))
+	case s.Label == nil && fd.HasFlag(kfn.FlagIsRet) && !fd.HasFlag(kfn.FlagIsCall):
+		c.Out.AddExit(s.Loc, result.Code)
+	default:
+		c.Out.AddCode(s.Loc, result.Code)
+		if s.Label != nil {
+			c.Out.AddLabelRef(s.Label.Ident, s.Label.Loc)
+		}
+	}
+	if result.Append != nil {
+		c.Out.AddCode(s.Loc, result.Append)
+	}
+	if dest != nil {
+		c.traceValue(s.Loc, dest)
+	}
+}
+
+// foldCondJump compiles a conditional goto/gosub whose condition folded to
+// a constant (NormalizeParams runs ConstFold) as either nothing or an
+// unconditional jump. Only done at -O1 and above, so that -O0 output
+// matches the naive emitter.
+func (c *Compiler) foldCondJump(s ast.FuncCallStmt, fd *kfn.FuncDef, params []ast.Param) bool {
+	if !fd.HasFlag(kfn.FlagIsCond) || s.Label == nil || len(params) != 1 {
+		return false
+	}
+	sp, ok := params[0].(ast.SimpleParam)
+	if !ok {
+		return false
+	}
+	handled, jump, ident := gotojmp.SpecialCase(sp.Expr, fd.HasFlag(kfn.FlagIsNeg), fd.HasFlag(kfn.FlagIsCall))
+	if handled && jump {
+		c.compileFuncCall(ast.FuncCallStmt{Loc: s.Loc, Ident: ident, Label: s.Label})
+	}
+	return handled
+}
+
+// compileUnknownOp assembles op<type:module:code, overload>(...) for
+// opcodes that have no KFN definition (Function.compile_unknown). The
+// prototype is inferred from the argument expressions; a -> target other
+// than store is assigned from the store register after the call.
+func (c *Compiler) compileUnknownOp(s ast.UnknownOpStmt) {
+	module := s.OpModule
+	if s.OpIdent != "" {
+		m, ok := c.Reg.Modules[s.OpIdent]
+		if !ok {
+			c.error(s.Loc, diag.UnknownModule, fmt.Sprintf("unknown module '%s'", s.OpIdent))
+			return
+		}
+		module = m
+	}
+	params := c.Norm.NormalizeParams(s.Params)
+	asmParams := make([]fn.AsmParam, 0, len(params))
+	proto := kfn.Prototype{Defined: true}
+	for _, p := range params {
+		ap, ok := c.assembleParam(p)
+		if !ok {
+			return
+		}
+		asmParams = append(asmParams, ap)
+		pt := kfn.PAny
+		if sp, ok := p.(ast.SimpleParam); ok {
+			switch fn.ClassifyExpr(sp.Expr) {
+			case fn.ETInt:
+				pt = kfn.PIntV
+			case fn.ETStr:
+				pt = kfn.PStrV
+			case fn.ETLiteral:
+				pt = kfn.PStrC
+			}
+		}
+		proto.Params = append(proto.Params, kfn.Parameter{Type: pt})
+	}
+	fd := &kfn.FuncDef{
+		Ident:      kfn.IdentOfOpcode(s.OpType, module, s.OpCode, s.Overload),
+		Flags:      []kfn.FuncFlag{kfn.FlagPushStore},
+		OpType:     s.OpType,
+		OpModule:   module,
+		OpCode:     s.OpCode,
+		Prototypes: make([]kfn.Prototype, s.Overload+1),
+	}
+	fd.Prototypes[s.Overload] = proto
+	returnVal := ""
+	if s.Dest != nil {
+		dest := c.normExpr(s.Dest)
+		if !c.checkEncodable(s.Loc, dest) {
+			return
+		}
+		returnVal = string(codegen.EncodeExpr(dest))
+	}
+	result, err := fn.Assemble(fd, asmParams, s.Overload, returnVal)
+	if err != nil {
+		c.fail(s.Loc, diag.ReturnValue, err)
+		return
+	}
+	c.Out.AddCode(s.Loc, result.Code)
+	if result.Append != nil {
+		c.Out.AddCode(s.Loc, result.Append)
+	}
+}
+
+// assembleParam serializes one normalized parameter. Errors are recorded
+// on the compiler; the boolean result reports success.
+func (c *Compiler) assembleParam(p ast.Param) (fn.AsmParam, bool) {
+	switch x := p.(type) {
+	case ast.SimpleParam:
+		return c.assembleExpr(x.Loc, x.Expr)
+	case ast.ComplexParam:
+		items := make([]fn.AsmParam, 0, len(x.Exprs))
+		for _, e := range x.Exprs {
+			ap, ok := c.assembleExpr(x.Loc, e)
+			if !ok {
+				return fn.AsmParam{}, false
+			}
+			items = append(items, ap)
+		}
+		return fn.AsmParam{Kind: fn.AsmList, Items: items}, true
+	case ast.SpecialParam:
+		items := make([]fn.AsmParam, 0, len(x.Exprs))
+		for _, e := range x.Exprs {
+			ap, ok := c.assembleExpr(x.Loc, e)
+			if !ok {
+				return fn.AsmParam{}, false
+			}
+			items = append(items, ap)
+		}
+		return fn.AsmParam{Kind: fn.AsmSpecial, SpecID: x.Tag, Items: items}, true
+	}
+	c.error(ast.Nowhere, diag.Internal, fmt.Sprintf("unsupported parameter: %T", p))
+	return fn.AsmParam{}, false
+}
+
+func (c *Compiler) assembleExpr(loc ast.Loc, e ast.Expr) (fn.AsmParam, bool) {
+	e = c.normExpr(e)
+	if !c.checkEncodable(loc, e) {
+		return fn.AsmParam{}, false
+	}
+	code := string(codegen.EncodeExpr(e))
+	switch fn.ClassifyExpr(e) {
+	case fn.ETLiteral:
+		return fn.AsmParam{Kind: fn.AsmLiteral, Code: code}, true
+	case fn.ETStr:
+		return fn.AsmParam{Kind: fn.AsmString, Code: code}, true
+	}
+	return fn.AsmParam{Kind: fn.AsmInteger, Code: code}, true
+}
+
+// normExpr normalizes an expression for code generation and converts any
+// string literal it contains to the output encoding.
+func (c *Compiler) normExpr(e ast.Expr) ast.Expr {
+	e = c.Norm.NormalizeExpr(c.expandIntrinsics(e))
+	if lit, ok := e.(ast.StrLit); ok {
+		var text string
+		for _, t := range lit.Tokens {
+			switch tt := t.(type) {
+			case ast.TextToken:
+				text += tt.Text
+			case ast.SpaceToken:
+				for i := 0; i < tt.Count; i++ {
+					text += " "
+				}
+			case ast.DQuoteToken:
+				text += "\""
+			case ast.HyphenToken:
+				text += "-"
+			case ast.AsteriskToken:
+				text += "＊"
+			case ast.PercentToken:
+				text += "％"
+			case ast.LLenticToken:
+				text += "【"
+			case ast.RLenticToken:
+				text += "】"
+			default:
+				c.error(lit.Loc, diag.Text, "control codes are only allowed in text output")
+			}
+		}
+		return ast.StrLit{Loc: lit.Loc, Tokens: []ast.StrToken{
+			ast.TextToken{Loc: lit.Loc, Text: c.encodeText(lit.Loc, text)},
+		}}
+	}
+	return e
+}
+
+// selConds converts the conditions of a select option for sel.EmitSelect.
+func (c *Compiler) selConds(conds []ast.SelCond) []sel.SelCond {
+	out := make([]sel.SelCond, len(conds))
+	for i, sc := range conds {
+		cond := sel.SelCond{Kind: sel.CondFlag, Effect: sc.Ident}
+		if sc.Arg != nil {
+			cond.Kind, cond.Expr = sel.CondNonCond, c.normExpr(sc.Arg)
+		}
+		if sc.Cond != nil {
+			cond.Kind, cond.Cond = sel.CondCond, c.normExpr(sc.Cond)
+		}
+		out[i] = cond
+	}
+	return out
+}
+
+// encodeText converts UTF-8 source text to the output encoding. Characters
+// the encoding lacks are reported at loc, never replaced.
+func (c *Compiler) encodeText(loc ast.Loc, text string) string {
+	b, err := encoding.FromUTF8(text, c.Encoding)
+	if err != nil {
+		c.fail(loc, diag.Encoding, err)
+		return text
+	}
+	return string(b)
+}
+
+// checkEncodable reports expressions that survived normalization but have
+// no bytecode representation, such as undeclared identifiers.
+func (c *Compiler) checkEncodable(loc ast.Loc, e ast.Expr) bool {
+	switch x := e.(type) {
+	case ast.IntLit, ast.StoreRef, ast.StrLit:
+		return true
+	case ast.IntVar:
+		return c.checkEncodable(loc, x.Index)
+	case ast.StrVar:
+		return c.checkEncodable(loc, x.Index)
+	case ast.BinOp:
+		return c.checkEncodable(loc, x.LHS) && c.checkEncodable(loc, x.RHS)
+	case ast.CmpExpr:
+		return c.checkEncodable(loc, x.LHS) && c.checkEncodable(loc, x.RHS)
+	case ast.ChainExpr:
+		return c.checkEncodable(loc, x.LHS) && c.checkEncodable(loc, x.RHS)
+	case ast.UnaryExpr:
+		return c.checkEncodable(loc, x.Val)
+	case ast.ParenExpr:
+		return c.checkEncodable(loc, x.Expr)
+	case ast.VarOrFunc:
+		c.error(x.Loc, diag.Undefined, fmt.Sprintf("undeclared identifier '%s'", x.Ident))
+	case ast.Deref:
+		c.error(x.Loc, diag.Undefined, fmt.Sprintf("undeclared identifier '%s'", x.Ident))
+	case ast.FuncCall:
+		c.error(x.Loc, diag.Expr, fmt.Sprintf("function '%s' cannot be used in an expression here", x.Ident))
+	default:
+		c.error(loc, diag.Internal, fmt.Sprintf("expression of type %T cannot be compiled", e))
+	}
+	return false
+}
+
+// ============================================================
+// Inline expansion (#inline / #sinline calls)
+// ============================================================
+
+// maxInlineDepth bounds nested #inline expansions.
+const maxInlineDepth = 100
+
+// expandInline compiles a call to an #inline definition by expanding its
+// body in a fresh scope. Overloads are chosen by argument count as for KFN
+// functions. Arguments are normalized in the caller's scope, so names in
+// the body cannot capture them: constants and plain variables are bound as
+// macros, anything else is evaluated once into a temporary. Omitted
+// optional parameters are hidden, so defined?() reports them as absent.
+// The parameters and temporaries go out of scope after the expansion;
+// what the body of an #inline declares stays in the caller's scope, while
+// the body of an #sinline has a scope of its own.
+func (c *Compiler) expandInline(s ast.FuncCallStmt) {
+	var defs []memory.Symbol
+	for _, sym := range c.Mem.GetAll(s.Ident) {
+		if sym.Kind != memory.KindInline {
+			break
+		}
+		defs = append(defs, sym)
+	}
+	fd := &kfn.FuncDef{Ident: s.Ident}
+	for _, d := range defs {
+		proto := kfn.Prototype{Defined: true}
+		for _, p := range d.InlineParams {
+			par := kfn.Parameter{Type: kfn.PAny}
+			if p.Optional || p.Default != nil {
+				par.Flags = []kfn.ParamFlag{kfn.FOptional}
+			}
+			proto.Params = append(proto.Params, par)
+		}
+		fd.Prototypes = append(fd.Prototypes, proto)
+	}
+	idx, err := fn.ChooseOverloadByCount(fd, len(s.Params))
+	if err != nil {
+		c.fail(s.Loc, diag.ParamCount, err)
+		return
+	}
+	def := defs[idx]
+	if lens := fn.GetPrototypeLengths(fd)[idx]; len(s.Params) < lens.Min || len(s.Params) > lens.Max {
+		c.error(s.Loc, diag.ParamCount, fmt.Sprintf("'%s' expects %d to %d parameters, got %d", s.Ident, lens.Min, lens.Max, len(s.Params)))
+		return
+	}
+	if c.inlineDepth >= maxInlineDepth {
+		c.error(s.Loc, diag.Inline, fmt.Sprintf("inline expansion of '%s' nested too deeply", s.Ident))
+		return
+	}
+
+	args := make([]ast.Expr, len(def.InlineParams))
+	for i, p := range def.InlineParams {
+		var e ast.Expr
+		if i < len(s.Params) {
+			sp, ok := s.Params[i].(ast.SimpleParam)
+			if !ok {
+				c.error(s.Loc, diag.Inline, fmt.Sprintf("parameter %d of inline '%s' must be an expression", i+1, s.Ident))
+				return
+			}
+			e = sp.Expr
+		} else if p.Default != nil {
+			e = p.Default
+		} else {
+			continue
+		}
+		args[i] = c.Norm.NormalizeExpr(c.expandIntrinsics(e))
+	}
+
+	c.inlineDepth++
+	c.Mem.OpenScope()
+	var hidden []memory.Hidden
+	for i, p := range def.InlineParams {
+		e := args[i]
+		if e == nil {
+			hidden = append(hidden, c.Mem.Hide(p.Ident))
+			continue
+		}
+		if !inlineArgIsSimple(e) {
+			e = c.inlineTemp(s.Loc, e)
+		}
+		c.Mem.Define(p.Ident, memory.Symbol{Kind: memory.KindMacro, Expr: e})
+	}
+	if def.InlineScoped {
+		c.Mem.OpenScope()
+		c.ParseElt(def.InlineBody)
+		c.Mem.CloseScope()
+		c.Mem.CloseScope()
+	} else {
+		bound := make(map[string]bool)
+		for _, name := range c.Mem.ScopeNames() {
+			bound[name] = true
+		}
+		c.ParseElt(def.InlineBody)
+		c.Mem.CloseScopeKeeping(func(name string) bool { return !bound[name] })
+	}
+	for i := len(hidden) - 1; i >= 0; i-- {
+		c.Mem.Restore(hidden[i])
+	}
+	c.inlineDepth--
+}
+
+// inlineArgIsSimple reports whether an argument can be substituted as is
+// without changing how often or when it is evaluated.
+func inlineArgIsSimple(e ast.Expr) bool {
+	switch x := e.(type) {
+	case ast.IntLit, ast.StrLit, ast.VarOrFunc:
+		return true
+	case ast.IntVar:
+		_, ok := x.Index.(ast.IntLit)
+		return ok
+	case ast.StrVar:
+		_, ok := x.Index.(ast.IntLit)
+		return ok
+	}
+	return false
+}
+
+// inlineTemp evaluates an inline argument into a temporary variable of the
+// current scope and returns the temporary.
+func (c *Compiler) inlineTemp(loc ast.Loc, e ast.Expr) ast.Expr {
+	var tmp ast.Expr
+	var err error
+	switch ast.TypeOf(e) {
+	case ast.TypeInt:
+		tmp, err = c.Mem.AllocTempInt()
+	case ast.TypeStr, ast.TypeLiteral:
+		tmp, err = c.Mem.AllocTempStr()
+	default:
+		return e
+	}
+	if err != nil {
+		c.fail(loc, diag.Alloc, err)
+		return e
+	}
+	c.ParseNormElt(ast.AssignStmt{Loc: loc, Dest: tmp, Op: ast.AssignSet, Expr: e})
+	return tmp
+}
+
+// ============================================================
+// Text output (handle_textout, line 652)
+// ============================================================
+
+// handleTextout compiles a bare string statement. rlBabel takes over when
+// its header is loaded; otherwise __DynamicLineation__ selects the DTO
+// token arrays of textout.kh, and plain static output is the default.
+func (c *Compiler) handleTextout(s ast.ReturnStmt) {
+	var toks []ast.StrToken
+	switch e := c.Norm.NormalizeExpr(c.expandIntrinsics(s.Expr)).(type) {
+	case ast.StrLit:
+		toks = c.normStrTokens(e.Tokens)
+	case ast.StrVar:
+		toks = []ast.StrToken{ast.CodeToken{Loc: s.Loc, Ident: "s",
+			Params: []ast.Param{ast.SimpleParam{Loc: s.Loc, Expr: e}}}}
+	case ast.ResRef:
+		res, err := c.State.GetResource(e.Key)
+		if err != nil {
+			c.fail(e.Loc, diag.Undefined, err)
+			return
+		}
+		toks = c.normStrTokens(parser.StrTokens(res.Loc, res.Text))
+	default:
+		c.error(s.Loc, diag.Text, "only strings can be output as text")
+		return
+	}
+	toks = c.castNames(toks)
+	switch {
+	case c.Mem.Defined("__RLBABEL_KH__"):
+		c.Mem.OpenScope()
+		scratch, err := c.Mem.AllocTempStr()
+		if err != nil {
+			c.fail(s.Loc, diag.Alloc, err)
+		} else if ops, err := rlbabel.Compile(s.Loc, toks, rlbabel.DefaultCompileOptions(), scratch); err != nil {
+			c.fail(s.Loc, diag.Text, err)
+		} else {
+			c.runTextOps(ops)
+		}
+		c.Mem.CloseScope()
+	case c.Mem.Defined("__DynamicLineation__"):
+		c.dynamicTextout(s.Loc, toks)
+	default:
+		ops, err := textout.CompileStub(s.Loc, toks)
+		if err != nil {
+			c.fail(s.Loc, diag.Text, err)
+			return
+		}
+		c.runTextOps(ops)
+	}
+}
+
+// castNames replaces the speaker names in the name blocks of toks (\{...}
+// and 【...】) with their translation in the cast. Blocks containing
+// anything other than plain text, such as name variables, are left alone.
+func (c *Compiler) castNames(toks []ast.StrToken) []ast.StrToken {
+	if len(c.State.Cast) == 0 {
+		return toks
+	}
+	var out []ast.StrToken
+	for i := 0; i < len(toks); i++ {
+		out = append(out, toks[i])
+		switch toks[i].(type) {
+		case ast.SpeakerToken, ast.LLenticToken:
+		default:
+			continue
+		}
+		var name string
+		var loc ast.Loc
+		j := i + 1
+	scan:
+		for ; j < len(toks); j++ {
+			switch t := toks[j].(type) {
+			case ast.TextToken:
+				name, loc = name+t.Text, t.Loc
+			case ast.SpaceToken:
+				name += strings.Repeat(" ", t.Count)
+			default:
+				break scan
+			}
+		}
+		if j == len(toks) || j == i+1 {
+			continue
+		}
+		switch toks[j].(type) {
+		case ast.RCurToken, ast.RLenticToken:
+		default:
+			continue
+		}
+		if tr := c.State.Cast.Name(name); tr != name {
+			out = append(out, ast.TextToken{Loc: loc, Text: tr})
+			i = j - 1
+		}
+	}
+	return out
+}
+
+// normStrTokens normalizes the expressions embedded in string tokens.
+func (c *Compiler) normStrTokens(toks []ast.StrToken) []ast.StrToken {
+	out := make([]ast.StrToken, len(toks))
+	for i, t := range toks {
+		switch tt := t.(type) {
+		case ast.NameToken:
+			tt.Index = c.normExpr(tt.Index)
+			if tt.CharID != nil {
+				tt.CharID = c.normExpr(tt.CharID)
+			}
+			t = tt
+		case ast.GlossToken:
+			tt.Base = c.normStrTokens(tt.Base)
+			tt.Gloss = c.normStrTokens(tt.Gloss)
+			t = tt
+		case ast.CodeToken:
+			if tt.OptArg != nil {
+				tt.OptArg = c.normExpr(tt.OptArg)
+			}
+			tt.Params = c.Norm.NormalizeParams(tt.Params)
+			t = tt
+		}
+		out[i] = t
+	}
+	return out
+}
+
+// dynamicTextout stores the DTO token array for a string in a block of
+// int registers and passes it to the textout.kh runtime.
+func (c *Compiler) dynamicTextout(loc ast.Loc, toks []ast.StrToken) {
+	text, dto, err := textout.CompileDTO(loc, toks, func(s string) []byte {
+		return []byte(c.encodeText(loc, s))
+	})
+	if err != nil {
+		c.fail(loc, diag.Text, err)
+		return
+	}
+	c.Mem.OpenScope()
+	defer c.Mem.CloseScope()
+	str, err := c.Mem.AllocTempStr()
+	if err != nil {
+		c.fail(loc, diag.Alloc, err)
+		return
+	}
+	// The text is already encoded: emit it directly rather than through
+	// normExpr, which would convert it a second time.
+	c.Out.EmitAssignment(loc, str, ast.AssignSet,
+		ast.StrLit{Loc: loc, Tokens: []ast.StrToken{ast.TextToken{Loc: loc, Text: text}}})
+	bank, index, err := c.Mem.FindBlock(false, len(dto))
+	if err != nil {
+		c.error(loc, diag.Alloc, fmt.Sprintf("cannot allocate text tokens: %v", err))
+		return
+	}
+	name := fmt.Sprintf("[dto %d.%d]", bank, index)
+	if _, err := c.Mem.AllocVar(name, memory.VarType{BitWidth: 32}, len(dto), &[2]int{bank, index}); err != nil {
+		c.fail(loc, diag.Alloc, err)
+		return
+	}
+	for i, tok := range dto {
+		dest := ast.IntVar{Loc: loc, Bank: bank, Index: ast.IntLit{Loc: loc, Val: int32(index + i)}}
+		c.ParseNormElt(ast.AssignStmt{Loc: loc, Dest: dest, Op: ast.AssignSet, Expr: tok})
+	}
+	c.Out.AddKidoku(loc, loc.Line)
+	c.runTextOps([]textout.Op{textout.CallOp(loc, textout.DTORuntime, str,
+		ast.IntLit{Loc: loc, Val: int32(bank)}, ast.IntLit{Loc: loc, Val: int32(index)},
+		ast.IntLit{Loc: loc, Val: int32(len(dto))})})
+}
+
+// runTextOps emits compiled text output.
+func (c *Compiler) runTextOps(ops []textout.Op) {
+	for _, op := range ops {
+		switch op.Kind {
+		case textout.OpText:
+			c.Out.AddCode(op.Loc, codegen.EncodeText([]byte(c.encodeText(op.Loc, op.Text)), c.Encoding))
+		case textout.OpKidoku:
+			c.Out.AddKidoku(op.Loc, op.Loc.Line)
+		case textout.OpCall:
+			c.compileFuncCall(ast.FuncCallStmt{Loc: op.Loc, Ident: op.Ident, Params: op.Params, Dest: op.Dest})
+		}
+	}
+}
+
+// ============================================================
+// Runtime instrumentation (trace_eval, line 145)
+// ============================================================
+
+// debugFunc is the KFN function that writes to the engine's debug output.
+// It must have overloads taking a single int and a single str.
+const debugFunc = "DebugMessage"
+
+// trace logs "file:line" before the first statement compiled from each
+// source line (--runtime-trace=1 and above). Labels reset the position,
+// so that code reached by a jump is always traced.
+func (c *Compiler) trace(stmt ast.Stmt) {
+	if c.RuntimeTrace <= 0 || c.instrumenting {
+		return
+	}
+	switch stmt.(type) {
+	case ast.LabelStmt, ast.SeqStmt, ast.BlockStmt, ast.HidingStmt,
+		ast.DirectiveStmt, ast.DTargetStmt, ast.DefineStmt, ast.DConstStmt,
+		ast.DInlineStmt, ast.DUndefStmt, ast.DSetStmt, ast.DVersionStmt,
+		ast.DIfStmt, ast.DForStmt:
+		return
+	}
+	loc := stmt.StmtLoc()
+	if loc == ast.Nowhere || loc == c.traceLoc {
+		return
+	}
+	c.traceLoc = loc
+	c.instrumenting = true
+	defer func() { c.instrumenting = false }()
+	c.debugMessage(loc, debugText(fmt.Sprintf("%s:%d", filepath.Base(loc.File), loc.Line)))
+}
+
+// traceValue logs the value just assigned to dest (--runtime-trace=2 and
+// above), preceded by the variable's name and, when it is not constant,
+// its index.
+func (c *Compiler) traceValue(loc ast.Loc, dest ast.Expr) {
+	if c.RuntimeTrace < 2 || c.instrumenting {
+		return
+	}
+	bank, index, ok := varIndex(dest)
+	if !ok {
+		return
+	}
+	c.instrumenting = true
+	defer func() { c.instrumenting = false }()
+	if lit, ok := index.(ast.IntLit); ok {
+		c.debugMessage(loc, debugText(fmt.Sprintf("%s[%d] =", ast.VariableName(bank), lit.Val)))
+	} else {
+		c.debugMessage(loc, debugText(ast.VariableName(bank)+"[] index, value ="))
+		c.debugMessage(loc, index)
+	}
+	c.debugMessage(loc, dest)
+}
+
+// checkBounds emits, before the statement at loc, a range check for every
+// variable index in exprs that is not a compile-time constant
+// (--array-bounds). An index out of range is logged with its position and
+// value; execution then continues.
+//
+//	goto_unless (idx < 0 || idx >= len) @ok
+//	DebugMessage('file:line: intA[] index out of range')
+//	DebugMessage(idx)
+//	@ok
+func (c *Compiler) checkBounds(loc ast.Loc, exprs ...ast.Expr) {
+	if !c.ArrayBounds || c.instrumenting {
+		return
+	}
+	var vars []ast.Expr
+	for _, e := range exprs {
+		vars = indexedVars(e, vars)
+	}
+	if len(vars) == 0 {
+		return
+	}
+	c.instrumenting = true
+	defer func() { c.instrumenting = false }()
+	for _, v := range vars {
+		bank, index, _ := varIndex(v)
+		n := memory.BankLen(bank)
+		if n == 0 {
+			continue
+		}
+		bad := ast.ChainExpr{
+			LHS: ast.CmpExpr{LHS: index, Op: ast.CmpLtn, RHS: ast.IntLit{Val: 0}},
+			Op:  ast.ChainOr,
+			RHS: ast.CmpExpr{LHS: index, Op: ast.CmpGte, RHS: ast.IntLit{Val: int32(n)}},
+		}
+		ok := c.State.UniqueLabel(loc)
+		c.compileFuncCall(meta.MakeGotoUnless(bad, ok).(ast.FuncCallStmt))
+		c.debugMessage(loc, debugText(fmt.Sprintf("%s:%d: %s[] index out of range",
+			filepath.Base(loc.File), loc.Line, ast.VariableName(bank))))
+		c.debugMessage(loc, index)
+		c.ParseNormElt(ast.LabelStmt{Loc: loc, Label: ok})
+	}
+}
+
+// debugMessage emits a call to debugFunc with e, using the overload that
+// takes e's type. A KFN without debugFunc is reported once.
+func (c *Compiler) debugMessage(loc ast.Loc, e ast.Expr) {
+	fd, ok := c.Reg.Lookup(debugFunc)
+	if !ok {
+		if !c.noDebugFunc {
+			c.noDebugFunc = true
+			c.error(loc, diag.Undefined, fmt.Sprintf("--runtime-trace and --array-bounds need '%s' in the KFN", debugFunc))
+		}
+		return
+	}
+	ap, ok := c.assembleExpr(loc, e)
+	if !ok {
+		return
+	}
+	et := fn.ClassifyExpr(c.normExpr(e))
+	for i, proto := range fd.Prototypes {
+		if !proto.Defined || len(proto.Params) != 1 || fn.CheckParamType(proto.Params[0].Type, et) != "" {
+			continue
+		}
+		result, err := fn.Assemble(fd, []fn.AsmParam{ap}, i, "")
+		if err != nil {
+			c.fail(loc, diag.ParamType, err)
+			return
+		}
+		c.Out.AddCode(loc, result.Code)
+		return
+	}
+	c.error(loc, diag.ParamType, fmt.Sprintf("no overload of %s takes a single %s", debugFunc, fn.TypeName(paramTypeOf(et))))
+}
+
+// paramTypeOf is the KFN type that accepts an expression of type et.
+func paramTypeOf(et fn.ExprType) kfn.ParamType {
+	if et == fn.ETInt {
+		return kfn.PIntV
+	}
+	return kfn.PStrV
+}
+
+func debugText(s string) ast.Expr {
+	return ast.StrLit{Tokens: []ast.StrToken{ast.TextToken{Text: s}}}
+}
+
+// varIndex splits an int or str variable into its bank and index.
+func varIndex(e ast.Expr) (bank int, index ast.Expr, ok bool) {
+	switch v := e.(type) {
+	case ast.IntVar:
+		return v.Bank, v.Index, true
+	case ast.StrVar:
+		return v.Bank, v.Index, true
+	}
+	return 0, nil, false
+}
+
+// indexedVars appends to acc the variables in a normalized expression
+// whose index is not constant, innermost first.
+func indexedVars(e ast.Expr, acc []ast.Expr) []ast.Expr {
+	switch x := e.(type) {
+	case ast.IntVar, ast.StrVar:
+		_, index, _ := varIndex(x)
+		acc = indexedVars(index, acc)
+		if !ast.IsConst(index) {
+			acc = append(acc, x)
+		}
+	case ast.BinOp:
+		acc = indexedVars(x.RHS, indexedVars(x.LHS, acc))
+	case ast.CmpExpr:
+		acc = indexedVars(x.RHS, indexedVars(x.LHS, acc))
+	case ast.ChainExpr:
+		acc = indexedVars(x.RHS, indexedVars(x.LHS, acc))
+	case ast.UnaryExpr:
+		acc = indexedVars(x.Val, acc)
+	case ast.ParenExpr:
+		acc = indexedVars(x.Expr, acc)
+	}
+	return acc
+}
+
+// ============================================================
+// Source loading (get_ast_of_file, line 471)
+// ============================================================
+
+// loadFrame is one entry of the #load chain.
+type loadFrame struct {
+	path string
+	loc  ast.Loc // location of the #load that pulled the file in
+}
+
+// loadFile compiles the statements of a #load'ed header in place.
+func (c *Compiler) loadFile(s ast.LoadFileStmt) {
+	name, err := c.Norm.NormalizeAndGetStr(c.expandIntrinsics(s.Path))
+	if err != nil || name == "" {
+		c.error(s.Loc, diag.NotConst, "#load expects a constant file name")
+		return
+	}
+	path, ok := c.findFile(s.Loc, name)
+	if !ok {
+		c.error(s.Loc, diag.Load, fmt.Sprintf("cannot find '%s' to #load", name))
+		return
+	}
+	for i, f := range c.loadStack {
+		if f.path != path {
+			continue
+		}
+		chain := make([]string, 0, len(c.loadStack)-i)
+		for _, g := range c.loadStack[i+1:] {
+			chain = append(chain, g.loc.String())
+		}
+		chain = append(chain, s.Loc.String())
+		c.error(s.Loc, diag.LoadCycle, fmt.Sprintf("recursive #load of '%s': %s", path, strings.Join(chain, " -> ")))
+		return
+	}
+	sf, err := c.readSource(path)
+	if err != nil {
+		c.fail(s.Loc, diag.Load, err)
+		return
+	}
+	c.loadStack = append(c.loadStack, loadFrame{path: path, loc: s.Loc})
+	c.Parse(sf.Stmts)
+	c.loadStack = c.loadStack[:len(c.loadStack)-1]
+}
+
+// findFile resolves a #load name against the including file's directory,
+// IncludeDirs and the RLdev library directory, trying a .kh extension
+// when the name has none. The paths tried before the one found are
+// recorded for Missed.
+func (c *Compiler) findFile(loc ast.Loc, name string) (string, bool) {
+	names := []string{name}
+	if filepath.Ext(name) == "" {
+		names = append(names, name+".kh")
+	}
+	var dirs []string
+	if !filepath.IsAbs(name) {
+		dirs = append(dirs, filepath.Dir(loc.File))
+		dirs = append(dirs, c.IncludeDirs...)
+	}
+	var missed []string
+	for _, n := range names {
+		cands := make([]string, 0, len(dirs)+1)
+		for _, d := range dirs {
+			cands = append(cands, filepath.Join(d, n))
+		}
+		cands = append(cands, config.LibFile(n))
+		for _, p := range cands {
+			if st, err := os.Stat(p); err == nil && !st.IsDir() {
+				for _, m := range missed {
+					c.missed[m] = true
 				}
+				return cleanPath(p), true
 			}
+			missed = append(missed, cleanPath(p))
 		}
+	}
+	return "", false
+}
+
+// readSource returns the parsed AST of a file, lexing and parsing each
+// file only once.
+func (c *Compiler) readSource(path string) (*ast.SourceFile, error) {
+	key := cleanPath(path)
+	if sf, ok := c.files[key]; ok {
+		return sf, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := encoding.ToUTF8(data, c.SourceEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	sf, err := parser.ParseFile([]byte(src), path)
+	if err != nil {
+		return nil, err
+	}
+	c.files[key] = sf
+	return sf, nil
+}
+
+// Files returns the absolute paths of the source files read so far: the
+// main file and every header it loaded, directly or not, in sorted order.
+func (c *Compiler) Files() []string {
+	files := make([]string, 0, len(c.files))
+	for f := range c.files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Missed returns the absolute paths #load looked for and did not find
+// before finding the files it loaded, in sorted order. A file created at
+// one of them would change what the source loads.
+func (c *Compiler) Missed() []string {
+	missed := make([]string, 0, len(c.missed))
+	for f := range c.missed {
+		missed = append(missed, f)
+	}
+	sort.Strings(missed)
+	return missed
+}
 
+// Source returns the parsed AST of a file read so far, or nil.
+func (c *Compiler) Source(path string) *ast.SourceFile {
+	return c.files[cleanPath(path)]
+}
+
+func cleanPath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return filepath.Clean(p)
+}
+
+// window implements partial compilation: it keeps the top-level
+// statements that start between StartLine and EndLine, plus the directives
+// and declarations outside it for the symbols they define. The labels in
+// the dropped statements are all defined on a halt after the window, so
+// that jumps out of the fragment stop the scene.
+func (c *Compiler) window(stmts []ast.Stmt) []ast.Stmt {
+	out, stubs := c.windowStmts(stmts, make(map[string]bool))
+	return append(append(out, stubs...), ast.HaltStmt{})
+}
+
+// windowStmts returns the statements of stmts kept by the window and the
+// label stubs of those it drops. An #if outside the window is kept with
+// its arms windowed in turn, and the stubs of its arms are put under the
+// same condition, so that a label defined in several arms is stubbed
+// once. seen holds the labels stubbed so far.
+func (c *Compiler) windowStmts(stmts []ast.Stmt, seen map[string]bool) (out, stubs []ast.Stmt) {
+	for _, s := range stmts {
+		line := s.StmtLoc().Line
+		inside := (c.StartLine <= 0 || line >= c.StartLine) && (c.EndLine <= 0 || line <= c.EndLine)
+		switch x := s.(type) {
+		case ast.DirectiveStmt, ast.DTargetStmt, ast.DefineStmt, ast.DConstStmt,
+			ast.DInlineStmt, ast.DUndefStmt, ast.DSetStmt, ast.DVersionStmt,
+			ast.DeclStmt, ast.LoadFileStmt:
+			inside = true
+		case ast.DIfStmt:
+			if !inside {
+				kept, stub := c.windowDIf(x, seen)
+				out = append(out, kept)
+				if stub != nil {
+					stubs = append(stubs, *stub)
+				}
+				continue
+			}
+		}
+		if inside {
+			out = append(out, s)
+			continue
+		}
+		for _, l := range labelsIn(s, nil) {
+			if !seen[l.Ident] {
+				seen[l.Ident] = true
+				stubs = append(stubs, ast.LabelStmt{Loc: l.Loc, Label: l})
+			}
+		}
+	}
+	return out, stubs
+}
+
+// windowDIf windows the arms of an #if chain. It returns the chain as
+// kept, and the chain of the stubs of its arms, or nil if it has none.
+func (c *Compiler) windowDIf(s ast.DIfStmt, seen map[string]bool) (ast.DIfStmt, *ast.DIfStmt) {
+	// each arm stubs its own labels: only one of them is compiled
+	armSeen := func() map[string]bool {
+		m := make(map[string]bool, len(seen))
+		for k := range seen {
+			m[k] = true
+		}
+		return m
+	}
+	kept, stub := s, s
+	kept.Body, stub.Body = c.windowStmts(s.Body, armSeen())
+	has := len(stub.Body) > 0
+	switch cont := s.Cont.(type) {
+	case ast.DElseStmt:
+		keptElse, stubElse := cont, cont
+		keptElse.Body, stubElse.Body = c.windowStmts(cont.Body, armSeen())
+		kept.Cont, stub.Cont = keptElse, stubElse
+		has = has || len(stubElse.Body) > 0
+	case ast.DIfStmt:
+		keptIf, stubIf := c.windowDIf(cont, seen)
+		kept.Cont = keptIf
+		if stubIf != nil {
+			stub.Cont = *stubIf
+			has = true
+		} else {
+			stub.Cont = ast.DEndifStmt{Loc: cont.Loc}
+		}
+	}
+	if !has {
+		return kept, nil
+	}
+	return kept, &stub
+}
+
+// labelsIn appends the labels defined in s and its nested blocks.
+func labelsIn(s ast.Stmt, acc []ast.Label) []ast.Label {
+	each := func(ss []ast.Stmt) {
+		for _, s := range ss {
+			acc = labelsIn(s, acc)
+		}
+	}
+	switch x := s.(type) {
+	case ast.LabelStmt:
+		acc = append(acc, x.Label)
+	case ast.BlockStmt:
+		each(x.Stmts)
+	case ast.SeqStmt:
+		each(x.Stmts)
+	case ast.IfStmt:
+		acc = labelsIn(x.Then, acc)
+		if x.Else != nil {
+			acc = labelsIn(x.Else, acc)
+		}
+	case ast.WhileStmt:
+		acc = labelsIn(x.Body, acc)
+	case ast.RepeatStmt:
+		each(x.Body)
+	case ast.ForStmt:
+		each(x.Init)
+		each(x.Step)
+		acc = labelsIn(x.Body, acc)
+	case ast.CaseStmt:
+		for _, a := range x.Arms {
+			each(a.Body)
+		}
+		each(x.Default)
+	case ast.HidingStmt:
+		acc = labelsIn(x.Body, acc)
+	case ast.DForStmt:
+		acc = labelsIn(x.Body, acc)
+	case ast.DIfStmt:
+		each(x.Body)
+		switch c := x.Cont.(type) {
+		case ast.DElseStmt:
+			each(c.Body)
+		case ast.DIfStmt:
+			acc = labelsIn(c, acc)
+		}
+	}
+	return acc
+}
+
+// ============================================================
+// Variable declarations (Variables.allocate, variables.ml)
+// ============================================================
+
+// declare allocates registers for the variables of an int/str declaration
+// and emits their initializers. Slots are released when the enclosing
+// scope closes, except for ext declarations.
+func (c *Compiler) declare(s ast.DeclStmt) {
+	vt := memory.VarType{IsStr: s.Type.IsStr, BitWidth: s.Type.BitWidth}
+	var zero, block, ext bool
+	for _, d := range s.Dirs {
+		switch d {
+		case ast.DirZero:
+			zero = true
+		case ast.DirBlock:
+			block = true
+		case ast.DirExt:
+			ext = true
+		}
+	}
+
+	lens := make([]int, len(s.Vars))
+	for i, v := range s.Vars {
+		n, ok := c.arrayLen(v)
+		if !ok {
+			return
+		}
+		lens[i] = n
+	}
+
+	// (block) places every variable of the declaration in one contiguous run.
+	var next *[2]int
+	if block {
+		total := 0
+		for i, v := range s.Vars {
+			if v.AddrFrom == nil {
+				total += memory.SlotCount(vt, lens[i])
+			}
+		}
+		bank, idx, err := c.Mem.FindBlock(vt.IsStr, total)
+		if err != nil {
+			c.error(s.Loc, diag.Alloc, fmt.Sprintf("cannot allocate block: %v", err))
+			return
+		}
+		next = &[2]int{bank, idx}
+	}
+
+	for i, v := range s.Vars {
+		addr := next
+		if v.AddrFrom != nil {
+			a, ok := c.explicitAddr(v, vt)
+			if !ok {
+				continue
+			}
+			addr = &a
+		}
+		alloc := c.Mem.AllocVar
+		if ext {
+			alloc = c.Mem.AllocExtVar
+		}
+		sv, err := alloc(v.Ident, vt, lens[i], addr)
+		if err != nil {
+			c.error(v.Loc, diag.Alloc, fmt.Sprintf("cannot allocate '%s': %v", v.Ident, err))
+			continue
+		}
+		if next != nil && addr == next {
+			next = &[2]int{next[0], next[1] + sv.AllocLen}
+		}
+		c.initVar(v, sv, zero)
+	}
+}
+
+// arrayLen returns the number of elements of a declared variable, or 0 for
+// a scalar.
+func (c *Compiler) arrayLen(v ast.VarDecl) (int, bool) {
+	switch {
+	case v.ArraySize != nil:
+		n, ok := c.constValue(v.ArraySize)
+		if !ok || n <= 0 {
+			c.error(v.Loc, diag.Decl, fmt.Sprintf("size of array '%s' must be a positive constant", v.Ident))
+			return 0, false
+		}
+		if len(v.ArrayInit) > int(n) {
+			c.error(v.Loc, diag.Decl, fmt.Sprintf("too many initializers for '%s[%d]'", v.Ident, n))
+			return 0, false
+		}
+		return int(n), true
+	case v.AutoArray:
+		if len(v.ArrayInit) == 0 {
+			c.error(v.Loc, diag.Decl, fmt.Sprintf("array '%s[]' needs an initializer to determine its size", v.Ident))
+			return 0, false
+		}
+		return len(v.ArrayInit), true
+	case v.ArrayInit != nil:
+		c.error(v.Loc, diag.Decl, fmt.Sprintf("array initializer for scalar '%s'", v.Ident))
+		return 0, false
+	}
+	return 0, true
+}
+
+// explicitAddr evaluates the address of a `-> intX[n]` or `-> space.index`
+// declaration.
+func (c *Compiler) explicitAddr(v ast.VarDecl, vt memory.VarType) ([2]int, bool) {
+	var bank int
+	var index ast.Expr
+	isStr := false
+	from := c.Norm.NormalizeExpr(v.AddrFrom)
+	switch x := from.(type) {
+	case ast.IntVar:
+		if v.AddrTo == nil {
+			bank, index = x.Bank, x.Index
+		}
+	case ast.StrVar:
+		if v.AddrTo == nil {
+			bank, index, isStr = x.Bank, x.Index, true
+		}
 	default:
-		c.warning(ast.Nowhere, fmt.Sprintf("unhandled normalized stmt: %T", stmt))
+		if b, ok := c.constValue(from); ok && v.AddrTo != nil {
+			bank, index, isStr = int(b), v.AddrTo, vt.IsStr
+		}
+	}
+	if index == nil {
+		c.error(v.Loc, diag.Decl, fmt.Sprintf("invalid address for '%s'", v.Ident))
+		return [2]int{}, false
+	}
+	if isStr != vt.IsStr {
+		c.error(v.Loc, diag.Decl, fmt.Sprintf("cannot bind '%s' to %s: type mismatch", v.Ident, ast.VariableName(bank)))
+		return [2]int{}, false
+	}
+	n, ok := c.constValue(index)
+	if !ok {
+		c.error(v.Loc, diag.NotConst, fmt.Sprintf("address of '%s' must be constant", v.Ident))
+		return [2]int{}, false
+	}
+	return [2]int{bank, int(n)}, true
+}
+
+// initVar emits the initial assignments of a freshly allocated variable.
+// Uninitialized elements are only cleared for (zero) declarations.
+func (c *Compiler) initVar(v ast.VarDecl, sv *memory.StaticVar, zero bool) {
+	elem := func(i int) ast.Expr {
+		idx := ast.IntLit{Loc: v.Loc, Val: sv.Index + int32(i)}
+		if sv.IsStr {
+			return ast.StrVar{Loc: v.Loc, Bank: sv.TypedSpace, Index: idx}
+		}
+		return ast.IntVar{Loc: v.Loc, Bank: sv.TypedSpace, Index: idx}
+	}
+	var zeroVal ast.Expr = ast.IntLit{Loc: v.Loc, Val: 0}
+	if sv.IsStr {
+		zeroVal = ast.StrLit{Loc: v.Loc}
+	}
+	set := func(dest, e ast.Expr) {
+		c.ParseNormElt(ast.AssignStmt{Loc: v.Loc, Dest: dest, Op: ast.AssignSet, Expr: e})
+	}
+
+	if sv.ArrayLen == 0 {
+		switch {
+		case v.Init != nil:
+			set(elem(0), v.Init)
+		case zero:
+			set(elem(0), zeroVal)
+		}
+		return
+	}
+	for i, e := range v.ArrayInit {
+		set(elem(i), e)
+	}
+	if !zero || len(v.ArrayInit) == sv.ArrayLen {
+		return
+	}
+	// Clear the rest of an integer array with setrng when the KFN has it.
+	if _, ok := c.Reg.Lookup("setrng"); ok && !sv.IsStr && sv.ArrayLen-len(v.ArrayInit) > 1 {
+		c.compileFuncCall(ast.FuncCallStmt{Loc: v.Loc, Ident: "setrng", Params: []ast.Param{
+			ast.SimpleParam{Loc: v.Loc, Expr: elem(len(v.ArrayInit))},
+			ast.SimpleParam{Loc: v.Loc, Expr: elem(sv.ArrayLen - 1)},
+		}})
+		return
+	}
+	for i := len(v.ArrayInit); i < sv.ArrayLen; i++ {
+		set(elem(i), zeroVal)
 	}
 }
 
@@ -379,25 +1750,261 @@ func (c *Compiler) parseStruct(stmt ast.Stmt) {
 		c.continueStack = c.continueStack[:len(c.continueStack)-1]
 
 	case ast.CaseStmt:
-		// TODO: full case/switch — compile-time case selection + goto_on/goto_case fallback
-		c.warning(s.Loc, "case statement: TODO — full port pending")
+		c.compileCase(s)
 
 	case ast.HidingStmt:
-		// TODO: inline call hiding
+		h := c.Mem.Hide(s.Ident)
 		c.ParseElt(s.Body)
+		c.Mem.Restore(h)
+
+	case ast.DIfStmt:
+		c.compileDIf(s)
+
+	case ast.DForStmt:
+		from, ok1 := c.constValue(s.From)
+		to, ok2 := c.constValue(s.To)
+		if !ok1 || !ok2 {
+			c.error(s.Loc, diag.NotConst, "#for bounds must be compile-time constants")
+			return
+		}
+		// an int64 counter, so that to == MaxInt32 ends the loop
+		for i := int64(from); i <= int64(to); i++ {
+			c.Mem.OpenScope()
+			c.Mem.Define(s.Ident, memory.Symbol{Kind: memory.KindInteger, IntVal: int32(i)})
+			c.ParseElt(s.Body)
+			c.Mem.CloseScope()
+		}
 
 	default:
-		c.warning(ast.Nowhere, fmt.Sprintf("unknown structure: %T", stmt))
+		c.warning(ast.Nowhere, diag.Unhandled, fmt.Sprintf("unknown structure: %T", stmt))
+	}
+}
+
+// compileDIf evaluates an #if/#elseif/#else chain at compile time and
+// compiles the selected branch in the current scope, so that symbols
+// defined inside it remain visible afterwards.
+func (c *Compiler) compileDIf(s ast.DIfStmt) {
+	v, ok := c.constValue(undefinedToZero(c.Mem, s.Cond))
+	if !ok {
+		c.error(s.Loc, diag.NotConst, "#if condition must be a compile-time constant")
+		return
 	}
+	if v != 0 {
+		c.Parse(s.Body)
+		return
+	}
+	switch cont := s.Cont.(type) {
+	case ast.DIfStmt:
+		c.compileDIf(cont)
+	case ast.DElseStmt:
+		c.Parse(cont.Body)
+	}
+}
+
+// undefinedToZero replaces undefined bare identifiers with 0, so that
+// "#if SYMBOL" is false rather than an error when SYMBOL is not defined.
+func undefinedToZero(mem *memory.Memory, e ast.Expr) ast.Expr {
+	switch x := e.(type) {
+	case ast.VarOrFunc:
+		if !mem.Defined(x.Ident) {
+			return ast.IntLit{Loc: x.Loc, Val: 0}
+		}
+	case ast.BinOp:
+		x.LHS, x.RHS = undefinedToZero(mem, x.LHS), undefinedToZero(mem, x.RHS)
+		return x
+	case ast.CmpExpr:
+		x.LHS, x.RHS = undefinedToZero(mem, x.LHS), undefinedToZero(mem, x.RHS)
+		return x
+	case ast.ChainExpr:
+		x.LHS, x.RHS = undefinedToZero(mem, x.LHS), undefinedToZero(mem, x.RHS)
+		return x
+	case ast.UnaryExpr:
+		x.Val = undefinedToZero(mem, x.Val)
+		return x
+	case ast.ParenExpr:
+		x.Expr = undefinedToZero(mem, x.Expr)
+		return x
+	}
+	return e
+}
+
+// constValue evaluates an expression at compile time, expanding intrinsic
+// calls such as defined?() first.
+func (c *Compiler) constValue(e ast.Expr) (int32, bool) {
+	return c.Norm.NormalizeAndGetConst(c.expandIntrinsics(e))
+}
+
+// expandIntrinsics replaces calls to compile-time builtins with their
+// results throughout an expression.
+func (c *Compiler) expandIntrinsics(e ast.Expr) ast.Expr {
+	switch x := e.(type) {
+	case ast.FuncCall:
+		if !c.Intrin.IsBuiltin(x.Ident) {
+			return e
+		}
+		r, err := c.Intrin.EvalAsExpr(x.Ident, x.Loc, x.Params)
+		if err != nil {
+			c.fail(x.Loc, diag.Expr, err)
+			return ast.IntLit{Loc: x.Loc, Val: 0}
+		}
+		return c.expandIntrinsics(r)
+	case ast.BinOp:
+		x.LHS, x.RHS = c.expandIntrinsics(x.LHS), c.expandIntrinsics(x.RHS)
+		return x
+	case ast.CmpExpr:
+		x.LHS, x.RHS = c.expandIntrinsics(x.LHS), c.expandIntrinsics(x.RHS)
+		return x
+	case ast.ChainExpr:
+		x.LHS, x.RHS = c.expandIntrinsics(x.LHS), c.expandIntrinsics(x.RHS)
+		return x
+	case ast.UnaryExpr:
+		x.Val = c.expandIntrinsics(x.Val)
+		return x
+	case ast.ParenExpr:
+		x.Expr = c.expandIntrinsics(x.Expr)
+		return x
+	}
+	return e
+}
+
+// compileCase compiles case/ecase. A constant scrutinee selects its arm at
+// compile time; otherwise consecutive integer arm values become a goto_on
+// jump table and anything else a goto_case. Arms do not fall through, and
+// break jumps past the ecase.
+func (c *Compiler) compileCase(s ast.CaseStmt) {
+	endLbl := c.State.UniqueLabel(s.Loc)
+	c.breakStack = append(c.breakStack, endLbl.Ident)
+	defer func() { c.breakStack = c.breakStack[:len(c.breakStack)-1] }()
+
+	// Arm values, if every one of them is a compile-time constant.
+	vals := make([]int32, len(s.Arms))
+	allConst := true
+	for i, arm := range s.Arms {
+		v, ok := c.constValue(arm.Cond)
+		if !ok {
+			allConst = false
+			break
+		}
+		vals[i] = v
+	}
+
+	if v, ok := c.constValue(s.Expr); ok && allConst {
+		body := s.Default
+		for i, arm := range s.Arms {
+			if vals[i] == v {
+				body = arm.Body
+				break
+			}
+		}
+		c.Mem.OpenScope()
+		c.Parse(body)
+		c.Mem.CloseScope()
+		c.ParseNormElt(ast.LabelStmt{Loc: s.Loc, Label: endLbl})
+		return
+	}
+
+	scrutinee := c.normExpr(s.Expr)
+	if !c.checkEncodable(s.Loc, scrutinee) {
+		return
+	}
+	armLbls := make([]ast.Label, len(s.Arms))
+	for i := range s.Arms {
+		armLbls[i] = c.State.UniqueLabel(s.Loc)
+	}
+	defLbl := endLbl
+	if s.Default != nil {
+		defLbl = c.State.UniqueLabel(s.Loc)
+	}
+
+	if min, ok := denseRange(vals, allConst); ok {
+		// goto_on falls through when the index is out of range.
+		table := make([]ast.Label, len(vals))
+		for i, v := range vals {
+			table[v-min] = armLbls[i]
+		}
+		index := scrutinee
+		if min != 0 {
+			index = c.normExpr(ast.BinOp{Loc: s.Loc, LHS: scrutinee, Op: ast.OpSub, RHS: ast.IntLit{Loc: s.Loc, Val: min}})
+		}
+		gotojmp.EmitGotoOn(c.Out, s.Loc, c.Reg, "goto_on", index, table)
+		c.ParseElt(meta.MakeGoto(defLbl))
+	} else {
+		arms := make([]gotojmp.GotoCaseArm, 0, len(s.Arms)+1)
+		for i, arm := range s.Arms {
+			cond := c.normExpr(arm.Cond)
+			if !c.checkEncodable(s.Loc, cond) {
+				return
+			}
+			arms = append(arms, gotojmp.GotoCaseArm{Expr: cond, Label: armLbls[i]})
+		}
+		arms = append(arms, gotojmp.GotoCaseArm{IsDefault: true, Label: defLbl})
+		gotojmp.EmitGotoCase(c.Out, s.Loc, c.Reg, "goto_case", scrutinee, arms)
+	}
+
+	for i, arm := range s.Arms {
+		c.ParseNormElt(ast.LabelStmt{Loc: s.Loc, Label: armLbls[i]})
+		c.Mem.OpenScope()
+		c.Parse(arm.Body)
+		c.Mem.CloseScope()
+		c.ParseElt(meta.MakeGoto(endLbl))
+	}
+	if s.Default != nil {
+		c.ParseNormElt(ast.LabelStmt{Loc: s.Loc, Label: defLbl})
+		c.Mem.OpenScope()
+		c.Parse(s.Default)
+		c.Mem.CloseScope()
+	}
+	c.ParseNormElt(ast.LabelStmt{Loc: s.Loc, Label: endLbl})
+}
+
+// denseRange reports whether vals are distinct consecutive integers (in any
+// order) and returns the smallest of them.
+func denseRange(vals []int32, allConst bool) (int32, bool) {
+	if !allConst || len(vals) == 0 {
+		return 0, false
+	}
+	min, max := vals[0], vals[0]
+	seen := make(map[int32]bool, len(vals))
+	for _, v := range vals {
+		if seen[v] {
+			return 0, false
+		}
+		seen[v] = true
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return min, int64(max)-int64(min)+1 == int64(len(vals))
 }
 
 // HasErrors returns true if any errors were collected during compilation.
 func (c *Compiler) HasErrors() bool { return len(c.Errors) > 0 }
 
-func (c *Compiler) error(loc ast.Loc, msg string) {
-	c.Errors = append(c.Errors, fmt.Errorf("%s: %s", loc, msg))
+// Diagnostics returns every error and warning collected so far, in
+// source order. Errors from packages that do not report diagnostics are
+// wrapped as internal errors.
+func (c *Compiler) Diagnostics() []*diag.Diagnostic {
+	ds := make([]*diag.Diagnostic, 0, len(c.Errors)+len(c.Warnings))
+	for _, err := range c.Errors {
+		ds = append(ds, diag.Wrap(ast.Nowhere, diag.Internal, err))
+	}
+	ds = append(ds, c.Warnings...)
+	diag.Sort(ds)
+	return ds
+}
+
+func (c *Compiler) error(loc ast.Loc, code diag.Code, msg string) {
+	c.Errors = append(c.Errors, diag.Errorf(loc, code, "%s", msg))
+}
+
+// fail records err, which a sub-package returned for the statement at loc.
+func (c *Compiler) fail(loc ast.Loc, code diag.Code, err error) {
+	c.Errors = append(c.Errors, diag.Wrap(loc, code, err))
 }
 
-func (c *Compiler) warning(loc ast.Loc, msg string) {
-	c.Warnings = append(c.Warnings, fmt.Sprintf("%s: %s", loc, msg))
+func (c *Compiler) warning(loc ast.Loc, code diag.Code, msg string) {
+	c.Warnings = append(c.Warnings, diag.Warningf(loc, code, "%s", msg))
 }
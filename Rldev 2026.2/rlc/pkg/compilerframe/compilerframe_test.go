@@ -1,11 +1,23 @@
 package compilerframe
 
 import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/yoremi/rldev-go/pkg/kfn"
+	"github.com/yoremi/rldev-go/pkg/metadata"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/cast"
+	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
 	"github.com/yoremi/rldev-go/rlc/pkg/ini"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
+	"github.com/yoremi/rldev-go/rlc/pkg/memory"
+	"github.com/yoremi/rldev-go/rlc/pkg/meta"
+	"github.com/yoremi/rldev-go/rlc/pkg/parser"
 )
 
 func newComp() *Compiler {
@@ -52,12 +64,11 @@ func TestParseDirective(t *testing.T) {
 	if !c.Mem.Defined("X") { t.Error("X not defined") }
 }
 
-func TestParseTODO(t *testing.T) {
-	// Unimplemented statement types should produce warnings, not errors
+func TestParseUnknownOp(t *testing.T) {
 	c := newComp()
-	c.Parse([]ast.Stmt{ast.UnknownOpStmt{Loc: ast.Loc{File: "t", Line: 1}}})
-	if c.HasErrors() { t.Error("should not have errors, only warnings") }
-	if len(c.Warnings) == 0 { t.Error("should have TODO warning") }
+	c.Parse([]ast.Stmt{ast.UnknownOpStmt{Loc: ast.Loc{File: "t", Line: 1}, OpType: 1, OpModule: 4, OpCode: 12}})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if got, want := code(c), codegen.EncodeOpcode(1, 4, 12, 0, 0); !bytes.Equal(got, want) { t.Errorf("got %q, want %q", got, want) }
 }
 
 func TestCompileMergesDirectiveDiagnostics(t *testing.T) {
@@ -72,7 +83,7 @@ func TestCompileMergesDirectiveDiagnostics(t *testing.T) {
 func TestHasErrors(t *testing.T) {
 	c := newComp()
 	if c.HasErrors() { t.Error("fresh compiler should have no errors") }
-	c.error(ast.Nowhere, "test")
+	c.error(ast.Nowhere, diag.Internal, "test")
 	if !c.HasErrors() { t.Error("should have errors") }
 }
 
@@ -87,3 +98,756 @@ func TestRecursiveParse(t *testing.T) {
 	if !c.Mem.Defined("A") { t.Error("A") }
 	if !c.Mem.Defined("B") { t.Error("B") }
 }
+
+const testKFN = `
+module 001 = Jmp
+module 003 = Msg
+module 011 = Mem
+module 255 = Debug
+fun goto (skip goto) <0:Jmp:00000, 0> ()
+fun goto_unless (if neg goto) <0:Jmp:00002, 0> (<'condition')
+fun goto_on (skip goto) <0:Jmp:00003, 0> ()
+fun goto_case (skip goto) <0:Jmp:00004, 0> ()
+fun strout <0:Msg:00000, 0> (str)
+fun intout <0:Msg:00001, 0> (int)
+fun setrng <1:Mem:00000, 0> (int, int)
+fun br <0:Msg:00201, 0> ()
+fun FontColour <0:Msg:00102, 0> (int)
+fun DebugMessage <1:Debug:00010, 0> (int) (str)
+`
+
+func newKfnComp(t *testing.T) *Compiler {
+	t.Helper()
+	reg, err := kfn.Parse(strings.NewReader(testKFN))
+	if err != nil { t.Fatal(err) }
+	return New(reg, ini.NewTable())
+}
+
+func code(c *Compiler) []byte {
+	var b []byte
+	for _, ir := range c.Out.IR { b = append(b, ir.Bytes...) }
+	return b
+}
+
+func TestCompileFuncCall(t *testing.T) {
+	c := newKfnComp(t)
+	c.Compile([]ast.Stmt{ast.FuncCallStmt{Ident: "intout", Params: []ast.Param{
+		ast.SimpleParam{Expr: ast.IntLit{Val: 7}},
+	}}})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	want := append(codegen.EncodeOpcode(0, 3, 1, 1, 0), '(')
+	want = append(append(want, codegen.EncodeInt32(7)...), ')')
+	if !bytes.Equal(code(c), want) { t.Errorf("got %q, want %q", code(c), want) }
+}
+
+func TestCompileStringParam(t *testing.T) {
+	c := newKfnComp(t)
+	c.Compile([]ast.Stmt{ast.FuncCallStmt{Ident: "strout", Params: []ast.Param{
+		ast.SimpleParam{Expr: ast.StrLit{Tokens: []ast.StrToken{ast.TextToken{Text: "a b"}}}},
+	}}})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.HasSuffix(code(c), []byte("(\"a b\")")) { t.Errorf("got %q", code(c)) }
+}
+
+func TestCompileGotoLabel(t *testing.T) {
+	c := newKfnComp(t)
+	c.Compile([]ast.Stmt{
+		ast.LabelStmt{Label: ast.Label{Ident: "top"}},
+		meta.MakeGoto(ast.Label{Ident: "top"}),
+	})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	last := c.Out.IR[len(c.Out.IR)-1]
+	if last.Type != codegen.IRLabelRef || last.Label != "top" { t.Errorf("last IR: %+v", last) }
+	if _, err := c.Out.Generate(codegen.DefaultOptions()); err != nil { t.Error(err) }
+}
+
+func TestCompileDuplicateLabel(t *testing.T) {
+	c := newComp()
+	c.Compile([]ast.Stmt{
+		ast.LabelStmt{Label: ast.Label{Ident: "a"}},
+		ast.LabelStmt{Label: ast.Label{Ident: "a"}},
+	})
+	if !c.HasErrors() { t.Error("duplicate label should be an error") }
+}
+
+func TestCompileUndeclaredIdentifier(t *testing.T) {
+	c := newKfnComp(t)
+	c.Compile([]ast.Stmt{ast.FuncCallStmt{Ident: "intout", Params: []ast.Param{
+		ast.SimpleParam{Expr: ast.VarOrFunc{Ident: "nope"}},
+	}}})
+	if !c.HasErrors() { t.Error("undeclared identifier should be an error") }
+}
+
+func TestCompileUndefinedFunction(t *testing.T) {
+	c := newKfnComp(t)
+	c.Compile([]ast.Stmt{ast.VarOrFuncStmt{Ident: "nope"}})
+	if !c.HasErrors() { t.Error("undefined function should be an error") }
+}
+
+func hasOpcode(c *Compiler, module, opcode int) bool {
+	op := codegen.EncodeOpcode(0, module, opcode, 0, 0)[:5]
+	return bytes.Contains(code(c), op)
+}
+
+func intout(v int32) ast.Stmt {
+	return ast.FuncCallStmt{Ident: "intout", Params: []ast.Param{ast.SimpleParam{Expr: ast.IntLit{Val: v}}}}
+}
+
+func caseStmt(scrutinee ast.Expr, vals ...int32) ast.CaseStmt {
+	s := ast.CaseStmt{Expr: scrutinee}
+	for _, v := range vals {
+		s.Arms = append(s.Arms, ast.CaseArm{Cond: ast.IntLit{Val: v}, Body: []ast.Stmt{intout(v)}})
+	}
+	return s
+}
+
+func TestCaseConstant(t *testing.T) {
+	c := newKfnComp(t)
+	s := caseStmt(ast.IntLit{Val: 2}, 1, 2, 3)
+	s.Default = []ast.Stmt{intout(99)}
+	c.Compile([]ast.Stmt{s})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	got := code(c)
+	if !bytes.Contains(got, codegen.EncodeInt32(2)) { t.Error("selected arm missing") }
+	if bytes.Contains(got, codegen.EncodeInt32(1)) || bytes.Contains(got, codegen.EncodeInt32(99)) {
+		t.Error("unselected arms emitted")
+	}
+	if hasOpcode(c, 1, 3) || hasOpcode(c, 1, 4) { t.Error("constant case should not emit a jump table") }
+}
+
+func TestCaseConstantOther(t *testing.T) {
+	c := newKfnComp(t)
+	s := caseStmt(ast.IntLit{Val: 7}, 1, 2)
+	s.Default = []ast.Stmt{intout(99)}
+	c.Compile([]ast.Stmt{s})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeInt32(99)) { t.Error("other arm missing") }
+}
+
+func TestCaseDenseGotoOn(t *testing.T) {
+	c := newKfnComp(t)
+	v := ast.IntVar{Bank: 0, Index: ast.IntLit{Val: 0}}
+	c.Compile([]ast.Stmt{caseStmt(v, 3, 1, 2)})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !hasOpcode(c, 1, 3) { t.Error("expected goto_on") }
+	if hasOpcode(c, 1, 4) { t.Error("unexpected goto_case") }
+	// Index is rebased to zero: intA[0] - 1
+	if !bytes.Contains(code(c), []byte("\\\x01$\xff\x01\x00\x00\x00")) { t.Errorf("index not rebased: %q", code(c)) }
+	if _, err := c.Out.Generate(codegen.DefaultOptions()); err != nil { t.Error(err) }
+}
+
+func TestCaseSparseGotoCase(t *testing.T) {
+	c := newKfnComp(t)
+	v := ast.IntVar{Bank: 0, Index: ast.IntLit{Val: 0}}
+	s := caseStmt(v, 1, 5, 10)
+	s.Default = []ast.Stmt{intout(99)}
+	c.Compile([]ast.Stmt{s})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !hasOpcode(c, 1, 4) { t.Error("expected goto_case") }
+	if !bytes.Contains(code(c), []byte("()")) { t.Error("default arm missing") }
+	if _, err := c.Out.Generate(codegen.DefaultOptions()); err != nil { t.Error(err) }
+}
+
+func TestCaseBreak(t *testing.T) {
+	c := newKfnComp(t)
+	v := ast.IntVar{Bank: 0, Index: ast.IntLit{Val: 0}}
+	s := caseStmt(v, 0, 1)
+	s.Arms[0].Body = append([]ast.Stmt{ast.BreakStmt{}}, s.Arms[0].Body...)
+	c.Compile([]ast.Stmt{s})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if len(c.breakStack) != 0 { t.Error("break stack not restored") }
+	if _, err := c.Out.Generate(codegen.DefaultOptions()); err != nil { t.Error(err) }
+}
+
+func difChain(conds []ast.Expr, elseBody []ast.Stmt) ast.DIfStmt {
+	var cont ast.DIfCont = ast.DEndifStmt{}
+	if elseBody != nil {
+		cont = ast.DElseStmt{Body: elseBody}
+	}
+	for i := len(conds) - 1; i > 0; i-- {
+		cont = ast.DIfStmt{Cond: conds[i], Body: []ast.Stmt{intout(int32(i))}, Cont: cont}
+	}
+	return ast.DIfStmt{Cond: conds[0], Body: []ast.Stmt{intout(0)}, Cont: cont}
+}
+
+func TestDIfSelectsBranch(t *testing.T) {
+	tests := []struct {
+		conds []ast.Expr
+		want  int32
+	}{
+		{[]ast.Expr{ast.IntLit{Val: 1}, ast.IntLit{Val: 1}}, 0},
+		{[]ast.Expr{ast.IntLit{Val: 0}, ast.IntLit{Val: 1}}, 1},
+		{[]ast.Expr{ast.IntLit{Val: 0}, ast.IntLit{Val: 0}}, 99},
+	}
+	for i, tt := range tests {
+		c := newKfnComp(t)
+		c.Compile([]ast.Stmt{difChain(tt.conds, []ast.Stmt{intout(99)})})
+		if c.HasErrors() { t.Fatal(c.Errors) }
+		got := code(c)
+		for _, v := range []int32{0, 1, 99} {
+			if emitted := bytes.Contains(got, codegen.EncodeInt32(v)); emitted != (v == tt.want) {
+				t.Errorf("case %d: branch %d emitted=%v", i, v, emitted)
+			}
+		}
+	}
+}
+
+func TestDIfDefinedSymbol(t *testing.T) {
+	c := newKfnComp(t)
+	cond := ast.FuncCall{Ident: "defined?", Params: []ast.Param{ast.SimpleParam{Expr: ast.VarOrFunc{Ident: "__RLBABEL_KH__"}}}}
+	c.Compile([]ast.Stmt{difChain([]ast.Expr{cond}, []ast.Stmt{intout(99)})})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeInt32(99)) { t.Error("#else branch not taken") }
+
+	c = newKfnComp(t)
+	c.Compile([]ast.Stmt{
+		ast.DefineStmt{Ident: "__RLBABEL_KH__", Value: ast.IntLit{Val: 1}},
+		difChain([]ast.Expr{ast.VarOrFunc{Ident: "__RLBABEL_KH__"}}, []ast.Stmt{intout(99)}),
+	})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeInt32(0)) { t.Error("#if branch not taken") }
+}
+
+func TestDIfUndefinedIsFalse(t *testing.T) {
+	c := newKfnComp(t)
+	c.Compile([]ast.Stmt{difChain([]ast.Expr{ast.VarOrFunc{Ident: "NOPE"}}, nil)})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if len(code(c)) != 0 { t.Errorf("unexpected code: %q", code(c)) }
+}
+
+func TestDIfNonConstant(t *testing.T) {
+	c := newKfnComp(t)
+	c.Compile([]ast.Stmt{difChain([]ast.Expr{ast.IntVar{Bank: 0, Index: ast.IntLit{}}}, nil)})
+	if !c.HasErrors() { t.Error("non-constant #if should be an error") }
+}
+
+func TestDForUnrolls(t *testing.T) {
+	c := newKfnComp(t)
+	body := ast.FuncCallStmt{Ident: "intout", Params: []ast.Param{ast.SimpleParam{Expr: ast.VarOrFunc{Ident: "i"}}}}
+	c.Compile([]ast.Stmt{ast.DForStmt{Ident: "i", From: ast.IntLit{Val: 1}, To: ast.IntLit{Val: 3}, Body: body}})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	for v := int32(1); v <= 3; v++ {
+		if !bytes.Contains(code(c), codegen.EncodeInt32(v)) { t.Errorf("iteration %d missing", v) }
+	}
+	if c.Mem.Defined("i") { t.Error("loop symbol leaked out of #for") }
+}
+
+func TestDForEndsAtMaxInt(t *testing.T) {
+	c := newKfnComp(t)
+	body := ast.FuncCallStmt{Ident: "intout", Params: []ast.Param{ast.SimpleParam{Expr: ast.VarOrFunc{Ident: "i"}}}}
+	c.Compile([]ast.Stmt{ast.DForStmt{Ident: "i", From: ast.IntLit{Val: math.MaxInt32 - 1}, To: ast.IntLit{Val: math.MaxInt32}, Body: body}})
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if n := bytes.Count(code(c), codegen.EncodeInt32(math.MaxInt32)); n != 1 { t.Errorf("last iteration compiled %d times", n) }
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, src := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil { t.Fatal(err) }
+		if err := os.WriteFile(p, []byte(src), 0644); err != nil { t.Fatal(err) }
+	}
+}
+
+func TestLoadHeaderFromSourceDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.org": "#load 'defs.kh'\nintout(N)\n",
+		"defs.kh":  "#define N = 7\n",
+	})
+	c := newKfnComp(t)
+	if err := c.CompileFile(filepath.Join(dir, "main.org")); err != nil { t.Fatal(err) }
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeInt32(7)) { t.Errorf("got %q", code(c)) }
+}
+
+func TestLoadHeaderFromIncludeDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"src/main.org": "#load 'defs'\nintout(N)\n",
+		"inc/defs.kh":  "#define N = 3\n",
+	})
+	c := newKfnComp(t)
+	if err := c.CompileFile(filepath.Join(dir, "src", "main.org")); err != nil { t.Fatal(err) }
+	if !c.HasErrors() { t.Error("header outside the search path should not be found") }
+
+	c = newKfnComp(t)
+	c.IncludeDirs = []string{filepath.Join(dir, "inc")}
+	if err := c.CompileFile(filepath.Join(dir, "src", "main.org")); err != nil { t.Fatal(err) }
+	if c.HasErrors() { t.Fatal(c.Errors) }
+}
+
+func TestLoadHeaderParsedOnce(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.org":  "#load 'a'\n#load 'b'\n",
+		"a.kh":      "#load 'common'\n",
+		"b.kh":      "#load 'common'\n",
+		"common.kh": "intout(1)\n",
+	})
+	c := newKfnComp(t)
+	if err := c.CompileFile(filepath.Join(dir, "main.org")); err != nil { t.Fatal(err) }
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if len(c.files) != 4 { t.Errorf("parsed %d files, want 4", len(c.files)) }
+}
+
+func TestLoadCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.org": "#load 'b'\n",
+		"b.kh":     "\n#load 'main.org'\n",
+	})
+	c := newKfnComp(t)
+	if err := c.CompileFile(filepath.Join(dir, "main.org")); err != nil { t.Fatal(err) }
+	if len(c.Errors) != 1 { t.Fatalf("errors: %v", c.Errors) }
+	msg := c.Errors[0].Error()
+	if !strings.Contains(msg, "recursive #load") || !strings.Contains(msg, "main.org:1") || !strings.Contains(msg, "b.kh:2") {
+		t.Errorf("cycle message: %s", msg)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"main.org": "#load 'nope'\n"})
+	c := newKfnComp(t)
+	if err := c.CompileFile(filepath.Join(dir, "main.org")); err != nil { t.Fatal(err) }
+	if !c.HasErrors() { t.Error("missing header should be an error") }
+}
+
+func compileSrc(t *testing.T, c *Compiler, src string) {
+	t.Helper()
+	sf, err := parser.ParseFile([]byte(src), "test.org")
+	if err != nil { t.Fatal(err) }
+	c.Compile(sf.Stmts)
+}
+
+func staticVar(t *testing.T, c *Compiler, name string) *memory.StaticVar {
+	t.Helper()
+	sym, ok := c.Mem.Get(name)
+	if !ok || sym.Kind != memory.KindStaticVar { t.Fatalf("%s is not a variable", name) }
+	return sym.Var
+}
+
+func TestDeclInitializes(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "int x = 5\nintout(x)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	v := staticVar(t, c, "x")
+	if v.TypedSpace != c.Mem.IntAllocSpace || v.Index != 0 { t.Errorf("x at %d[%d]", v.TypedSpace, v.Index) }
+	x := codegen.EncodeExpr(ast.IntVar{Bank: v.TypedSpace, Index: ast.IntLit{Val: 0}})
+	if !bytes.Contains(code(c), append(x, '\\', codegen.AssignCode(ast.AssignSet))) { t.Errorf("no assignment in %q", code(c)) }
+}
+
+func TestDeclFreedOnScopeClose(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "int a\n: int b, d ;\nint e\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if c.Mem.Defined("b") { t.Error("b should be out of scope") }
+	if e := staticVar(t, c, "e"); e.Index != 1 { t.Errorf("e should reuse b's slot, got %d", e.Index) }
+}
+
+func TestDeclExplicitAddress(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "int a -> intA[5]\nstr s -> strS[3]\nint b -> 1.20\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if v := staticVar(t, c, "a"); v.TypedSpace != 0 || v.Index != 5 { t.Errorf("a at %d[%d]", v.TypedSpace, v.Index) }
+	if v := staticVar(t, c, "s"); v.TypedSpace != 0x12 || v.Index != 3 { t.Errorf("s at %d[%d]", v.TypedSpace, v.Index) }
+	if v := staticVar(t, c, "b"); v.TypedSpace != 1 || v.Index != 20 { t.Errorf("b at %d[%d]", v.TypedSpace, v.Index) }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "int a -> strS[0]\n")
+	if !c.HasErrors() { t.Error("int bound to a string bank should be an error") }
+}
+
+func TestDeclBlock(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "int h\n: int t ;\nint (block) a[2], b\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	a, b := staticVar(t, c, "a"), staticVar(t, c, "b")
+	if a.AllocIndex != 1 || b.AllocIndex != 3 { t.Errorf("a at %d, b at %d", a.AllocIndex, b.AllocIndex) }
+}
+
+func TestDeclZero(t *testing.T) {
+	set := []byte{'\\', codegen.AssignCode(ast.AssignSet)}
+	c := newComp()
+	compileSrc(t, c, "int (zero) a[3]\nstr (zero) s\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if n := bytes.Count(code(c), set); n != 4 { t.Errorf("%d assignments, want 4", n) }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "int (zero) a[10] = {1}\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeOpcode(1, 11, 0, 0, 0)[:5]) { t.Error("expected setrng") }
+	if n := bytes.Count(code(c), set); n != 1 { t.Errorf("%d assignments, want 1", n) }
+}
+
+func TestDeclArrayInit(t *testing.T) {
+	c := newComp()
+	compileSrc(t, c, "int a[] = {1, 2, 3}\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if v := staticVar(t, c, "a"); v.ArrayLen != 3 { t.Errorf("len %d", v.ArrayLen) }
+
+	c = newComp()
+	compileSrc(t, c, "int a[2] = {1, 2, 3}\n")
+	if !c.HasErrors() { t.Error("too many initializers should be an error") }
+}
+
+func TestDeclExt(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, ": int (ext) g ;\nintout(g)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+}
+
+func TestDeclBankExhausted(t *testing.T) {
+	c := newComp()
+	c.Mem.IntAllocLast = 2
+	compileSrc(t, c, "int a\nint b[2]\n")
+	if len(c.Errors) != 1 { t.Fatalf("errors: %v", c.Errors) }
+	if msg := c.Errors[0].Error(); !strings.Contains(msg, "test.org:2") || !strings.Contains(msg, "intL is full") {
+		t.Errorf("message: %s", msg)
+	}
+}
+
+func TestInlineExpands(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#inline show(a) intout(a)\nshow(5)\n#sub twice(a) : intout(a) intout(a) ;\ntwice(6)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeInt32(5)) { t.Errorf("got %q", code(c)) }
+	if n := bytes.Count(code(c), codegen.EncodeInt32(6)); n != 2 { t.Errorf("twice: %d calls", n) }
+	if c.Mem.Defined("a") { t.Error("parameter leaked into the caller") }
+}
+
+func TestInlineDefaultAndOptional(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#inline f(a, b = 3) intout(b)\nf(1)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeInt32(3)) { t.Errorf("default: %q", code(c)) }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "int b\n#inline g(a, [b]) #if defined?(b)\nintout(8)\n#else\nintout(9)\n#endif\ng(1)\ng(1, 2)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	nine, eight := bytes.Index(code(c), codegen.EncodeInt32(9)), bytes.Index(code(c), codegen.EncodeInt32(8))
+	if nine < 0 || eight < nine { t.Errorf("optional: %q", code(c)) }
+	if !c.Mem.Defined("b") { t.Error("caller's b should be restored") }
+}
+
+func TestInlineOverloadByCount(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#inline f(a) intout(11)\n#inline f(a, b) intout(22)\nf(0, 0)\nf(0)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	two, one := bytes.Index(code(c), codegen.EncodeInt32(22)), bytes.Index(code(c), codegen.EncodeInt32(11))
+	if two < 0 || one < two { t.Errorf("got %q", code(c)) }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "#inline f(a) intout(a)\nf(1, 2)\n")
+	if !c.HasErrors() { t.Error("wrong parameter count should be an error") }
+}
+
+func TestInlineHygiene(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "int x = 7\n#inline f(a) : int x = 1 intout(a) ;\nf(x)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	outer := codegen.EncodeExpr(ast.IntVar{Bank: c.Mem.IntAllocSpace, Index: ast.IntLit{Val: 0}})
+	if !bytes.Contains(code(c), append([]byte("("), append(outer, ')')...)) { t.Errorf("argument captured: %q", code(c)) }
+	if v := staticVar(t, c, "x"); v.Index != 0 { t.Errorf("x resolves to slot %d", v.Index) }
+}
+
+func TestInlineScoped(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#inline f(a) int y = a\n#sinline g(a) int z = a\nf(1)\ng(2)\nint w\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !c.Mem.Defined("y") { t.Error("#inline declaration should stay in the caller's scope") }
+	if c.Mem.Defined("z") { t.Error("#sinline declaration leaked into the caller") }
+	if c.Mem.Defined("a") { t.Error("parameter leaked into the caller") }
+	if v := staticVar(t, c, "w"); v.Index != 1 { t.Errorf("w at slot %d, want z's freed slot 1", v.Index) }
+}
+
+func TestInlineTemporary(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "int x\n#inline f(a) : intout(a) intout(a) ;\nf(x + 1)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if n := bytes.Count(code(c), []byte{'\\', codegen.AssignCode(ast.AssignSet)}); n != 1 { t.Errorf("%d assignments, want 1", n) }
+}
+
+func TestInlineRecursionLimit(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#inline f(a) f(a)\nf(1)\n")
+	if len(c.Errors) != 1 || !strings.Contains(c.Errors[0].Error(), "too deeply") { t.Errorf("errors: %v", c.Errors) }
+}
+
+func TestHiding(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "int x\n#hiding x intout(x)\nintout(x)\n")
+	if len(c.Errors) != 1 { t.Errorf("errors: %v", c.Errors) }
+}
+
+func kidokus(c *Compiler) int {
+	n := 0
+	for _, ir := range c.Out.IR { if ir.Type == codegen.IRKidoku { n++ } }
+	return n
+}
+
+func TestTextoutStatic(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "'\\{Kotomi}Hi, you\\n\\c{2}x'\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	want := "\x81\x79Kotomi\x81\x7a\"Hi, you\"" + string(codegen.EncodeOpcode(0, 3, 201, 0, 0))
+	if !bytes.Contains(code(c), []byte(want)) { t.Errorf("got %q", code(c)) }
+	if !bytes.Contains(code(c), codegen.EncodeOpcode(0, 3, 102, 1, 0)) { t.Errorf("\\c: %q", code(c)) }
+	if kidokus(c) != 1 { t.Errorf("%d kidoku markers", kidokus(c)) }
+}
+
+func TestTextoutStrVar(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "strS[0]\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), codegen.EncodeOpcode(0, 3, 0, 1, 0)) { t.Errorf("strout: %q", code(c)) }
+}
+
+func TestTextoutResource(t *testing.T) {
+	c := newKfnComp(t)
+	c.State.SetResource("hi", "Hi, \\{Kotomi}", ast.Nowhere)
+	compileSrc(t, c, "#res<hi>\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), []byte("\"Hi, \"\x81\x79Kotomi\x81\x7a")) { t.Errorf("got %q", code(c)) }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "#res<missing>\n")
+	if !c.HasErrors() { t.Error("undefined resource should be an error") }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "intA[0]\n")
+	if !c.HasErrors() { t.Error("integer text output should be an error") }
+}
+
+func TestTextoutDynamicLineation(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#define __DynamicLineation__\n#inline __dto_Textout(s, b, i, n) intout(n)\n'ab cd\\n'\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	// SText, NText and the \n code: three tokens
+	if !bytes.Contains(code(c), append(codegen.EncodeOpcode(0, 3, 1, 1, 0), append([]byte{'('}, codegen.EncodeInt32(3)...)...)) {
+		t.Errorf("got %q", code(c))
+	}
+	if !bytes.Contains(code(c), []byte("abcd")) { t.Errorf("text: %q", code(c)) }
+	if kidokus(c) != 1 { t.Errorf("%d kidoku markers", kidokus(c)) }
+}
+
+func TestTextoutRlBabel(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#define __RLBABEL_KH__\n#define __DynamicLineation__\n"+
+		"#inline __vwf_TextoutStart(s) strout(s)\n#inline __vwf_TextoutAppend(s) strout(s)\n"+
+		"#inline __vwf_TextoutDisplay() intout(99)\n'\\{A}Hi'\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), []byte("\"\x01A\x02Hi\"")) { t.Errorf("chunk: %q", code(c)) }
+	if !bytes.Contains(code(c), codegen.EncodeInt32(99)) { t.Errorf("display: %q", code(c)) }
+}
+
+func TestTextoutCodeOutsideText(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "strout('a\\nb')\n")
+	if !c.HasErrors() { t.Error("control code in a string argument should be an error") }
+}
+
+func TestUnknownOpArgs(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "op<0:Msg:01234, 2>(5, strS[1], 'hi')\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	want := append(codegen.EncodeOpcode(0, 3, 1234, 3, 2), '(')
+	if !bytes.HasPrefix(code(c), want) { t.Errorf("got %q", code(c)) }
+	if !bytes.HasSuffix(code(c), []byte("hi)")) { t.Errorf("args: %q", code(c)) }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "op<0:Nope:00001, 0>\n")
+	if !c.HasErrors() { t.Error("unknown module should be an error") }
+}
+
+func TestUnknownOpStore(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "op<1:Mem:00007, 0>(1) -> store\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if bytes.Contains(code(c), []byte("\\\x1e")) { t.Errorf("-> store should not assign: %q", code(c)) }
+
+	c = newKfnComp(t)
+	compileSrc(t, c, "op<1:Mem:00007, 0>(1) -> intA[3]\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.HasSuffix(code(c), []byte("\\\x1e$\xc8")) { t.Errorf("-> intA[3]: %q", code(c)) }
+}
+
+func TestStringSpecialCharacters(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "strout('a-b ＊【x】')\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), []byte("a-b \x81\x96\x81\x79x\x81\x7a")) { t.Errorf("got %q", code(c)) }
+}
+
+// selectSource is the disassembly of selectCode by kprl, with the resource
+// strings inlined; kprl's TestDisassembleRlcSelect checks the other way.
+const (
+	selectSource = "select_s[1]('Option A', hide if intA[0] == 1: 'B', colour(2) cursor if intA[1]: strS[0])"
+	selectCode   = "#\x00\x02\x03\x00\x03\x00\x00($\xff\x01\x00\x00\x00){\"Option A\"(($\x00[$\xff\x00\x00\x00\x00]\\($\xff\x01\x00\x00\x00)2)B(0$\xff\x02\x00\x00\x00($\x00[$\xff\x01\x00\x00\x00])4)$\x12[$\xff\x00\x00\x00\x00]}"
+)
+
+func TestSelectConditions(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, selectSource)
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if got := string(code(c)); got != selectCode { t.Errorf("got  %q\nwant %q", got, selectCode) }
+}
+
+func TestDiagnosticCodes(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "#warn 'w'\nintout(nothing[0])\n")
+	ds := c.Diagnostics()
+	if len(ds) != 2 { t.Fatalf("diagnostics: %v", ds) }
+	if ds[0].Severity != diag.SevWarning || ds[0].Code != diag.UserWarning || ds[0].Loc.Line != 1 { t.Errorf("warning: %s", ds[0]) }
+	if ds[1].Severity != diag.SevError || ds[1].Code != diag.Undefined || ds[1].Loc.Line != 2 { t.Errorf("error: %s", ds[1]) }
+}
+
+func TestParamTypeNamesPrototype(t *testing.T) {
+	c := newKfnComp(t)
+	compileSrc(t, c, "intout('text')\n")
+	ds := c.Diagnostics()
+	if len(ds) != 1 || ds[0].Code != diag.ParamType { t.Fatalf("diagnostics: %v", ds) }
+	if !strings.Contains(ds[0].Message, "expected integer") || !strings.Contains(ds[0].Message, "intout (int)") { t.Errorf("got %q", ds[0].Message) }
+}
+
+func TestFoldConstantConditional(t *testing.T) {
+	src := "if 2 > 1 intout(1) else intout(2)\nif 0 intout(3)\n"
+	c := newKfnComp(t)
+	compileSrc(t, c, src)
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	unless := codegen.EncodeOpcode(0, 1, 2, 0, 0)
+	if bytes.Count(code(c), unless) != 2 { t.Errorf("-O0 should keep both goto_unless: %q", code(c)) }
+
+	c = newKfnComp(t)
+	c.OptLevel = 1
+	compileSrc(t, c, src)
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if bytes.Contains(code(c), unless) { t.Errorf("goto_unless on constants should fold: %q", code(c)) }
+	var flows []codegen.Flow
+	for _, ir := range c.Out.IR {
+		if ir.Flow != codegen.FlowNext { flows = append(flows, ir.Flow) }
+	}
+	// if 0 -> goto_unless(0) -> goto
+	if len(flows) != 2 || flows[0] != codegen.FlowGoto || flows[1] != codegen.FlowGoto { t.Errorf("flows: %v", flows) }
+}
+
+func TestRuntimeTrace(t *testing.T) {
+	src := "intA[0] = 1\n@l\nintB[2] = intA[0]\n"
+	c := newKfnComp(t)
+	c.RuntimeTrace = 1
+	compileSrc(t, c, src)
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	debugStr := codegen.EncodeOpcode(1, 255, 10, 1, 1)
+	if n := bytes.Count(code(c), debugStr); n != 2 { t.Errorf("%d line traces, want 2: %q", n, code(c)) }
+	if !bytes.Contains(code(c), []byte("\"test.org:3\"")) { t.Errorf("no position: %q", code(c)) }
+	if !bytes.HasPrefix(code(c), debugStr) { t.Errorf("trace should prefix the statement: %q", code(c)) }
+
+	c = newKfnComp(t)
+	c.RuntimeTrace = 2
+	compileSrc(t, c, src)
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	// intB[2] = intA[0] is followed by its name and its new value
+	want := append(append([]byte{}, debugStr...), []byte("(\"intB[2] =\")")...)
+	want = append(append(want, codegen.EncodeOpcode(1, 255, 10, 1, 0)...), []byte("($\x01[$\xff\x02\x00\x00\x00])")...)
+	if !bytes.HasSuffix(code(c), want) { t.Errorf("no value trace: %q", code(c)) }
+
+	c = newKfnComp(t)
+	c.Reg = kfn.NewRegistry()
+	c.RuntimeTrace = 1
+	compileSrc(t, c, "intA[0] = 1\nintA[1] = 1\n")
+	if len(c.Errors) != 1 { t.Errorf("a missing DebugMessage should be reported once: %v", c.Errors) }
+}
+
+func TestArrayBounds(t *testing.T) {
+	c := newKfnComp(t)
+	c.ArrayBounds = true
+	compileSrc(t, c, "intA[3] = intB[intL[0]] + 1\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	unless := codegen.EncodeOpcode(0, 1, 2, 0, 0)
+	if n := bytes.Count(code(c), unless); n != 1 { t.Errorf("%d checks, want 1 (only intB[intL[0]]): %q", n, code(c)) }
+	if !bytes.Contains(code(c), []byte("$\xff\xd0\x07\x00\x00")) { t.Errorf("intB bound 2000 missing: %q", code(c)) }
+	if !bytes.Contains(code(c), []byte("intB[] index out of range")) { t.Errorf("no message: %q", code(c)) }
+
+	c = newKfnComp(t)
+	c.ArrayBounds = true
+	compileSrc(t, c, "intout(intA[intB[intC[0]]])\nstrout(strK[intA[0]])\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if n := bytes.Count(code(c), unless); n != 3 { t.Errorf("%d checks, want 3: %q", n, code(c)) }
+	inner := bytes.Index(code(c), []byte("intB[] index"))
+	outer := bytes.Index(code(c), []byte("intA[] index"))
+	if inner < 0 || outer < inner { t.Errorf("inner index should be checked first: %q", code(c)) }
+	if !bytes.Contains(code(c), []byte("$\xff\x03\x00\x00\x00")) { t.Errorf("strK bound 3 missing: %q", code(c)) }
+}
+
+func TestLineWindow(t *testing.T) {
+	dir := t.TempDir()
+	src := "#define N = 7\nintA[0] = 9\n@a\nintout(N)\ngoto @b\nif 1: @c intout(3);\n@b\nintout(4)\n"
+	writeFiles(t, dir, map[string]string{"main.org": src})
+	c := newKfnComp(t)
+	c.StartLine, c.EndLine = 4, 5
+	if err := c.CompileFile(filepath.Join(dir, "main.org")); err != nil { t.Fatal(err) }
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if bytes.Contains(code(c), []byte("$\xff\x09\x00\x00\x00")) { t.Errorf("line 2 compiled: %q", code(c)) }
+	if !bytes.Contains(code(c), []byte("$\xff\x07\x00\x00\x00")) { t.Errorf("#define outside the window lost: %q", code(c)) }
+	var labels []string
+	for _, e := range c.Out.IR {
+		if e.Type == codegen.IRLabel { labels = append(labels, e.Label) }
+	}
+	if strings.Join(labels, " ") != "a c b" { t.Errorf("stub labels: %v", labels) }
+	if c.Out.IR[len(c.Out.IR)-1].Flow != codegen.FlowExit { t.Error("window should end with halt") }
+}
+
+func TestLineWindowDirectives(t *testing.T) {
+	dir := t.TempDir()
+	src := "#if 1\n#define N = 7\n@a\nintout(1)\n#else\n@a\n#endif\n" +
+		"#for i = 1 .. 1 : @f ;\nif 1: #if 0 @d #else @d #endif ;\nintout(N)\ngoto @a\ngoto @f\ngoto @d\n"
+	writeFiles(t, dir, map[string]string{"main.org": src})
+	c := newKfnComp(t)
+	c.StartLine, c.EndLine = 10, 13
+	if err := c.CompileFile(filepath.Join(dir, "main.org")); err != nil { t.Fatal(err) }
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	if !bytes.Contains(code(c), []byte("$\xff\x07\x00\x00\x00")) { t.Errorf("#define inside #if lost: %q", code(c)) }
+	if bytes.Contains(code(c), []byte("$\xff\x01\x00\x00\x00")) { t.Errorf("line 4 compiled: %q", code(c)) }
+	var labels []string
+	for _, e := range c.Out.IR {
+		if e.Type == codegen.IRLabel { labels = append(labels, e.Label) }
+	}
+	if strings.Join(labels, " ") != "a f d" { t.Errorf("stub labels: %v", labels) }
+}
+
+func TestFlagLabels(t *testing.T) {
+	c := newKfnComp(t)
+	c.FlagLabels = true
+	compileSrc(t, c, "@a\nwhile intA[0] < 3: intA[0] += 1;\n@b\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	var lines []int
+	for _, e := range c.Out.IR {
+		if e.Type == codegen.IRKidoku { lines = append(lines, e.Index) }
+	}
+	if len(lines) != 2 || lines[0] != 1 || lines[1] != 3 { t.Errorf("kidoku at %v, want [1 3]", lines) }
+}
+
+func TestCastNames(t *testing.T) {
+	c := newKfnComp(t)
+	c.State.Cast = cast.Table{"ことみ": "Kotomi", "渚": "Nagisa"}
+	compileSrc(t, c, "#character 'ことみ'\n'\\{ことみ}Hi'\n'【渚】Yo'\n'【岡崎】Hey'\n'\\{\\m{0}}x'\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	for _, want := range []string{"\x81\x79Kotomi\x81\x7a", "\x81\x79Nagisa\x81\x7a", "\x81\x79\x89\xaa\x8d\xe8\x81\x7a"} {
+		if !bytes.Contains(code(c), []byte(want)) { t.Errorf("missing %q in %q", want, code(c)) }
+	}
+	if len(c.State.DramatisPersonae) != 1 || c.State.DramatisPersonae[0] != "Kotomi" { t.Errorf("dramatis: %v", c.State.DramatisPersonae) }
+}
+
+func TestTargetVersionSelectsFunctions(t *testing.T) {
+	reg, err := kfn.Parse(strings.NewReader("module 003 = Msg\nver < 1.3\n  fun out <0:Msg:00101, 0> (int)\nend\nver >= 1.3\n  fun out <0:Msg:00102, 0> (int)\nend\n"))
+	if err != nil { t.Fatal(err) }
+	c := New(reg, ini.NewTable())
+	compileSrc(t, c, "out(1)\n#version 1.3\nout(2)\n")
+	if c.HasErrors() { t.Fatal(c.Errors) }
+	old, cur := codegen.EncodeOpcode(0, 3, 101, 1, 0), codegen.EncodeOpcode(0, 3, 102, 1, 0)
+	if i, j := bytes.Index(code(c), old), bytes.Index(code(c), cur); i < 0 || j < i { t.Errorf("out should follow #version: %q", code(c)) }
+	if c.TextTransform() != metadata.TransformNone { t.Error("TextTransform") }
+	compileSrc(t, c, "#define __RLBABEL_KH__\n")
+	if c.TextTransform() != metadata.TransformWestern { t.Error("rlBabel should be Western") }
+}
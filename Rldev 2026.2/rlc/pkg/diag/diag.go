@@ -0,0 +1,202 @@
+// Package diag defines the compiler's diagnostics.
+//
+// Every error or warning reported by rlc is a Diagnostic: a source
+// location, a severity, a stable code and a message. Diagnostics are
+// rendered for the terminal with the offending source line and a caret,
+// or written as a JSON array (--diagnostics=json) for editors and CI.
+//
+// Diagnostic implements error, and its Error() text is the traditional
+// "file:line: message" form, so code that only deals in errors keeps
+// working unchanged.
+package diag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+)
+
+// ============================================================
+// Severity and codes
+// ============================================================
+
+// Severity classifies a diagnostic.
+type Severity int
+
+const (
+	SevError Severity = iota
+	SevWarning
+	SevNote
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SevWarning:
+		return "warning"
+	case SevNote:
+		return "note"
+	}
+	return "error"
+}
+
+// MarshalJSON writes the severity by name.
+func (s Severity) MarshalJSON() ([]byte, error) { return json.Marshal(s.String()) }
+
+// Code identifies a kind of diagnostic. Codes are stable: tools may match
+// on them, so existing codes must never be renumbered.
+type Code string
+
+// Error codes.
+const (
+	Internal       Code = "E0000" // unsupported construct or internal error
+	Syntax         Code = "E0001" // source does not parse
+	Load           Code = "E0002" // #load'ed or input file missing or unreadable
+	LoadCycle      Code = "E0003" // recursive #load
+	Undefined      Code = "E0100" // undeclared identifier or undefined function
+	UnknownModule  Code = "E0101" // op<> names a module the KFN does not define
+	DuplicateLabel Code = "E0102" // label defined twice
+	ParamType      Code = "E0200" // argument of the wrong type
+	ParamCount     Code = "E0201" // wrong number of arguments
+	ReturnValue    Code = "E0202" // return value missing or unexpected
+	Alloc          Code = "E0300" // no free registers
+	Decl           Code = "E0301" // invalid variable declaration
+	NotConst       Code = "E0400" // compile-time constant required
+	Encoding       Code = "E0500" // text not representable in the output encoding
+	Text           Code = "E0501" // invalid text output or control code
+	ControlFlow    Code = "E0600" // break/continue outside a loop
+	Inline         Code = "E0700" // invalid #inline expansion
+	Directive      Code = "E0800" // invalid compiler directive
+	UserError      Code = "E0801" // #error
+	Expr           Code = "E0900" // invalid expression
+)
+
+// Warning and note codes.
+const (
+	Unhandled     Code = "W0000" // statement the compiler does not handle yet
+	TargetIgnored Code = "W0001" // #target overridden by the command line
+	UserWarning   Code = "W0002" // #warn
+	UserPrint     Code = "N0001" // #print
+)
+
+// ============================================================
+// Diagnostic
+// ============================================================
+
+// Diagnostic is one located compiler message.
+type Diagnostic struct {
+	Loc      ast.Loc
+	Severity Severity
+	Code     Code
+	Message  string
+}
+
+// Errorf returns an error diagnostic.
+func Errorf(loc ast.Loc, code Code, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{Loc: loc, Severity: SevError, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Warningf returns a warning diagnostic.
+func Warningf(loc ast.Loc, code Code, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{Loc: loc, Severity: SevWarning, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Wrap turns an error from a package that does not report diagnostics into
+// an error diagnostic at loc. A leading "loc: " in its text is dropped, as
+// the location is now carried separately. Diagnostics are returned as is.
+func Wrap(loc ast.Loc, code Code, err error) *Diagnostic {
+	var d *Diagnostic
+	if errors.As(err, &d) {
+		return d
+	}
+	msg := err.Error()
+	if loc != ast.Nowhere {
+		msg = strings.TrimPrefix(msg, loc.String()+": ")
+	}
+	return &Diagnostic{Loc: loc, Severity: SevError, Code: code, Message: msg}
+}
+
+// Error returns "file:line: message", or just the message for a
+// diagnostic that has no location.
+func (d *Diagnostic) Error() string { return d.prefix() + d.Message }
+
+// String returns "file:line: severity[code]: message".
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s%s[%s]: %s", d.prefix(), d.Severity, d.Code, d.Message)
+}
+
+func (d *Diagnostic) prefix() string {
+	if d.Loc == ast.Nowhere {
+		return ""
+	}
+	return d.Loc.String() + ": "
+}
+
+// Sort orders ds by file and line. Diagnostics without a location come
+// last, and diagnostics at the same location keep their order.
+func Sort(ds []*Diagnostic) {
+	sort.SliceStable(ds, func(i, j int) bool {
+		a, b := ds[i].Loc, ds[j].Loc
+		switch {
+		case a == ast.Nowhere || b == ast.Nowhere:
+			return b == ast.Nowhere && a != ast.Nowhere
+		case a.File != b.File:
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+}
+
+// ============================================================
+// Rendering
+// ============================================================
+
+// LineFunc returns the text of a source line (1-based), if available.
+type LineFunc func(file string, line int) (string, bool)
+
+// Render writes a diagnostic followed by the offending source line and a
+// caret under its first non-blank character.
+//
+//	main.org:3: error[E0100]: undeclared identifier 'x'
+//	    3 |   intout(x)
+//	      |   ^
+func Render(w io.Writer, d *Diagnostic, lines LineFunc) {
+	fmt.Fprintln(w, d.String())
+	if lines == nil || d.Loc.File == "" || d.Loc.Line <= 0 {
+		return
+	}
+	text, ok := lines(d.Loc.File, d.Loc.Line)
+	if !ok {
+		return
+	}
+	text = strings.TrimRight(text, " \t\r")
+	indent := text[:len(text)-len(strings.TrimLeft(text, " \t"))]
+	gutter := fmt.Sprintf("%5d", d.Loc.Line)
+	fmt.Fprintf(w, "%s | %s\n", gutter, text)
+	fmt.Fprintf(w, "%s | %s^\n", strings.Repeat(" ", len(gutter)), indent)
+}
+
+// jsonDiagnostic is the JSON form of a Diagnostic.
+type jsonDiagnostic struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Severity Severity `json:"severity"`
+	Code     Code     `json:"code"`
+	Message  string   `json:"message"`
+}
+
+// WriteJSON writes diagnostics as a JSON array (an empty array if there
+// are none).
+func WriteJSON(w io.Writer, ds []*Diagnostic) error {
+	out := make([]jsonDiagnostic, len(ds))
+	for i, d := range ds {
+		out[i] = jsonDiagnostic{File: d.Loc.File, Line: d.Loc.Line, Severity: d.Severity, Code: d.Code, Message: d.Message}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,64 @@
+package diag
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+)
+
+func TestDiagnosticText(t *testing.T) {
+	d := Errorf(ast.Loc{File: "a.org", Line: 3}, Undefined, "undeclared identifier '%s'", "x")
+	if d.Error() != "a.org:3: undeclared identifier 'x'" { t.Errorf("Error: %q", d.Error()) }
+	if d.String() != "a.org:3: error[E0100]: undeclared identifier 'x'" { t.Errorf("String: %q", d.String()) }
+	w := Warningf(ast.Nowhere, UserWarning, "hi")
+	if w.String() != "warning[W0002]: hi" { t.Errorf("no location: %q", w.String()) }
+}
+
+func TestWrap(t *testing.T) {
+	loc := ast.Loc{File: "a.org", Line: 2}
+	d := Wrap(loc, Alloc, errors.New("a.org:2: intL is full"))
+	if d.Message != "intL is full" || d.Code != Alloc || d.Loc != loc { t.Errorf("got %s", d) }
+	orig := Errorf(loc, Syntax, "bad")
+	if Wrap(ast.Nowhere, Load, orig) != orig { t.Error("diagnostics should be returned as is") }
+}
+
+func TestSort(t *testing.T) {
+	ds := []*Diagnostic{
+		Errorf(ast.Nowhere, Internal, "e"),
+		Errorf(ast.Loc{File: "b.org", Line: 1}, Syntax, "d"),
+		Errorf(ast.Loc{File: "a.org", Line: 9}, Syntax, "c"),
+		Warningf(ast.Loc{File: "a.org", Line: 2}, UserWarning, "a"),
+		Errorf(ast.Loc{File: "a.org", Line: 2}, Syntax, "b"),
+	}
+	Sort(ds)
+	var got string
+	for _, d := range ds {
+		got += d.Message
+	}
+	if got != "abcde" { t.Errorf("got %s", got) }
+}
+
+func TestRender(t *testing.T) {
+	d := Errorf(ast.Loc{File: "a.org", Line: 2}, Undefined, "undeclared identifier 'x'")
+	var b bytes.Buffer
+	Render(&b, d, func(file string, line int) (string, bool) { return "\tintout(x)", line == 2 })
+	want := "a.org:2: error[E0100]: undeclared identifier 'x'\n    2 | \tintout(x)\n      | \t^\n"
+	if b.String() != want { t.Errorf("got:\n%s\nwant:\n%s", b.String(), want) }
+
+	b.Reset()
+	Render(&b, d, func(string, int) (string, bool) { return "", false })
+	if strings.Count(b.String(), "\n") != 1 { t.Errorf("missing line should print the header only: %q", b.String()) }
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteJSON(&b, nil); err != nil || strings.TrimSpace(b.String()) != "[]" { t.Errorf("empty: %q", b.String()) }
+	b.Reset()
+	WriteJSON(&b, []*Diagnostic{Warningf(ast.Loc{File: "a.org", Line: 1}, TargetIgnored, "ignored")})
+	for _, s := range []string{`"file": "a.org"`, `"line": 1`, `"severity": "warning"`, `"code": "W0001"`, `"message": "ignored"`} {
+		if !strings.Contains(b.String(), s) { t.Errorf("missing %s in %s", s, b.String()) }
+	}
+}
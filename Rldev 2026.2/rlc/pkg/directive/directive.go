@@ -25,11 +25,12 @@ package directive
 import (
 	"fmt"
 
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
 	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
 	"github.com/yoremi/rldev-go/rlc/pkg/expr"
 	"github.com/yoremi/rldev-go/rlc/pkg/ini"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/memory"
 	"github.com/yoremi/rldev-go/rlc/pkg/meta"
 )
@@ -50,15 +51,15 @@ type Compiler struct {
 
 	// Errors/warnings collected during compilation
 	Errors   []error
-	Warnings []string
+	Warnings []*diag.Diagnostic
 }
 
-func (c *Compiler) error(loc ast.Loc, msg string) {
-	c.Errors = append(c.Errors, fmt.Errorf("%s: %s", loc, msg))
+func (c *Compiler) error(loc ast.Loc, code diag.Code, msg string) {
+	c.Errors = append(c.Errors, diag.Errorf(loc, code, "%s", msg))
 }
 
-func (c *Compiler) warning(loc ast.Loc, msg string) {
-	c.Warnings = append(c.Warnings, fmt.Sprintf("%s: %s", loc, msg))
+func (c *Compiler) warning(loc ast.Loc, code diag.Code, msg string) {
+	c.Warnings = append(c.Warnings, diag.Warningf(loc, code, "%s", msg))
 }
 
 // ============================================================
@@ -73,7 +74,7 @@ func (c *Compiler) Compile(stmt ast.Stmt) {
 
 	case ast.DTargetStmt:
 		if c.TargetForced {
-			c.warning(s.Loc, "target specified on command-line: ignoring #target directive")
+			c.warning(s.Loc, diag.TargetIgnored, "target specified on command-line: ignoring #target directive")
 		} else {
 			t := kfn.ParseTarget(s.Target)
 			if c.Target != nil {
@@ -103,7 +104,7 @@ func (c *Compiler) Compile(stmt ast.Stmt) {
 					StrVal: str,
 				})
 			} else {
-				c.error(s.Loc, fmt.Sprintf("const value for '%s' must be a compile-time constant", s.Ident))
+				c.error(s.Loc, diag.NotConst, fmt.Sprintf("const value for '%s' must be a compile-time constant", s.Ident))
 			}
 		}
 
@@ -112,12 +113,13 @@ func (c *Compiler) Compile(stmt ast.Stmt) {
 			Kind:         memory.KindInline,
 			InlineParams: s.Params,
 			InlineBody:   s.Body,
+			InlineScoped: s.Scoped,
 		})
 
 	case ast.DUndefStmt:
 		for _, name := range s.Idents {
 			if err := c.Mem.Undefine(name); err != nil {
-				c.error(s.Loc, fmt.Sprintf("cannot undefine '%s': %v", name, err))
+				c.error(s.Loc, diag.Directive, fmt.Sprintf("cannot undefine '%s': %v", name, err))
 			}
 		}
 
@@ -139,7 +141,7 @@ func (c *Compiler) Compile(stmt ast.Stmt) {
 func (c *Compiler) compileSet(s ast.DSetStmt) {
 	sym, ok := c.Mem.Get(s.Ident)
 	if !ok {
-		c.error(s.Loc, fmt.Sprintf("cannot mutate '%s': not defined", s.Ident))
+		c.error(s.Loc, diag.Directive, fmt.Sprintf("cannot mutate '%s': not defined", s.Ident))
 		return
 	}
 	switch sym.Kind {
@@ -156,7 +158,7 @@ func (c *Compiler) compileSet(s ast.DSetStmt) {
 			c.Mem.Mutate(s.Ident, memory.Symbol{Kind: memory.KindMacro, Expr: s.Value})
 		}
 	default:
-		c.error(s.Loc, fmt.Sprintf("cannot mutate '%s': not a constant", s.Ident))
+		c.error(s.Loc, diag.Directive, fmt.Sprintf("cannot mutate '%s': not a constant", s.Ident))
 	}
 }
 
@@ -168,15 +170,15 @@ func (c *Compiler) compileGeneric(loc ast.Loc, name string, value ast.Expr) {
 	switch name {
 	case "warn":
 		s := c.exprToString(value)
-		c.warning(loc, s)
+		c.warning(loc, diag.UserWarning, s)
 
 	case "error":
 		s := c.exprToString(value)
-		c.error(loc, s)
+		c.error(loc, diag.UserError, s)
 
 	case "print":
 		s := c.exprToString(value)
-		c.Warnings = append(c.Warnings, fmt.Sprintf("%s line %d: %s", loc.File, loc.Line, s))
+		c.Warnings = append(c.Warnings, &diag.Diagnostic{Loc: loc, Severity: diag.SevNote, Code: diag.UserPrint, Message: s})
 
 	case "resource":
 		// Resource loading would be handled by the full compiler
@@ -204,7 +206,7 @@ func (c *Compiler) compileGeneric(loc ast.Loc, name string, value ast.Expr) {
 		if err == nil {
 			idx := int(v)
 			if idx < 0 || idx >= 100 {
-				c.error(loc, fmt.Sprintf("invalid entrypoint #Z%02d: valid values are 0..99", idx))
+				c.error(loc, diag.Directive, fmt.Sprintf("invalid entrypoint #Z%02d: valid values are 0..99", idx))
 			} else if c.Output != nil {
 				c.Output.AddEntrypoint(idx)
 			}
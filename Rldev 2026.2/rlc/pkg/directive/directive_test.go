@@ -3,11 +3,11 @@ package directive
 import (
 	"testing"
 
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
 	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
 	"github.com/yoremi/rldev-go/rlc/pkg/expr"
 	"github.com/yoremi/rldev-go/rlc/pkg/ini"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/memory"
 	"github.com/yoremi/rldev-go/rlc/pkg/meta"
 )
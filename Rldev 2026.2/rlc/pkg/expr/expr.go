@@ -24,6 +24,7 @@ import (
 	"fmt"
 
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
 	"github.com/yoremi/rldev-go/rlc/pkg/memory"
 )
 
@@ -132,11 +133,11 @@ func NewNormalizer(mem *memory.Memory) *Normalizer {
 }
 
 func (n *Normalizer) error(loc ast.Loc, msg string) {
-	n.Errors = append(n.Errors, fmt.Errorf("%s: %s", loc, msg))
+	n.Errors = append(n.Errors, diag.Errorf(loc, diag.Expr, "%s", msg))
 }
 
 func (n *Normalizer) errorf(loc ast.Loc, format string, args ...interface{}) {
-	n.Errors = append(n.Errors, fmt.Errorf("%s: %s", loc, fmt.Sprintf(format, args...)))
+	n.Errors = append(n.Errors, diag.Errorf(loc, diag.Expr, format, args...))
 }
 
 // ============================================================
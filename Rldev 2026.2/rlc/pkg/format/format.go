@@ -0,0 +1,708 @@
+// Package format prints a Kepago AST back out as canonical source, for
+// `rlc fmt`.
+//
+// The canonical form has one statement per line, two spaces of
+// indentation per block level, single spaces around binary and assignment
+// operators, and at most one blank line between statements. Literals keep
+// their source spelling ($FF stays $FF, strings are copied verbatim with
+// their control codes), and comments are put back before the statement
+// they preceded or at the end of the line they trailed. #if bodies are not
+// indented, so that whole-file guards in headers leave the file flat.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/lexer"
+	"github.com/yoremi/rldev-go/rlc/pkg/parser"
+	"github.com/yoremi/rldev-go/rlc/pkg/token"
+)
+
+// indentUnit is one level of indentation.
+const indentUnit = "  "
+
+// Source parses src and returns it in canonical form. As a safety net,
+// the result is parsed again and must give the same program; otherwise
+// the file is left to the user rather than silently changed. CRLF line
+// endings are kept.
+func Source(src []byte, filename string) ([]byte, error) {
+	crlf := bytes.Contains(src, []byte("\r\n"))
+	src = bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))
+	sf, err := parser.ParseFile(src, filename)
+	if err != nil {
+		return nil, err
+	}
+	out := print(sf, src)
+	check, err := parser.ParseFile(out, filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: formatted source does not parse (%v); please report this", filename, err)
+	}
+	if !same(reflect.ValueOf(sf.Stmts), reflect.ValueOf(check.Stmts)) || len(check.Comments) != len(sf.Comments) {
+		return nil, fmt.Errorf("%s: formatting would change the program; please report this", filename)
+	}
+	if crlf {
+		out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	}
+	return out, nil
+}
+
+// print prints a parsed source file. The source text gives what the AST
+// does not record: blank lines, the lines of closing keywords such as
+// #endif, before which comments must be put back, and the text after
+// `eof`, which is copied as it is.
+func print(sf *ast.SourceFile, src []byte) []byte {
+	p := &printer{comments: sf.Comments, lineOut: make(map[int]int), blankSrc: make(map[int]bool),
+		closers: make(map[token.Type][]int)}
+	lines := strings.Split(string(src), "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			p.blankSrc[i+1] = true
+		}
+	}
+	eof := 0
+	lex := lexer.New(string(src), sf.Name)
+	for t := lex.Next(); t.Type != token.EOF && eof == 0; t = lex.Next() {
+		switch t.Type {
+		case token.ELSE, token.TILL, token.OTHER, token.ECASE, token.DELSE, token.DENDIF:
+			p.closers[t.Type] = append(p.closers[t.Type], t.Line)
+		case token.DEOF:
+			eof = t.Line
+		}
+	}
+	p.stmts(sf.Stmts)
+	if eof == 0 {
+		p.flushComments(math.MaxInt32)
+	} else {
+		p.flushComments(eof)
+		p.blank(eof)
+		tail := lines[eof-1:]
+		for len(tail) > 0 && strings.TrimSpace(tail[len(tail)-1]) == "" {
+			tail = tail[:len(tail)-1]
+		}
+		p.out = append(p.out, tail...)
+	}
+	var b strings.Builder
+	for _, l := range p.out {
+		b.WriteString(strings.TrimRight(l, " \t"))
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// ============================================================
+// Statements
+// ============================================================
+
+// printer accumulates output lines. Statements carry the source line they
+// started on, which places comments and blank lines.
+type printer struct {
+	out      []string
+	indent   int
+	open     bool // at the start of a block: no blank line
+	prev     int  // source line of the last line printed
+	blankSrc map[int]bool
+	closers  map[token.Type][]int // source lines of the closing keywords, in order
+	comments []ast.Comment
+	next     int         // first comment not printed yet
+	lineOut  map[int]int // source line -> output line of the last statement started on it
+}
+
+// line prints text at the current indentation. src is the source line it
+// comes from, or 0 if unknown.
+func (p *printer) line(src int, text string) {
+	if src > 0 {
+		p.flushComments(src)
+		p.blank(src)
+		p.lineOut[src] = len(p.out)
+		p.prev = src
+	}
+	p.out = append(p.out, strings.Repeat(indentUnit, p.indent)+text)
+	p.open = false
+}
+
+// blank keeps one blank line where the source had any before line src.
+func (p *printer) blank(src int) {
+	if p.blankSrc[src-1] && src != p.prev && !p.open && len(p.out) > 0 {
+		p.out = append(p.out, "")
+	}
+}
+
+// flushComments prints the comments from before source line src.
+// Trailing comments go back on the line of their statement when it was
+// printed, and on a line of their own otherwise.
+func (p *printer) flushComments(src int) {
+	for ; p.next < len(p.comments) && p.comments[p.next].Loc.Line < src; p.next++ {
+		c := p.comments[p.next]
+		if i, ok := p.lineOut[c.Loc.Line]; ok && c.Trailing {
+			p.out[i] += " " + c.Text
+			continue
+		}
+		p.blank(c.Loc.Line)
+		p.out = append(p.out, strings.Repeat(indentUnit, p.indent)+c.Text)
+		p.open = false
+		p.prev = c.Loc.Line
+	}
+}
+
+// closer returns the source line of the next closing keyword of type t,
+// or 0 if there is none.
+func (p *printer) closer(t token.Type) int {
+	ls := p.closers[t]
+	if len(ls) == 0 {
+		return 0
+	}
+	p.closers[t] = ls[1:]
+	return ls[0]
+}
+
+func (p *printer) stmts(ss []ast.Stmt) {
+	for i, s := range ss {
+		p.stmt(s)
+		// A label right after a bare identifier or a call would be read
+		// as its goto target: keep them apart.
+		if i+1 < len(ss) && len(p.out) > 0 {
+			if _, ok := ss[i+1].(ast.LabelStmt); ok && endsCall(p.out[len(p.out)-1]) {
+				p.out[len(p.out)-1] += ","
+			}
+		}
+	}
+}
+
+// block prints statements one level deeper.
+func (p *printer) block(ss []ast.Stmt) {
+	p.indent++
+	p.open = true
+	p.stmts(ss)
+	p.indent--
+}
+
+// body prints a header and the statement it controls: a block goes
+// between the header's ':' and a closing ';', anything else on the next
+// line, indented.
+func (p *printer) body(src int, header string, s ast.Stmt) {
+	if b, ok := s.(ast.BlockStmt); ok {
+		p.line(src, header+":")
+		p.block(b.Stmts)
+		p.line(0, ";")
+		return
+	}
+	p.line(src, header)
+	p.block([]ast.Stmt{s})
+}
+
+func (p *printer) stmt(s ast.Stmt) {
+	if s == nil {
+		return
+	}
+	l := s.StmtLoc().Line
+	switch s := s.(type) {
+	case ast.HaltStmt:
+		p.line(l, "halt")
+	case ast.BreakStmt:
+		p.line(l, "break")
+	case ast.ContinueStmt:
+		p.line(l, "continue")
+	case ast.LabelStmt:
+		p.line(l, "@"+s.Label.Ident)
+	case ast.ReturnStmt:
+		switch {
+		case !s.Explicit:
+			p.line(l, Expr(s.Expr))
+		case s.Expr != nil:
+			p.line(l, "return "+Expr(s.Expr))
+		default:
+			p.line(l, "return")
+		}
+	case ast.AssignStmt:
+		p.line(l, Expr(s.Dest)+" "+s.Op.String()+" "+Expr(s.Expr))
+	case ast.FuncCallStmt:
+		p.line(l, call(s.Ident, s.Params, s.Label))
+	case ast.SelectStmt:
+		p.line(l, selCall(s.Ident, s.Window, s.Params))
+	case ast.GotoOnStmt:
+		labels := make([]string, len(s.Labels))
+		for i, lb := range s.Labels {
+			labels[i] = "@" + lb.Ident
+		}
+		p.line(l, s.Ident+" "+Expr(s.Expr)+" { "+strings.Join(labels, ", ")+" }")
+	case ast.GotoCaseStmt:
+		arms := make([]string, len(s.Cases))
+		for i, c := range s.Cases {
+			v := "_"
+			if !c.IsDefault {
+				v = Expr(c.Expr)
+			}
+			arms[i] = v + ": @" + c.Label.Ident
+		}
+		p.line(l, s.Ident+" "+Expr(s.Expr)+" { "+strings.Join(arms, "; ")+" }")
+	case ast.UnknownOpStmt:
+		module := s.OpIdent
+		if module == "" {
+			module = strconv.Itoa(s.OpModule)
+		}
+		text := fmt.Sprintf("op<%d:%s:%05d, %d>", s.OpType, module, s.OpCode, s.Overload)
+		if len(s.Params) > 0 {
+			text += "(" + params(s.Params) + ")"
+		}
+		if s.Dest != nil {
+			text += " -> " + Expr(s.Dest)
+		}
+		p.line(l, text)
+	case ast.VarOrFuncStmt:
+		p.line(l, s.Ident)
+	case ast.RawCodeStmt:
+		elts := []string{"raw"}
+		for _, e := range s.Elts {
+			if e.Kind == "int" {
+				elts = append(elts, strconv.Itoa(int(e.Int)))
+			} else {
+				elts = append(elts, e.Str)
+			}
+		}
+		p.line(l, strings.Join(append(elts, "endraw"), " "))
+
+	case ast.IfStmt:
+		p.body(l, "if "+Expr(s.Cond), s.Then)
+		for s.Else != nil {
+			elif, ok := s.Else.(ast.IfStmt)
+			if !ok {
+				p.body(p.closer(token.ELSE), "else", s.Else)
+				break
+			}
+			p.closer(token.ELSE)
+			p.body(elif.Loc.Line, "else if "+Expr(elif.Cond), elif.Then)
+			s = elif
+		}
+	case ast.WhileStmt:
+		p.body(l, "while "+Expr(s.Cond), s.Body)
+	case ast.RepeatStmt:
+		p.line(l, "repeat")
+		p.block(s.Body)
+		p.line(p.closer(token.TILL), "till "+Expr(s.Cond))
+	case ast.ForStmt:
+		p.body(l, "for ("+inline(s.Init)+"; "+Expr(s.Cond)+"; "+inline(s.Step)+")", s.Body)
+	case ast.CaseStmt:
+		p.line(l, "case "+Expr(s.Expr))
+		for _, arm := range s.Arms {
+			p.line(arm.Cond.ExprLoc().Line, "of "+Expr(arm.Cond))
+			p.block(arm.Body)
+		}
+		if s.Default != nil {
+			p.line(p.closer(token.OTHER), "other")
+			p.block(s.Default)
+		}
+		p.line(p.closer(token.ECASE), "ecase")
+	case ast.BlockStmt:
+		p.body(l, "", s)
+	case ast.SeqStmt:
+		p.stmts(s.Stmts)
+	case ast.HidingStmt:
+		p.body(s.Loc.Line, "#hiding "+s.Ident, s.Body)
+
+	case ast.DeclStmt:
+		p.line(l, decl(s))
+	case ast.DefineStmt:
+		kw := "#define"
+		if s.Scoped {
+			kw = "#sdefine"
+		}
+		p.line(l, kw+" "+s.Ident+value(s.Value))
+	case ast.DConstStmt:
+		kw := [...]string{"#const", "#bind", "#ebind"}[s.Kind]
+		p.line(l, kw+" "+s.Ident+value(s.Value))
+	case ast.DUndefStmt:
+		p.line(l, "#undef "+strings.Join(s.Idents, ", "))
+	case ast.DSetStmt:
+		if s.ReadOnly {
+			p.line(l, "#set "+s.Ident+" "+s.Op.String()+" "+Expr(s.Value))
+		} else {
+			p.line(l, "#redef "+s.Ident+value(s.Value))
+		}
+	case ast.DTargetStmt:
+		p.line(l, "#target "+s.Target)
+	case ast.DVersionStmt:
+		parts := []ast.Expr{s.A, s.B, s.C, s.D}
+		for len(parts) > 1 && synthesised(parts[len(parts)-1]) {
+			parts = parts[:len(parts)-1]
+		}
+		p.line(l, "#version "+exprs(parts, "."))
+	case ast.DirectiveStmt:
+		text := "#" + s.Name
+		if s.Value != nil {
+			text += " " + Expr(s.Value)
+		}
+		p.line(l, text)
+	case ast.LoadFileStmt:
+		p.line(l, "#load "+Expr(s.Path))
+	case ast.DInlineStmt:
+		kw := "#inline"
+		if s.Scoped {
+			kw = "#sinline"
+		}
+		ps := make([]string, len(s.Params))
+		for i, ip := range s.Params {
+			switch {
+			case ip.Optional:
+				ps[i] = "[" + ip.Ident + "]"
+			case ip.Default != nil:
+				ps[i] = ip.Ident + " = " + Expr(ip.Default)
+			default:
+				ps[i] = ip.Ident
+			}
+		}
+		p.body(l, kw+" "+s.Ident+"("+strings.Join(ps, ", ")+")", s.Body)
+	case ast.DForStmt:
+		p.body(l, "#for "+s.Ident+" = "+Expr(s.From)+" .. "+Expr(s.To), s.Body)
+	case ast.DIfStmt:
+		p.dif(s, "#if")
+	default:
+		p.line(l, fmt.Sprintf("{- unprintable %T -}", s))
+	}
+}
+
+// dif prints an #if chain. The bodies keep the enclosing indentation.
+func (p *printer) dif(s ast.DIfStmt, kw string) {
+	cond := s.Cond
+	if s.Ifdef {
+		kw = "#ifdef"
+		if u, ok := cond.(ast.UnaryExpr); ok {
+			kw, cond = "#ifndef", u.Val
+		}
+		if fc, ok := cond.(ast.FuncCall); ok && len(fc.Params) == 1 {
+			if sp, ok := fc.Params[0].(ast.SimpleParam); ok {
+				cond = sp.Expr
+			}
+		}
+	}
+	p.line(s.Loc.Line, kw+" "+Expr(cond))
+	p.stmts(s.Body)
+	switch c := s.Cont.(type) {
+	case ast.DIfStmt:
+		p.dif(c, "#elseif")
+	case ast.DElseStmt:
+		p.line(p.closer(token.DELSE), "#else")
+		p.stmts(c.Body)
+		p.line(p.closer(token.DENDIF), "#endif")
+	default:
+		p.line(p.closer(token.DENDIF), "#endif")
+	}
+}
+
+// inline prints the statements of a for header on one line.
+func inline(ss []ast.Stmt) string {
+	p := &printer{lineOut: make(map[int]int), closers: make(map[token.Type][]int)}
+	p.stmts(ss)
+	for i := range p.out {
+		p.out[i] = strings.TrimSpace(p.out[i])
+	}
+	return strings.Join(p.out, ", ")
+}
+
+func decl(s ast.DeclStmt) string {
+	var b strings.Builder
+	switch {
+	case s.Type.IsStr:
+		b.WriteString("str")
+	case s.Type.BitWidth == 1:
+		b.WriteString("bit")
+	case s.Type.BitWidth == 2:
+		b.WriteString("bit2")
+	case s.Type.BitWidth == 4:
+		b.WriteString("bit4")
+	case s.Type.BitWidth == 8:
+		b.WriteString("byte")
+	default:
+		b.WriteString("int")
+	}
+	if len(s.Dirs) > 0 {
+		dirs := make([]string, len(s.Dirs))
+		for i, d := range s.Dirs {
+			dirs[i] = ast.DeclDirString(d)
+		}
+		b.WriteString("(" + strings.Join(dirs, ", ") + ")")
+	}
+	for i, v := range s.Vars {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(" " + v.Ident)
+		switch {
+		case v.AutoArray:
+			b.WriteString("[]")
+		case v.ArraySize != nil:
+			b.WriteString("[" + Expr(v.ArraySize) + "]")
+		}
+		switch {
+		case v.ArrayInit != nil:
+			b.WriteString(" = {" + exprs(v.ArrayInit, ", ") + "}")
+		case v.Init != nil:
+			b.WriteString(" = " + Expr(v.Init))
+		}
+		if v.AddrFrom != nil {
+			b.WriteString(" -> " + Expr(v.AddrFrom))
+			if v.AddrTo != nil {
+				b.WriteString("." + Expr(v.AddrTo))
+			}
+		}
+	}
+	return b.String()
+}
+
+// value prints the value of a #define-like directive; the implicit 1 of
+// `#define X` is left out.
+func value(e ast.Expr) string {
+	if synthesised(e) {
+		return ""
+	}
+	return " = " + Expr(e)
+}
+
+// synthesised reports whether e is a literal the parser made up rather
+// than read.
+func synthesised(e ast.Expr) bool {
+	lit, ok := e.(ast.IntLit)
+	return ok && lit.Raw == ""
+}
+
+// endsCall reports whether a printed line ends in a bare identifier or a
+// call, the only things a following label would attach to as their goto
+// target.
+func endsCall(line string) bool {
+	if strings.HasSuffix(line, ")") {
+		open := openParen(line)
+		return open > 0 && endsIdent(line[:open])
+	}
+	return endsIdent(line)
+}
+
+// endsIdent reports whether s ends in an identifier, rather than a
+// number, a label, a directive or a closing keyword.
+func endsIdent(s string) bool {
+	r := []rune(s)
+	i := len(r)
+	for i > 0 && lexer.IsIdentChar(r[i-1]) {
+		i--
+	}
+	if i == len(r) || (i > 0 && r[i-1] == '@') {
+		return false
+	}
+	if c := r[i]; (c >= '0' && c <= '9') || c == '$' || c == '#' {
+		return false
+	}
+	return !closers[string(r[i:])]
+}
+
+// openParen returns the index of the '(' matching the ')' that ends s, or
+// -1 if there is none. Parentheses in string literals are skipped.
+func openParen(s string) int {
+	var open []int
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			open = append(open, i)
+		case c == ')' && len(open) > 0:
+			if i == len(s)-1 {
+				return open[len(open)-1]
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	return -1
+}
+
+// closers are the keywords a printed line can end with.
+var closers = map[string]bool{
+	"halt": true, "break": true, "continue": true, "return": true, "repeat": true,
+	"else": true, "other": true, "ecase": true, "endraw": true,
+}
+
+// ============================================================
+// Expressions
+// ============================================================
+
+// Expr returns the canonical text of an expression.
+func Expr(e ast.Expr) string {
+	switch e := e.(type) {
+	case nil:
+		return ""
+	case ast.IntLit:
+		if e.Raw != "" {
+			return e.Raw
+		}
+		return strconv.Itoa(int(e.Val))
+	case ast.StrLit:
+		if e.Raw != "" {
+			return e.Raw
+		}
+		return quote(e.Tokens)
+	case ast.ResRef:
+		return "#res<" + e.Key + ">"
+	case ast.StoreRef:
+		return "store"
+	case ast.IntVar:
+		return ast.VariableName(e.Bank) + "[" + Expr(e.Index) + "]"
+	case ast.StrVar:
+		return ast.VariableName(e.Bank) + "[" + Expr(e.Index) + "]"
+	case ast.Deref:
+		return e.Ident + "[" + Expr(e.Index) + "]"
+	case ast.VarOrFunc:
+		return e.Ident
+	case ast.BinOp:
+		return Expr(e.LHS) + " " + e.Op.String() + " " + Expr(e.RHS)
+	case ast.CmpExpr:
+		return Expr(e.LHS) + " " + e.Op.String() + " " + Expr(e.RHS)
+	case ast.ChainExpr:
+		return Expr(e.LHS) + " " + e.Op.String() + " " + Expr(e.RHS)
+	case ast.UnaryExpr:
+		return e.Op.String() + Expr(e.Val)
+	case ast.ParenExpr:
+		return "(" + Expr(e.Expr) + ")"
+	case ast.FuncCall:
+		return call(e.Ident, e.Params, e.Label)
+	case ast.SelFuncCall:
+		return selCall(e.Ident, e.Window, e.Params)
+	case ast.ExprSeq:
+		return e.Name
+	}
+	return fmt.Sprintf("{- unprintable %T -}", e)
+}
+
+func exprs(es []ast.Expr, sep string) string {
+	parts := make([]string, len(es))
+	for i, e := range es {
+		parts[i] = Expr(e)
+	}
+	return strings.Join(parts, sep)
+}
+
+// call prints a function call. A call with a label and no parameters is
+// written without parentheses, as in `goto @x`.
+func call(ident string, ps []ast.Param, label *ast.Label) string {
+	s := ident
+	if ps != nil || label == nil {
+		s += "(" + params(ps) + ")"
+	}
+	if label != nil {
+		s += " @" + label.Ident
+	}
+	return s
+}
+
+func params(ps []ast.Param) string {
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		switch p := p.(type) {
+		case ast.SimpleParam:
+			parts[i] = Expr(p.Expr)
+		case ast.ComplexParam:
+			parts[i] = "{" + exprs(p.Exprs, ", ") + "}"
+		case ast.SpecialParam:
+			parts[i] = strconv.Itoa(p.Tag) + ":{" + exprs(p.Exprs, ", ") + "}"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func selCall(ident string, window ast.Expr, ps []ast.SelParam) string {
+	s := ident
+	if window != nil {
+		s += "[" + Expr(window) + "]"
+	}
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		switch p := p.(type) {
+		case ast.AlwaysSelParam:
+			parts[i] = Expr(p.Expr)
+		case ast.CondSelParam:
+			conds := make([]string, len(p.Conds))
+			for j, c := range p.Conds {
+				conds[j] = selCond(c)
+			}
+			parts[i] = strings.Join(conds, " ") + ": " + Expr(p.Expr)
+		}
+	}
+	return s + "(" + strings.Join(parts, ", ") + ")"
+}
+
+// selCond prints a select condition as effect(arg) if cond.
+func selCond(c ast.SelCond) string {
+	s := c.Ident
+	if c.Arg != nil {
+		s += "(" + Expr(c.Arg) + ")"
+	}
+	if c.Cond != nil {
+		s += " if " + Expr(c.Cond)
+	}
+	return s
+}
+
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quote writes the text of a synthesised string literal.
+func quote(toks []ast.StrToken) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, t := range toks {
+		if tt, ok := t.(ast.TextToken); ok {
+			b.WriteString(quoteEscaper.Replace(tt.Text))
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// ============================================================
+// AST walking
+// ============================================================
+
+var locType = reflect.TypeOf(ast.Loc{})
+
+// same compares two ASTs, ignoring source locations.
+func same(a, b reflect.Value) bool {
+	if !a.IsValid() || !b.IsValid() {
+		return a.IsValid() == b.IsValid()
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return same(a.Elem(), b.Elem())
+	case reflect.Struct:
+		if a.Type() == locType {
+			return true
+		}
+		for i := 0; i < a.NumField(); i++ {
+			if !same(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !same(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return a.Interface() == b.Interface()
+}
@@ -0,0 +1,156 @@
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+)
+
+func check(t *testing.T, src, want string) {
+	t.Helper()
+	got, err := Source([]byte(src), "test.org")
+	if err != nil { t.Fatal(err) }
+	if string(got) != want { t.Errorf("got:\n%s\nwant:\n%s", got, want) }
+	again, err := Source(got, "test.org")
+	if err != nil || string(again) != string(got) { t.Errorf("not idempotent: %v\n%s", err, again) }
+}
+
+func TestSpacingAndIndentation(t *testing.T) {
+	check(t, `#define   MAX=$FF
+int(zero) n=0,arr[3]={1,2,3}
+@loop
+intA[0]+=1, if intA[0]==MAX goto @done
+  intout(intA[0]*(2+n))
+if intA[0]<5: 'Hello, \{Kotomi}world'
+    strS[0]='a' ; else halt
+`, `#define MAX = $FF
+int(zero) n = 0, arr[3] = {1, 2, 3}
+@loop
+intA[0] += 1
+if intA[0] == MAX
+  goto @done
+intout(intA[0] * (2 + n))
+if intA[0] < 5:
+  'Hello, \{Kotomi}world'
+  strS[0] = 'a'
+;
+else
+  halt
+`)
+}
+
+func TestControlFlow(t *testing.T) {
+	check(t, `case intA[1] of 1 halt of 2 break other continue ecase
+repeat intA[2]-=1 till intA[2]<=0
+for(intA[3]=0;intA[3]<10;intA[3]+=1) intout(intA[3])
+while intA[0]>0 : intA[0]-=1 ;
+goto_on intA[0] {@a,@b}
+goto_case intA[0] {1:@a;_:@b}
+select('yes', hide if intA[0]: 'no')
+op<0:Msg:1,0>(5)
+`, `case intA[1]
+of 1
+  halt
+of 2
+  break
+other
+  continue
+ecase
+repeat
+  intA[2] -= 1
+till intA[2] <= 0
+for (intA[3] = 0; intA[3] < 10; intA[3] += 1)
+  intout(intA[3])
+while intA[0] > 0:
+  intA[0] -= 1
+;
+goto_on intA[0] { @a, @b }
+goto_case intA[0] { 1: @a; _: @b }
+select('yes', hide if intA[0]: 'no')
+op<0:Msg:00001, 0>(5)
+`)
+}
+
+func TestDirectives(t *testing.T) {
+	check(t, `#ifndef GUARD
+#define GUARD
+#set   X+=1
+#redef Y=2
+#version 1.2
+#sinline f(a,[b],c=3) intout(a)
+#for I=0..3 intout(I)
+#elseif X>1
+#else
+#error 'no'
+#endif
+`, `#ifndef GUARD
+#define GUARD
+#set X += 1
+#redef Y = 2
+#version 1.2
+#sinline f(a, [b], c = 3)
+  intout(a)
+#for I = 0 .. 3
+  intout(I)
+#elseif X > 1
+#else
+#error 'no'
+#endif
+`)
+}
+
+func TestComments(t *testing.T) {
+	check(t, `// header
+
+#if 1
+   foo   // trailing
+  {- block
+     comment -}
+  bar, baz // after two
+
+
+  // before endif
+#endif // guard
+`, `// header
+
+#if 1
+foo // trailing
+{- block
+     comment -}
+bar
+baz // after two
+
+// before endif
+#endif // guard
+`)
+}
+
+func TestLabelAfterCall(t *testing.T) {
+	// Without the comma, @b would become the goto target of foo.
+	check(t, "foo, @b\nhalt @c\n", "foo,\n@b\nhalt\n@c\n")
+	check(t, "intout(5), @b\nintA[0] = (intA[1])\n@c\n", "intout(5),\n@b\nintA[0] = (intA[1])\n@c\n")
+	// Nothing else takes a label.
+	check(t, "x = ~x & 0xff\n@lbl\nx = $ff\n@b\nstrS[0] = 'a (b)'\n@c\n", "x = ~x & 0xff\n@lbl\nx = $ff\n@b\nstrS[0] = 'a (b)'\n@c\n")
+}
+
+func TestEOF(t *testing.T) {
+	check(t, "halt\neof\n  notes  that are not code\n", "halt\neof\n  notes  that are not code\n")
+}
+
+func TestCRLF(t *testing.T) {
+	check(t, "intA[0]=1\r\n// c\r\n", "intA[0] = 1\r\n// c\r\n")
+}
+
+func TestRefused(t *testing.T) {
+	// The parser reads a stray ';' as text 0: printing it would change the
+	// program.
+	if _, err := Source([]byte("halt ;\n"), "test.org"); err == nil || !strings.Contains(err.Error(), "change the program") { t.Errorf("got %v", err) }
+	if _, err := Source([]byte("intA[0 = 1\n"), "test.org"); err == nil { t.Error("syntax error accepted") }
+}
+
+func TestExpr(t *testing.T) {
+	e := ast.BinOp{LHS: ast.IntLit{Val: 1}, Op: ast.OpShl, RHS: ast.UnaryExpr{Op: ast.UnarySub, Val: ast.IntVar{Bank: 0x0b, Index: ast.IntLit{Val: 2}}}}
+	if got := Expr(e); got != "1 << -intL[2]" { t.Errorf("got %q", got) }
+	if got := Expr(ast.StrLit{Tokens: []ast.StrToken{ast.TextToken{Text: `it's`}}}); got != `'it\'s'` { t.Errorf("got %q", got) }
+}
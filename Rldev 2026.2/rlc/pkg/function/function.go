@@ -17,9 +17,9 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
 	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 )
 
 // ============================================================
@@ -502,11 +502,7 @@ func CheckParamType(expected kfn.ParamType, actual ExprType) string {
 		if actual != ETInt {
 			return fmt.Sprintf("expected integer, found %s", etName(actual))
 		}
-	case kfn.PStr:
-		if actual != ETStr {
-			return fmt.Sprintf("expected string variable, found %s", etName(actual))
-		}
-	case kfn.PStrC, kfn.PStrV, kfn.PResStr:
+	case kfn.PStr, kfn.PStrC, kfn.PStrV, kfn.PResStr:
 		if actual != ETStr && actual != ETLiteral {
 			return fmt.Sprintf("expected string, found %s", etName(actual))
 		}
@@ -514,6 +510,59 @@ func CheckParamType(expected kfn.ParamType, actual ExprType) string {
 	return ""
 }
 
+// CheckParams type-checks the simple parameters of a call against
+// overload of fd. The error names the prototype that was expected.
+func CheckParams(fd *kfn.FuncDef, overload int, params []ast.Param) error {
+	if overload < 0 || overload >= len(fd.Prototypes) || !fd.Prototypes[overload].Defined {
+		return nil
+	}
+	defs := BuildParamDefs(fd.Prototypes[overload].Params, len(params))
+	for i, p := range params {
+		sp, ok := p.(ast.SimpleParam)
+		if !ok {
+			continue
+		}
+		et := ClassifyExpr(sp.Expr)
+		if et == ETInvalid {
+			continue
+		}
+		if msg := CheckParamType(defs[i].Type, et); msg != "" {
+			return fmt.Errorf("%s: parameter %d: %s (prototype: %s)", fd.Ident, i+1, msg, PrototypeString(fd, overload))
+		}
+	}
+	return nil
+}
+
+// PrototypeString renders overload of fd in KFN syntax, e.g.
+// "strcpy (strV, str, ?int)".
+func PrototypeString(fd *kfn.FuncDef, overload int) string {
+	if overload < 0 || overload >= len(fd.Prototypes) || !fd.Prototypes[overload].Defined {
+		return fd.Ident
+	}
+	var parts []string
+	for _, p := range fd.Prototypes[overload].Params {
+		var pre, post string
+		tagged := false
+		for _, f := range p.Flags {
+			switch f {
+			case kfn.FTextObject: pre += "#"
+			case kfn.FOptional:   pre += "?"
+			case kfn.FUncount:    pre += "<"
+			case kfn.FReturn:     pre += ">"
+			case kfn.FFake:       pre += "="
+			case kfn.FArgc:       post += "+"
+			case kfn.FTagged:     tagged = true
+			}
+		}
+		s := pre + p.Type.String() + post
+		if tagged {
+			s += " '" + p.Tag + "'"
+		}
+		parts = append(parts, s)
+	}
+	return fmt.Sprintf("%s (%s)", fd.Ident, strings.Join(parts, ", "))
+}
+
 func etName(t ExprType) string {
 	switch t {
 	case ETInt:     return "integer"
@@ -543,6 +592,10 @@ func LookupFuncDef(reg *kfn.Registry, ident string, params []ast.Param, ctrlCode
 	if !ok || len(fns) == 0 {
 		return nil, fmt.Errorf("undefined function '%s'", ident)
 	}
+	fns = reg.ForTarget(fns)
+	if len(fns) == 0 {
+		return nil, fmt.Errorf("function '%s' is not available in %s", ident, reg.CurrentVersionString())
+	}
 
 	if len(fns) == 1 {
 		return fns[0], nil
@@ -5,8 +5,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 )
 
 // ============================================================
@@ -369,6 +369,22 @@ func TestCheckParamType(t *testing.T) {
 	if CheckParamType(kfn.PStrC, ETInt) == "" { t.Error("strC/int should fail") }
 	if CheckParamType(kfn.PStr, ETStr) != "" { t.Error("str/str") }
 	if CheckParamType(kfn.PStr, ETInt) == "" { t.Error("str/int should fail") }
+	if CheckParamType(kfn.PStr, ETLiteral) != "" { t.Error("str/literal") }
+}
+
+func TestPrototypeString(t *testing.T) {
+	fd := &kfn.FuncDef{Ident: "f", Prototypes: []kfn.Prototype{{Defined: true, Params: []kfn.Parameter{
+		{Type: kfn.PStrV}, {Type: kfn.PInt, Flags: []kfn.ParamFlag{kfn.FOptional}}, {Type: kfn.PIntC, Flags: []kfn.ParamFlag{kfn.FArgc}},
+	}}}}
+	if got := PrototypeString(fd, 0); got != "f (strV, ?int, intC+)" { t.Errorf("got %q", got) }
+	if got := PrototypeString(fd, 1); got != "f" { t.Errorf("undefined overload: %q", got) }
+}
+
+func TestCheckParams(t *testing.T) {
+	fd := &kfn.FuncDef{Ident: "intout", Prototypes: []kfn.Prototype{{Defined: true, Params: []kfn.Parameter{{Type: kfn.PInt}}}}}
+	if err := CheckParams(fd, 0, []ast.Param{ast.SimpleParam{Expr: ast.IntLit{Val: 1}}}); err != nil { t.Error(err) }
+	err := CheckParams(fd, 0, []ast.Param{ast.SimpleParam{Expr: ast.StrLit{}}})
+	if err == nil || !strings.Contains(err.Error(), "parameter 1") || !strings.Contains(err.Error(), "intout (int)") { t.Errorf("got %v", err) }
 }
 
 // ============================================================
@@ -389,6 +405,14 @@ func TestLookupFuncDefUndefined(t *testing.T) {
 	if err == nil { t.Error("expected error") }
 }
 
+func TestLookupFuncDefUnavailable(t *testing.T) {
+	reg := kfn.NewRegistry()
+	reg.Target = kfn.TargetRealLive
+	reg.Register(&kfn.FuncDef{Ident: "kin", Targets: []kfn.TargetConstraint{{Class: kfn.TargetKinetic}}})
+	_, err := LookupFuncDef(reg, "kin", nil, false)
+	if err == nil || !strings.Contains(err.Error(), "not available in RealLive") { t.Errorf("got %v", err) }
+}
+
 func TestLookupFuncDefCtrlCode(t *testing.T) {
 	reg := kfn.NewRegistry()
 	reg.Register(&kfn.FuncDef{Ident: "strout", CCStr: "strout", OpModule: 3, OpCode: 0})
@@ -20,9 +20,9 @@
 package gotojmp
 
 import (
+	"github.com/yoremi/rldev-go/pkg/kfn"
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
 	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
-	"github.com/yoremi/rldev-go/rlc/pkg/kfn"
 )
 
 // ============================================================
@@ -66,6 +66,16 @@ func NewTable() *Table {
 	return &Table{defs: make(map[string][]Value)}
 }
 
+// Clone returns a copy of the table that can be modified (for instance by
+// #kidoku_type) without affecting t.
+func (t *Table) Clone() *Table {
+	c := NewTable()
+	for k, v := range t.defs {
+		c.defs[k] = v
+	}
+	return c
+}
+
 // Set defines a key with a value list.
 func (t *Table) Set(key string, values []Value) {
 	t.defs[strings.ToLower(key)] = values
@@ -23,12 +23,21 @@ import (
 
 // Lexer tokenizes Kepago source code into a stream of token.Token values.
 type Lexer struct {
-	src    []rune
-	pos    int
-	line   int
-	file   string
-	tokens []token.Token
-	idx    int // current read position in tokens
+	src      []rune
+	pos      int
+	line     int
+	file     string
+	tokens   []token.Token
+	idx      int // current read position in tokens
+	comments []Comment
+}
+
+// Comment is a comment or #line directive skipped by the lexer. The
+// parser keeps them so that tools regenerating source can put them back.
+type Comment struct {
+	Line     int
+	Text     string // as written, delimiters included
+	Trailing bool   // follows code on the same line
 }
 
 // New creates a Lexer from source text.
@@ -56,6 +65,9 @@ func (l *Lexer) Peek() token.Token {
 	return l.tokens[l.idx]
 }
 
+// Comments returns the comments of the source in order.
+func (l *Lexer) Comments() []Comment { return l.comments }
+
 // Backup unreads one token.
 func (l *Lexer) Backup() {
 	if l.idx > 0 {
@@ -104,6 +116,20 @@ func (l *Lexer) emitIntStr(typ token.Type, iv int32, sv string) {
 	l.tokens = append(l.tokens, token.Token{Type: typ, IntVal: iv, StrVal: sv, Line: l.line, File: l.file})
 }
 
+// setRaw records the source text from start as the spelling of the last
+// token.
+func (l *Lexer) setRaw(start int) {
+	l.tokens[len(l.tokens)-1].Raw = string(l.src[start:l.pos])
+}
+
+// addComment records the source text from start as a comment that began
+// on line.
+func (l *Lexer) addComment(start, line int) {
+	trailing := len(l.tokens) > 0 && l.tokens[len(l.tokens)-1].Line == line
+	text := strings.TrimRight(string(l.src[start:l.pos]), "\r\n")
+	l.comments = append(l.comments, Comment{Line: line, Text: text, Trailing: trailing})
+}
+
 // --- Main scan loop ---
 
 func (l *Lexer) scan() {
@@ -248,6 +274,7 @@ func (l *Lexer) scanOneChar(c rune) bool {
 
 func (l *Lexer) scanNumber() {
 	c := l.ch()
+	start := l.pos
 
 	// 0xHEX (C-style, with warning in OCaml)
 	if c == '0' && (l.peek1() == 'x' || l.peek1() == 'X') {
@@ -256,6 +283,7 @@ func (l *Lexer) scanNumber() {
 		s = strings.ReplaceAll(s, "_", "")
 		v, _ := strconv.ParseInt("0x"+s, 0, 32)
 		l.emitInt(int32(v))
+		l.setRaw(start)
 		return
 	}
 
@@ -277,6 +305,7 @@ func (l *Lexer) scanNumber() {
 			if s == "" { s = "0" }
 			v, _ := strconv.ParseInt(s, 2, 32)
 			l.emitInt(int32(v))
+			l.setRaw(start)
 		} else if next == '%' {
 			// $%octal
 			l.pos++
@@ -285,12 +314,14 @@ func (l *Lexer) scanNumber() {
 			if s == "" { s = "0" }
 			v, _ := strconv.ParseInt(s, 8, 32)
 			l.emitInt(int32(v))
+			l.setRaw(start)
 		} else if isHexDigit(next) {
 			// $hex
 			s := l.collectWhile(isHexDigitOrUnderscore)
 			s = strings.ReplaceAll(s, "_", "")
 			v, _ := strconv.ParseInt(s, 16, 32)
 			l.emitInt(int32(v))
+			l.setRaw(start)
 		} else {
 			// $ followed by non-hex → rewind, treat as ident
 			l.pos--
@@ -304,12 +335,14 @@ func (l *Lexer) scanNumber() {
 	s = strings.ReplaceAll(s, "_", "")
 	v, _ := strconv.ParseInt(s, 10, 32)
 	l.emitInt(int32(v))
+	l.setRaw(start)
 }
 
 // --- Strings ---
 
 func (l *Lexer) scanString() {
 	quote := l.ch()
+	start := l.pos
 	l.pos++ // skip opening quote
 	var sb strings.Builder
 	for l.pos < len(l.src) {
@@ -319,14 +352,13 @@ func (l *Lexer) scanString() {
 			break
 		}
 		if c == '\\' && l.pos+1 < len(l.src) {
+			// Control codes (\n, \i{...}, \{...) and escaped backslashes
+			// are kept for the parser, which splits the string into tokens.
 			l.pos++
-			switch l.src[l.pos] {
-			case 'n':  sb.WriteByte('\n')
-			case 't':  sb.WriteByte('\t')
-			case '\\': sb.WriteByte('\\')
-			case '\'': sb.WriteByte('\'')
-			case '"':  sb.WriteByte('"')
-			default:   sb.WriteRune(l.src[l.pos])
+			switch e := l.src[l.pos]; e {
+			case '\'', '"': sb.WriteRune(e)
+			case 't':       sb.WriteByte('\t')
+			default:        sb.WriteByte('\\'); sb.WriteRune(e)
 			}
 			l.pos++
 		} else {
@@ -336,6 +368,7 @@ func (l *Lexer) scanString() {
 		}
 	}
 	l.emitStr(token.STRING, sb.String())
+	l.setRaw(start)
 }
 
 // --- Labels ---
@@ -362,10 +395,24 @@ func (l *Lexer) scanIdentOrKeyword() {
 	// Magic constants
 	if word == "__file__" {
 		l.emitStr(token.STRING, l.file)
+		l.setRaw(start)
 		return
 	}
 	if word == "__line__" {
 		l.emitInt(int32(l.line))
+		l.setRaw(start)
+		return
+	}
+
+	// #res<key>: resource string reference
+	if word == "#res" && l.pos < len(l.src) && l.src[l.pos] == '<' {
+		l.pos++
+		key := l.collectWhile(func(r rune) bool { return r != '>' && r != '\n' })
+		if l.pos < len(l.src) && l.src[l.pos] == '>' {
+			l.pos++
+		}
+		l.emitStr(token.DRES, key)
+		l.setRaw(start)
 		return
 	}
 
@@ -375,6 +422,7 @@ func (l *Lexer) scanIdentOrKeyword() {
 		if l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
 			ns := l.collectWhile(func(r rune) bool { return r >= '0' && r <= '9' })
 			n, _ := strconv.Atoi(ns)
+			l.addComment(start, l.line)
 			l.line = n
 		}
 		return
@@ -419,10 +467,12 @@ func (l *Lexer) skipInlineSpace() {
 }
 
 func (l *Lexer) skipLineComment() {
+	start := l.pos
 	l.pos += 2 // skip //
 	for l.pos < len(l.src) && l.src[l.pos] != '\n' {
 		l.pos++
 	}
+	l.addComment(start, l.line)
 	if l.pos < len(l.src) {
 		l.pos++ // skip \n
 		l.line++
@@ -430,6 +480,8 @@ func (l *Lexer) skipLineComment() {
 }
 
 func (l *Lexer) skipBlockComment() {
+	start, line := l.pos, l.line
+	defer func() { l.addComment(start, line) }()
 	l.pos += 2 // skip {-
 	for l.pos < len(l.src) {
 		if l.src[l.pos] == '-' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '}' {
@@ -468,6 +520,10 @@ func isIdentCont(r rune) bool {
 	return isIdentStart(r) || (r >= '0' && r <= '9')
 }
 
+// IsIdentChar reports whether r may appear in an identifier or a label
+// name. Editors use it to find the word under the cursor.
+func IsIdentChar(r rune) bool { return isIdentCont(r) }
+
 func isHexDigit(r rune) bool {
 	return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
 }
@@ -513,6 +569,7 @@ var keywords = map[string]kwEntry{
 	"#version":     {token.DVERSION, 0, ""},
 	"#inline":      {token.DINLINE, 0, ""},
 	"#sinline":     {token.DINLINE, 0, "scoped"},
+	"#sub":         {token.DINLINE, 0, ""},
 	"#load":        {token.DLOAD, 0, ""},
 	"#if":          {token.DIF, 0, ""},
 	"#ifdef":       {token.DIFDEF, 1, ""}, // IntVal=1 → true
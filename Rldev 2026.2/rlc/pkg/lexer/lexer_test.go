@@ -138,7 +138,7 @@ func TestLexDirectives(t *testing.T) {
 		{"#load", token.DLOAD},
 		{"#if", token.DIF}, {"#ifdef", token.DIFDEF}, {"#ifndef", token.DIFDEF},
 		{"#else", token.DELSE}, {"#elseif", token.DELSEIF}, {"#endif", token.DENDIF},
-		{"#for", token.DFOR}, {"#inline", token.DINLINE}, {"#hiding", token.DHIDING},
+		{"#for", token.DFOR}, {"#inline", token.DINLINE}, {"#sub", token.DINLINE}, {"#hiding", token.DHIDING},
 	}
 	for _, tt := range tests {
 		l := New(tt.src, "test")
@@ -163,6 +163,15 @@ func TestLexDWithExpr(t *testing.T) {
 	}
 }
 
+func TestLexResRef(t *testing.T) {
+	l := New("#res<greeting> #resource", "test")
+	tok := l.Next()
+	if tok.Type != token.DRES || tok.StrVal != "greeting" || tok.Raw != "#res<greeting>" {
+		t.Errorf("got %s %q %q", tok.Type, tok.StrVal, tok.Raw)
+	}
+	if tok := l.Next(); tok.Type != token.DWITHEXPR { t.Errorf("#resource: got %s", tok.Type) }
+}
+
 func TestLexVariables(t *testing.T) {
 	tests := []struct{ src string; typ token.Type; bank int32 }{
 		{"intA", token.VAR, 0x00}, {"intB", token.VAR, 0x01},
@@ -310,3 +319,17 @@ func TestLexPeekBackup(t *testing.T) {
 	tok2b := l.Next()
 	if tok2b.IntVal != 2 { t.Errorf("backup+next: got %d", tok2b.IntVal) }
 }
+
+func TestLexRawAndComments(t *testing.T) {
+	l := New("intA[0] = $FF // hex\n{- two\nlines -} 'a\\'b' 1_000\n#line 40\n", "test")
+	var raws []string
+	for tok := l.Next(); tok.Type != token.EOF; tok = l.Next() {
+		if tok.Raw != "" { raws = append(raws, tok.Raw) }
+	}
+	if len(raws) != 4 || raws[1] != "$FF" || raws[2] != `'a\'b'` || raws[3] != "1_000" { t.Errorf("raw: %q", raws) }
+	cs := l.Comments()
+	if len(cs) != 3 { t.Fatalf("comments: %+v", cs) }
+	if cs[0] != (Comment{Line: 1, Text: "// hex", Trailing: true}) { t.Errorf("line comment: %+v", cs[0]) }
+	if cs[1] != (Comment{Line: 2, Text: "{- two\nlines -}"}) { t.Errorf("block comment: %+v", cs[1]) }
+	if cs[2] != (Comment{Line: 4, Text: "#line 40"}) { t.Errorf("#line: %+v", cs[2]) }
+}
@@ -51,6 +51,7 @@
 //     Single (')    single-quoted string
 //     Double (")    double-quoted string
 //     ResStr (<)    resource string (terminated by < or EOF)
+//     Raw           contents of a string literal scanned by the main lexer
 package lexer
 
 import (
@@ -65,6 +66,7 @@ const (
 	StrSingle StrTerminator = iota // terminated by '
 	StrDouble                      // terminated by "
 	StrResStr                      // terminated by < or EOF (resource strings)
+	StrRaw                         // terminated by EOF (contents of a literal already delimited by the main lexer)
 )
 
 // StrTokenType identifies the kind of string token.
@@ -0,0 +1,536 @@
+// Package lsp implements `rlc lsp`, a Language Server Protocol server for
+// Kepago sources, speaking JSON-RPC over stdio.
+//
+// It provides:
+//
+//   - diagnostics: each open document is compiled when it is opened and
+//     on every change, and its syntax and compile errors and warnings are
+//     published;
+//   - hover: the KFN prototypes of a function, or what the symbol table
+//     holds for a #define'd name, constant or variable;
+//   - go to definition: labels, #define/#const/#bind names, #inline's and
+//     variable declarations, in the document and the headers it #load's;
+//   - completion: function names from reallive.kfn.
+//
+// Documents are synchronised in full. Source locations only carry a line,
+// so definition ranges cover the name when it is found on its line, and
+// diagnostics cover the whole line.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/yoremi/rldev-go/pkg/config"
+	"github.com/yoremi/rldev-go/pkg/encoding"
+	"github.com/yoremi/rldev-go/pkg/kfn"
+	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/compilerframe"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
+	"github.com/yoremi/rldev-go/rlc/pkg/ini"
+	"github.com/yoremi/rldev-go/rlc/pkg/lexer"
+	"github.com/yoremi/rldev-go/rlc/pkg/memory"
+)
+
+// Server is a language server. Documents are checked with compilers from
+// NewCompiler, or, if it is nil, with plain compilers for KFN.
+type Server struct {
+	KFN         *kfn.Registry
+	NewCompiler func(path string) *compilerframe.Compiler
+
+	out      io.Writer
+	docs     map[string]*document // by URI
+	shutdown bool
+}
+
+// document is an open source file and the result of its last check.
+type document struct {
+	uri   string
+	path  string
+	lines []string
+
+	// From the last check: the compiler, which holds the symbol table,
+	// and the definitions, which are kept from the last check that parsed
+	// while the source has syntax errors.
+	comp *compilerframe.Compiler
+	defs map[string][]ast.Loc
+}
+
+// errExitWithoutShutdown is returned by Serve when the client exits
+// without asking the server to shut down first.
+var errExitWithoutShutdown = errors.New("exit without shutdown")
+
+// Serve reads requests from in and writes responses to out until the
+// client sends exit.
+func (s *Server) Serve(in io.Reader, out io.Writer) error {
+	s.out = out
+	s.docs = make(map[string]*document)
+	r := bufio.NewReader(in)
+	for {
+		m, err := readMessage(r)
+		var rerr *rpcError
+		switch {
+		case errors.As(err, &rerr):
+			s.replyError(m.ID, rerr.Code, rerr.Message)
+			continue
+		case err == io.EOF:
+			return errExitWithoutShutdown
+		case err != nil:
+			return err
+		}
+		if m.Method == "exit" {
+			if !s.shutdown {
+				return errExitWithoutShutdown
+			}
+			return nil
+		}
+		if err := s.handle(m); err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches one message. Unknown notifications, and notifications
+// with invalid parameters, are ignored.
+func (s *Server) handle(m *message) error {
+	var (
+		result interface{}
+		err    error
+	)
+	badParams := false
+	decode := func(v interface{}) bool {
+		if json.Unmarshal(m.Params, v) != nil {
+			badParams = true
+			return false
+		}
+		return true
+	}
+	switch m.Method {
+	case "initialize":
+		result = map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // full
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]interface{}{},
+			},
+			"serverInfo": map[string]string{"name": "rlc", "version": config.Version},
+		}
+	case "shutdown":
+		s.shutdown = true
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if decode(&p) {
+			err = s.update(p.TextDocument.URI, p.TextDocument.Text)
+		}
+	case "textDocument/didChange":
+		var p didChangeParams
+		if decode(&p) && len(p.ContentChanges) > 0 {
+			err = s.update(p.TextDocument.URI, p.ContentChanges[len(p.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		var p didCloseParams
+		if decode(&p) {
+			delete(s.docs, p.TextDocument.URI)
+			err = s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: p.TextDocument.URI, Diagnostics: []Diagnostic{}})
+		}
+	case "textDocument/hover", "textDocument/definition", "textDocument/completion":
+		var p positionParams
+		if !decode(&p) {
+			break
+		}
+		d := s.docs[p.TextDocument.URI]
+		if d == nil {
+			break
+		}
+		switch m.Method {
+		case "textDocument/hover":
+			if h := s.hover(d, p.Position); h != nil {
+				result = h
+			}
+		case "textDocument/definition":
+			result = s.definition(d, p.Position)
+		case "textDocument/completion":
+			result = s.completion(d, p.Position)
+		}
+	default:
+		return s.replyError(m.ID, codeMethodNotFound, "unsupported method "+m.Method)
+	}
+	switch {
+	case err != nil:
+		return err
+	case m.ID == nil:
+		return nil
+	case badParams:
+		return s.replyError(m.ID, codeInvalidParams, "invalid parameters for "+m.Method)
+	}
+	return writeMessage(s.out, response{JSONRPC: "2.0", ID: m.ID, Result: result})
+}
+
+func (s *Server) replyError(id json.RawMessage, code int, msg string) error {
+	if id == nil {
+		return nil
+	}
+	return writeMessage(s.out, errorResponse{JSONRPC: "2.0", ID: id, Error: rpcError{Code: code, Message: msg}})
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	return writeMessage(s.out, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// ============================================================
+// Checking documents
+// ============================================================
+
+// update records the new text of a document, checks it and publishes its
+// diagnostics.
+func (s *Server) update(uri, text string) error {
+	d := s.docs[uri]
+	if d == nil {
+		d = &document{uri: uri, path: uriToPath(uri)}
+		s.docs[uri] = d
+	}
+	d.lines = strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	ds := s.check(d, text)
+	return s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: ds})
+}
+
+// check compiles the text of d and returns its diagnostics. Diagnostics
+// located in other files (#load'ed headers) are shown on the first line,
+// prefixed with their location.
+func (s *Server) check(d *document, text string) []Diagnostic {
+	comp := s.compiler(d.path)
+	d.comp = comp
+	out := []Diagnostic{}
+	for _, dg := range compile(comp, d.path, text) {
+		line := 0
+		msg := dg.Message
+		switch {
+		case dg.Loc.File != "" && samePath(dg.Loc.File, d.path):
+			line = dg.Loc.Line - 1
+		case dg.Loc != ast.Nowhere:
+			msg = dg.Loc.String() + ": " + msg
+		}
+		if line < 0 || line >= len(d.lines) {
+			line = 0
+		}
+		sev := severityError
+		switch dg.Severity {
+		case diag.SevWarning:
+			sev = severityWarning
+		case diag.SevNote:
+			sev = severityInformation
+		}
+		out = append(out, Diagnostic{
+			Range:    Range{Position{line, 0}, Position{line, utf16Len(d.lines[line])}},
+			Severity: sev,
+			Code:     string(dg.Code),
+			Source:   "rlc",
+			Message:  msg,
+		})
+	}
+	if comp.Source(d.path) != nil {
+		d.defs = definitions(comp)
+	}
+	return out
+}
+
+func (s *Server) compiler(path string) *compilerframe.Compiler {
+	if s.NewCompiler != nil {
+		return s.NewCompiler(path)
+	}
+	return compilerframe.New(s.KFN.Clone(), ini.NewTable())
+}
+
+// compile runs comp over text and returns its diagnostics. The compiler
+// is not expected to panic, but a server that dies on a half-typed line
+// is of no use, so a panic is reported as an internal error.
+func compile(comp *compilerframe.Compiler, path, text string) (ds []*diag.Diagnostic) {
+	defer func() {
+		if r := recover(); r != nil {
+			ds = append(comp.Diagnostics(), diag.Errorf(ast.Nowhere, diag.Internal, "internal compiler error: %v", r))
+		}
+	}()
+	if err := comp.CompileSource(path, []byte(text)); err != nil {
+		comp.Errors = append(comp.Errors, diag.Wrap(ast.Nowhere, diag.Syntax, err))
+	}
+	return comp.Diagnostics()
+}
+
+// definitions indexes the labels ("@name"), macros, constants, inlines
+// and variables defined by the files comp read.
+func definitions(comp *compilerframe.Compiler) map[string][]ast.Loc {
+	defs := make(map[string][]ast.Loc)
+	add := func(name string, loc ast.Loc) { defs[name] = append(defs[name], loc) }
+	for _, f := range comp.Files() {
+		walk(comp.Source(f).Stmts, func(s ast.Stmt) {
+			switch x := s.(type) {
+			case ast.LabelStmt:
+				add("@"+x.Label.Ident, x.Label.Loc)
+			case ast.DefineStmt:
+				add(x.Ident, x.Loc)
+			case ast.DConstStmt:
+				add(x.Ident, x.Loc)
+			case ast.DInlineStmt:
+				add(x.Ident, x.Loc)
+			case ast.DeclStmt:
+				for _, v := range x.Vars {
+					add(v.Ident, v.Loc)
+				}
+			}
+		})
+	}
+	return defs
+}
+
+// walk calls fn for every statement of stmts, including nested ones.
+func walk(stmts []ast.Stmt, fn func(ast.Stmt)) {
+	for _, s := range stmts {
+		walkStmt(s, fn)
+	}
+}
+
+func walkStmt(s ast.Stmt, fn func(ast.Stmt)) {
+	if s == nil {
+		return
+	}
+	fn(s)
+	switch x := s.(type) {
+	case ast.BlockStmt:
+		walk(x.Stmts, fn)
+	case ast.SeqStmt:
+		walk(x.Stmts, fn)
+	case ast.IfStmt:
+		walkStmt(x.Then, fn)
+		walkStmt(x.Else, fn)
+	case ast.WhileStmt:
+		walkStmt(x.Body, fn)
+	case ast.RepeatStmt:
+		walk(x.Body, fn)
+	case ast.ForStmt:
+		walk(x.Init, fn)
+		walk(x.Step, fn)
+		walkStmt(x.Body, fn)
+	case ast.CaseStmt:
+		for _, a := range x.Arms {
+			walk(a.Body, fn)
+		}
+		walk(x.Default, fn)
+	case ast.HidingStmt:
+		walkStmt(x.Body, fn)
+	case ast.DInlineStmt:
+		walkStmt(x.Body, fn)
+	case ast.DForStmt:
+		walkStmt(x.Body, fn)
+	case ast.DIfStmt:
+		walk(x.Body, fn)
+		switch c := x.Cont.(type) {
+		case ast.DElseStmt:
+			walk(c.Body, fn)
+		case ast.DIfStmt:
+			walkStmt(c, fn)
+		}
+	}
+}
+
+// ============================================================
+// Hover, definition, completion
+// ============================================================
+
+// hover describes the function or symbol under the cursor.
+func (s *Server) hover(d *document, pos Position) *Hover {
+	word, rng := d.wordAt(pos)
+	if word == "" || word[0] == '@' {
+		return nil
+	}
+	var text string
+	if fns := s.KFN.Functions[word]; len(fns) > 0 {
+		var sigs []string
+		for _, f := range fns {
+			sigs = append(sigs, f.Signatures()...)
+		}
+		text = "```kepago\n" + strings.Join(sigs, "\n") + "\n```"
+	} else if d.comp != nil {
+		sym, ok := d.comp.Mem.Get(word)
+		if !ok {
+			return nil
+		}
+		text = fmt.Sprintf("`%s`: %s", word, d.comp.Mem.Describe(word))
+		switch sym.Kind {
+		case memory.KindInteger:
+			text += fmt.Sprintf(" = %d", sym.IntVal)
+		case memory.KindString:
+			text += fmt.Sprintf(" = %q", sym.StrVal)
+		}
+	} else {
+		return nil
+	}
+	return &Hover{Contents: markupContent{Kind: "markdown", Value: text}, Range: &rng}
+}
+
+// definition returns where the label or symbol under the cursor is
+// defined.
+func (s *Server) definition(d *document, pos Position) []Location {
+	word, _ := d.wordAt(pos)
+	locs := []Location{}
+	for _, loc := range d.defs[word] {
+		line := loc.Line - 1
+		text := s.lineText(d, loc.File, line)
+		start := 0
+		if i := strings.Index(text, word); i >= 0 {
+			start = utf16Len(text[:i])
+		}
+		locs = append(locs, Location{
+			URI:   pathToURI(loc.File),
+			Range: Range{Position{line, start}, Position{line, start + utf16Len(word)}},
+		})
+	}
+	return locs
+}
+
+// completion offers the KFN functions whose name starts with the word
+// before the cursor.
+func (s *Server) completion(d *document, pos Position) []CompletionItem {
+	prefix := d.prefixAt(pos)
+	items := []CompletionItem{}
+	for name, fns := range s.KFN.Functions {
+		if !strings.HasPrefix(name, prefix) || strings.HasPrefix(name, "__") {
+			continue
+		}
+		item := CompletionItem{Label: name, Kind: completionKindFunction}
+		if sigs := fns[0].Signatures(); len(sigs) > 0 {
+			item.Detail = sigs[0]
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+// lineText returns a line of a file: from the editor if it is open, or
+// from disk in the source encoding.
+func (s *Server) lineText(d *document, path string, line int) string {
+	lines := d.lines
+	if !samePath(path, d.path) {
+		lines = nil
+		for _, o := range s.docs {
+			if samePath(path, o.path) {
+				lines = o.lines
+			}
+		}
+		if lines == nil {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return ""
+			}
+			src, err := encoding.ToUTF8(data, d.comp.SourceEncoding)
+			if err != nil {
+				return ""
+			}
+			lines = strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+		}
+	}
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+	return lines[line]
+}
+
+// ============================================================
+// Positions
+// ============================================================
+
+// wordAt returns the identifier, or @label, at pos and its range.
+func (d *document) wordAt(pos Position) (string, Range) {
+	if pos.Line < 0 || pos.Line >= len(d.lines) {
+		return "", Range{}
+	}
+	line := []rune(d.lines[pos.Line])
+	i := runeIndex(line, pos.Character)
+	start, end := i, i
+	for start > 0 && lexer.IsIdentChar(line[start-1]) {
+		start--
+	}
+	for end < len(line) && lexer.IsIdentChar(line[end]) {
+		end++
+	}
+	if start == end {
+		return "", Range{}
+	}
+	if start > 0 && line[start-1] == '@' {
+		start--
+	}
+	rng := Range{
+		Position{pos.Line, utf16Len(string(line[:start]))},
+		Position{pos.Line, utf16Len(string(line[:end]))},
+	}
+	return string(line[start:end]), rng
+}
+
+// prefixAt returns the part of the identifier at pos that precedes it.
+func (d *document) prefixAt(pos Position) string {
+	if pos.Line < 0 || pos.Line >= len(d.lines) {
+		return ""
+	}
+	line := []rune(d.lines[pos.Line])
+	end := runeIndex(line, pos.Character)
+	start := end
+	for start > 0 && lexer.IsIdentChar(line[start-1]) {
+		start--
+	}
+	return string(line[start:end])
+}
+
+// runeIndex converts a UTF-16 column to an index into line.
+func runeIndex(line []rune, col int) int {
+	n := 0
+	for i, r := range line {
+		if n >= col {
+			return i
+		}
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func samePath(a, b string) bool {
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// uriToPath converts a file:// URI to a path; other URIs are returned as
+// they are.
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	p := u.Path
+	if len(p) >= 3 && p[0] == '/' && p[2] == ':' { // /C:/...
+		p = p[1:]
+	}
+	return filepath.FromSlash(p)
+}
+
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	p := filepath.ToSlash(path)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
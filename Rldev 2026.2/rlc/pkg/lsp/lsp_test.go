@@ -0,0 +1,203 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yoremi/rldev-go/pkg/kfn"
+)
+
+const testKFN = `
+module 001 = Jmp
+module 003 = Msg
+fun goto (skip goto) <0:Jmp:00000, 0> ()
+fun intout <0:Msg:00001, 0> (int)
+fun strout <0:Msg:00000, 0> (str)
+`
+
+const testSource = `#load 'defs'
+#define LIMIT = 3
+intA[0] = LIMIT * 2
+@loop
+intout(MAX)
+goto @loop
+`
+
+// session runs a server over the given messages and returns what it
+// wrote, decoded.
+func session(t *testing.T, msgs ...interface{}) []map[string]interface{} {
+	t.Helper()
+	reg, err := kfn.Parse(strings.NewReader(testKFN))
+	if err != nil { t.Fatal(err) }
+	var in bytes.Buffer
+	for _, m := range msgs {
+		if err := writeMessage(&in, m); err != nil { t.Fatal(err) }
+	}
+	var out bytes.Buffer
+	s := &Server{KFN: reg}
+	if err := s.Serve(&in, &out); err != nil { t.Fatal(err) }
+	var res []map[string]interface{}
+	for _, body := range strings.Split(out.String(), "Content-Length: ")[1:] {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(body[strings.Index(body, "{"):]), &v); err != nil { t.Fatal(err) }
+		res = append(res, v)
+	}
+	return res
+}
+
+func request(id int, method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+}
+
+func notify(method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+}
+
+func at(uri string, line, char int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     map[string]int{"line": line, "character": char},
+	}
+}
+
+// testDoc writes defs.kh next to the document and returns its URI.
+func testDoc(t *testing.T) string {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "defs.kh"), []byte("// header\n#const MAX = 10\n"), 0644)
+	return pathToURI(filepath.Join(dir, "seen0001.org"))
+}
+
+func open(uri, text string) map[string]interface{} {
+	return notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "kepago", "version": 1, "text": text},
+	})
+}
+
+// result returns the result of the response to request id.
+func result(t *testing.T, res []map[string]interface{}, id int) interface{} {
+	t.Helper()
+	for _, m := range res {
+		if v, ok := m["id"]; ok && v == float64(id) {
+			if e, ok := m["error"]; ok { t.Fatalf("request %d failed: %v", id, e) }
+			return m["result"]
+		}
+	}
+	t.Fatalf("no response to request %d", id)
+	return nil
+}
+
+// diagnostics returns the messages of the last diagnostics published.
+func diagnostics(res []map[string]interface{}) []string {
+	var msgs []string
+	for _, m := range res {
+		if m["method"] != "textDocument/publishDiagnostics" { continue }
+		msgs = []string{}
+		for _, d := range m["params"].(map[string]interface{})["diagnostics"].([]interface{}) {
+			d := d.(map[string]interface{})
+			line := d["range"].(map[string]interface{})["start"].(map[string]interface{})["line"]
+			msgs = append(msgs, fmt.Sprintf("%v:%v", line, d["code"]))
+		}
+	}
+	return msgs
+}
+
+func shutdown(id int) []interface{} {
+	return []interface{}{request(id, "shutdown", nil), notify("exit", nil)}
+}
+
+func TestInitializeShutdown(t *testing.T) {
+	res := session(t, append([]interface{}{request(1, "initialize", map[string]interface{}{})}, shutdown(2)...)...)
+	caps := result(t, res, 1).(map[string]interface{})["capabilities"].(map[string]interface{})
+	if caps["hoverProvider"] != true || caps["definitionProvider"] != true || caps["textDocumentSync"] != float64(1) { t.Errorf("capabilities: %v", caps) }
+	if result(t, res, 2) != nil { t.Error("shutdown should return null") }
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	var in, out bytes.Buffer
+	writeMessage(&in, notify("exit", nil))
+	if err := (&Server{KFN: kfn.NewRegistry()}).Serve(&in, &out); err == nil { t.Error("exit without shutdown accepted") }
+}
+
+func TestUnknownMethod(t *testing.T) {
+	res := session(t, append([]interface{}{request(1, "workspace/symbol", map[string]interface{}{}), notify("$/whatever", nil)}, shutdown(2)...)...)
+	if e, ok := res[0]["error"].(map[string]interface{}); !ok || e["code"] != float64(codeMethodNotFound) { t.Errorf("got %v", res[0]) }
+}
+
+func TestDiagnostics(t *testing.T) {
+	uri := testDoc(t)
+	res := session(t, append([]interface{}{open(uri, testSource)}, shutdown(1)...)...)
+	if got := diagnostics(res); len(got) != 0 { t.Errorf("clean source: %v", got) }
+
+	bad := strings.Replace(testSource, "intout(MAX)", "intuot(MAX)", 1)
+	res = session(t, append([]interface{}{open(uri, testSource),
+		notify("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+			"contentChanges": []map[string]string{{"text": bad}},
+		})}, shutdown(1)...)...)
+	if got := diagnostics(res); len(got) != 1 || got[0] != "4:E0100" { t.Errorf("undefined function: %v", got) }
+
+	res = session(t, append([]interface{}{open(uri, "intA[0] = (1\n")}, shutdown(1)...)...)
+	if got := diagnostics(res); len(got) != 1 || !strings.HasSuffix(got[0], ":E0001") { t.Errorf("syntax error: %v", got) }
+}
+
+func TestHover(t *testing.T) {
+	uri := testDoc(t)
+	res := session(t, append([]interface{}{open(uri, testSource),
+		request(1, "textDocument/hover", at(uri, 4, 3)),
+		request(2, "textDocument/hover", at(uri, 4, 8)),
+		request(3, "textDocument/hover", at(uri, 3, 2)),
+	}, shutdown(4)...)...)
+	h := result(t, res, 1).(map[string]interface{})["contents"].(map[string]interface{})["value"].(string)
+	if !strings.Contains(h, "intout <0:3:00001, 0> (int)") { t.Errorf("function hover: %q", h) }
+	h = result(t, res, 2).(map[string]interface{})["contents"].(map[string]interface{})["value"].(string)
+	if h != "`MAX`: integer constant = 10" { t.Errorf("constant hover: %q", h) }
+	if result(t, res, 3) != nil { t.Error("hover on a label") }
+}
+
+func TestDefinition(t *testing.T) {
+	uri := testDoc(t)
+	res := session(t, append([]interface{}{open(uri, testSource),
+		request(1, "textDocument/definition", at(uri, 5, 7)),
+		request(2, "textDocument/definition", at(uri, 2, 12)),
+		request(3, "textDocument/definition", at(uri, 4, 9)),
+	}, shutdown(4)...)...)
+	loc := func(id int) string {
+		ls := result(t, res, id).([]interface{})
+		if len(ls) != 1 { t.Fatalf("request %d: %v", id, ls) }
+		l := ls[0].(map[string]interface{})
+		start := l["range"].(map[string]interface{})["start"].(map[string]interface{})
+		return fmt.Sprintf("%s:%v:%v", filepath.Base(uriToPath(l["uri"].(string))), start["line"], start["character"])
+	}
+	if got := loc(1); got != "seen0001.org:3:0" { t.Errorf("label: %s", got) }
+	if got := loc(2); got != "seen0001.org:1:8" { t.Errorf("#define: %s", got) }
+	if got := loc(3); got != "defs.kh:1:7" { t.Errorf("header #const: %s", got) }
+}
+
+func TestCompletion(t *testing.T) {
+	uri := testDoc(t)
+	res := session(t, append([]interface{}{open(uri, testSource+"in\n"),
+		request(1, "textDocument/completion", at(uri, 6, 2)),
+	}, shutdown(2)...)...)
+	items := result(t, res, 1).([]interface{})
+	if len(items) != 1 { t.Fatalf("items: %v", items) }
+	item := items[0].(map[string]interface{})
+	if item["label"] != "intout" || item["detail"] != "intout <0:3:00001, 0> (int)" { t.Errorf("item: %v", item) }
+}
+
+func TestWordAt(t *testing.T) {
+	d := &document{lines: []string{"【理樹】 goto @ラベル1 // x"}}
+	if w, r := d.wordAt(Position{0, 6}); w != "goto" || r.Start.Character != 5 || r.End.Character != 9 { t.Errorf("got %q %v", w, r) }
+	if w, _ := d.wordAt(Position{0, 12}); w != "@ラベル1" { t.Errorf("got %q", w) }
+	if w, _ := d.wordAt(Position{0, 4}); w != "" { t.Errorf("got %q", w) }
+	if p := d.prefixAt(Position{0, 7}); p != "go" { t.Errorf("prefix %q", p) }
+}
+
+func TestURIs(t *testing.T) {
+	if p := uriToPath("file:///tmp/a%20b/seen.org"); p != filepath.FromSlash("/tmp/a b/seen.org") { t.Errorf("got %q", p) }
+	if u := pathToURI("/tmp/a b/seen.org"); u != "file:///tmp/a%20b/seen.org" { t.Errorf("got %q", u) }
+}
@@ -55,6 +55,7 @@ type Symbol struct {
 	// For KindInline
 	InlineParams []ast.InlineParam
 	InlineBody   ast.Stmt
+	InlineScoped bool // #sinline
 
 	// For KindStaticVar
 	Var *StaticVar
@@ -123,6 +124,12 @@ func (m *Memory) OpenScope() {
 
 // CloseScope pops the current scope and deallocates its symbols.
 func (m *Memory) CloseScope() {
+	m.CloseScopeKeeping(nil)
+}
+
+// CloseScopeKeeping pops the current scope like CloseScope, but moves the
+// symbols for which keep returns true to the enclosing scope instead.
+func (m *Memory) CloseScopeKeeping(keep func(name string) bool) {
 	if len(m.scopes) <= 1 {
 		return // never close the top-level scope
 	}
@@ -130,6 +137,10 @@ func (m *Memory) CloseScope() {
 	m.scopes = m.scopes[:len(m.scopes)-1]
 
 	for name := range top {
+		if keep != nil && keep(name) {
+			m.scopes[len(m.scopes)-1][name] = true
+			continue
+		}
 		entries := m.symbols[name]
 		if len(entries) == 0 {
 			continue
@@ -153,6 +164,15 @@ func (m *Memory) CloseScope() {
 	}
 }
 
+// ScopeNames returns the names defined in the current scope.
+func (m *Memory) ScopeNames() []string {
+	var names []string
+	for name := range m.scopes[len(m.scopes)-1] {
+		names = append(names, name)
+	}
+	return names
+}
+
 // ScopeDepth returns the current nesting depth.
 func (m *Memory) ScopeDepth() int { return len(m.scopes) }
 
@@ -190,6 +210,39 @@ func (m *Memory) Get(name string) (Symbol, bool) {
 	return entries[0].sym, true
 }
 
+// GetAll returns every visible definition of a symbol, innermost first.
+func (m *Memory) GetAll(name string) []Symbol {
+	entries := m.symbols[name]
+	syms := make([]Symbol, len(entries))
+	for i, e := range entries {
+		syms[i] = e.sym
+	}
+	return syms
+}
+
+// Hidden holds the definitions of a symbol removed by Hide.
+type Hidden struct {
+	name    string
+	entries []symbolEntry
+}
+
+// Hide temporarily removes every definition of a symbol (pull_sym in
+// memory.ml). Restore puts them back.
+func (m *Memory) Hide(name string) Hidden {
+	h := Hidden{name: name, entries: m.symbols[name]}
+	delete(m.symbols, name)
+	return h
+}
+
+// Restore reinstates the definitions removed by Hide (replace_sym), below
+// any definition made while they were hidden.
+func (m *Memory) Restore(h Hidden) {
+	if len(h.entries) == 0 {
+		return
+	}
+	m.symbols[h.name] = append(m.symbols[h.name], h.entries...)
+}
+
 // Undefine removes a symbol from the current scope.
 func (m *Memory) Undefine(name string) error {
 	entries := m.symbols[name]
@@ -428,50 +481,89 @@ const (
 	DirLabel                // write to flag.ini
 )
 
-// AllocVar allocates a variable in a register bank and defines it.
-// Returns the StaticVar descriptor.
-func (m *Memory) AllocVar(name string, vt VarType, arrayLen int, fixedAddr *[2]int) (*StaticVar, error) {
-	isStr := vt.IsStr
-	blockSize := arrayLen
-	if blockSize == 0 {
-		blockSize = 1
-	}
-	if !isStr && vt.BitWidth < 32 {
+// SlotCount returns the number of int32 slots a variable of the given type
+// and array length (0 for a scalar) occupies.
+func SlotCount(vt VarType, arrayLen int) int {
+	if !vt.IsStr && vt.BitWidth < 32 {
 		// Sub-int types: multiple elements pack into fewer int32 slots
-		blockSize = (arrayLen*vt.BitWidth-1)/32 + 1
-		if blockSize < 1 {
-			blockSize = 1
+		n := (arrayLen*vt.BitWidth-1)/32 + 1
+		if n < 1 {
+			n = 1
 		}
+		return n
+	}
+	if arrayLen == 0 {
+		return 1
+	}
+	return arrayLen
+}
+
+// FindBlock finds, without reserving it, a free run of length slots in the
+// default int or str allocation range. Returns the bank and first index.
+func (m *Memory) FindBlock(isStr bool, length int) (bank, index int, err error) {
+	bank, first, last := m.IntAllocSpace, m.IntAllocFirst, m.IntAllocLast
+	if isStr {
+		bank, first, last = m.StrAllocSpace, m.StrAllocFirst, m.StrAllocLast
 	}
+	space, err := varIdx(bank)
+	if err != nil {
+		return 0, 0, err
+	}
+	idx, err := m.alloc.FindUnusedBlock(space, first, length)
+	if err != nil || idx+length > last {
+		return 0, 0, fmt.Errorf("%s is full: no room for %d slot(s) in %d..%d",
+			ast.VariableName(bank), length, first, last-1)
+	}
+	return bank, idx, nil
+}
+
+// AllocVar allocates a variable in a register bank and defines it in the
+// current scope, so that CloseScope frees its slots again.
+// Returns the StaticVar descriptor.
+func (m *Memory) AllocVar(name string, vt VarType, arrayLen int, fixedAddr *[2]int) (*StaticVar, error) {
+	return m.allocVar(name, vt, arrayLen, fixedAddr, false)
+}
+
+// AllocExtVar is AllocVar for ext declarations: the variable is defined
+// globally and survives the scope it was declared in.
+func (m *Memory) AllocExtVar(name string, vt VarType, arrayLen int, fixedAddr *[2]int) (*StaticVar, error) {
+	return m.allocVar(name, vt, arrayLen, fixedAddr, true)
+}
+
+func (m *Memory) allocVar(name string, vt VarType, arrayLen int, fixedAddr *[2]int, global bool) (*StaticVar, error) {
+	isStr := vt.IsStr
+	blockSize := SlotCount(vt, arrayLen)
 
 	var space, index int
 	if fixedAddr != nil {
 		space = fixedAddr[0]
 		index = fixedAddr[1]
-	} else {
-		if isStr {
-			space = m.StrAllocSpace
-		} else {
-			space = m.IntAllocSpace
-		}
-		spaceIdx, err := varIdx(space)
-		if err != nil {
+		n := BankLen(space)
+		if n == 0 {
+			_, err := varIdx(space)
 			return nil, err
 		}
-		var max int
-		if isStr {
-			max = m.StrAllocLast
-		} else {
-			max = m.IntAllocLast
+		if index < 0 || index >= n {
+			return nil, fmt.Errorf("%s[%d] is out of range for %s", ast.VariableName(space), index, name)
+		}
+		// An address in a bit view of an int bank is rounded to the
+		// slot it is in; it must be the first element of that slot.
+		if view := space / 26; view > 0 {
+			per := 32 / [...]int{32, 1, 2, 4, 8}[view]
+			if index%per != 0 {
+				return nil, fmt.Errorf("%s[%d] does not start an int slot for %s", ast.VariableName(space), index, name)
+			}
+			space, index, n = space%26, index/per, n/per
+		}
+		if index+blockSize > n {
+			return nil, fmt.Errorf("%s[%d] has no room for the %d slot(s) of %s", ast.VariableName(space), index, blockSize, name)
 		}
-		idx, err := m.alloc.FindUnusedBlock(spaceIdx, 0, blockSize)
+	} else {
+		var err error
+		space, index, err = m.FindBlock(isStr, blockSize)
 		if err != nil {
 			return nil, err
 		}
-		if idx+blockSize > max {
-			return nil, fmt.Errorf("unable to allocate block for %s", name)
-		}
-		index = idx
 	}
 
 	// Compute typed space and access address for sub-int types
@@ -497,11 +589,12 @@ func (m *Memory) AllocVar(name string, vt VarType, arrayLen int, fixedAddr *[2]i
 		IsStr:      isStr,
 	}
 
-	m.Define(name, Symbol{
-		Kind:   KindStaticVar,
-		Var:    sv,
-		Scoped: true,
-	})
+	sym := Symbol{Kind: KindStaticVar, Var: sv}
+	if global {
+		m.DefineGlobal(name, sym)
+	} else {
+		m.Define(name, sym)
+	}
 
 	return sv, nil
 }
@@ -525,6 +618,30 @@ func getRealAddress(vt VarType, space, allocIndex int) (typedSpace, accessIndex
 	return space, allocIndex
 }
 
+// BankLen returns the number of elements in a register bank: 2000 in the
+// int and str banks, 40 in intL and 3 in strK, times 32/width in the bit
+// views of the int banks. It returns 0 for banks it does not know.
+func BankLen(bank int) int {
+	base, view := bank%26, bank/26
+	if bank < 0 || view > 4 {
+		return 0
+	}
+	n := 0
+	switch {
+	case base < 7, base == 25:
+		n = 2000
+	case base == 11:
+		n = 40
+	case view > 0:
+		return 0
+	case base == 12, base == 18:
+		n = 2000
+	case base == 10:
+		n = 3
+	}
+	return n * 32 / [...]int{32, 1, 2, 4, 8}[view]
+}
+
 // AllocTempInt allocates a temporary integer variable and returns its expression.
 func (m *Memory) AllocTempInt() (ast.Expr, error) {
 	space := m.IntAllocSpace
@@ -257,6 +257,35 @@ func TestAllocVarSubInt(t *testing.T) {
 	}
 }
 
+func TestAllocVarFixedRange(t *testing.T) {
+	m := New()
+	if _, err := m.AllocVar("k", VarType{IsStr: true}, 0, &[2]int{10, 2}); err != nil { t.Error(err) }
+	if _, err := m.AllocVar("k3", VarType{IsStr: true}, 0, &[2]int{10, 3}); err == nil { t.Error("strK[3] should be out of range") }
+	if _, err := m.AllocVar("l", VarType{BitWidth: 32}, 2, &[2]int{11, 38}); err != nil { t.Error(err) }
+	if _, err := m.AllocVar("l2", VarType{BitWidth: 32}, 2, &[2]int{11, 39}); err == nil { t.Error("intL[39..40] should be out of range") }
+	if _, err := m.AllocVar("l100", VarType{BitWidth: 32}, 0, &[2]int{11, 100}); err == nil { t.Error("intL[100] should be out of range") }
+
+	// intAb[64] is the first bit of intA[2]
+	sv, err := m.AllocVar("b", VarType{BitWidth: 1}, 8, &[2]int{26, 64})
+	if err != nil { t.Fatal(err) }
+	if sv.AllocSpace != 0 || sv.AllocIndex != 2 || sv.TypedSpace != 26 || sv.Index != 64 { t.Errorf("b: %+v", sv) }
+	if _, err := m.AllocVar("b2", VarType{BitWidth: 1}, 0, &[2]int{26, 65}); err == nil { t.Error("intAb[65] is inside a slot") }
+	if _, err := m.AllocVar("b3", VarType{BitWidth: 1}, 64, &[2]int{26, 63968}); err == nil { t.Error("intAb[63968..] should be out of range") }
+	if _, err := m.AllocVar("x", VarType{BitWidth: 32}, 0, &[2]int{7, 0}); err == nil { t.Error("bank 7 cannot hold variables") }
+}
+
+func TestCloseScopeKeeping(t *testing.T) {
+	m := New()
+	m.OpenScope()
+	m.OpenScope()
+	if _, err := m.AllocVar("kept", VarType{BitWidth: 32}, 0, nil); err != nil { t.Fatal(err) }
+	if _, err := m.AllocVar("freed", VarType{BitWidth: 32}, 0, nil); err != nil { t.Fatal(err) }
+	m.CloseScopeKeeping(func(name string) bool { return name == "kept" })
+	if !m.Defined("kept") || m.Defined("freed") { t.Fatal("wrong symbols kept") }
+	m.CloseScope()
+	if m.Defined("kept") { t.Error("kept symbol should belong to the enclosing scope") }
+}
+
 func TestAllocTempInt(t *testing.T) {
 	m := New()
 	expr, err := m.AllocTempInt()
@@ -323,3 +352,55 @@ func TestGetRealAddress(t *testing.T) {
 	ts, ai = getRealAddress(VarType{IsStr: true}, 12, 5)
 	if ts != 12 || ai != 5 { t.Errorf("str: got %d,%d", ts, ai) }
 }
+
+func TestSlotCount(t *testing.T) {
+	if n := SlotCount(VarType{BitWidth: 32}, 0); n != 1 { t.Errorf("scalar: %d", n) }
+	if n := SlotCount(VarType{BitWidth: 32}, 5); n != 5 { t.Errorf("int[5]: %d", n) }
+	if n := SlotCount(VarType{BitWidth: 8}, 5); n != 2 { t.Errorf("byte[5]: %d", n) }
+	if n := SlotCount(VarType{IsStr: true}, 3); n != 3 { t.Errorf("str[3]: %d", n) }
+}
+
+func TestAllocVarRespectsRange(t *testing.T) {
+	m := New()
+	m.IntAllocFirst, m.IntAllocLast = 100, 102
+	sv, err := m.AllocVar("a", VarType{BitWidth: 32}, 2, nil)
+	if err != nil { t.Fatal(err) }
+	if sv.AllocIndex != 100 { t.Errorf("got %d, want 100", sv.AllocIndex) }
+	if _, err := m.AllocVar("b", VarType{BitWidth: 32}, 0, nil); err == nil { t.Error("range should be exhausted") }
+}
+
+func TestAllocExtVarSurvivesScope(t *testing.T) {
+	m := New()
+	m.OpenScope()
+	if _, err := m.AllocExtVar("g", VarType{BitWidth: 32}, 0, nil); err != nil { t.Fatal(err) }
+	m.CloseScope()
+	if !m.Defined("g") { t.Error("ext variable should outlive its scope") }
+}
+
+func TestGetAll(t *testing.T) {
+	m := New()
+	m.Define("f", Symbol{Kind: KindInteger, IntVal: 1})
+	m.Define("f", Symbol{Kind: KindInteger, IntVal: 2})
+	syms := m.GetAll("f")
+	if len(syms) != 2 || syms[0].IntVal != 2 || syms[1].IntVal != 1 { t.Errorf("got %+v", syms) }
+}
+
+func TestHideRestore(t *testing.T) {
+	m := New()
+	m.Define("x", Symbol{Kind: KindInteger, IntVal: 1})
+	h := m.Hide("x")
+	if m.Defined("x") { t.Error("x should be hidden") }
+	m.OpenScope()
+	m.Define("x", Symbol{Kind: KindInteger, IntVal: 2})
+	m.CloseScope()
+	m.Restore(h)
+	sym, ok := m.Get("x")
+	if !ok || sym.IntVal != 1 { t.Errorf("x after restore: %+v", sym) }
+}
+
+func TestBankLen(t *testing.T) {
+	cases := map[int]int{0x00: 2000, 0x19: 2000, 0x0b: 40, 0x0a: 3, 0x0c: 2000, 0x12: 2000, 0x1a: 64000, 0x25: 1280, 0x68: 8000, 0x07: 0, 0x24: 0, 0x82: 0}
+	for bank, want := range cases {
+		if got := BankLen(bank); got != want { t.Errorf("BankLen(%#x) = %d, want %d", bank, got, want) }
+	}
+}
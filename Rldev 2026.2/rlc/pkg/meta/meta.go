@@ -20,9 +20,11 @@ package meta
 
 import (
 	"fmt"
+	"strings"
 	"sync/atomic"
 
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/cast"
 )
 
 // ============================================================
@@ -35,6 +37,9 @@ type State struct {
 	DramatisPersonae []string // debug: character name list
 	Val0x2C          int      // header field at offset 0x2c (#Z-1)
 
+	// Cast (--cast): speaker name translations
+	Cast cast.Table
+
 	// Resources (#res strings)
 	Resources map[string]Resource // key → resource string + location
 	BaseRes   map[string]Resource // base resource strings
@@ -76,6 +81,10 @@ func (s *State) UniqueLabel(loc ast.Loc) ast.Label {
 	return ast.Label{Loc: loc, Ident: name}
 }
 
+// IsUniqueLabel reports whether ident was generated by UniqueLabel rather
+// than written in the source.
+func IsUniqueLabel(ident string) bool { return strings.HasPrefix(ident, "__auto@_") }
+
 // GetResource looks up a resource string by key.
 func (s *State) GetResource(key string) (Resource, error) {
 	r, ok := s.Resources[key]
@@ -104,9 +113,10 @@ func (s *State) SetBaseResource(key string, text string, loc ast.Loc) {
 	s.BaseRes[key] = Resource{Text: text, Loc: loc}
 }
 
-// AddCharacter adds a character name to the dramatis personae list.
+// AddCharacter adds a character name to the dramatis personae list,
+// translated through the cast.
 func (s *State) AddCharacter(name string) {
-	s.DramatisPersonae = append(s.DramatisPersonae, name)
+	s.DramatisPersonae = append(s.DramatisPersonae, s.Cast.Name(name))
 }
 
 // ============================================================
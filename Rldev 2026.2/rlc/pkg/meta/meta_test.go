@@ -37,6 +37,9 @@ func TestUniqueLabel(t *testing.T) {
 	if l1.Ident[:8] != "__auto@_" {
 		t.Errorf("label format: %q", l1.Ident)
 	}
+	if !IsUniqueLabel(l1.Ident) || IsUniqueLabel("start") {
+		t.Error("IsUniqueLabel")
+	}
 }
 
 func TestResources(t *testing.T) {
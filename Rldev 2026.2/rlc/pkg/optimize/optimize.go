@@ -0,0 +1,186 @@
+// Package optimize implements the -O passes over codegen.Output.IR.
+//
+// OCaml rlc only ever optimised constant conditionals (goto.ml
+// special_case); this package adds the IR-level passes that make the
+// output of structured control flow smaller:
+//
+//   - DeadCode: removes instructions after an unconditional goto, ret or
+//     halt that no label or entrypoint makes reachable again.
+//   - UnusedLabels: drops labels that nothing references.
+//   - ThreadJumps: retargets jumps whose target is itself an unconditional
+//     goto.
+//   - JumpsToNext: removes gotos to the very next instruction.
+//
+// Constant conditional jumps are folded while compiling (see
+// compilerframe.Compiler.OptLevel), as the condition is no longer
+// available once it has been encoded.
+//
+// Instructions are recognised by the Flow of their IRCode elements, which
+// the compiler sets when it emits jumps and exits. Labels are zero-width,
+// so every pass keeps the bytes of the remaining instructions unchanged.
+//
+// Levels:
+//
+//	-O0  no passes: output is byte-identical to the naive emitter
+//	-O1  constant conditionals, dead code, unused labels
+//	-O2  -O1 plus jump threading and gotos to the next instruction
+package optimize
+
+import (
+	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
+)
+
+// Optimize runs the passes enabled at level over out, until none of them
+// changes anything.
+func Optimize(out *codegen.Output, level int) {
+	if level <= 0 {
+		return
+	}
+	for {
+		n := len(out.IR)
+		changed := false
+		if level >= 2 && ThreadJumps(out.IR) {
+			changed = true
+		}
+		out.IR = DeadCode(out.IR)
+		out.IR = UnusedLabels(out.IR)
+		if level >= 2 {
+			out.IR = JumpsToNext(out.IR)
+		}
+		if !changed && len(out.IR) == n {
+			return
+		}
+	}
+}
+
+// referenced returns the set of labels that some IRLabelRef points to.
+func referenced(ir []codegen.IR) map[string]bool {
+	refs := make(map[string]bool)
+	for _, e := range ir {
+		if e.Type == codegen.IRLabelRef {
+			refs[e.Label] = true
+		}
+	}
+	return refs
+}
+
+// ============================================================
+// Dead code
+// ============================================================
+
+// DeadCode removes the elements that follow an unconditional goto, ret or
+// halt, up to the next referenced label or entrypoint.
+func DeadCode(ir []codegen.IR) []codegen.IR {
+	refs := referenced(ir)
+	out := ir[:0:0]
+	reachable := true
+	for i := 0; i < len(ir); i++ {
+		e := ir[i]
+		switch {
+		case e.Type == codegen.IREntrypoint, e.Type == codegen.IRLabel && refs[e.Label]:
+			reachable = true
+		case !reachable:
+			continue
+		}
+		out = append(out, e)
+		if e.Type != codegen.IRCode {
+			continue
+		}
+		switch e.Flow {
+		case codegen.FlowGoto:
+			if i+1 < len(ir) {
+				i++
+				out = append(out, ir[i])
+			}
+			reachable = false
+		case codegen.FlowExit:
+			reachable = false
+		}
+	}
+	return out
+}
+
+// ============================================================
+// Unused labels
+// ============================================================
+
+// UnusedLabels drops the labels that nothing references.
+func UnusedLabels(ir []codegen.IR) []codegen.IR {
+	refs := referenced(ir)
+	out := ir[:0:0]
+	for _, e := range ir {
+		if e.Type == codegen.IRLabel && !refs[e.Label] {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// ============================================================
+// Jump threading
+// ============================================================
+
+// ThreadJumps retargets every label reference whose target is immediately
+// followed by an unconditional goto to that goto's own target. It reports
+// whether anything changed.
+func ThreadJumps(ir []codegen.IR) bool {
+	// Where each label leads when it is only followed by other labels and
+	// then a goto.
+	next := make(map[string]string)
+	for i, e := range ir {
+		if e.Type != codegen.IRLabel {
+			continue
+		}
+		j := i + 1
+		for j < len(ir) && ir[j].Type == codegen.IRLabel {
+			j++
+		}
+		if j+1 < len(ir) && ir[j].Type == codegen.IRCode && ir[j].Flow == codegen.FlowGoto && ir[j+1].Type == codegen.IRLabelRef {
+			next[e.Label] = ir[j+1].Label
+		}
+	}
+	changed := false
+	for i, e := range ir {
+		if e.Type != codegen.IRLabelRef {
+			continue
+		}
+		target := e.Label
+		seen := map[string]bool{target: true}
+		for {
+			t, ok := next[target]
+			if !ok || seen[t] {
+				break
+			}
+			seen[t] = true
+			target = t
+		}
+		if target != e.Label {
+			ir[i].Label = target
+			changed = true
+		}
+	}
+	return changed
+}
+
+// JumpsToNext removes unconditional gotos whose target label follows them
+// with nothing but other labels in between.
+func JumpsToNext(ir []codegen.IR) []codegen.IR {
+	out := ir[:0:0]
+	for i := 0; i < len(ir); i++ {
+		e := ir[i]
+		if e.Type == codegen.IRCode && e.Flow == codegen.FlowGoto && i+1 < len(ir) && ir[i+1].Type == codegen.IRLabelRef {
+			target := ir[i+1].Label
+			j := i + 2
+			for j < len(ir) && ir[j].Type == codegen.IRLabel && ir[j].Label != target {
+				j++
+			}
+			if j < len(ir) && ir[j].Type == codegen.IRLabel {
+				i++
+				continue
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
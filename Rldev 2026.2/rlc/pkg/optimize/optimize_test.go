@@ -0,0 +1,128 @@
+package optimize
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/codegen"
+)
+
+// shape renders IR compactly: "code", "goto>L", "if>L", "exit", "@L", "ep".
+func shape(ir []codegen.IR) string {
+	var parts []string
+	for i := 0; i < len(ir); i++ {
+		e := ir[i]
+		switch e.Type {
+		case codegen.IRLabel:
+			parts = append(parts, "@"+e.Label)
+		case codegen.IREntrypoint:
+			parts = append(parts, "ep")
+		case codegen.IRLabelRef:
+			parts = append(parts, ">"+e.Label)
+		case codegen.IRCode:
+			switch e.Flow {
+			case codegen.FlowGoto:
+				parts = append(parts, "goto>"+ir[i+1].Label)
+				i++
+			case codegen.FlowCondGoto:
+				parts = append(parts, "if>"+ir[i+1].Label)
+				i++
+			case codegen.FlowExit:
+				parts = append(parts, "exit")
+			default:
+				parts = append(parts, string(e.Bytes))
+			}
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func lbl(s string) ast.Label { return ast.Label{Ident: s} }
+
+func gotoOp() []byte { return codegen.EncodeOpcode(0, 1, 0, 0, 0) }
+
+func TestDeadCode(t *testing.T) {
+	o := codegen.NewOutput()
+	o.AddCodeStr(ast.Nowhere, "a")
+	o.AddJump(ast.Nowhere, gotoOp(), lbl("end"), false)
+	o.AddCodeStr(ast.Nowhere, "dead")
+	o.AddLabel("unused", ast.Nowhere)
+	o.AddCodeStr(ast.Nowhere, "dead2")
+	o.AddLabel("end", ast.Nowhere)
+	o.AddExit(ast.Nowhere, []byte{0})
+	o.AddCodeStr(ast.Nowhere, "dead3")
+	o.AddEntrypoint(1)
+	o.AddCodeStr(ast.Nowhere, "b")
+	if got := shape(DeadCode(o.IR)); got != "a goto>end @end exit ep b" { t.Errorf("got %q", got) }
+}
+
+func TestConditionalGotoIsNotAnExit(t *testing.T) {
+	o := codegen.NewOutput()
+	o.AddJump(ast.Nowhere, []byte("c"), lbl("x"), true)
+	o.AddCodeStr(ast.Nowhere, "live")
+	o.AddLabel("x", ast.Nowhere)
+	if got := shape(DeadCode(o.IR)); got != "if>x live @x" { t.Errorf("got %q", got) }
+}
+
+func TestUnusedLabels(t *testing.T) {
+	o := codegen.NewOutput()
+	o.AddLabel("a", ast.Nowhere)
+	o.AddLabel("b", ast.Nowhere)
+	o.AddJump(ast.Nowhere, gotoOp(), lbl("b"), false)
+	if got := shape(UnusedLabels(o.IR)); got != "@b goto>b" { t.Errorf("got %q", got) }
+}
+
+func TestThreadJumps(t *testing.T) {
+	o := codegen.NewOutput()
+	o.AddJump(ast.Nowhere, []byte("c"), lbl("a"), true)
+	o.AddCodeStr(ast.Nowhere, "x")
+	o.AddLabel("a", ast.Nowhere)
+	o.AddJump(ast.Nowhere, gotoOp(), lbl("b"), false)
+	o.AddLabel("b", ast.Nowhere)
+	o.AddLabel("c", ast.Nowhere)
+	o.AddJump(ast.Nowhere, gotoOp(), lbl("d"), false)
+	o.AddLabel("d", ast.Nowhere)
+	o.AddCodeStr(ast.Nowhere, "y")
+	o.AddLabel("loop", ast.Nowhere)
+	o.AddJump(ast.Nowhere, gotoOp(), lbl("loop"), false)
+	if !ThreadJumps(o.IR) { t.Fatal("expected a change") }
+	if got := shape(o.IR); got != "if>d x @a goto>d @b @c goto>d @d y @loop goto>loop" { t.Errorf("got %q", got) }
+	if ThreadJumps(o.IR) { t.Error("second run should change nothing") }
+}
+
+func TestJumpsToNext(t *testing.T) {
+	o := codegen.NewOutput()
+	o.AddJump(ast.Nowhere, gotoOp(), lbl("b"), false)
+	o.AddLabel("a", ast.Nowhere)
+	o.AddLabel("b", ast.Nowhere)
+	o.AddJump(ast.Nowhere, gotoOp(), lbl("a"), false)
+	if got := shape(JumpsToNext(o.IR)); got != "@a @b goto>a" { t.Errorf("got %q", got) }
+}
+
+func TestOptimizeLevels(t *testing.T) {
+	build := func() *codegen.Output {
+		o := codegen.NewOutput()
+		o.AddJump(ast.Nowhere, []byte("c"), lbl("else"), true)
+		o.AddCodeStr(ast.Nowhere, "then")
+		o.AddJump(ast.Nowhere, gotoOp(), lbl("end"), false)
+		o.AddLabel("else", ast.Nowhere)
+		o.AddJump(ast.Nowhere, gotoOp(), lbl("end"), false)
+		o.AddCodeStr(ast.Nowhere, "dead")
+		o.AddLabel("end", ast.Nowhere)
+		o.AddExit(ast.Nowhere, []byte{0})
+		return o
+	}
+	o := build()
+	want := shape(o.IR)
+	Optimize(o, 0)
+	if got := shape(o.IR); got != want { t.Errorf("-O0 changed the IR: %q", got) }
+
+	o = build()
+	Optimize(o, 1)
+	if got := shape(o.IR); got != "if>else then goto>end @else goto>end @end exit" { t.Errorf("-O1: %q", got) }
+
+	o = build()
+	Optimize(o, 2)
+	if got := shape(o.IR); got != "if>end then @end exit" { t.Errorf("-O2: %q", got) }
+}
@@ -20,8 +20,11 @@ package parser
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
 	"github.com/yoremi/rldev-go/rlc/pkg/lexer"
 	"github.com/yoremi/rldev-go/rlc/pkg/token"
 )
@@ -40,7 +43,18 @@ func New(l *lexer.Lexer) *Parser {
 }
 
 // ParseFile is a convenience: lex + parse source into a SourceFile.
-func ParseFile(src []byte, filename string) (*ast.SourceFile, error) {
+// Syntax errors (raised as panics by syntaxError) are returned as
+// *diag.Diagnostic.
+func ParseFile(src []byte, filename string) (sf *ast.SourceFile, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if d, ok := r.(*diag.Diagnostic); ok {
+				sf, err = nil, d
+				return
+			}
+			sf, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
 	l := lexer.New(string(src), filename)
 	p := New(l)
 	return p.ParseProgram(), nil
@@ -52,9 +66,14 @@ func (p *Parser) advance() token.Token {
 	return prev
 }
 
+// syntaxError aborts parsing with a syntax error diagnostic at loc.
+func syntaxError(loc ast.Loc, format string, args ...interface{}) {
+	panic(diag.Errorf(loc, diag.Syntax, format, args...))
+}
+
 func (p *Parser) expect(t token.Type) token.Token {
 	if p.cur.Type != t {
-		panic(fmt.Sprintf("%s:%d: expected %s, got %s", p.cur.File, p.cur.Line, t, p.cur.Type))
+		syntaxError(ast.Loc{File: p.cur.File, Line: p.cur.Line}, "expected %s, got %s", t, p.cur.Type)
 	}
 	return p.advance()
 }
@@ -78,7 +97,11 @@ func (p *Parser) loc() ast.Loc {
 // ParseProgram parses a full source file.
 func (p *Parser) ParseProgram() *ast.SourceFile {
 	stmts := p.parseStatements()
-	return &ast.SourceFile{Name: p.cur.File, Stmts: stmts}
+	sf := &ast.SourceFile{Name: p.cur.File, Stmts: stmts}
+	for _, c := range p.lex.Comments() {
+		sf.Comments = append(sf.Comments, ast.Comment{Loc: ast.Loc{File: p.cur.File, Line: c.Line}, Text: c.Text, Trailing: c.Trailing})
+	}
+	return sf
 }
 
 // ParseExpression parses a single expression (for #if evaluation etc.).
@@ -303,8 +326,17 @@ func (p *Parser) parseCStatement() ast.Stmt {
 // ============================================================
 
 func (p *Parser) parseDIf() ast.Stmt {
-	loc := p.loc(); p.advance() // skip #if / #ifdef / #ifndef
+	loc := p.loc()
+	ifdef, negate := p.cur.Type == token.DIFDEF, p.cur.IntVal == 0
+	p.advance() // skip #if / #ifdef / #ifndef
 	cond := p.parseExpr()
+	if ifdef {
+		// #ifdef X == #if defined?(X); #ifndef X == #if !defined?(X)
+		cond = ast.FuncCall{Loc: loc, Ident: "defined?", Params: []ast.Param{ast.SimpleParam{Loc: loc, Expr: cond}}}
+		if negate {
+			cond = ast.UnaryExpr{Loc: loc, Op: ast.UnaryNot, Val: cond}
+		}
+	}
 	body := p.parseStatementsUntil(token.DELSE, token.DELSEIF, token.DENDIF)
 	var cont ast.DIfCont
 	if p.match(token.DENDIF) {
@@ -318,7 +350,7 @@ func (p *Parser) parseDIf() ast.Stmt {
 	} else {
 		cont = ast.DEndifStmt{Loc: p.loc()}
 	}
-	return ast.DIfStmt{Loc: loc, Cond: cond, Body: body, Cont: cont}
+	return ast.DIfStmt{Loc: loc, Cond: cond, Ifdef: ifdef, Body: body, Cont: cont}
 }
 
 func (p *Parser) parseDFor() ast.Stmt {
@@ -373,8 +405,8 @@ func (p *Parser) parseDSet() ast.Stmt {
 	name := p.expect(token.IDENT).StrVal
 	op := p.parseAssignOp()
 	val := p.parseExpr()
-	_ = op // simplified: always treat as set
-	return ast.DSetStmt{Loc: loc, Ident: name, ReadOnly: true, Value: val}
+	// simplified: the compiler treats every op as =
+	return ast.DSetStmt{Loc: loc, Ident: name, ReadOnly: true, Op: op, Value: val}
 }
 
 func (p *Parser) parseDWithExpr() ast.Stmt {
@@ -408,7 +440,8 @@ func (p *Parser) parseDVersion() ast.Stmt {
 }
 
 func (p *Parser) parseDInline() ast.Stmt {
-	loc := p.loc(); p.expect(token.DINLINE)
+	loc := p.loc()
+	scoped := p.expect(token.DINLINE).StrVal == "scoped"
 	name := p.expect(token.IDENT).StrVal
 	p.expect(token.LPAR)
 	var params []ast.InlineParam
@@ -428,7 +461,7 @@ func (p *Parser) parseDInline() ast.Stmt {
 	}
 	p.expect(token.RPAR)
 	body := p.parseStatement()
-	return ast.DInlineStmt{Loc: loc, Ident: name, Params: params, Body: body}
+	return ast.DInlineStmt{Loc: loc, Ident: name, Scoped: scoped, Params: params, Body: body}
 }
 
 func (p *Parser) parseDHiding() ast.Stmt {
@@ -509,21 +542,51 @@ func (p *Parser) parseSelParamList() []ast.SelParam {
 	return params
 }
 
+// parseSelParam parses one select option, optionally preceded by its
+// conditions and a colon:
+//
+//	{ effect [ '(' arg ')' ] [ 'if' cond ] } ':' expr
+//
+// where effect is colour, title, grey, hide, blank or cursor.
 func (p *Parser) parseSelParam() ast.SelParam {
 	loc := p.loc()
-	expr := p.parseExpr()
-	if p.cur.Type != token.COLON {
+	var conds []ast.SelCond
+	for p.cur.Type == token.IDENT && isSelEffect(p.cur.StrVal) {
+		c := ast.SelCond{Loc: p.loc(), Ident: p.cur.StrVal}
+		p.advance()
+		if p.match(token.LPAR) {
+			c.Arg = p.parseExpr()
+			p.expect(token.RPAR)
+		}
+		if p.match(token.IF) {
+			c.Cond = p.parseExpr()
+		}
+		c.IsFlag = c.Arg == nil && c.Cond == nil
+		conds = append(conds, c)
+	}
+	if conds == nil {
+		expr := p.parseExpr()
+		if p.cur.Type == token.COLON {
+			syntaxError(p.loc(), "select conditions must be colour, title, grey, hide, blank or cursor")
+		}
 		return ast.AlwaysSelParam{Loc: loc, Expr: expr}
 	}
-	// conditional: conds : expr
-	// Not fully implemented — return as always for simplicity
-	p.advance()
-	val := p.parseExpr()
-	return ast.AlwaysSelParam{Loc: loc, Expr: val}
+	p.expect(token.COLON)
+	return ast.CondSelParam{Loc: loc, Conds: conds, Expr: p.parseExpr()}
+}
+
+// isSelEffect reports whether ident names the effect of a select
+// condition.
+func isSelEffect(ident string) bool {
+	switch ident {
+	case "colour", "title", "grey", "hide", "blank", "cursor":
+		return true
+	}
+	return false
 }
 
 // ============================================================
-// Unknown op: op<type:module:code,overload>(params)
+// Unknown op: op<type:module:code,overload>(params) [-> dest]
 // ============================================================
 
 func (p *Parser) parseUnknownOp() ast.Stmt {
@@ -531,11 +594,11 @@ func (p *Parser) parseUnknownOp() ast.Stmt {
 	p.expect(token.LTN)
 	opType := int(p.expect(token.INTEGER).IntVal)
 	p.parseSep()
-	opModule := 0
+	opModule, opIdent := 0, ""
 	if p.cur.Type == token.INTEGER {
 		opModule = int(p.cur.IntVal); p.advance()
 	} else if p.cur.Type == token.IDENT {
-		_ = p.cur.StrVal; p.advance() // module name lookup would go here
+		opIdent = p.cur.StrVal; p.advance() // resolved against the KFN modules
 	}
 	p.parseSep()
 	opCode := int(p.expect(token.INTEGER).IntVal)
@@ -547,7 +610,12 @@ func (p *Parser) parseUnknownOp() ast.Stmt {
 		params = p.parseParamList()
 		p.expect(token.RPAR)
 	}
-	return ast.UnknownOpStmt{Loc: loc, OpType: opType, OpModule: opModule, OpCode: opCode, Overload: overload, Params: params}
+	var dest ast.Expr
+	if p.match(token.ARROW) {
+		dest = p.parseExpr()
+	}
+	return ast.UnknownOpStmt{Loc: loc, OpIdent: opIdent, OpType: opType, OpModule: opModule, OpCode: opCode,
+		Overload: overload, Params: params, Dest: dest}
 }
 
 func (p *Parser) parseSep() {
@@ -621,10 +689,12 @@ func (p *Parser) parseVarDecl() ast.VarDecl {
 			vd.Init = p.parseExpr()
 		}
 	}
+	// addrdecl: -> intX[n] or -> space.index
 	if p.match(token.ARROW) {
 		vd.AddrFrom = p.parseExpr()
-		p.expect(token.POINT)
-		vd.AddrTo = p.parseExpr()
+		if p.match(token.POINT) {
+			vd.AddrTo = p.parseExpr()
+		}
 	}
 	return vd
 }
@@ -794,11 +864,11 @@ func (p *Parser) parsePrimary() ast.Expr {
 	loc := p.loc()
 	switch p.cur.Type {
 	case token.INTEGER:
-		v := p.cur.IntVal; p.advance()
-		return ast.IntLit{Loc: loc, Val: v}
+		tok := p.advance()
+		return ast.IntLit{Loc: loc, Val: tok.IntVal, Raw: tok.Raw}
 	case token.STRING:
-		s := p.cur.StrVal; p.advance()
-		return ast.StrLit{Loc: loc, Tokens: []ast.StrToken{ast.TextToken{Loc: loc, Text: s}}}
+		tok := p.advance()
+		return ast.StrLit{Loc: loc, Tokens: StrTokens(loc, tok.StrVal), Raw: tok.Raw}
 	case token.DRES:
 		key := p.cur.StrVal; p.advance()
 		return ast.ResRef{Loc: loc, Key: key}
@@ -828,6 +898,12 @@ func (p *Parser) parsePrimary() ast.Expr {
 			p.expect(token.RSQU)
 			return ast.Deref{Loc: loc, Ident: name, Index: idx}
 		}
+		if p.cur.Type == token.LABEL {
+			// Parameterless goto-style call: goto @label
+			lbl := ast.Label{Loc: p.loc(), Ident: p.cur.StrVal}
+			p.advance()
+			return ast.FuncCall{Loc: loc, Ident: name, Label: &lbl}
+		}
 		return ast.VarOrFunc{Loc: loc, Ident: name}
 	case token.GOTO:
 		name := p.cur.StrVal; p.advance()
@@ -891,6 +967,163 @@ func (p *Parser) parseParam() ast.Param {
 	return ast.SimpleParam{Loc: loc, Expr: p.parseExpr()}
 }
 
+// ============================================================
+// String contents (strLexer.ml tokens -> ast.StrToken)
+// ============================================================
+
+// StrTokens splits the contents of a string literal, or a resource
+// string, into rich string tokens with lexer.StrLexer. Runs of plain
+// text, spaces and hyphens are merged, so a string without control codes
+// yields a single TextToken.
+func StrTokens(loc ast.Loc, s string) []ast.StrToken {
+	var toks []ast.StrToken
+	var text strings.Builder
+	dbcs, speakers := false, 0
+	flush := func() {
+		if text.Len() > 0 {
+			toks = append(toks, ast.TextToken{Loc: loc, DBCS: dbcs, Text: text.String()})
+			text.Reset()
+			dbcs = false
+		}
+	}
+	add := func(t ast.StrToken) {
+		flush()
+		toks = append(toks, t)
+	}
+	for _, st := range lexer.NewStrLexer(s, lexer.StrRaw, loc.File, loc.Line).TokenizeAll() {
+		l := ast.Loc{File: loc.File, Line: st.Line}
+		switch st.Type {
+		case lexer.STText:
+			text.WriteString(st.Text)
+			dbcs = dbcs || st.DBCS
+		case lexer.STSpace:
+			text.WriteString(strings.Repeat(" ", st.Count))
+		case lexer.STHyphen:
+			text.WriteByte('-')
+		case lexer.STDQuote:
+			add(ast.DQuoteToken{Loc: l})
+		case lexer.STLLentic:
+			add(ast.LLenticToken{Loc: l})
+		case lexer.STRLentic:
+			add(ast.RLenticToken{Loc: l})
+		case lexer.STAsterisk:
+			add(ast.AsteriskToken{Loc: l})
+		case lexer.STPercent:
+			add(ast.PercentToken{Loc: l})
+		case lexer.STSpeaker:
+			add(ast.SpeakerToken{Loc: l})
+			speakers++
+		case lexer.STRCur:
+			if speakers == 0 {
+				text.WriteByte('}')
+				continue
+			}
+			add(ast.RCurToken{Loc: l})
+			speakers--
+		case lexer.STDelete:
+			add(ast.DeleteToken{Loc: l})
+		case lexer.STAdd:
+			add(ast.AddToken{Loc: l, Key: st.Params})
+		case lexer.STResRef:
+			add(ast.ResRefToken{Loc: l, Key: st.Params})
+		case lexer.STRewrite:
+			n, err := strconv.Atoi(strings.TrimSpace(st.Params))
+			if err != nil {
+				syntaxError(l, "\\f{} expects a number")
+			}
+			add(ast.RewriteToken{Loc: l, Key: n})
+		case lexer.STName:
+			params := strParams(l, st.Params)
+			if len(params) < 1 || len(params) > 2 {
+				syntaxError(l, "name variables expect an index and an optional character")
+			}
+			nt := ast.NameToken{Loc: l, Global: !st.IsLocal, Index: simpleExpr(params[0])}
+			if len(params) == 2 {
+				nt.CharID = simpleExpr(params[1])
+			}
+			add(nt)
+		case lexer.STGloss:
+			gt := ast.GlossToken{Loc: l, IsRuby: st.Ident == "ruby", GlossKey: st.GlossID,
+				Base: StrTokens(l, st.Params)}
+			switch {
+			case st.Gloss != "":
+				gt.Gloss = StrTokens(l, st.Gloss)
+			case st.GlossID == "":
+				syntaxError(l, "\\%s{} expects ={gloss}", st.Ident)
+			}
+			add(gt)
+		case lexer.STCode:
+			for _, t := range codeTokens(l, st) {
+				if tt, ok := t.(ast.TextToken); ok {
+					text.WriteString(tt.Text)
+				} else {
+					add(t)
+				}
+			}
+		}
+	}
+	flush()
+	if speakers > 0 {
+		syntaxError(loc, "unterminated speaker block in string")
+	}
+	return toks
+}
+
+// singleLetterCodes are control codes that take no parameters and may be
+// followed directly by text, as in 'one\ntwo'.
+var singleLetterCodes = map[byte]bool{'n': true, 'r': true, 'p': true, 'b': true, 'u': true}
+
+// codeTokens converts a control code token. The string lexer reads a code
+// name greedily, so \nfoo comes back as the code "nfoo"; it is split into
+// \n and the text "foo".
+func codeTokens(l ast.Loc, st lexer.StrToken) []ast.StrToken {
+	if len(st.Ident) > 1 && st.Params == "" && st.Gloss == "" && singleLetterCodes[st.Ident[0]] &&
+		!knownCodes[st.Ident] {
+		return []ast.StrToken{ast.CodeToken{Loc: l, Ident: st.Ident[:1]}, ast.TextToken{Loc: l, Text: st.Ident[1:]}}
+	}
+	ct := ast.CodeToken{Loc: l, Ident: st.Ident}
+	if st.Gloss != "" {
+		ct.OptArg = strSubParser(l, st.Gloss).parseExpr()
+	}
+	ct.Params = strParams(l, st.Params)
+	return []ast.StrToken{ct}
+}
+
+// knownCodes are the multi-letter control codes understood by textout.
+var knownCodes = map[string]bool{
+	"size": true, "wait": true, "em": true, "name": true, "ruby": true,
+	"mv": true, "mvx": true, "mvy": true, "pos": true, "posx": true, "posy": true,
+}
+
+// strParams parses the {...} contents of a control code as a parameter list.
+func strParams(l ast.Loc, src string) []ast.Param {
+	if strings.TrimSpace(src) == "" {
+		return nil
+	}
+	sub := strSubParser(l, src)
+	params := sub.parseParamList()
+	if sub.cur.Type != token.EOF {
+		syntaxError(l, "unexpected %s in control code parameters", sub.cur.Type)
+	}
+	return params
+}
+
+// strSubParser parses code embedded in a string; the source is padded so
+// that locations keep the string's line number.
+func strSubParser(l ast.Loc, src string) *Parser {
+	if l.Line > 1 {
+		src = strings.Repeat("\n", l.Line-1) + src
+	}
+	return New(lexer.New(src, l.File))
+}
+
+func simpleExpr(p ast.Param) ast.Expr {
+	if sp, ok := p.(ast.SimpleParam); ok {
+		return sp.Expr
+	}
+	return nil
+}
+
 func isExprStart(t token.Type) bool {
 	switch t {
 	case token.INTEGER, token.STRING, token.DRES, token.IDENT,
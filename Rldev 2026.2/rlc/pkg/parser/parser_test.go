@@ -1,9 +1,11 @@
 package parser
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/diag"
 	"github.com/yoremi/rldev-go/rlc/pkg/lexer"
 	"github.com/yoremi/rldev-go/rlc/pkg/token"
 )
@@ -257,6 +259,15 @@ func TestParseDeclArray(t *testing.T) {
 	if sz.Val != 10 { t.Errorf("size: got %d", sz.Val) }
 }
 
+func TestParseDeclAddress(t *testing.T) {
+	sf := parse("int a -> intA[5], b -> 1.20")
+	ds := sf.Stmts[0].(ast.DeclStmt)
+	if v, ok := ds.Vars[0].AddrFrom.(ast.IntVar); !ok || v.Bank != 0 || ds.Vars[0].AddrTo != nil {
+		t.Errorf("a: %+v", ds.Vars[0])
+	}
+	if ds.Vars[1].AddrFrom == nil || ds.Vars[1].AddrTo == nil { t.Errorf("b: %+v", ds.Vars[1]) }
+}
+
 func TestParseReturn(t *testing.T) {
 	sf := parse("return 42")
 	rs, ok := sf.Stmts[0].(ast.ReturnStmt)
@@ -317,6 +328,13 @@ func TestParseSelect(t *testing.T) {
 	if ss.Ident != "select" { t.Errorf("ident: got %q", ss.Ident) }
 	if ss.Opcode != 1 { t.Errorf("opcode: got %d", ss.Opcode) }
 	if len(ss.Params) != 2 { t.Errorf("params: got %d", len(ss.Params)) }
+
+	sf = parse("select(colour(2) cursor if intA[1]: 'a')")
+	p, ok := sf.Stmts[0].(ast.SelectStmt).Params[0].(ast.CondSelParam)
+	if !ok || len(p.Conds) != 2 { t.Fatalf("got %#v", sf.Stmts[0]) }
+	if c := p.Conds[0]; c.Ident != "colour" || c.Arg == nil || c.Cond != nil { t.Errorf("colour: %#v", c) }
+	if c := p.Conds[1]; c.Ident != "cursor" || c.Arg != nil || c.Cond == nil { t.Errorf("cursor: %#v", c) }
+	if _, err := ParseFile([]byte("select(intA[0]: 'a')"), "test.org"); err == nil { t.Error("a condition without an effect should be a syntax error") }
 }
 
 func TestParseFile(t *testing.T) {
@@ -334,3 +352,92 @@ func TestParserUsesTokenPackage(t *testing.T) {
 	_ = token.IF
 	_ = token.EOF
 }
+
+func TestParseGotoLabel(t *testing.T) {
+	sf := parse("goto @done")
+	if len(sf.Stmts) != 1 { t.Fatalf("got %d stmts", len(sf.Stmts)) }
+	fc, ok := sf.Stmts[0].(ast.FuncCallStmt)
+	if !ok { t.Fatalf("got %T", sf.Stmts[0]) }
+	if fc.Ident != "goto" || fc.Label == nil || fc.Label.Ident != "done" {
+		t.Errorf("goto: %+v", fc)
+	}
+}
+
+func TestParseFileSyntaxError(t *testing.T) {
+	_, err := ParseFile([]byte("intA[0 = 1"), "test.org")
+	if err == nil { t.Fatal("expected syntax error") }
+	d, ok := err.(*diag.Diagnostic)
+	if !ok { t.Fatalf("got %T", err) }
+	if d.Code != diag.Syntax || d.Loc.File != "test.org" || d.Loc.Line != 1 { t.Errorf("got %s", d) }
+}
+
+func TestParseIfdef(t *testing.T) {
+	sf := parse("#ifndef FOO halt #endif")
+	d, ok := sf.Stmts[0].(ast.DIfStmt)
+	if !ok { t.Fatalf("got %T", sf.Stmts[0]) }
+	u, ok := d.Cond.(ast.UnaryExpr)
+	if !ok || u.Op != ast.UnaryNot { t.Fatalf("cond: %#v", d.Cond) }
+	if fc, ok := u.Val.(ast.FuncCall); !ok || fc.Ident != "defined?" { t.Errorf("inner: %#v", u.Val) }
+}
+
+func strToks(t *testing.T, src string) []ast.StrToken {
+	t.Helper()
+	ret, ok := parse(src).Stmts[0].(ast.ReturnStmt)
+	if !ok { t.Fatalf("%s: not a text statement", src) }
+	lit, ok := ret.Expr.(ast.StrLit)
+	if !ok { t.Fatalf("%s: got %T", src, ret.Expr) }
+	return lit.Tokens
+}
+
+func TestParseStringPlain(t *testing.T) {
+	toks := strToks(t, `'Hello, world'`)
+	if len(toks) != 1 { t.Fatalf("got %#v", toks) }
+	if tt, ok := toks[0].(ast.TextToken); !ok || tt.Text != "Hello, world" { t.Errorf("got %#v", toks[0]) }
+}
+
+func TestParseStringCodes(t *testing.T) {
+	toks := strToks(t, `'\{Kotomi}"Hi\nthere\i{intA[0]}\c{1, 2}\\'`)
+	var kinds []string
+	for _, tk := range toks { kinds = append(kinds, fmt.Sprintf("%T", tk)) }
+	want := []string{"ast.SpeakerToken", "ast.TextToken", "ast.RCurToken", "ast.DQuoteToken", "ast.TextToken",
+		"ast.CodeToken", "ast.TextToken", "ast.CodeToken", "ast.CodeToken", "ast.TextToken"}
+	if fmt.Sprint(kinds) != fmt.Sprint(want) { t.Fatalf("got %v", kinds) }
+	if ct := toks[5].(ast.CodeToken); ct.Ident != "n" { t.Errorf("\\n: %#v", ct) }
+	if ct := toks[7].(ast.CodeToken); ct.Ident != "i" || len(ct.Params) != 1 { t.Errorf("\\i: %#v", ct) }
+	if ct := toks[8].(ast.CodeToken); ct.Ident != "c" || len(ct.Params) != 2 { t.Errorf("\\c: %#v", ct) }
+	if tt := toks[9].(ast.TextToken); tt.Text != `\` { t.Errorf("escaped backslash: %q", tt.Text) }
+}
+
+func TestParseStringNamesAndGlosses(t *testing.T) {
+	toks := strToks(t, `'\m{1,2}\name{\l{0}}\ruby{kanji}={kana}\g{word}=<k1>'`)
+	if len(toks) != 6 { t.Fatalf("got %#v", toks) }
+	if nt, ok := toks[0].(ast.NameToken); !ok || !nt.Global || nt.CharID == nil { t.Errorf("\\m: %#v", toks[0]) }
+	if _, ok := toks[2].(ast.NameToken); !ok { t.Errorf("\\name: %#v", toks[1:4]) }
+	if gt, ok := toks[4].(ast.GlossToken); !ok || !gt.IsRuby || len(gt.Gloss) != 1 { t.Errorf("\\ruby: %#v", toks[4]) }
+	if gt, ok := toks[5].(ast.GlossToken); !ok || gt.IsRuby || gt.GlossKey != "k1" { t.Errorf("\\g: %#v", toks[5]) }
+}
+
+func TestParseStringBadCode(t *testing.T) {
+	if _, err := ParseFile([]byte(`'\ruby{a}'`), "test.org"); err == nil { t.Error("\\ruby without gloss should fail") }
+	if _, err := ParseFile([]byte(`'\{unclosed'`), "test.org"); err == nil { t.Error("unterminated speaker should fail") }
+}
+
+func TestParseUnknownOp(t *testing.T) {
+	sf := parse("op<1:Sys:01234, 2>(intA[0], 'x') -> intB[1]")
+	op, ok := sf.Stmts[0].(ast.UnknownOpStmt)
+	if !ok { t.Fatalf("got %T", sf.Stmts[0]) }
+	if op.OpType != 1 || op.OpIdent != "Sys" || op.OpCode != 1234 || op.Overload != 2 { t.Errorf("opcode: %+v", op) }
+	if len(op.Params) != 2 { t.Errorf("params: %d", len(op.Params)) }
+	if _, ok := op.Dest.(ast.IntVar); !ok { t.Errorf("dest: %#v", op.Dest) }
+}
+
+func TestParseKeepsSpelling(t *testing.T) {
+	sf := parse("#ifdef FOO #endif\n#set X += $10 // c\n#sinline f() halt\nselect(colour(2) hide if intA[0]: 'a')")
+	if len(sf.Stmts) != 4 { t.Fatalf("got %d stmts", len(sf.Stmts)) }
+	if d := sf.Stmts[0].(ast.DIfStmt); !d.Ifdef { t.Error("#ifdef not recorded") }
+	ds := sf.Stmts[1].(ast.DSetStmt)
+	if ds.Op != ast.AssignAdd || ds.Value.(ast.IntLit).Raw != "$10" { t.Errorf("#set: %#v", ds) }
+	if p, ok := sf.Stmts[3].(ast.SelectStmt).Params[0].(ast.CondSelParam); !ok || len(p.Conds) != 2 { t.Errorf("select conditions dropped: %#v", sf.Stmts[3]) }
+	if !sf.Stmts[2].(ast.DInlineStmt).Scoped { t.Error("#sinline not scoped") }
+	if len(sf.Comments) != 1 || sf.Comments[0].Text != "// c" || sf.Comments[0].Loc.Line != 2 { t.Errorf("comments: %+v", sf.Comments) }
+}
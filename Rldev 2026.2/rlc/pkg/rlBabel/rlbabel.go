@@ -32,8 +32,10 @@ package rlbabel
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
+	"github.com/yoremi/rldev-go/rlc/pkg/textout"
 )
 
 // ============================================================
@@ -315,3 +317,171 @@ func GlossCompileOptions() CompileOptions {
 }
 
 
+// ============================================================
+// Text compilation (from rlBabel.ml compile)
+// ============================================================
+
+// Compile compiles string tokens for the VWF runtime. Text is collected
+// into chunks: the first is passed to opts.VWF.FStart and the following
+// ones to FAppend; FDisplay ends the block. Chunks are split wherever a
+// runtime value (\s{}, \i{}) or a stub control code has to be inserted.
+// scratch is a string variable used to format non-constant \i{} values.
+func Compile(loc ast.Loc, toks []ast.StrToken, opts CompileOptions, scratch ast.Expr) ([]textout.Op, error) {
+	var ops []textout.Op
+	var chunk []byte
+	started := false
+	emit := func(arg ast.Expr) {
+		fn := opts.VWF.FAppend
+		if !started {
+			fn, started = opts.VWF.FStart, true
+		}
+		ops = append(ops, textout.CallOp(loc, fn, arg))
+	}
+	flush := func() {
+		if len(chunk) > 0 || !started {
+			emit(ast.StrLit{Loc: loc, Tokens: []ast.StrToken{ast.TextToken{Loc: loc, Text: string(chunk)}}})
+			chunk = nil
+		}
+	}
+	var walk func(toks []ast.StrToken) error
+	walk = func(toks []ast.StrToken) error {
+		for _, t := range toks {
+			switch tt := t.(type) {
+			case ast.TextToken:
+				chunk = append(chunk, tt.Text...)
+				if strings.HasSuffix(tt.Text, "＊") || strings.HasSuffix(tt.Text, "％") {
+					flush()
+				}
+			case ast.SpaceToken:
+				chunk = append(chunk, strings.Repeat(" ", tt.Count)...)
+			case ast.DQuoteToken:
+				chunk = append(chunk, TokenQuote)
+			case ast.SpeakerToken:
+				chunk = append(chunk, TokenNameLeft)
+			case ast.RCurToken:
+				chunk = append(chunk, TokenNameRight)
+			case ast.LLenticToken:
+				chunk = append(chunk, "【"...)
+			case ast.RLenticToken:
+				chunk = append(chunk, "】"...)
+			case ast.HyphenToken:
+				chunk = append(chunk, '-')
+			case ast.AsteriskToken, ast.PercentToken:
+				if _, ok := tt.(ast.AsteriskToken); ok {
+					chunk = append(chunk, "＊"...)
+				} else {
+					chunk = append(chunk, "％"...)
+				}
+				flush()
+			case ast.NameToken:
+				s, err := textout.NameText(tt)
+				if err != nil {
+					return fmt.Errorf("%s: %v", tt.Loc, err)
+				}
+				chunk = append(chunk, s...)
+				flush()
+			case ast.GlossToken:
+				if tt.IsRuby {
+					// furigana is not supported by the VWF runtime
+					if err := walk(tt.Base); err != nil {
+						return err
+					}
+					continue
+				}
+				if tt.GlossKey != "" {
+					return fmt.Errorf("%s: resource glosses are not supported here", tt.Loc)
+				}
+				gops, err := Compile(tt.Loc, tt.Gloss, GlossCompileOptions(), scratch)
+				if err != nil {
+					return err
+				}
+				flush()
+				ops = append(ops, gops...)
+				chunk = append(chunk, TokenBeginGloss)
+				if err := walk(tt.Base); err != nil {
+					return err
+				}
+				chunk = append(chunk, TokenBeginGloss)
+			case ast.CodeToken:
+				if err := compileCode(tt, &chunk, flush, emit, &ops, scratch); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("%s: unsupported element in text output", loc)
+			}
+		}
+		return nil
+	}
+	if err := walk(toks); err != nil {
+		return nil, err
+	}
+	flush()
+	if opts.WithKidoku {
+		ops = append(ops, textout.Op{Kind: textout.OpKidoku, Loc: loc})
+	}
+	ops = append(ops, textout.CallOp(loc, opts.VWF.FDisplay))
+	return ops, nil
+}
+
+// compileCode handles one control code for Compile.
+func compileCode(ct ast.CodeToken, chunk *[]byte, flush func(), emit func(ast.Expr), ops *[]textout.Op, scratch ast.Expr) error {
+	switch ct.Ident {
+	case "n":
+		*chunk = append(*chunk, TokenBreak)
+	case "r":
+		*chunk = append(*chunk, TokenClearIndent, TokenBreak)
+	case "b":
+		*chunk = append(*chunk, TokenEmphasis)
+	case "u":
+		*chunk = append(*chunk, TokenRegular)
+	case "s":
+		if len(ct.Params) != 1 {
+			return fmt.Errorf("%s: \\s{} must have exactly one parameter", ct.Loc)
+		}
+		sp, _ := ct.Params[0].(ast.SimpleParam)
+		if _, ok := sp.Expr.(ast.StrVar); !ok {
+			return fmt.Errorf("%s: \\s{} parameter must be a string variable", ct.Loc)
+		}
+		flush()
+		emit(sp.Expr)
+	case "i":
+		if len(ct.Params) != 1 {
+			return fmt.Errorf("%s: \\i{} must have exactly one parameter", ct.Loc)
+		}
+		sp, _ := ct.Params[0].(ast.SimpleParam)
+		if lit, ok := sp.Expr.(ast.IntLit); ok && ct.OptArg == nil {
+			*chunk = append(*chunk, fmt.Sprint(lit.Val)...)
+			return nil
+		}
+		if scratch == nil {
+			return fmt.Errorf("%s: no scratch variable for \\i{}", ct.Loc)
+		}
+		flush()
+		call := textout.CallOp(ct.Loc, "itoa", sp.Expr)
+		if ct.OptArg != nil {
+			call.Params = append(call.Params, ast.SimpleParam{Loc: ct.Loc, Expr: ct.OptArg})
+		}
+		call.Dest = scratch
+		*ops = append(*ops, call)
+		emit(scratch)
+	case "e", "em":
+		em, err := ProcessEmoji(ct.Ident, ct.Params)
+		if err != nil {
+			return fmt.Errorf("%s: %v", ct.Loc, err)
+		}
+		if !em.IsConst {
+			return fmt.Errorf("%s: \\%s{} index must be constant", ct.Loc, ct.Ident)
+		}
+		*chunk = append(*chunk, em.EmojiMarker)
+		*chunk = append(*chunk, em.IndexText...)
+	default:
+		stub, err := textout.CompileStub(ct.Loc, []ast.StrToken{ct})
+		if err != nil {
+			return err
+		}
+		flush()
+		// drop the stub's kidoku marker; the block gets its own
+		*ops = append(*ops, stub[1:]...)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package rlbabel
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/yoremi/rldev-go/rlc/pkg/ast"
@@ -196,3 +197,30 @@ func TestTextEltKindRange(t *testing.T) {
 	}
 	if len(kinds) != 22 { t.Errorf("expected 22 kinds, got %d", len(kinds)) }
 }
+
+// ============================================================
+// Compile
+// ============================================================
+
+func TestCompile(t *testing.T) {
+	scratch := ast.StrVar{Bank: 0x12, Index: ast.IntLit{Val: 1}}
+	ops, err := Compile(ast.Nowhere, []ast.StrToken{
+		ast.SpeakerToken{}, ast.TextToken{Text: "A"}, ast.RCurToken{}, ast.DQuoteToken{},
+		ast.CodeToken{Ident: "i", Params: []ast.Param{ast.SimpleParam{Expr: ast.IntVar{Bank: 0, Index: ast.IntLit{Val: 0}}}}},
+		ast.CodeToken{Ident: "n"},
+	}, DefaultCompileOptions(), scratch)
+	if err != nil { t.Fatal(err) }
+	var idents []string
+	for _, op := range ops { idents = append(idents, op.Ident) }
+	want := []string{"__vwf_TextoutStart", "itoa", "__vwf_TextoutAppend", "__vwf_TextoutAppend", "", "__vwf_TextoutDisplay"}
+	if fmt.Sprint(idents) != fmt.Sprint(want) { t.Fatalf("got %v", idents) }
+	first := ops[0].Params[0].(ast.SimpleParam).Expr.(ast.StrLit).Tokens[0].(ast.TextToken).Text
+	if first != "\x01A\x02\x08" { t.Errorf("first chunk: %q", first) }
+	if ops[2].Params[0].(ast.SimpleParam).Expr != ast.Expr(scratch) { t.Error("\\i should append the scratch string") }
+}
+
+func TestCompileEmpty(t *testing.T) {
+	ops, err := Compile(ast.Nowhere, nil, GlossCompileOptions(), nil)
+	if err != nil { t.Fatal(err) }
+	if len(ops) != 2 || ops[0].Ident != "__vwf_GlossTextStart" || ops[1].Ident != "__vwf_GlossTextSet" { t.Errorf("got %+v", ops) }
+}
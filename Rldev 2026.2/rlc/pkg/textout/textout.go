@@ -277,6 +277,373 @@ const (
 	SJISPercent      = "\x81\x93" // ％
 )
 
+// ============================================================
+// Output operations (shared by the static, DTO and rlBabel paths)
+// ============================================================
+
+// OpKind classifies one step of compiled text output.
+type OpKind int
+
+const (
+	OpText   OpKind = iota // text written to the bytecode (UTF-8, encoded by the caller)
+	OpCall                 // call to a function or #inline by name
+	OpKidoku               // kidoku marker
+)
+
+// Op is one step of compiled text output. The compiler runs these in
+// order: text is encoded and written, calls are resolved like any other
+// function call.
+type Op struct {
+	Kind   OpKind
+	Loc    ast.Loc
+	Text   string
+	Ident  string
+	Params []ast.Param
+	Dest   ast.Expr
+}
+
+// TextOp returns an OpText step.
+func TextOp(loc ast.Loc, text string) Op { return Op{Kind: OpText, Loc: loc, Text: text} }
+
+// CallOp returns an OpCall step.
+func CallOp(loc ast.Loc, ident string, args ...ast.Expr) Op {
+	op := Op{Kind: OpCall, Loc: loc, Ident: ident}
+	for _, a := range args {
+		op.Params = append(op.Params, ast.SimpleParam{Loc: loc, Expr: a})
+	}
+	return op
+}
+
+// ============================================================
+// Static text (from textout.ml compile_stub)
+// ============================================================
+
+// CompileStub compiles string tokens to static text: characters are
+// written straight into the bytecode and control codes become calls to
+// the corresponding Msg functions. Output starts with a kidoku marker.
+func CompileStub(loc ast.Loc, toks []ast.StrToken) ([]Op, error) {
+	ops := []Op{{Kind: OpKidoku, Loc: loc}}
+	var text []rune
+	flush := func() {
+		if len(text) > 0 {
+			ops = append(ops, TextOp(loc, string(text)))
+			text = nil
+		}
+	}
+	call := func(l ast.Loc, ident string, args ...ast.Expr) {
+		flush()
+		ops = append(ops, CallOp(l, ident, args...))
+	}
+	var walk func(toks []ast.StrToken) error
+	walk = func(toks []ast.StrToken) error {
+		for _, t := range toks {
+			switch tt := t.(type) {
+			case ast.TextToken:
+				text = append(text, []rune(tt.Text)...)
+			case ast.SpaceToken:
+				for i := 0; i < tt.Count; i++ {
+					text = append(text, ' ')
+				}
+			case ast.DQuoteToken:
+				text = append(text, '"')
+			case ast.SpeakerToken, ast.LLenticToken:
+				text = append(text, '【')
+			case ast.RCurToken, ast.RLenticToken:
+				text = append(text, '】')
+			case ast.AsteriskToken:
+				text = append(text, '＊')
+			case ast.PercentToken:
+				text = append(text, '％')
+			case ast.HyphenToken:
+				text = append(text, '-')
+			case ast.NameToken:
+				s, err := NameText(tt)
+				if err != nil {
+					return fmt.Errorf("%s: %v", tt.Loc, err)
+				}
+				text = append(text, []rune(s)...)
+			case ast.GlossToken:
+				if tt.IsRuby {
+					call(tt.Loc, "ruby")
+				}
+				if err := walk(tt.Base); err != nil {
+					return err
+				}
+				if tt.IsRuby {
+					flush()
+					op := CallOp(tt.Loc, "ruby")
+					var gloss []rune
+					for _, g := range tt.Gloss {
+						if gt, ok := g.(ast.TextToken); ok {
+							gloss = append(gloss, []rune(gt.Text)...)
+						}
+					}
+					op.Params = []ast.Param{ast.SimpleParam{Loc: tt.Loc,
+						Expr: ast.StrLit{Loc: tt.Loc, Tokens: []ast.StrToken{ast.TextToken{Loc: tt.Loc, Text: string(gloss)}}}}}
+					ops = append(ops, op)
+				}
+			case ast.CodeToken:
+				if err := stubCode(tt, &text, call); err != nil {
+					return fmt.Errorf("%s: %v", tt.Loc, err)
+				}
+			default:
+				return fmt.Errorf("%s: unsupported element in text output", loc)
+			}
+		}
+		return nil
+	}
+	if err := walk(toks); err != nil {
+		return nil, err
+	}
+	flush()
+	return ops, nil
+}
+
+// stubCode compiles one control code for static output.
+func stubCode(ct ast.CodeToken, text *[]rune, call func(ast.Loc, string, ...ast.Expr)) error {
+	args := extractSimpleExprs(ct.Params)
+	switch ct.Ident {
+	case "n":
+		call(ct.Loc, "br")
+	case "r":
+		call(ct.Loc, "par")
+	case "p":
+		call(ct.Loc, "page")
+	case "b", "u":
+		// emphasis is only meaningful to rlBabel
+	case "s":
+		param := oneSimpleParam(ct.Params)
+		if _, ok := param.(ast.StrVar); !ok {
+			return errorf("\\s{} parameter must be a string variable")
+		}
+		call(ct.Loc, "strout", param)
+	case "i":
+		param := oneSimpleParam(ct.Params)
+		if param == nil {
+			return errorf("\\i{} must have exactly one parameter")
+		}
+		if lit, ok := param.(ast.IntLit); ok && ct.OptArg == nil {
+			*text = append(*text, []rune(int32ToString(lit.Val))...)
+			return nil
+		}
+		if ct.OptArg != nil {
+			call(ct.Loc, "intout", param, ct.OptArg)
+		} else {
+			call(ct.Loc, "intout", param)
+		}
+	case "c":
+		call(ct.Loc, "FontColour", args...)
+	case "size":
+		call(ct.Loc, "FontSize", args...)
+	case "wait":
+		if len(args) != 1 {
+			return errorf("\\wait{} must have exactly one parameter")
+		}
+		call(ct.Loc, "wait", args...)
+	case "mv", "mvx", "mvy", "pos", "posx", "posy":
+		want := 1
+		if ct.Ident == "mv" || ct.Ident == "pos" {
+			want = 2
+		}
+		if len(args) != want {
+			return errorf("\\%s{} expects %d parameter(s)", ct.Ident, want)
+		}
+		fn := "TextOffset"
+		if ct.Ident[0] == 'p' {
+			fn = "TextPos"
+		}
+		switch ct.Ident[len(ct.Ident)-1] {
+		case 'x':
+			fn += "X"
+		case 'y':
+			fn += "Y"
+		}
+		call(ct.Loc, fn, args...)
+	case "e", "em":
+		if len(args) < 1 {
+			return errorf("\\%s{} requires at least one parameter", ct.Ident)
+		}
+		idx, ok := args[0].(ast.IntLit)
+		if !ok {
+			return errorf("\\%s{} index must be constant in static text", ct.Ident)
+		}
+		if len(args) >= 2 {
+			call(ct.Loc, "FontSize", args[1])
+		}
+		*text = append(*text, []rune(emojiText(ct.Ident, idx.Val))...)
+		if len(args) >= 2 {
+			call(ct.Loc, "FontSize")
+		}
+	default:
+		return errorf("unknown control code '\\%s'", ct.Ident)
+	}
+	return nil
+}
+
+// emojiText returns the inline emoji sequence: ＃Ｅ (colour) or ＃ｅ
+// (monochrome) followed by a two-digit full-width index.
+func emojiText(code string, idx int32) string {
+	marker := "＃Ｅ"
+	if code == "em" {
+		marker = "＃ｅ"
+	}
+	return marker + fullWidthNumber(int(idx), 2)
+}
+
+// NameText returns the text form of a name variable: ＊ (local) or ％
+// (global), the name's index as one or two full-width letters, and an
+// optional full-width character index. Both must be constants.
+func NameText(nt ast.NameToken) (string, error) {
+	idx, ok := nt.Index.(ast.IntLit)
+	if !ok || idx.Val < 0 || idx.Val >= 26*27 {
+		return "", errorf("name index must be a constant between 0 and %d", 26*27-1)
+	}
+	s := "＊"
+	if nt.Global {
+		s = "％"
+	}
+	if idx.Val >= 26 {
+		s += string(rune('Ａ' + idx.Val/26 - 1))
+	}
+	s += string(rune('Ａ' + idx.Val%26))
+	if nt.CharID != nil {
+		ch, ok := nt.CharID.(ast.IntLit)
+		if !ok || ch.Val < 0 || ch.Val > 9 {
+			return "", errorf("name character index must be a constant between 0 and 9")
+		}
+		s += fullWidthNumber(int(ch.Val), 1)
+	}
+	return s, nil
+}
+
+func fullWidthNumber(v, width int) string {
+	digits := []rune(fmt.Sprintf("%0*d", width, v))
+	for i, d := range digits {
+		digits[i] = d - '0' + '０'
+	}
+	return string(digits)
+}
+
+// ============================================================
+// Dynamic lineation (from textout.ml compile)
+// ============================================================
+
+// DTORuntime is the textout.kh routine that lays out a DTO token array.
+// It is called as DTORuntime(text, bank, index, count), where text holds
+// the encoded characters and bank/index locate the token array.
+const DTORuntime = "__dto_Textout"
+
+// CompileDTO compiles string tokens to a DTO token array. Text is
+// gathered into one buffer; enc converts it to the output encoding so
+// that token offsets refer to encoded bytes. The returned tokens are the
+// array elements in order (runtime expressions allowed).
+func CompileDTO(loc ast.Loc, toks []ast.StrToken, enc func(string) []byte) (string, []ast.Expr, error) {
+	var buf []byte
+	var out []ast.Expr
+	addText := func(s string) {
+		for len(s) > 0 {
+			// split on spaces; SBCS and DBCS runs get different IDs
+			i := 0
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			if i > 0 {
+				out = append(out, MakeToken(IDSpace, i, 0))
+				s = s[i:]
+				continue
+			}
+			j := 0
+			dbcs := s[0] >= 0x80
+			for j < len(s) && s[j] != ' ' && (s[j] >= 0x80) == dbcs {
+				j++
+			}
+			b := enc(s[:j])
+			id := IDNText
+			switch {
+			case dbcs:
+				id = IDDText
+			case j < len(s) && s[j] == ' ':
+				id = IDSText
+			}
+			out = append(out, MakeToken(id, len(buf), len(b)))
+			buf = append(buf, b...)
+			if id == IDSText {
+				s = s[j+1:]
+			} else {
+				s = s[j:]
+			}
+		}
+	}
+	var walk func(toks []ast.StrToken) error
+	walk = func(toks []ast.StrToken) error {
+		for _, t := range toks {
+			switch tt := t.(type) {
+			case ast.TextToken:
+				addText(tt.Text)
+			case ast.SpaceToken:
+				out = append(out, MakeToken(IDSpace, tt.Count, 0))
+			case ast.DQuoteToken:
+				out = append(out, MakeToken(IDDQuot, 0, 0))
+			case ast.SpeakerToken, ast.LLenticToken:
+				out = append(out, MakeToken(IDWName, 0, 0))
+			case ast.RCurToken, ast.RLenticToken:
+				out = append(out, MakeToken(IDWName, 1, 0))
+			case ast.AsteriskToken:
+				addText("＊")
+			case ast.PercentToken:
+				addText("％")
+			case ast.HyphenToken:
+				addText("-")
+			case ast.NameToken:
+				glb, follows := 0, 0
+				if tt.Global {
+					glb = 1
+				}
+				if tt.CharID != nil {
+					follows = 1
+				}
+				out = append(out, MakeTokenExpr(IDNameV, tt.Index, ast.IntLit{Val: int32(glb | follows<<1)}))
+				if tt.CharID != nil {
+					out = append(out, tt.CharID)
+				}
+			case ast.GlossToken:
+				open, mid := 0, 1
+				if !tt.IsRuby {
+					open, mid = 3, 4
+				}
+				out = append(out, MakeToken(IDRuby, open, 0))
+				if err := walk(tt.Base); err != nil {
+					return err
+				}
+				out = append(out, MakeToken(IDRuby, mid, 0))
+				if err := walk(tt.Gloss); err != nil {
+					return err
+				}
+				out = append(out, MakeToken(IDRuby, 2, 0))
+			case ast.CodeToken:
+				if tt.Ident == "b" || tt.Ident == "u" {
+					continue
+				}
+				res, err := ProcessControlCode(tt.Ident, tt.OptArg, tt.Params)
+				if err != nil {
+					return fmt.Errorf("%s: %v", tt.Loc, err)
+				}
+				if res.Text != "" {
+					addText(res.Text)
+				}
+				out = append(out, res.Tokens...)
+			default:
+				return fmt.Errorf("%s: unsupported element in text output", loc)
+			}
+		}
+		return nil
+	}
+	if err := walk(toks); err != nil {
+		return "", nil, err
+	}
+	return string(buf), out, nil
+}
+
 // ============================================================
 // Helpers
 // ============================================================
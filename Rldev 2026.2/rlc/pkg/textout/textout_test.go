@@ -253,3 +253,41 @@ func TestSJISConstants(t *testing.T) {
 	if SJISLeftBracket != "\x81\x79" { t.Error("left bracket") }
 	if SJISRightBracket != "\x81\x7a" { t.Error("right bracket") }
 }
+
+// ============================================================
+// Static and dynamic compilation
+// ============================================================
+
+func text(s string) ast.StrToken { return ast.TextToken{Text: s} }
+func code(id string, params ...ast.Param) ast.StrToken { return ast.CodeToken{Ident: id, Params: params} }
+
+func TestCompileStub(t *testing.T) {
+	ops, err := CompileStub(ast.Nowhere, []ast.StrToken{
+		ast.SpeakerToken{}, text("Kotomi"), ast.RCurToken{}, ast.DQuoteToken{}, text("Hi"),
+		code("n"), code("i", sp(ilit(42))), code("c", sp(ilit(3))), text("x"),
+	})
+	if err != nil { t.Fatal(err) }
+	if len(ops) != 6 { t.Fatalf("got %+v", ops) }
+	if ops[0].Kind != OpKidoku { t.Error("kidoku should come first") }
+	if ops[1].Text != "【Kotomi】\"Hi" { t.Errorf("text: %q", ops[1].Text) }
+	if ops[2].Ident != "br" || ops[4].Ident != "FontColour" { t.Errorf("calls: %+v", ops) }
+	if ops[3].Text != "42" { t.Errorf("constant \\i: %q", ops[3].Text) }
+}
+
+func TestCompileStubNameAndEmoji(t *testing.T) {
+	ops, err := CompileStub(ast.Nowhere, []ast.StrToken{
+		ast.NameToken{Index: ilit(27), CharID: ilit(1)}, code("em", sp(ilit(5))),
+	})
+	if err != nil { t.Fatal(err) }
+	if ops[1].Text != "＊ＡＢ１＃ｅ０５" { t.Errorf("got %q", ops[1].Text) }
+	if _, err := CompileStub(ast.Nowhere, []ast.StrToken{code("zz")}); err == nil { t.Error("unknown code") }
+}
+
+func TestCompileDTO(t *testing.T) {
+	txt, toks, err := CompileDTO(ast.Nowhere, []ast.StrToken{text("ab cd"), code("n"), ast.DQuoteToken{}},
+		func(s string) []byte { return []byte(s) })
+	if err != nil { t.Fatal(err) }
+	if txt != "abcd" { t.Errorf("text: %q", txt) }
+	// SText(0,2) NText(2,2) CCode(\n) DQuot
+	if len(toks) != 4 { t.Fatalf("got %d tokens", len(toks)) }
+}
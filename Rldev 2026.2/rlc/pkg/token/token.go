@@ -143,6 +143,7 @@ type Token struct {
 	Type   Type
 	IntVal int32  // for INTEGER, INT (bit width), VAR/SVAR/REG (bank), SELECT (opcode)
 	StrVal string // for IDENT, LABEL, STRING text, GOTO name, GO_LIST/GO_CASE name, DWITHEXPR name
+	Raw    string // source spelling of INTEGER and STRING tokens (quotes included)
 	Line   int    // source line number
 	File   string // source file name
 }